@@ -0,0 +1,174 @@
+// AlterTable.go
+// Description: Table definition changes for the HTDB library
+// Rewrites a table's records into a new field layout
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// alterTable replaces the fields of a table and rewrites every record into the
+// new layout. Fields are matched by name: kept fields keep their values, new
+// fields are null and values of dropped fields are lost. A changed field type
+// only works while no record holds a value of the old type.
+func (tm *TableManager) alterTable(table *Table, fields []Field) error {
+	fields = append([]Field{timePKField}, fields...)
+	err := validateFieldNames(fields)
+	if err == nil {
+		err = validateFieldLengths(fields)
+	}
+	if err == nil {
+		err = validateFieldCompression(fields)
+	}
+	if err == nil {
+		err = validateFieldIndexes(fields)
+	}
+	if err == nil {
+		err = validateFieldCollations(fields)
+	}
+	if err != nil {
+		return err
+	}
+
+	altered := &Table{
+		TableName:        table.TableName,
+		Fields:           fields,
+		SchemaPath:       table.SchemaPath,
+		FormatVersion:    layoutVersion, // The records are rewritten in the current format
+		BlockCompression: table.BlockCompression,
+		db:               table.db,
+	}
+	kept := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		kept[field.Name] = true
+	}
+
+	// Stored ref values aren't recompressed
+	for _, old := range table.Fields {
+		for _, field := range fields {
+			if field.Name == old.Name && field.Type == "ref" && old.Type == "ref" && field.Compression != old.Compression {
+				return fmt.Errorf("changing the compression of field '%s' is not supported", field.Name)
+			}
+		}
+	}
+
+	// Commits on the table finish first, records staged against the old fields are refused afterwards
+	unlock, err := tm.db.lockTableDDL(tableCacheKey(table))
+	if err != nil {
+		return newTableError(table, err)
+	}
+	defer unlock()
+
+	store := table.storage()
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	records, err := table.allRecords()
+	if err != nil {
+		return fmt.Errorf("failed to read records of table '%s': %v", table.TableName, err)
+	}
+	for _, record := range records {
+		for name := range record.FieldsMeta {
+			if !kept[name] {
+				delete(record.FieldsData, name)
+				delete(record.FieldsMeta, name)
+				delete(record.RefOffsets, name)
+			}
+		}
+	}
+
+	// New ref fields need their side file before records can reference it
+	for _, field := range fields {
+		if field.Type != "ref" {
+			continue
+		}
+		refFile, err := store.OpenFile(table.RefFilePath(field.Name), os.O_CREATE|os.O_WRONLY, tm.db.fileMode())
+		if err != nil {
+			return fmt.Errorf("failed to create ref field file: %v", err)
+		}
+		refFile.Close()
+	}
+
+	// The new configuration is staged next to the old one and swapped in right
+	// after the records, so both change as close together as possible
+	confJSON, err := json.MarshalIndent(altered, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize table to JSON: %v", err)
+	}
+	confPath := table.confPath()
+	err = writeFile(store, confPath+".temp", confJSON, tm.db.fileMode())
+	if err != nil {
+		return fmt.Errorf("failed to write table configuration: %v", err)
+	}
+
+	err = altered.writeRecords(records)
+	if err != nil {
+		store.Remove(confPath + ".temp")
+		return fmt.Errorf("failed to rewrite table '%s': %v", table.TableName, err)
+	}
+	err = store.Rename(confPath+".temp", confPath)
+	if err != nil {
+		return fmt.Errorf("failed to replace table configuration: %v", err)
+	}
+
+	// Archived versions are read with the table's fields
+	err = alterArchive(table, altered, kept)
+	if err != nil {
+		return err
+	}
+
+	// Indexes describe the rewritten file, those of dropped or unindexed fields go
+	err = altered.rebuildIndexes()
+	if err != nil {
+		return fmt.Errorf("failed to rebuild indexes of table '%s': %v", table.TableName, err)
+	}
+	for _, field := range table.Fields {
+		if field.Index == IndexNone {
+			continue
+		}
+		if _, indexed := altered.fullTextField(field.Name); !indexed {
+			store.Remove(table.fullTextIndexPath(field.Name))
+		}
+	}
+
+	// Statistics of an analyzed table describe the new fields from now on
+	if _, err := store.Stat(table.analysisPath()); err == nil {
+		_, err = altered.analyze()
+		if err != nil {
+			return fmt.Errorf("failed to analyze table '%s': %v", table.TableName, err)
+		}
+	}
+
+	// Side files of dropped ref fields are no longer referenced
+	for _, field := range table.Fields {
+		if field.Type == "ref" && !kept[field.Name] {
+			path := table.RefFilePath(field.Name)
+			if tm.db != nil {
+				tm.db.files.invalidate(path)
+			}
+			store.Remove(path)
+			store.Remove(table.refGapsPath(field.Name))
+		}
+	}
+
+	// Cached records and positions belong to the old layout
+	tm.recordCache.invalidateTable(tableCacheKey(table))
+	tm.primaryKeys.invalidate(tableCacheKey(table))
+
+	unlock()
+	table.Fields = fields
+	table.FormatVersion = layoutVersion
+	table.layout = nil
+	table.generation = tm.db.ddl.generation(tableCacheKey(table))
+
+	tm.db.log(slog.LevelInfo, "table altered",
+		"schema", filepath.Base(table.SchemaPath), "table", table.TableName, "fields", len(fields), "records", len(records))
+	return nil
+}
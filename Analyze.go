@@ -0,0 +1,227 @@
+// Analyze.go
+// Description: Per-field value statistics of the HTDB library
+// Distinct counts, ranges, frequent values and nulls, kept next to the table configuration
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// analyzeTopValues is the number of most frequent values kept for a string field
+const analyzeTopValues = 10
+
+// TableAnalysis holds the value statistics of a table's current records,
+// gathered by AnalyzeTable and refreshed by compaction
+type TableAnalysis struct {
+	AnalyzedAt time.Time    `json:"analyzed_at"`
+	TableSize  int64        `json:"table_size"` // Size of the table file the statistics describe
+	Records    int          `json:"records"`    // Current records, see TableStats.CurrentRecords
+	Fields     []FieldStats `json:"fields"`
+	Stale      bool         `json:"stale"` // The table file changed since, set when read
+}
+
+// FieldStats holds the value statistics of a single field
+type FieldStats struct {
+	Field     string       `json:"field"`
+	Nulls     int          `json:"nulls"`
+	Distinct  int          `json:"distinct"`             // Distinct non-null values, not counted for ref fields
+	Min       interface{}  `json:"min,omitempty"`        // Smallest value of int, float and timeID fields
+	Max       interface{}  `json:"max,omitempty"`        // Largest value of int, float and timeID fields
+	TopValues []ValueCount `json:"top_values,omitempty"` // Most frequent values of string fields, most frequent first
+}
+
+// ValueCount is a value and the number of current records holding it
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// AnalyzeTable gathers the value statistics of the table's current records
+// and stores them next to the table configuration. They are returned by Stats
+// and marked stale once the table file changes, compaction refreshes them.
+func (tm *TableManager) AnalyzeTable(table *Table) (*TableAnalysis, error) {
+	if err := tm.db.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	lock := table.lock()
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return table.analyze()
+}
+
+// analyze gathers and writes the value statistics of the table. The caller
+// must hold the table's lock.
+func (t *Table) analyze() (*TableAnalysis, error) {
+	analysis := &TableAnalysis{AnalyzedAt: time.Now().UTC()}
+	layout := t.Layout()
+
+	collectors := make([]*fieldCollector, len(layout.Fields))
+	for i, fieldLayout := range layout.Fields {
+		collectors[i] = &fieldCollector{field: fieldLayout.Field, counts: make(map[interface{}]int)}
+	}
+
+	record := &Record{}
+	err := t.scanRawRecords(func(data []byte) error {
+		analysis.TableSize += int64(len(data))
+		if !isLiveRecord(data) || checkRecordData(data, layout) != nil {
+			return nil
+		}
+		analysis.Records++
+
+		err := record.DeserializeInto(data, layout)
+		if err != nil {
+			return err
+		}
+		for _, collector := range collectors {
+			collector.add(record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to analyze table '%s': %w", t.TableName, err)
+	}
+
+	for _, collector := range collectors {
+		analysis.Fields = append(analysis.Fields, collector.stats())
+	}
+
+	err = t.writeAnalysis(analysis)
+	if err != nil {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+// fieldCollector gathers the statistics of one field during a scan
+type fieldCollector struct {
+	field    Field
+	nulls    int
+	counts   map[interface{}]int // Records by value, ref fields aren't counted
+	min, max interface{}
+}
+
+// add counts the field's value in a record
+func (c *fieldCollector) add(record *Record) {
+	value, exists := record.FieldsData[c.field.Name]
+	if record.FieldsMeta[c.field.Name].IsNull || !exists && c.field.Type != "ref" {
+		c.nulls++
+		return
+	}
+	if c.field.Type == "ref" {
+		return // The value lives in the ref file
+	}
+
+	c.counts[value]++
+	switch c.field.Type {
+	case Int, Float, TimeID:
+		if c.min == nil || lessThan(value, c.min) {
+			c.min = value
+		}
+		if c.max == nil || greaterThan(value, c.max) {
+			c.max = value
+		}
+	}
+}
+
+// stats returns the gathered statistics
+func (c *fieldCollector) stats() FieldStats {
+	stats := FieldStats{Field: c.field.Name, Nulls: c.nulls, Distinct: len(c.counts), Min: c.min, Max: c.max}
+	if c.field.Type != String {
+		return stats
+	}
+
+	for value, count := range c.counts {
+		stats.TopValues = append(stats.TopValues, ValueCount{Value: value.(string), Count: count})
+	}
+	sort.Slice(stats.TopValues, func(i, j int) bool {
+		a, b := stats.TopValues[i], stats.TopValues[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Value < b.Value
+	})
+	if len(stats.TopValues) > analyzeTopValues {
+		stats.TopValues = stats.TopValues[:analyzeTopValues]
+	}
+	return stats
+}
+
+// readAnalysis reads the stored value statistics of the table and marks them
+// stale if the table file changed since. It returns nil if the table was never analyzed.
+func (t *Table) readAnalysis() (*TableAnalysis, error) {
+	store := t.storage()
+	data, err := readFile(store, t.analysisPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read statistics of table '%s': %w", t.TableName, err)
+	}
+
+	// Numbers are kept exact, timeIDs don't fit into a float64
+	var analysis TableAnalysis
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&analysis)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid statistics of table '%s': %v", ErrCorrupt, t.TableName, err)
+	}
+	for i := range analysis.Fields {
+		stats := &analysis.Fields[i]
+		stats.Min = t.analysisNumber(stats.Field, stats.Min)
+		stats.Max = t.analysisNumber(stats.Field, stats.Max)
+	}
+
+	size, _ := t.dataSize()
+	analysis.Stale = size != analysis.TableSize
+	return &analysis, nil
+}
+
+// analysisNumber converts a decoded min or max back to the type of its field
+func (t *Table) analysisNumber(fieldName string, value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	for _, field := range t.Fields {
+		if field.Name != fieldName {
+			continue
+		}
+		if field.Type == Float {
+			f, _ := number.Float64()
+			return f
+		}
+		i, _ := number.Int64()
+		return i
+	}
+	return value
+}
+
+// writeAnalysis replaces the stored value statistics of the table through a temporary file
+func (t *Table) writeAnalysis(analysis *TableAnalysis) error {
+	data, err := json.MarshalIndent(analysis, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode statistics of table '%s': %v", t.TableName, err)
+	}
+
+	store := t.storage()
+	path := t.analysisPath()
+	err = writeFile(store, path+".temp", data, t.db.fileMode())
+	if err == nil {
+		err = store.Rename(path+".temp", path)
+	}
+	if err != nil {
+		store.Remove(path + ".temp")
+		return fmt.Errorf("failed to write statistics of table '%s': %v", t.TableName, err)
+	}
+	return nil
+}
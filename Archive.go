@@ -0,0 +1,391 @@
+// Archive.go
+// Description: Archive of old record versions for the HTDB library
+// Cleanup can move outdated and deleted records into a per-table archive instead of dropping them
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// archiveSuffix is appended to a table's name to name its archive. The archive
+// is stored like a table of that name, table names can't contain dots so it
+// never clashes with one.
+const archiveSuffix = ".archive"
+
+// CleanupMode is what cleanup does with outdated and deleted records
+type CleanupMode string
+
+const (
+	CleanupDrop    CleanupMode = "drop"    // Remove them, the default
+	CleanupArchive CleanupMode = "archive" // Move them into the table's archive, see QueryArchive
+)
+
+// SetCleanupMode sets what cleanup does with outdated and deleted records and
+// writes it to the config file. Cleanup policies may override it, see SetCleanupPolicy.
+func (db *HTDB) SetCleanupMode(mode CleanupMode) error {
+	config := db.Config()
+	config.CleanupMode = string(mode)
+	return db.SetConfig(config)
+}
+
+// archiveTable returns the archive of the table. It has the fields of the
+// table without their indexes and keeps its records in <table>.archive.htdb,
+// the ref values in ref files of its own.
+func (t *Table) archiveTable() *Table {
+	fields := make([]Field, len(t.Fields))
+	copy(fields, t.Fields)
+	for i := range fields {
+		fields[i].Index = IndexNone
+	}
+	return &Table{
+		TableName:     t.TableName + archiveSuffix,
+		Fields:        fields,
+		SchemaPath:    t.SchemaPath,
+		FormatVersion: t.FormatVersion,
+		db:            t.db,
+		schema:        t.schema,
+	}
+}
+
+// archiveFilePaths returns the paths of every file of the table's archive
+func (t *Table) archiveFilePaths() []string {
+	archive := t.archiveTable()
+	paths := []string{archive.filePath(), archive.layoutHashPath()}
+	for _, field := range archive.Fields {
+		if field.Type == "ref" {
+			paths = append(paths, archive.RefFilePath(field.Name))
+		}
+	}
+	return paths
+}
+
+// QueryArchive creates a query over the archived versions of a table. Every
+// archived version is a candidate, outdated and deleted ones alike, and the
+// results are not reduced to the latest version of a record. Archived records
+// carry the values of their ref fields, not offsets.
+func (tm *TableManager) QueryArchive(table *Table) *Query {
+	query := tm.Select(table)
+	query.archived = true
+	return query
+}
+
+// PruneArchive removes the archived versions of a table created before
+// olderThan, their ref values included, and returns how many were removed
+func (tm *TableManager) PruneArchive(table *Table, olderThan time.Time) (int, error) {
+	if err := tm.db.checkOpen(); err != nil {
+		return 0, err
+	}
+	if err := table.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	// Cleanup appends to the archive while it holds the table's lock
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	archive := table.archiveTable()
+	archiveLock := archive.lock()
+	archiveLock.Lock()
+	defer archiveLock.Unlock()
+
+	store := table.storage()
+	err := archive.checkLayoutHash(store)
+	if err != nil {
+		return 0, newTableError(table, err)
+	}
+	records, err := archive.allRecords()
+	var truncated *TruncatedTableError
+	if err != nil && !errors.As(err, &truncated) {
+		return 0, fmt.Errorf("failed to read archive of table '%s': %w", table.TableName, err)
+	}
+
+	cutoff := olderThan.UnixNano()
+	seen := make(map[int64]bool, len(records))
+	var kept []*Record
+	pruned := 0
+	for _, record := range records {
+		if seen[record.ID] {
+			continue // Archived again after an interrupted cleanup
+		}
+		seen[record.ID] = true
+		if record.ID < cutoff {
+			pruned++
+			continue
+		}
+		kept = append(kept, record)
+	}
+	if len(kept) == len(records) && truncated == nil {
+		return 0, nil
+	}
+
+	// Ref values only the pruned versions used are dropped with them
+	err = archive.rewriteRecords(kept, archive.refFields())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune archive of table '%s': %w", table.TableName, err)
+	}
+
+	tm.db.log(slog.LevelInfo, "archive pruned",
+		"schema", table.schemaName(), "table", table.TableName, "records", pruned, "kept", len(kept))
+	return pruned, nil
+}
+
+// writeRecordsTemp writes serialized records into a new compaction temporary
+// file for path, see createTempFile, and syncs it. It returns the file's name,
+// the file is removed if the write fails.
+func (t *Table) writeRecordsTemp(store Storage, path string, records []*Record) (string, error) {
+	file, tempPath, err := createTempFile(store, path, compactionTempSuffix, t.db.fileMode())
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	err = t.encodeRecords(writer, records)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		store.Remove(tempPath)
+		return "", fmt.Errorf("failed to write records to temporary file: %v", err)
+	}
+	err = file.Sync()
+	if err != nil {
+		store.Remove(tempPath)
+		return "", fmt.Errorf("failed to sync temporary file: %v", err)
+	}
+	return tempPath, nil
+}
+
+// archiver appends the records a compaction drops to the table's archive.
+// Its records are on disk before the compaction commits; if the compaction
+// doesn't, they are archived again by the next one, so readers of the archive
+// skip versions they already saw.
+type archiver struct {
+	table    *Table // The archive
+	file     StorageFile
+	writer   *bufio.Writer
+	refs     []*refCompactor // Copy ref values into the archive's ref files
+	lock     *sync.RWMutex
+	archived int
+}
+
+// newArchiver opens the archive of a table for a compaction, locking it until
+// close. compactors are the table's ref compactors, the ref values are read
+// from their source files. The caller must hold the table's lock.
+func newArchiver(table *Table, compactors []*refCompactor) (*archiver, error) {
+	archive := table.archiveTable()
+	store := table.storage()
+	mode := table.db.fileMode()
+
+	a := &archiver{table: archive, lock: archive.lock()}
+	a.lock.Lock()
+
+	err := archive.checkLayoutHash(store)
+	if err == nil {
+		err = archive.writeLayoutHash(store)
+	}
+	if err != nil {
+		a.lock.Unlock()
+		return nil, err
+	}
+
+	a.file, err = store.OpenFile(archive.filePath(), os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		a.lock.Unlock()
+		return nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+
+	// A record cut short by an interrupted cleanup is still in the table file
+	stat, err := a.file.Stat()
+	if err == nil {
+		size := stat.Size() - stat.Size()%int64(archive.RecordSize())
+		err = a.file.Truncate(size)
+		if err == nil {
+			_, err = a.file.Seek(size, io.SeekStart)
+		}
+	}
+	if err != nil {
+		a.close()
+		return nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+	a.writer = bufio.NewWriter(a.file)
+
+	for _, compactor := range compactors {
+		dst, err := store.OpenFile(archive.RefFilePath(compactor.fieldName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
+		if err != nil {
+			a.close()
+			return nil, fmt.Errorf("failed to open archive ref file: %v", err)
+		}
+		stat, err := dst.Stat()
+		if err != nil {
+			dst.Close()
+			a.close()
+			return nil, fmt.Errorf("failed to get file stats: %v", err)
+		}
+		a.refs = append(a.refs, &refCompactor{
+			fieldName: compactor.fieldName,
+			src:       compactor.src,
+			srcSize:   compactor.srcSize,
+			gaps:      compactor.gaps,
+			dst:       dst,
+			offset:    stat.Size(),
+		})
+	}
+	return a, nil
+}
+
+// add appends a record dropped by the compaction to the archive
+func (a *archiver) add(recordData []byte, buf []byte) error {
+	record, err := deserializeRecordLayout(recordData, a.table.Layout())
+	if err != nil {
+		return fmt.Errorf("failed to deserialize record: %v", err)
+	}
+
+	// Values out of range are nulled like in the compacted table
+	for _, ref := range a.refs {
+		_, err = ref.copyRecord(record, buf)
+		if err != nil {
+			return fmt.Errorf("failed to archive ref field %s: %v", ref.fieldName, err)
+		}
+	}
+
+	data, err := record.serializeLayout(a.table.Layout())
+	if err != nil {
+		return fmt.Errorf("failed to serialize record: %v", err)
+	}
+	_, err = a.writer.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	a.archived++
+	return nil
+}
+
+// finish flushes and syncs the archive
+func (a *archiver) finish() error {
+	for _, ref := range a.refs {
+		err := ref.dst.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync archive ref file: %v", err)
+		}
+	}
+	err := a.writer.Flush()
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	return nil
+}
+
+// close closes the archive's files and unlocks it. The source ref files
+// belong to the compaction.
+func (a *archiver) close() {
+	for _, ref := range a.refs {
+		ref.dst.Close()
+	}
+	a.refs = nil
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if a.lock != nil {
+		a.lock.Unlock()
+		a.lock = nil
+	}
+}
+
+// streamArchive streams the archived records of the table selected by
+// options, skipping versions in seen and adding the streamed ones to it. The
+// values of ref fields are read from the archive's ref files into FieldsData,
+// their offsets would be taken for offsets into the table's.
+func (t *Table) streamArchive(options ScanOptions, seen map[int64]bool, fn func(*Record) error) error {
+	archive := t.archiveTable()
+	err := archive.checkLayoutHash(t.storage())
+	if err != nil {
+		return newTableError(t, err)
+	}
+
+	refs := newRefReader(archive)
+	defer refs.close()
+
+	options.IncludeArchived = false
+	err = archive.StreamRecordsWith(options, func(record *Record) error {
+		if seen[record.ID] {
+			return nil
+		}
+		seen[record.ID] = true
+
+		for _, field := range archive.Fields {
+			if _, exists := record.RefOffsets[field.Name]; !exists || field.Type != "ref" {
+				continue
+			}
+			value, err := refs.read(record, field)
+			if err != nil {
+				return newRecordError(t, record.ID, err)
+			}
+			record.FieldsData[field.Name] = value
+			delete(record.RefOffsets, field.Name)
+		}
+		return fn(record)
+	})
+	var truncated *TruncatedTableError
+	if errors.As(err, &truncated) {
+		return nil // Cut short by an interrupted cleanup, the records are still in the table
+	}
+	return err
+}
+
+// alterArchive rewrites the archive of a table into the fields of altered
+// like alterTable does with the table. The caller must hold the table's lock.
+func alterArchive(table, altered *Table, kept map[string]bool) error {
+	archive := table.archiveTable()
+	store := table.storage()
+	if _, err := store.Stat(archive.filePath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	lock := archive.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	records, err := archive.allRecords()
+	var truncated *TruncatedTableError
+	if err != nil && !errors.As(err, &truncated) {
+		return fmt.Errorf("failed to read archive of table '%s': %v", table.TableName, err)
+	}
+	for _, record := range records {
+		for name := range record.FieldsMeta {
+			if !kept[name] {
+				delete(record.FieldsData, name)
+				delete(record.FieldsMeta, name)
+				delete(record.RefOffsets, name)
+			}
+		}
+	}
+
+	err = altered.archiveTable().writeRecords(records)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite archive of table '%s': %v", table.TableName, err)
+	}
+
+	for _, field := range archive.Fields {
+		if field.Type == "ref" && !kept[field.Name] {
+			path := archive.RefFilePath(field.Name)
+			table.db.files.invalidate(path)
+			store.Remove(path)
+		}
+	}
+	return nil
+}
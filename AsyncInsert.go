@@ -0,0 +1,252 @@
+// AsyncInsert.go
+// Description: Write-behind queue for the HTDB library
+// Batches asynchronous inserts per table into single commits
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+const (
+	defaultAsyncQueueSize = 1024 // Buffered inserts per table before InsertAsync blocks
+	defaultAsyncBatchSize = 256  // Maximum inserts committed together
+)
+
+// AsyncInsertError is reported for an asynchronous insert that could not be
+// written. It carries the original payload so the caller can retry it.
+type AsyncInsertError struct {
+	Table *Table
+	Data  map[string]interface{}
+	Err   error
+}
+
+func (e *AsyncInsertError) Error() string {
+	return fmt.Sprintf("async insert into table '%s' failed: %v", e.Table.TableName, e.Err)
+}
+
+func (e *AsyncInsertError) Unwrap() error {
+	return e.Err
+}
+
+// asyncInsert is a single queued insert
+type asyncInsert struct {
+	table *Table
+	data  map[string]interface{}
+}
+
+// asyncWriter owns the per-table insert queues of a TableManager
+type asyncWriter struct {
+	tm      *TableManager
+	queues  map[string]chan asyncInsert
+	onError func(*AsyncInsertError)
+	pending int  // Inserts queued but not yet written
+	closed  bool // No new inserts are accepted
+	wg      sync.WaitGroup
+	drained *sync.Cond   // Signalled when pending drops to zero or the failures are delivered
+	sendMu  sync.RWMutex // Held for reading while sending, so CloseAsync never closes a queue mid-send
+	mu      sync.Mutex
+
+	failures   []*AsyncInsertError // Failed inserts waiting for the error handler, oldest first
+	delivering bool                // A goroutine is handing failures to the error handler
+}
+
+// newAsyncWriter creates the write-behind queue of a TableManager
+func newAsyncWriter(tm *TableManager) *asyncWriter {
+	w := &asyncWriter{
+		tm:     tm,
+		queues: make(map[string]chan asyncInsert),
+	}
+	w.drained = sync.NewCond(&w.mu)
+	return w
+}
+
+// SetAsyncErrorHandler sets the callback receiving inserts from InsertAsync
+// that failed to be written. Without a handler failures are logged as errors.
+// The handler is called on a goroutine of its own, one failure at a time in
+// the order they happened, so it may retry them with InsertAsync. It must not
+// call FlushAsync or CloseAsync, they wait for the handler to return.
+func (tm *TableManager) SetAsyncErrorHandler(handler func(*AsyncInsertError)) {
+	tm.asyncWriter.mu.Lock()
+	defer tm.asyncWriter.mu.Unlock()
+
+	tm.asyncWriter.onError = handler
+}
+
+// InsertAsync queues a record for insertion and returns right away. Queued
+// inserts of a table are written in batches by a background writer, so a crash
+// can lose inserts that were accepted but not yet written. Use FlushAsync to
+// wait for the queue to drain.
+func (tm *TableManager) InsertAsync(table *Table, data map[string]interface{}) error {
+	if err := tm.db.checkAccepting(); err != nil {
+		return err
+	}
+	w := tm.asyncWriter
+
+	w.sendMu.RLock()
+	defer w.sendMu.RUnlock()
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return fmt.Errorf("async inserts are closed")
+	}
+
+	key := tableCacheKey(table)
+	queue, exists := w.queues[key]
+	if !exists {
+		queue = make(chan asyncInsert, defaultAsyncQueueSize)
+		w.queues[key] = queue
+		w.wg.Add(1)
+		go w.run(queue)
+	}
+	w.pending++
+	w.mu.Unlock()
+
+	// Sending may block when the queue is full, that is the back pressure
+	queue <- asyncInsert{table: table, data: data}
+	return nil
+}
+
+// FlushAsync blocks until every insert queued by InsertAsync so far was
+// written or handed to the error handler, and the handler returned
+func (tm *TableManager) FlushAsync() {
+	w := tm.asyncWriter
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.pending > 0 || w.delivering {
+		w.drained.Wait()
+	}
+}
+
+// CloseAsync stops accepting asynchronous inserts, writes everything still
+// queued and stops the background writers
+func (tm *TableManager) CloseAsync() {
+	w := tm.asyncWriter
+
+	w.sendMu.Lock()
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		w.sendMu.Unlock()
+		return
+	}
+	w.closed = true
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.mu.Unlock()
+	w.sendMu.Unlock()
+
+	w.wg.Wait()
+
+	// Failures of the last batches still reach the handler
+	w.mu.Lock()
+	for w.delivering {
+		w.drained.Wait()
+	}
+	w.mu.Unlock()
+}
+
+// run consumes a table's queue, committing the inserts in batches
+func (w *asyncWriter) run(queue chan asyncInsert) {
+	defer w.wg.Done()
+
+	for first := range queue {
+		batch := []asyncInsert{first}
+
+		// Take whatever else is already waiting, up to the batch size
+	collect:
+		for len(batch) < defaultAsyncBatchSize {
+			select {
+			case insert, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, insert)
+			default:
+				break collect
+			}
+		}
+
+		w.writeBatch(batch)
+
+		w.mu.Lock()
+		w.pending -= len(batch)
+		if w.pending == 0 {
+			w.drained.Broadcast()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// writeBatch commits a batch of inserts in a single transaction
+func (w *asyncWriter) writeBatch(batch []asyncInsert) {
+	tx := w.tm.beginTransaction()
+
+	var staged []asyncInsert
+	for _, insert := range batch {
+		_, err := tx.StageInsert(insert.table, insert.data)
+		if err != nil {
+			w.report(insert, err)
+			continue
+		}
+		staged = append(staged, insert)
+	}
+
+	if len(staged) == 0 {
+		w.tm.RollbackTransaction(tx)
+		return
+	}
+
+	err := w.tm.CommitTransaction(tx)
+	if err != nil {
+		for _, insert := range staged {
+			w.report(insert, err)
+		}
+	}
+}
+
+// report queues a failed insert for the error handler. The writer never
+// waits for the handler, which may block on the writer's own queue.
+func (w *asyncWriter) report(insert asyncInsert, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.onError == nil {
+		w.tm.db.log(slog.LevelError, "async insert failed",
+			"schema", insert.table.schemaName(), "table", insert.table.TableName, "error", err)
+		return
+	}
+
+	w.failures = append(w.failures, &AsyncInsertError{Table: insert.table, Data: insert.data, Err: err})
+	if !w.delivering {
+		w.delivering = true
+		go w.deliver()
+	}
+}
+
+// deliver hands the queued failures to the error handler until none are left
+func (w *asyncWriter) deliver() {
+	w.mu.Lock()
+	for len(w.failures) > 0 {
+		failure := w.failures[0]
+		w.failures[0] = nil
+		w.failures = w.failures[1:]
+		handler := w.onError
+		w.mu.Unlock()
+
+		if handler != nil {
+			handler(failure)
+		}
+		w.mu.Lock()
+	}
+	w.delivering = false
+	w.drained.Broadcast()
+	w.mu.Unlock()
+}
@@ -0,0 +1,109 @@
+// AsyncInsert_test.go
+// Description: Tests of the write-behind queue of the HTDB library
+// Queued inserts are written in batches, failures reach the handler without blocking the writer
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInsertAsyncFlush(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", []Field{{Name: "key", Type: Int, Length: 8}})
+
+	for key := 0; key < 3000; key++ {
+		err := tm.InsertAsync(table, map[string]interface{}{"key": key})
+		if err != nil {
+			t.Fatalf("failed to queue insert: %v", err)
+		}
+	}
+	tm.FlushAsync()
+
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if len(records) != 3000 {
+		t.Errorf("table holds %d records after the flush, want 3000", len(records))
+	}
+}
+
+// A handler retrying failed inserts with InsertAsync must not block the
+// writer that reports the failures
+func TestInsertAsyncRetryingHandler(t *testing.T) {
+	// Not closed in a cleanup, closing would hang on a stuck writer as well
+	db, err := Open(MemoryPath, OpenOptions{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", []Field{{Name: "key", Type: Int, Length: 8}})
+
+	var failures atomic.Int64
+	tm.SetAsyncErrorHandler(func(failure *AsyncInsertError) {
+		failures.Add(1)
+		retry := map[string]interface{}{"key": failure.Data["key"]}
+		err := tm.InsertAsync(failure.Table, retry)
+		if err != nil {
+			t.Errorf("failed to retry insert: %v", err)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := 0; key < 5000; key++ {
+			err := tm.InsertAsync(table, map[string]interface{}{"key": key, "unknown": true})
+			if err != nil {
+				t.Errorf("failed to queue insert: %v", err)
+				return
+			}
+		}
+		tm.FlushAsync()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("inserts hung after %d failures", failures.Load())
+	}
+	defer db.Close()
+
+	if failures.Load() != 5000 {
+		t.Errorf("handler got %d failures, want 5000", failures.Load())
+	}
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if len(records) != 5000 {
+		t.Errorf("table holds %d records after the retries, want 5000", len(records))
+	}
+}
+
+func TestCloseAsyncDeliversFailures(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", []Field{{Name: "key", Type: Int, Length: 8}})
+
+	var failures atomic.Int64
+	tm.SetAsyncErrorHandler(func(*AsyncInsertError) {
+		failures.Add(1)
+	})
+	for key := 0; key < 100; key++ {
+		err := tm.InsertAsync(table, map[string]interface{}{"key": "not a number"})
+		if err != nil {
+			t.Fatalf("failed to queue insert: %v", err)
+		}
+	}
+	tm.CloseAsync()
+
+	if failures.Load() != 100 {
+		t.Errorf("handler got %d failures before CloseAsync returned, want 100", failures.Load())
+	}
+}
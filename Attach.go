@@ -0,0 +1,240 @@
+// Attach.go
+// Description: Attached schemas of the HTDB library
+// Mounts schema directories outside the main path, e.g. reference datasets shared by several services
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AttachedSchema is a schema directory outside the main path, see AttachSchema
+type AttachedSchema struct {
+	Path     string `json:"path"`                // Directory of the schema
+	ReadOnly bool   `json:"read_only,omitempty"` // Writes are rejected with ErrReadOnly
+}
+
+// attachments are the attached schemas of a database, replaced as a whole on change
+type attachments struct {
+	schemas  map[string]AttachedSchema
+	readOnly []string // Cleaned directories of the read-only schemas
+}
+
+// AttachSchema mounts the schema directory at path under name, so its tables
+// can be used like those of the main path. Writes to a read-only schema are
+// rejected with ErrReadOnly and the cleanup worker leaves it alone. The mapping
+// is kept in the config file and restored by Open. Attached schemas are not
+// part of backups.
+func (db *HTDB) AttachSchema(name, path string, readOnly bool) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if !validName(name) {
+		return invalidSchemaName(name)
+	}
+	if _, attached := db.attachedSchemas()[name]; attached {
+		return fmt.Errorf("schema '%s' is already attached: %w", name, ErrAlreadyExists)
+	}
+	if _, err := db.storage().Stat(filepath.Join(db.mainPath, name)); !os.IsNotExist(err) {
+		return fmt.Errorf("schema '%s' exists in the main path: %w", name, ErrAlreadyExists)
+	}
+
+	path = filepath.Clean(path)
+	_, err := db.storage().Stat(schemaIndexPath(path))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: directory '%s' is not a schema, it has no index", ErrSchemaNotFound, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = db.updateAttached(func(schemas map[string]AttachedSchema) {
+		schemas[name] = AttachedSchema{Path: path, ReadOnly: readOnly}
+	})
+	if err != nil {
+		return err
+	}
+
+	// The tables must be readable by this version of the library
+	tables, err := db.TableNames(name)
+	if err == nil {
+		for _, table := range tables {
+			_, err = db.getTable(name + ":" + table)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		db.DetachSchema(name)
+		return err
+	}
+	return nil
+}
+
+// DetachSchema removes an attached schema from the database. Its files are not touched.
+func (db *HTDB) DetachSchema(name string) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	attached, exists := db.attachedSchemas()[name]
+	if !exists {
+		return fmt.Errorf("schema '%s' is not attached: %w", name, ErrSchemaNotFound)
+	}
+
+	err := db.updateAttached(func(schemas map[string]AttachedSchema) {
+		delete(schemas, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Forget everything cached about its tables
+	entries, err := db.storage().ReadDir(attached.Path)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		path := filepath.Join(attached.Path, entry.Name())
+		db.files.invalidate(path)
+		db.tableManager.recordCache.invalidateTable(path)
+		db.tableManager.primaryKeys.invalidate(filepath.Clean(path))
+	}
+	return nil
+}
+
+// AttachedSchemas returns the attached schemas by name
+func (db *HTDB) AttachedSchemas() map[string]AttachedSchema {
+	schemas := make(map[string]AttachedSchema)
+	for name, attached := range db.attachedSchemas() {
+		schemas[name] = attached
+	}
+	return schemas
+}
+
+// attachedSchemas returns the attached schemas by name, it must not be changed
+func (db *HTDB) attachedSchemas() map[string]AttachedSchema {
+	if current := db.attached.Load(); current != nil {
+		return current.schemas
+	}
+	return nil
+}
+
+// setAttached makes schemas the attached schemas
+func (db *HTDB) setAttached(schemas map[string]AttachedSchema) {
+	current := &attachments{schemas: make(map[string]AttachedSchema, len(schemas))}
+	for name, attached := range schemas {
+		attached.Path = filepath.Clean(attached.Path)
+		current.schemas[name] = attached
+		if attached.ReadOnly {
+			current.readOnly = append(current.readOnly, attached.Path)
+		}
+	}
+	db.attached.Store(current)
+}
+
+// updateAttached changes the attached schemas and writes them to the config file
+func (db *HTDB) updateAttached(change func(schemas map[string]AttachedSchema)) error {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	schemas := make(map[string]AttachedSchema)
+	for name, attached := range db.attachedSchemas() {
+		schemas[name] = attached
+	}
+	change(schemas)
+	if len(schemas) == 0 {
+		schemas = nil
+	}
+
+	// The file is updated as it is, the running settings may differ from it
+	config, _, err := readConfig(db.storage(), db.mainPath)
+	if err != nil {
+		return err
+	}
+	config.AttachedSchemas = schemas
+	err = writeConfig(db.storage(), db.mainPath, config, DurabilityFlush)
+	if err != nil {
+		return err
+	}
+
+	db.config.AttachedSchemas = schemas
+	db.setAttached(schemas)
+	return nil
+}
+
+// schemaPath returns the directory of a schema, attached or in the main path
+func (db *HTDB) schemaPath(name string) string {
+	if attached, exists := db.attachedSchemas()[name]; exists {
+		return attached.Path
+	}
+	return filepath.Join(db.mainPath, name)
+}
+
+// isReadOnlySchema reports whether a schema is attached read-only
+func (db *HTDB) isReadOnlySchema(name string) bool {
+	return db.attachedSchemas()[name].ReadOnly
+}
+
+// isReadOnlyPath reports whether path lies in a read-only attached schema
+func (db *HTDB) isReadOnlyPath(path string) bool {
+	current := db.attached.Load()
+	if current == nil || len(current.readOnly) == 0 {
+		return false
+	}
+
+	path = filepath.Clean(path)
+	for _, dir := range current.readOnly {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable returns ErrReadOnly for tables of read-only attached schemas
+func (t *Table) checkWritable() error {
+	if t.db != nil && t.db.isReadOnlyPath(t.SchemaPath) {
+		return newTableError(t, ErrReadOnly)
+	}
+	return nil
+}
+
+// readOnlySchemaStorage rejects writes into read-only attached schemas
+type readOnlySchemaStorage struct {
+	Storage
+	db *HTDB
+}
+
+func (s readOnlySchemaStorage) OpenFile(name string, flag int, perm fs.FileMode) (StorageFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 && s.db.isReadOnlyPath(name) {
+		return nil, storagePathError("open", name, ErrReadOnly)
+	}
+	return s.Storage.OpenFile(name, flag, perm)
+}
+
+func (s readOnlySchemaStorage) Mkdir(name string, perm fs.FileMode) error {
+	if s.db.isReadOnlyPath(name) {
+		return storagePathError("mkdir", name, ErrReadOnly)
+	}
+	return s.Storage.Mkdir(name, perm)
+}
+
+func (s readOnlySchemaStorage) Remove(name string) error {
+	if s.db.isReadOnlyPath(name) {
+		return storagePathError("remove", name, ErrReadOnly)
+	}
+	return s.Storage.Remove(name)
+}
+
+func (s readOnlySchemaStorage) Rename(oldPath, newPath string) error {
+	if s.db.isReadOnlyPath(oldPath) || s.db.isReadOnlyPath(newPath) {
+		return storagePathError("rename", newPath, ErrReadOnly)
+	}
+	return s.Storage.Rename(oldPath, newPath)
+}
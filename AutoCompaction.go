@@ -0,0 +1,101 @@
+// AutoCompaction.go
+// Description: Compaction thresholds of the HTDB library
+// Compacts tables once their share of outdated and deleted records grows past a threshold
+// Author: harto.dev
+
+package hartoDb_go
+
+import "log/slog"
+
+// SetCompactionThreshold sets the dead record ratio, outdated and deleted
+// versions over all versions, a table must exceed to be compacted by the
+// cleanup worker. A commit that takes a table over its threshold schedules it
+// right away, the periodic passes skip tables within theirs. An empty schema
+// and table set the threshold of every table without one of its own. A ratio
+// of 0 removes the threshold, tables without one are compacted by every pass.
+// Compact and TriggerNow compact every table regardless of thresholds.
+func (db *HTDB) SetCompactionThreshold(schema, table string, ratio float64) error {
+	config := db.Config()
+	if schema == "" && table == "" {
+		config.CompactionThreshold = ratio
+		return db.SetConfig(config)
+	}
+
+	thresholds := make(map[string]float64, len(config.TableCompactionThresholds))
+	for key, threshold := range config.TableCompactionThresholds {
+		thresholds[key] = threshold
+	}
+	if ratio == 0 {
+		delete(thresholds, schema+":"+table)
+	} else {
+		thresholds[schema+":"+table] = ratio
+	}
+	config.TableCompactionThresholds = thresholds
+	return db.SetConfig(config)
+}
+
+// compactionThreshold returns the compaction threshold of a table, 0 if it has none
+func (db *HTDB) compactionThreshold(schema, table string) float64 {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	threshold, ok := db.config.TableCompactionThresholds[schema+":"+table]
+	if !ok {
+		threshold = db.config.CompactionThreshold
+	}
+	return threshold
+}
+
+// deadRatio returns the share of dead records, 0 for an empty table
+func deadRatio(dead, records int) float64 {
+	if records == 0 {
+		return 0
+	}
+	return float64(dead) / float64(records)
+}
+
+// checkCompactionThreshold schedules the table for compaction if the dead
+// records of a commit took it over its threshold
+func (tm *TableManager) checkCompactionThreshold(table *Table, dead, records int) {
+	threshold := tm.db.compactionThreshold(table.schemaName(), table.TableName)
+	if threshold <= 0 || deadRatio(dead, records) <= threshold {
+		return
+	}
+
+	worker := tm.cleanupWorker.Load()
+	if worker == nil {
+		return
+	}
+	tm.db.log(slog.LevelDebug, "table scheduled for compaction",
+		"schema", table.schemaName(), "table", table.TableName,
+		"dead_ratio", deadRatio(dead, records), "threshold", threshold)
+	worker.schedule(table.schemaName() + ":" + table.TableName)
+}
+
+// schedule compacts the table on the next scheduled pass, which starts right
+// away if the worker is idle. It does not block.
+func (w *CleanupWorker) schedule(table string) {
+	w.mu.Lock()
+	if w.scheduled == nil {
+		w.scheduled = make(map[string]bool)
+	}
+	w.scheduled[table] = true
+	w.mu.Unlock()
+
+	select {
+	case w.compactChan <- struct{}{}:
+	default:
+	}
+}
+
+// performScheduled compacts the scheduled tables still over their threshold
+func (w *CleanupWorker) performScheduled() {
+	w.mu.Lock()
+	tables := w.scheduled
+	w.scheduled = nil
+	w.mu.Unlock()
+
+	if len(tables) > 0 {
+		w.performPass(cleanupPass{tables: tables, thresholds: true})
+	}
+}
@@ -0,0 +1,58 @@
+// AutoCompaction_test.go
+// Description: Tests of threshold triggered compaction of the HTDB library
+// Commits schedule compactions while the cleanup worker is started and stopped
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactionThresholdDuringWorkerRestarts(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	err := db.SetCompactionThreshold("s", "t", 0.1)
+	if err != nil {
+		t.Fatalf("failed to set threshold: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		record := insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "first"})
+		for version := 0; version < 100; version++ {
+			var err error
+			record, err = tm.UpdateRecord(table, record, map[string]interface{}{"note": fmt.Sprint(version)})
+			if err != nil {
+				t.Errorf("failed to update record: %v", err)
+				return
+			}
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		err := tm.StartCleanupWorker(time.Hour)
+		if err != nil {
+			t.Fatalf("failed to start worker: %v", err)
+		}
+		err = tm.StopCleanupWorker()
+		if err != nil {
+			t.Fatalf("failed to stop worker: %v", err)
+		}
+	}
+
+	got := currentValues(t, tm, table)
+	if got[1] != "99" {
+		t.Errorf("record reads %q after the updates, want \"99\"", got[1])
+	}
+}
@@ -0,0 +1,468 @@
+// Backup.go
+// Description: Online backups for the HTDB library
+// Writes every schema of a database into a single tar archive with a checksummed manifest
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupFormatVersion = 1               // Version of the archive layout
+	backupManifestName  = "manifest.json" // Last entry of every archive
+)
+
+// BackupOptions configures Backup
+type BackupOptions struct {
+	Gzip     bool                 // Compress the archive (tar.gz instead of tar)
+	Progress func(BackupProgress) // Called after every archived file, may be nil
+}
+
+// BackupProgress describes how far a running backup is
+type BackupProgress struct {
+	File       string // Path of the file just archived, relative to the main path
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+}
+
+// BackupManifest is stored as the last entry of a backup archive
+type BackupManifest struct {
+	FormatVersion int               `json:"format_version"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Files         []BackupFileEntry `json:"files"`
+}
+
+// BackupFileEntry describes a single archived file
+type BackupFileEntry struct {
+	Path   string `json:"path"`   // Relative to the main path, with forward slashes
+	Size   int64  `json:"size"`   // Bytes archived
+	SHA256 string `json:"sha256"` // Hex checksum of the archived bytes
+}
+
+// backupFile is a file opened while the snapshot was taken
+type backupFile struct {
+	path string
+	file StorageFile
+	size int64
+	mode os.FileMode
+}
+
+// Backup writes a consistent snapshot of every schema to w as a tar archive.
+// Commits are only paused while the files are opened, the copying happens
+// afterwards from the open handles, and readers are never blocked. The archive
+// ends with a manifest holding the size and checksum of every file.
+func (db *HTDB) Backup(w io.Writer, options BackupOptions) error {
+	files, err := db.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}()
+
+	var bytesTotal int64
+	for _, f := range files {
+		bytesTotal += f.size
+	}
+
+	var gzipWriter *gzip.Writer
+	if options.Gzip {
+		gzipWriter = gzip.NewWriter(w)
+		w = gzipWriter
+	}
+	tarWriter := tar.NewWriter(w)
+
+	manifest := BackupManifest{
+		FormatVersion: backupFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+	}
+	progress := BackupProgress{FilesTotal: len(files), BytesTotal: bytesTotal}
+
+	for _, f := range files {
+		entry, err := writeBackupFile(tarWriter, f, manifest.CreatedAt)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, entry)
+
+		progress.File = entry.Path
+		progress.FilesDone++
+		progress.BytesDone += entry.Size
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+	}
+
+	// The manifest goes last, its checksums are computed while copying
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup manifest: %v", err)
+	}
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0644,
+		Size:    int64(len(manifestData)),
+		ModTime: manifest.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write backup manifest: %v", err)
+	}
+	_, err = tarWriter.Write(manifestData)
+	if err != nil {
+		return fmt.Errorf("failed to write backup manifest: %v", err)
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to finish backup archive: %v", err)
+	}
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			return fmt.Errorf("failed to finish backup archive: %v", err)
+		}
+	}
+	return nil
+}
+
+// snapshotFiles opens every file of every schema while holding the read lock
+// of every table, so no commit or compaction can change them in between.
+// Table files are replaced by renames and ref files only grow, so the open
+// handles and sizes stay a consistent snapshot after the locks are released.
+// A transaction commits its tables one after another, the commit lock is held
+// as well so none is captured half-applied.
+func (db *HTDB) snapshotFiles() ([]*backupFile, error) {
+	paths, locks, err := db.schemaFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// Taken before the table locks, like commits do
+	if tm := db.tableManager; tm != nil {
+		tm.transactionsMu.Lock()
+		defer tm.transactionsMu.Unlock()
+	}
+	for _, lock := range locks {
+		lock.RLock()
+	}
+	defer func() {
+		for _, lock := range locks {
+			lock.RUnlock()
+		}
+	}()
+
+	store := db.storage()
+	var files []*backupFile
+	for _, path := range paths {
+		file, err := openFile(store, path)
+		if os.IsNotExist(err) {
+			continue // Removed since the directory was listed
+		}
+		if err == nil {
+			var stat os.FileInfo
+			stat, err = file.Stat()
+			if err == nil {
+				relPath, _ := filepath.Rel(db.mainPath, path)
+				files = append(files, &backupFile{
+					path: filepath.ToSlash(relPath),
+					file: file,
+					size: stat.Size(),
+					mode: stat.Mode().Perm(),
+				})
+				continue
+			}
+			file.Close()
+		}
+
+		for _, f := range files {
+			f.file.Close()
+		}
+		return nil, fmt.Errorf("failed to open '%s' for backup: %v", path, err)
+	}
+
+	return files, nil
+}
+
+// schemaFiles lists every file of every schema in the main path, sorted, and
+// the locks of the tables they belong to. Hold the read locks to keep the
+// files from changing.
+func (db *HTDB) schemaFiles() ([]string, []*sync.RWMutex, error) {
+	store := db.storage()
+	schemas, err := store.ReadDir(db.mainPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read main path: %v", err)
+	}
+
+	// Collect the files and the locks of the tables they belong to
+	var paths []string
+	var locks []*sync.RWMutex
+	seenLocks := make(map[*sync.RWMutex]bool)
+	for _, schema := range schemas {
+		if !isSchemaDir(schema) {
+			continue
+		}
+		schemaPath := filepath.Join(db.mainPath, schema.Name())
+
+		entries, err := store.ReadDir(schemaPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read schema '%s': %v", schema.Name(), err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || isTransientFile(name) {
+				continue
+			}
+			paths = append(paths, filepath.Join(schemaPath, name))
+
+			if strings.HasSuffix(name, ".conf"+fileEnding) && name != "index.conf"+fileEnding {
+				tableName := strings.TrimSuffix(name, ".conf"+fileEnding)
+				lock := tableLock(tableFilePath(schemaPath, tableName))
+				if !seenLocks[lock] {
+					seenLocks[lock] = true
+					locks = append(locks, lock)
+				}
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, locks, nil
+}
+
+// isTransientFile reports whether a file only exists during a write,
+// compaction or transaction and doesn't belong in a backup
+func isTransientFile(name string) bool {
+	return strings.HasSuffix(name, ".temp") || strings.HasSuffix(name, ".journal") || strings.HasSuffix(name, stagingEnding)
+}
+
+// writeBackupFile copies the snapshotted bytes of a file into the archive
+func writeBackupFile(tarWriter *tar.Writer, f *backupFile, modTime time.Time) (BackupFileEntry, error) {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:    f.path,
+		Mode:    int64(f.mode),
+		Size:    f.size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return BackupFileEntry{}, fmt.Errorf("failed to write '%s' to backup: %v", f.path, err)
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tarWriter, hash), io.NewSectionReader(f.file, 0, f.size))
+	if err != nil {
+		return BackupFileEntry{}, fmt.Errorf("failed to write '%s' to backup: %v", f.path, err)
+	}
+
+	return BackupFileEntry{
+		Path:   f.path,
+		Size:   f.size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Restore unpacks a backup archive written by Backup (plain or gzipped) into
+// the database. The database must not have any schemas yet. Every file is
+// checked against the manifest, if anything doesn't match the restored files
+// are removed again and an error is returned. The ref side files of the
+// restored tables are then rebuilt like with Table.RewriteRefData, so they
+// only hold the values the records use.
+func (db *HTDB) Restore(r io.Reader) error {
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return err
+	}
+	for _, schema := range schemas {
+		if _, attached := db.attachedSchemas()[schema]; !attached {
+			return fmt.Errorf("can't restore into a database that already has schemas")
+		}
+	}
+
+	reader := bufio.NewReader(r)
+	magic, _ := reader.Peek(2)
+	var archive io.Reader = reader
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read backup archive: %v", err)
+		}
+		defer gzipReader.Close()
+		archive = gzipReader
+	}
+
+	restored := make(map[string]BackupFileEntry)
+	var createdFiles, createdDirs []string
+	undo := func() {
+		store := db.storage()
+		for _, path := range createdFiles {
+			store.Remove(path)
+		}
+		for _, path := range createdDirs {
+			store.Remove(path)
+		}
+	}
+
+	var manifest *BackupManifest
+	tarReader := tar.NewReader(archive)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			undo()
+			return fmt.Errorf("failed to read backup archive: %v", err)
+		}
+
+		if header.Name == backupManifestName {
+			manifest = &BackupManifest{}
+			err = json.NewDecoder(tarReader).Decode(manifest)
+			if err != nil {
+				undo()
+				return fmt.Errorf("failed to decode backup manifest: %v", err)
+			}
+			continue
+		}
+
+		entry, err := db.restoreBackupFile(tarReader, header, &createdFiles, &createdDirs)
+		if err != nil {
+			undo()
+			return err
+		}
+		restored[entry.Path] = entry
+	}
+
+	err = checkBackupManifest(manifest, restored)
+	if err != nil {
+		undo()
+		return err
+	}
+
+	if db.GetDurability() >= DurabilityFsync {
+		store := db.storage()
+		for _, dir := range append(createdDirs, db.mainPath) {
+			err = store.SyncDir(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The side files of a backup hold the values of versions cleaned up since
+	// as well, the restored tables get fresh ones with the values they use
+	var restoredSchemas []string
+	seen := make(map[string]bool)
+	for path := range restored {
+		schema, _, _ := strings.Cut(path, "/")
+		if !seen[schema] {
+			seen[schema] = true
+			restoredSchemas = append(restoredSchemas, schema)
+		}
+	}
+	sort.Strings(restoredSchemas)
+	for _, schema := range restoredSchemas {
+		tableNames, err := db.TableNames(schema)
+		if err != nil {
+			return fmt.Errorf("backup restored, but %w", err)
+		}
+		for _, tableName := range tableNames {
+			table, err := db.getTable(schema + ":" + tableName)
+			if err == nil {
+				err = table.rebuildRefFiles()
+			}
+			if err != nil {
+				return fmt.Errorf("backup restored, but failed to rebuild the ref files of '%s:%s': %w", schema, tableName, err)
+			}
+		}
+	}
+
+	db.log(slog.LevelInfo, "backup restored", "files", len(restored))
+	return nil
+}
+
+// restoreBackupFile writes a single archived file into its schema directory
+func (db *HTDB) restoreBackupFile(tarReader *tar.Reader, header *tar.Header, createdFiles, createdDirs *[]string) (BackupFileEntry, error) {
+	parts := strings.Split(header.Name, "/")
+	if header.Typeflag != tar.TypeReg || len(parts) != 2 || parts[0] == "" || parts[1] == "" ||
+		parts[0] == "." || parts[0] == ".." || parts[1] == "." || parts[1] == ".." {
+		return BackupFileEntry{}, fmt.Errorf("unexpected entry '%s' in backup archive", header.Name)
+	}
+
+	store := db.storage()
+	schemaPath := filepath.Join(db.mainPath, parts[0])
+	if _, err := store.Stat(schemaPath); os.IsNotExist(err) {
+		err = store.Mkdir(schemaPath, db.dirMode())
+		if err != nil {
+			return BackupFileEntry{}, fmt.Errorf("failed to create schema '%s': %v", parts[0], err)
+		}
+		*createdDirs = append(*createdDirs, schemaPath)
+	}
+
+	path := filepath.Join(schemaPath, parts[1])
+	file, err := store.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return BackupFileEntry{}, fmt.Errorf("failed to restore '%s': %v", header.Name, err)
+	}
+	*createdFiles = append(*createdFiles, path)
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), tarReader)
+	if err == nil && db.GetDurability() >= DurabilityFlush {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return BackupFileEntry{}, fmt.Errorf("failed to restore '%s': %v", header.Name, err)
+	}
+
+	return BackupFileEntry{
+		Path:   header.Name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// checkBackupManifest compares the restored files with the manifest of the archive
+func checkBackupManifest(manifest *BackupManifest, restored map[string]BackupFileEntry) error {
+	if manifest == nil {
+		return fmt.Errorf("backup archive has no manifest")
+	}
+	if manifest.FormatVersion != backupFormatVersion {
+		return fmt.Errorf("unsupported backup format version %d", manifest.FormatVersion)
+	}
+	if len(manifest.Files) != len(restored) {
+		return fmt.Errorf("backup archive holds %d files, its manifest lists %d", len(restored), len(manifest.Files))
+	}
+
+	for _, expected := range manifest.Files {
+		actual, exists := restored[expected.Path]
+		if !exists {
+			return fmt.Errorf("file '%s' of the manifest is missing from the backup archive", expected.Path)
+		}
+		if actual != expected {
+			return fmt.Errorf("file '%s' doesn't match its checksum in the backup manifest", expected.Path)
+		}
+	}
+	return nil
+}
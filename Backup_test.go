@@ -0,0 +1,250 @@
+// Backup_test.go
+// Description: Tests of backups and ref file rebuilds of the HTDB library
+// Restored and rebuilt tables must read the same ref values for every record,
+// backups taken during commits hold every transaction whole or not at all
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// insertNotes inserts records with notes of different lengths, updates and
+// deletes some of them and returns the notes the current records hold
+func insertNotes(t *testing.T, tm *TableManager, table *Table, count int64) map[int64]string {
+	t.Helper()
+	want := make(map[int64]string)
+	for key := int64(0); key < count; key++ {
+		note := strings.Repeat(fmt.Sprint(key), int(key%5)+1)
+		record := insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "note": note})
+		switch key % 3 {
+		case 0:
+			err := tm.DeleteRecord(table, record)
+			if err != nil {
+				t.Fatalf("failed to delete record: %v", err)
+			}
+			continue
+		case 1:
+			note = "updated " + note
+			_, err := tm.UpdateRecord(table, record, map[string]interface{}{"note": note})
+			if err != nil {
+				t.Fatalf("failed to update record: %v", err)
+			}
+		}
+		want[key] = note
+	}
+	return want
+}
+
+func TestRestoreKeepsRefContent(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, filepath.Join(dir, "source"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	want := insertNotes(t, tm, table, 30)
+	_, err := tm.Compact()
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+
+	var archive bytes.Buffer
+	err = db.Backup(&archive, BackupOptions{Gzip: true})
+	if err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+
+	restored := openTestDB(t, filepath.Join(dir, "restored"))
+	err = restored.Restore(&archive)
+	if err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	tm = restored.GetTableManager()
+	table, err = tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get restored table: %v", err)
+	}
+	got := currentValues(t, tm, table)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("restored records = %v, want %v", got, want)
+	}
+}
+
+// Records with stored offsets and records holding their value, as read from
+// an export, share the rebuilt side file
+func TestRewriteRefData(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	want := insertNotes(t, tm, table, 30)
+
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	nextID := int64(1000)
+	for key := int64(100); key < 105; key++ {
+		note := "exported " + fmt.Sprint(key)
+		records = append(records, NewRecord(nextID, map[string]interface{}{"key": key, "note": note}))
+		nextID++
+		want[key] = note
+	}
+
+	err = table.RewriteRefData(records, "note")
+	if err != nil {
+		t.Fatalf("failed to rewrite ref data: %v", err)
+	}
+
+	// The table file was rewritten with the records in the same step
+	got := currentValues(t, tm, table)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records after the rewrite = %v, want %v", got, want)
+	}
+	all, err := tm.GetAllRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if len(all) != len(records) {
+		t.Errorf("table holds %d records after the rewrite, want %d", len(all), len(records))
+	}
+	var size int64
+	for _, note := range want {
+		size += int64(len(note))
+	}
+	info, err := db.storage().Stat(table.RefFilePath("note"))
+	if err != nil {
+		t.Fatalf("failed to stat ref file: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("rebuilt ref file holds %d bytes, the current values %d", info.Size(), size)
+	}
+}
+
+// failingRenameStorage fails renames onto the file with the given name
+type failingRenameStorage struct {
+	Storage
+	name string
+}
+
+func (s failingRenameStorage) Rename(oldPath, newPath string) error {
+	if filepath.Base(newPath) == s.name {
+		return errors.New("disk full")
+	}
+	return s.Storage.Rename(oldPath, newPath)
+}
+
+// A rewrite that stops after the side file was swapped is finished by
+// recovery, the table file never points into the wrong side file
+func TestRewriteRefDataInterrupted(t *testing.T) {
+	memory := NewMemoryStorage()
+	db, err := Open("db", OpenOptions{Create: true, Storage: memory})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	want := insertNotes(t, tm, table, 30)
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	db.Close()
+
+	db, err = Open("db", OpenOptions{Storage: failingRenameStorage{Storage: memory, name: "t" + fileEnding}})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	table, err = db.GetTableManager().GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	err = table.RewriteRefData(records, "note")
+	if err == nil {
+		t.Fatalf("rewrite succeeded without replacing the table file")
+	}
+	db.Close()
+
+	db, err = Open("db", OpenOptions{Storage: memory})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	tm = db.GetTableManager()
+	table, err = tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	got := currentValues(t, tm, table)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records after recovery = %v, want %v", got, want)
+	}
+}
+
+// Every transaction inserts into both tables, a backup holds as many records
+// in one as in the other
+func TestBackupDuringTransactions(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	tables := []*Table{
+		createTestTable(t, db, "s", "a", noteFields),
+		createTestTable(t, db, "s", "b", noteFields),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := 0; key < 200; key++ {
+			tx := tm.BeginTransaction()
+			for _, table := range tables {
+				_, err := tx.StageInsert(table, map[string]interface{}{"key": key, "note": "note"})
+				if err != nil {
+					t.Errorf("failed to stage insert: %v", err)
+					return
+				}
+			}
+			err := tm.CommitTransaction(tx)
+			if err != nil {
+				t.Errorf("failed to commit: %v", err)
+				return
+			}
+		}
+	}()
+
+	for backingUp := true; backingUp; {
+		select {
+		case <-done:
+			backingUp = false
+		default:
+		}
+		var archive bytes.Buffer
+		err := db.Backup(&archive, BackupOptions{})
+		if err != nil {
+			t.Fatalf("failed to back up: %v", err)
+		}
+
+		restored := openTestDB(t, MemoryPath)
+		err = restored.Restore(&archive)
+		if err != nil {
+			t.Fatalf("failed to restore: %v", err)
+		}
+		var counts []int
+		for _, name := range []string{"a", "b"} {
+			table, err := restored.GetTableManager().GetTable("s", name)
+			if err != nil {
+				t.Fatalf("failed to get restored table: %v", err)
+			}
+			counts = append(counts, len(currentValues(t, restored.GetTableManager(), table)))
+		}
+		restored.Close()
+		if counts[0] != counts[1] {
+			t.Errorf("backup holds %d records in a and %d in b", counts[0], counts[1])
+			break
+		}
+	}
+	<-done
+}
@@ -0,0 +1,583 @@
+// BlockCompression.go
+// Description: Block compressed table files of the HTDB library
+// Stores the records of cold tables in compressed blocks that scans decompress one at a time
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"sync"
+)
+
+// BlockCompressor compresses the record blocks of tables with block
+// compression. Implementations must be safe for concurrent use.
+type BlockCompressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte, size int) ([]byte, error) // size is the length of the uncompressed block
+}
+
+// BlockCompressorFlate is the name of the built-in compressor, DEFLATE of the
+// standard library. Others such as zstd or snappy can be added with
+// RegisterBlockCompressor without the library depending on them.
+const BlockCompressorFlate = "flate"
+
+// DefaultBlockRecords is the number of records per block if none is given
+const DefaultBlockRecords = 1024
+
+// BlockCompression is the block compression setting of a table, see SetBlockCompression
+type BlockCompression struct {
+	Compressor   string `json:"compressor"`   // Name of a registered BlockCompressor
+	BlockRecords int    `json:"blockRecords"` // Records per block
+}
+
+// blockCompressors are the registered compressors by name
+var blockCompressors = struct {
+	byName map[string]BlockCompressor
+	mu     sync.RWMutex
+}{byName: map[string]BlockCompressor{BlockCompressorFlate: flateCompressor{}}}
+
+// RegisterBlockCompressor makes a compressor available to SetBlockCompression
+// under name. Tables compressed with it can only be read once it is
+// registered, it has to be registered before the database is opened.
+func RegisterBlockCompressor(name string, compressor BlockCompressor) {
+	blockCompressors.mu.Lock()
+	defer blockCompressors.mu.Unlock()
+
+	blockCompressors.byName[name] = compressor
+}
+
+// blockCompressor returns the registered compressor with the given name
+func blockCompressor(name string) (BlockCompressor, error) {
+	blockCompressors.mu.RLock()
+	defer blockCompressors.mu.RUnlock()
+
+	compressor, exists := blockCompressors.byName[name]
+	if !exists {
+		return nil, fmt.Errorf("block compressor '%s' is not registered", name)
+	}
+	return compressor, nil
+}
+
+// flateCompressor is the built-in BlockCompressorFlate
+type flateCompressor struct{}
+
+func (flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(data []byte, size int) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	block := make([]byte, size)
+	_, err := io.ReadFull(reader, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// A block compressed table file starts with blockMagic, the format version,
+// the record size, the records per block and the compressor name. The blocks
+// follow, then the block index with an entry per block and a footer pointing
+// at the index. Full blocks are compressed, the last one is stored as is
+// until it fills up.
+const (
+	blockMagic          = "HTBLOCK\xff" // Negative as a record id, so no plain table file starts with it
+	blockFormatVersion  = 1
+	blockHeaderSize     = len(blockMagic) + 1 + 4 + 4 + 1 // Without the compressor name
+	blockIndexEntrySize = 8 + 4 + 4 + 1                   // Offset, stored length, records, compressed flag
+	blockFooterSize     = 8 + 4 + len(blockMagic)         // Index offset, blocks, magic
+
+	maxBlockRecords = 1 << 20
+	maxBlockSize    = 1 << 30
+)
+
+// blockEntry is a block of a block compressed table file
+type blockEntry struct {
+	offset     int64 // Offset of the stored block in the file
+	length     int64 // Stored length
+	records    int64
+	compressed bool
+	start      int64 // Offset of the block's first record in the record stream
+}
+
+// SetBlockCompression rewrites the table file in blocks of blockRecords
+// records, each compressed with the named compressor, zero blockRecords uses
+// DefaultBlockRecords. An empty compressor rewrites the file uncompressed.
+// Meant for cold tables: reads decompress a block at a time, scans read far
+// less from disk, but every commit rewrites and recompresses the whole file.
+// Record positions of the primary key index stay the same, position p is
+// record p % blockRecords of block p / blockRecords.
+func (tm *TableManager) SetBlockCompression(table *Table, compressor string, blockRecords int) error {
+	if err := tm.db.checkOpen(); err != nil {
+		return err
+	}
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+
+	var settings *BlockCompression
+	if compressor != "" {
+		if blockRecords == 0 {
+			blockRecords = DefaultBlockRecords
+		}
+		settings = &BlockCompression{Compressor: compressor, BlockRecords: blockRecords}
+		err := settings.validate(table.RecordSize())
+		if err != nil {
+			return newTableError(table, err)
+		}
+	}
+
+	// Commits on the table finish first, the records are rewritten
+	unlock, err := tm.db.lockTableDDL(tableCacheKey(table))
+	if err != nil {
+		return newTableError(table, err)
+	}
+	defer unlock()
+
+	store := table.storage()
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	records, err := table.allRecords()
+	if err != nil {
+		return fmt.Errorf("failed to read records of table '%s': %v", table.TableName, err)
+	}
+
+	updated := *table
+	updated.BlockCompression = settings
+	confJSON, err := json.MarshalIndent(&updated, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize table to JSON: %v", err)
+	}
+	confPath := table.confPath()
+	err = writeFile(store, confPath+".temp", confJSON, tm.db.fileMode())
+	if err != nil {
+		return fmt.Errorf("failed to write table configuration: %v", err)
+	}
+
+	// Readers tell the formats apart by the file, so the order doesn't matter to them
+	err = updated.writeRecords(records)
+	if err != nil {
+		store.Remove(confPath + ".temp")
+		return fmt.Errorf("failed to rewrite table '%s': %v", table.TableName, err)
+	}
+	err = store.Rename(confPath+".temp", confPath)
+	if err != nil {
+		return fmt.Errorf("failed to replace table configuration: %v", err)
+	}
+
+	unlock()
+	table.BlockCompression = settings
+	table.generation = tm.db.ddl.generation(tableCacheKey(table))
+
+	tm.db.log(slog.LevelInfo, "block compression changed",
+		"schema", table.schemaName(), "table", table.TableName, "compressor", compressor, "records", len(records))
+	return nil
+}
+
+// validate checks the settings for records of the given size
+func (c *BlockCompression) validate(recordSize int) error {
+	if _, err := blockCompressor(c.Compressor); err != nil {
+		return err
+	}
+	if len(c.Compressor) > 255 {
+		return fmt.Errorf("block compressor name '%s' is too long", c.Compressor)
+	}
+	if c.BlockRecords < 1 || c.BlockRecords > maxBlockRecords || c.BlockRecords*recordSize > maxBlockSize {
+		return fmt.Errorf("a block must hold 1 to %d records of at most %d bytes together", maxBlockRecords, maxBlockSize)
+	}
+	return nil
+}
+
+// encodeRecords writes the serialized records to w, in blocks if the table
+// has block compression
+func (t *Table) encodeRecords(w io.Writer, records []*Record) error {
+	encoder, err := t.newRecordEncoder(w)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		_, err = encoder.write(record)
+		if err != nil {
+			return err
+		}
+	}
+	return encoder.finish()
+}
+
+// recordEncoder writes the records of a table file one at a time, so
+// compaction can stream them
+type recordEncoder struct {
+	w          io.Writer
+	layout     *RecordLayout
+	settings   *BlockCompression // Nil for a plain table file
+	compressor BlockCompressor
+	block      []byte // Records of the block being filled
+	records    int    // Records in block
+	offset     int64  // Offset of the next block in the file
+	index      []byte
+}
+
+// newRecordEncoder starts a table file on w, writing the block header if the
+// table has block compression
+func (t *Table) newRecordEncoder(w io.Writer) (*recordEncoder, error) {
+	encoder := &recordEncoder{w: w, layout: t.Layout(), settings: t.BlockCompression}
+	if encoder.settings == nil {
+		return encoder, nil
+	}
+
+	err := encoder.settings.validate(encoder.layout.Size)
+	if err != nil {
+		return nil, err
+	}
+	encoder.compressor, _ = blockCompressor(encoder.settings.Compressor)
+	encoder.block = make([]byte, 0, encoder.settings.BlockRecords*encoder.layout.Size)
+
+	header := []byte(blockMagic)
+	header = append(header, blockFormatVersion)
+	header = binary.LittleEndian.AppendUint32(header, uint32(encoder.layout.Size))
+	header = binary.LittleEndian.AppendUint32(header, uint32(encoder.settings.BlockRecords))
+	header = append(header, byte(len(encoder.settings.Compressor)))
+	header = append(header, encoder.settings.Compressor...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write block header: %w", err)
+	}
+	encoder.offset = int64(len(header))
+	return encoder, nil
+}
+
+// write serializes a record and returns its size in the record stream
+func (e *recordEncoder) write(record *Record) (int, error) {
+	data, err := record.serializeLayout(e.layout)
+	if err != nil {
+		return 0, fmt.Errorf("failed to serialize record: %w", err)
+	}
+	if e.settings == nil {
+		_, err = e.w.Write(data)
+		if err != nil {
+			return 0, fmt.Errorf("failed to write record: %w", err)
+		}
+		return len(data), nil
+	}
+
+	e.block = append(e.block, data...)
+	e.records++
+	if e.records == e.settings.BlockRecords {
+		err = e.writeBlock(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// writeBlock writes the filled block and its index entry. Only full blocks
+// are compressed, the last one is stored as is until a rewrite fills it.
+func (e *recordEncoder) writeBlock(compress bool) error {
+	stored := e.block
+	if compress {
+		var err error
+		stored, err = e.compressor.Compress(e.block)
+		if err != nil {
+			return fmt.Errorf("failed to compress block: %v", err)
+		}
+	}
+	_, err := e.w.Write(stored)
+	if err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+
+	e.index = binary.LittleEndian.AppendUint64(e.index, uint64(e.offset))
+	e.index = binary.LittleEndian.AppendUint32(e.index, uint32(len(stored)))
+	e.index = binary.LittleEndian.AppendUint32(e.index, uint32(e.records))
+	if compress {
+		e.index = append(e.index, 1)
+	} else {
+		e.index = append(e.index, 0)
+	}
+	e.offset += int64(len(stored))
+	e.block, e.records = e.block[:0], 0
+	return nil
+}
+
+// finish writes the last partial block and the block index
+func (e *recordEncoder) finish() error {
+	if e.settings == nil {
+		return nil
+	}
+	if e.records > 0 {
+		err := e.writeBlock(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	footer := binary.LittleEndian.AppendUint64(e.index, uint64(e.offset))
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(e.index)/blockIndexEntrySize))
+	footer = append(footer, blockMagic...)
+	_, err := e.w.Write(footer)
+	if err != nil {
+		return fmt.Errorf("failed to write block index: %w", err)
+	}
+	return nil
+}
+
+// isBlockFile reports whether a table file is block compressed
+func isBlockFile(file io.ReaderAt) bool {
+	magic := make([]byte, len(blockMagic))
+	_, err := file.ReadAt(magic, 0)
+	return err == nil && string(magic) == blockMagic
+}
+
+// openTableFile opens the record stream of a table file: the file itself, or
+// a read-only view decompressing it if it is block compressed
+func openTableFile(store Storage, path string) (StorageFile, error) {
+	file, err := openFile(store, path)
+	if err != nil || !isBlockFile(file) {
+		return file, err
+	}
+	blocks, err := readBlockIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("table file '%s': %w", path, err)
+	}
+	return blocks, nil
+}
+
+// blockFile is the record stream of a block compressed table file. It keeps
+// the last decompressed block, scans read it in small pieces.
+type blockFile struct {
+	file       StorageFile
+	compressor BlockCompressor
+	recordSize int64
+	blockSize  int64 // Size of a full block
+	blocks     []blockEntry
+	size       int64 // Size of the record stream
+
+	mu       sync.Mutex
+	position int64 // Offset for Read and Seek
+	cached   int   // Block in data, -1 for none
+	data     []byte
+}
+
+// errBlockFileReadOnly is returned by the write methods of a blockFile
+var errBlockFileReadOnly = errors.New("block compressed table files can't be written in place")
+
+// readBlockIndex reads the header and block index of a block compressed table file
+func readBlockIndex(file StorageFile) (*blockFile, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file stats: %w", err)
+	}
+	size := stat.Size()
+
+	header := make([]byte, blockHeaderSize)
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block header can't be read: %v", ErrCorrupt, err)
+	}
+	offset := len(blockMagic)
+	if header[offset] != blockFormatVersion {
+		return nil, fmt.Errorf("%w: unknown block format version %d", ErrUnsupportedVersion, header[offset])
+	}
+	recordSize := int64(binary.LittleEndian.Uint32(header[offset+1:]))
+	blockRecords := int64(binary.LittleEndian.Uint32(header[offset+5:]))
+	name := make([]byte, header[offset+9])
+	_, err = file.ReadAt(name, int64(blockHeaderSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: block header can't be read: %v", ErrCorrupt, err)
+	}
+	if recordSize == 0 || blockRecords == 0 {
+		return nil, fmt.Errorf("%w: block header describes empty blocks", ErrCorrupt)
+	}
+	compressor, err := blockCompressor(string(name))
+	if err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, blockFooterSize)
+	if size < int64(blockHeaderSize+len(name)+blockFooterSize) {
+		return nil, fmt.Errorf("%w: block compressed table file is truncated", ErrCorrupt)
+	}
+	_, err = file.ReadAt(footer, size-int64(blockFooterSize))
+	if err != nil || string(footer[12:]) != blockMagic {
+		return nil, fmt.Errorf("%w: block compressed table file is truncated", ErrCorrupt)
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	count := int64(binary.LittleEndian.Uint32(footer[8:]))
+	if indexOffset+count*blockIndexEntrySize != size-int64(blockFooterSize) {
+		return nil, fmt.Errorf("%w: block index doesn't match the file size", ErrCorrupt)
+	}
+
+	index := make([]byte, count*blockIndexEntrySize)
+	_, err = file.ReadAt(index, indexOffset)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block index can't be read: %v", ErrCorrupt, err)
+	}
+
+	blocks := &blockFile{file: file, compressor: compressor, recordSize: recordSize, blockSize: blockRecords * recordSize, cached: -1}
+	for i := int64(0); i < count; i++ {
+		entry := index[i*blockIndexEntrySize:]
+		block := blockEntry{
+			offset:     int64(binary.LittleEndian.Uint64(entry)),
+			length:     int64(binary.LittleEndian.Uint32(entry[8:])),
+			records:    int64(binary.LittleEndian.Uint32(entry[12:])),
+			compressed: entry[16] == 1,
+			start:      blocks.size,
+		}
+		if block.offset+block.length > indexOffset {
+			return nil, fmt.Errorf("%w: block %d lies outside of the file", ErrCorrupt, i)
+		}
+		if block.records > blockRecords || block.records < blockRecords && i < count-1 {
+			return nil, fmt.Errorf("%w: block %d holds %d records, blocks hold %d", ErrCorrupt, i, block.records, blockRecords)
+		}
+		blocks.blocks = append(blocks.blocks, block)
+		blocks.size += block.records * recordSize
+	}
+	return blocks, nil
+}
+
+// ReadAt reads the record stream at off, decompressing the blocks it covers
+func (f *blockFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	read := 0
+	for read < len(p) {
+		position := off + int64(read)
+		if position >= f.size {
+			return read, io.EOF
+		}
+		index := int(position / f.blockSize) // Every block but the last is full
+		data, err := f.blockLocked(index)
+		if err != nil {
+			return read, err
+		}
+		read += copy(p[read:], data[position-f.blocks[index].start:])
+	}
+	return read, nil
+}
+
+// blockLocked returns the uncompressed records of a block. The caller must hold mu.
+func (f *blockFile) blockLocked(index int) ([]byte, error) {
+	if f.cached == index {
+		return f.data, nil
+	}
+
+	block := f.blocks[index]
+	stored := make([]byte, block.length)
+	_, err := f.file.ReadAt(stored, block.offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %d: %w", index, err)
+	}
+
+	size := block.records * f.recordSize
+	data := stored
+	if block.compressed {
+		data, err = f.compressor.Decompress(stored, int(size))
+		if err != nil {
+			return nil, fmt.Errorf("%w: block %d can't be decompressed: %v", ErrCorrupt, index, err)
+		}
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("%w: block %d holds %d bytes, expected %d", ErrCorrupt, index, len(data), size)
+	}
+
+	f.cached, f.data = index, data
+	return data, nil
+}
+
+func (f *blockFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	position := f.position
+	f.mu.Unlock()
+
+	n, err := f.ReadAt(p, position)
+	f.mu.Lock()
+	f.position += int64(n)
+	f.mu.Unlock()
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *blockFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.position
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek before the start of the table file")
+	}
+	f.position = offset
+	return offset, nil
+}
+
+// Stat returns the info of the table file with the size of its record stream
+func (f *blockFile) Stat() (fs.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return blockFileInfo{FileInfo: info, size: f.size}, nil
+}
+
+func (f *blockFile) Write(p []byte) (int, error) { return 0, errBlockFileReadOnly }
+func (f *blockFile) Truncate(int64) error        { return errBlockFileReadOnly }
+func (f *blockFile) Sync() error                 { return nil }
+func (f *blockFile) Close() error                { return f.file.Close() }
+
+// blockFileInfo is the info of a block compressed table file, sized as its record stream
+type blockFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i blockFileInfo) Size() int64 { return i.size }
+
+// dataSize returns the size of the table's record stream, that of the file
+// unless it is block compressed
+func (t *Table) dataSize() (int64, error) {
+	file, release, err := t.openFile()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
@@ -0,0 +1,443 @@
+// CSV.go
+// Description: CSV export and import for the HTDB library
+// Streams the current records of a table as CSV and loads CSV files into tables
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVExportOptions configures ExportCSV
+type CSVExportOptions struct {
+	Query      *Query // Only export the records matching this query, nil exports every current record
+	TimeFormat string // Layout for timeID fields, defaults to time.RFC3339Nano
+	NullToken  string // Written for null fields, defaults to an empty cell
+}
+
+const defaultImportBatchSize = 500 // Records inserted per transaction during an import
+
+// CSVImportOptions configures ImportCSV
+type CSVImportOptions struct {
+	BatchSize       int    // Records inserted per transaction, defaults to 500
+	TimeFormat      string // Layout for timeID fields, defaults to time.RFC3339Nano. Integers are read as nanoseconds.
+	NullToken       string // Cells holding this token are null
+	EmptyAsDefault  bool   // Empty cells get the zero value of their field instead of null
+	ContinueOnError bool   // Skip rows that fail and keep importing instead of stopping at the first one
+}
+
+// ImportRowError is the failure of a single imported row
+type ImportRowError struct {
+	Line int // Line of the row in the input
+	Err  error
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ImportRowError) Unwrap() error {
+	return e.Err
+}
+
+// ImportErrors collects the rows that failed an import that continued on errors
+type ImportErrors []*ImportRowError
+
+func (e ImportErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, rowErr := range e {
+		messages[i] = rowErr.Error()
+	}
+	return fmt.Sprintf("%d rows failed to import: %s", len(e), strings.Join(messages, "; "))
+}
+
+// ExportCSV writes the current records of a table to w as CSV, starting with a
+// header row of field names. Records are streamed, so memory use doesn't grow
+// with the table unless the query sorts. Ref fields are resolved to their content.
+func (tm *TableManager) ExportCSV(table *Table, w io.Writer, options CSVExportOptions) error {
+	timeFormat := options.TimeFormat
+	if timeFormat == "" {
+		timeFormat = time.RFC3339Nano
+	}
+
+	if options.Query != nil && tableCacheKey(options.Query.table) != tableCacheKey(table) {
+		return fmt.Errorf("query doesn't select from table '%s'", table.TableName)
+	}
+	fields := exportFields(table, options.Query)
+
+	refs := newRefReader(table)
+	defer refs.close()
+
+	writer := csv.NewWriter(w)
+
+	// Header row
+	header := make([]string, len(fields))
+	for i, field := range fields {
+		header[i] = field.Name
+	}
+	err := writer.Write(header)
+	if err != nil {
+		return fmt.Errorf("failed to write CSV header: %v", err)
+	}
+
+	row := make([]string, len(fields))
+	writeRecord := func(record *Record) error {
+		for i, field := range fields {
+			value, present, err := exportValue(record, field, refs)
+			if err != nil {
+				return fmt.Errorf("failed to export record %d: %v", record.ID, err)
+			}
+			if !present {
+				row[i] = options.NullToken
+				continue
+			}
+			row[i] = formatCSVValue(value, field, timeFormat)
+		}
+		return writer.Write(row)
+	}
+
+	if options.Query != nil {
+		err = options.Query.Stream(writeRecord)
+	} else {
+		err = table.StreamRecordsWith(ScanOptions{}, writeRecord)
+	}
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	err = writer.Error()
+	if err != nil {
+		return fmt.Errorf("failed to write CSV: %v", err)
+	}
+	return nil
+}
+
+// exportFields returns the fields an export writes, the projection of the query if it has one
+func exportFields(table *Table, query *Query) []Field {
+	if query == nil || len(query.fields) == 0 {
+		return table.Fields
+	}
+
+	var fields []Field
+	for _, field := range table.Fields {
+		for _, name := range query.fields {
+			if field.Name == name {
+				fields = append(fields, field)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// exportValue returns the value of a field for exporting: string padding is
+// trimmed and ref fields are resolved. It reports false for null fields.
+func exportValue(record *Record, field Field, refs *refReader) (interface{}, bool, error) {
+	if record.FieldsMeta[field.Name].IsNull {
+		return nil, false, nil
+	}
+
+	if field.Type == "ref" {
+		if _, exists := record.RefOffsets[field.Name]; !exists {
+			return nil, false, nil
+		}
+		value, err := refs.read(record, field)
+		if err != nil {
+			return nil, false, err
+		}
+		return value, true, nil
+	}
+
+	value, exists := record.FieldsData[field.Name]
+	if !exists || value == nil {
+		return nil, false, nil
+	}
+	if str, ok := value.(string); ok {
+		return strings.TrimRight(str, "\x00"), true, nil
+	}
+	return value, true, nil
+}
+
+// formatCSVValue formats an exported value as a CSV cell
+func formatCSVValue(value interface{}, field Field, timeFormat string) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int64:
+		if field.Type == TimeID {
+			return time.Unix(0, v).UTC().Format(timeFormat)
+		}
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// ImportCSV inserts the rows of a CSV file into a table and returns how many
+// were inserted. The header row maps columns to fields, an id column is ignored
+// as records get new ids. Rows are inserted in batched transactions. By default
+// the first failing row stops the import and its batch is rolled back, batches
+// committed before stay. With ContinueOnError failing rows are skipped and
+// returned together as ImportErrors.
+func (tm *TableManager) ImportCSV(table *Table, r io.Reader, options CSVImportOptions) (int, error) {
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+	timeFormat := options.TimeFormat
+	if timeFormat == "" {
+		timeFormat = time.RFC3339Nano
+	}
+
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+
+	// Map the columns to fields
+	columns := make([]*Field, len(header))
+	for i, name := range header {
+		if name == "id" {
+			continue
+		}
+		found := false
+		for j := range table.Fields {
+			if table.Fields[j].Name == name {
+				columns[i] = &table.Fields[j]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("column '%s' is not a field of table '%s'", name, table.TableName)
+		}
+	}
+
+	batch := newImportBatch(tm, table, batchSize)
+	var rowErrors ImportErrors
+
+	// fail handles a failed row according to the error mode
+	fail := func(rowErr *ImportRowError) error {
+		if options.ContinueOnError {
+			rowErrors = append(rowErrors, rowErr)
+			return nil
+		}
+		batch.rollback()
+		return rowErr
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				batch.rollback()
+				return batch.inserted, fmt.Errorf("failed to read CSV: %v", err)
+			}
+			err = fail(&ImportRowError{Line: parseErr.Line, Err: parseErr.Err})
+			if err != nil {
+				return batch.inserted, err
+			}
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		data, err := parseCSVRow(row, columns, options, timeFormat)
+		if err == nil {
+			err = batch.add(data)
+		}
+		if err != nil {
+			err = fail(&ImportRowError{Line: line, Err: err})
+			if err != nil {
+				return batch.inserted, err
+			}
+			continue
+		}
+
+		if batch.full() {
+			err = batch.commit()
+			if err != nil {
+				return batch.inserted, err
+			}
+		}
+	}
+
+	err = batch.commit()
+	if err != nil {
+		return batch.inserted, err
+	}
+
+	if len(rowErrors) > 0 {
+		return batch.inserted, rowErrors
+	}
+	return batch.inserted, nil
+}
+
+// parseCSVRow converts the cells of a row to the types of their fields
+func parseCSVRow(row []string, columns []*Field, options CSVImportOptions, timeFormat string) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(row))
+	for i, cell := range row {
+		field := columns[i]
+		if field == nil {
+			continue
+		}
+
+		if options.NullToken != "" && cell == options.NullToken {
+			data[field.Name] = nil
+			continue
+		}
+		if cell == "" {
+			if options.EmptyAsDefault {
+				data[field.Name] = zeroValue(*field)
+			} else {
+				data[field.Name] = nil
+			}
+			continue
+		}
+
+		value, err := parseCSVValue(cell, *field, timeFormat)
+		if err != nil {
+			return nil, err
+		}
+		data[field.Name] = value
+	}
+	return data, nil
+}
+
+// parseCSVValue converts a CSV cell to the type of its field
+func parseCSVValue(cell string, field Field, timeFormat string) (interface{}, error) {
+	switch field.Type {
+	case String:
+		if uint(len(cell)) > field.capacity() {
+			return nil, fmt.Errorf("value of field '%s' is longer than %d bytes", field.Name, field.capacity())
+		}
+		return cell, nil
+	case "ref":
+		return cell, nil
+	case Int:
+		value, err := strconv.ParseInt(cell, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires an int value: %v", field.Name, err)
+		}
+		return value, nil
+	case Float:
+		value, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires a float value: %v", field.Name, err)
+		}
+		return value, nil
+	case Bool:
+		value, err := strconv.ParseBool(cell)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires a bool value: %v", field.Name, err)
+		}
+		return value, nil
+	case TimeID:
+		if nanos, err := strconv.ParseInt(cell, 10, 64); err == nil {
+			return nanos, nil
+		}
+		value, err := time.Parse(timeFormat, cell)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires a time value: %v", field.Name, err)
+		}
+		return value.UnixNano(), nil
+	}
+	return nil, fmt.Errorf("unsupported field type '%s'", field.Type)
+}
+
+// zeroValue returns the default value of a field's type
+func zeroValue(field Field) interface{} {
+	switch field.Type {
+	case Int, TimeID:
+		return int64(0)
+	case Float:
+		return float64(0)
+	case Bool:
+		return false
+	}
+	return ""
+}
+
+// importBatch inserts imported records in transactions of a fixed size
+type importBatch struct {
+	tm       *TableManager
+	table    *Table
+	size     int
+	tx       *Transaction
+	staged   int
+	inserted int // Records in committed batches
+}
+
+// newImportBatch creates the batch writer of an import
+func newImportBatch(tm *TableManager, table *Table, size int) *importBatch {
+	return &importBatch{tm: tm, table: table, size: size}
+}
+
+// add stages a record in the current batch
+func (b *importBatch) add(data map[string]interface{}) error {
+	if b.tx == nil {
+		b.tx = b.tm.BeginTransaction()
+		b.tx.skipTriggers = true // Imported records already went through their triggers
+	}
+
+	_, err := b.tx.StageInsert(b.table, data)
+	if err != nil {
+		return err
+	}
+	b.staged++
+	return nil
+}
+
+// full reports whether the current batch should be committed
+func (b *importBatch) full() bool {
+	return b.staged >= b.size
+}
+
+// commit commits the records staged so far
+func (b *importBatch) commit() error {
+	if b.tx == nil {
+		return nil
+	}
+
+	tx := b.tx
+	b.tx = nil
+	if b.staged == 0 {
+		b.tm.RollbackTransaction(tx)
+		return nil
+	}
+
+	err := b.tm.CommitTransaction(tx)
+	if err != nil {
+		b.staged = 0
+		return fmt.Errorf("failed to commit import batch: %v", err)
+	}
+	b.inserted += b.staged
+	b.staged = 0
+	return nil
+}
+
+// rollback drops the records staged so far
+func (b *importBatch) rollback() {
+	if b.tx != nil {
+		b.tm.RollbackTransaction(b.tx)
+		b.tx = nil
+		b.staged = 0
+	}
+}
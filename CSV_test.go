@@ -0,0 +1,119 @@
+// CSV_test.go
+// Description: Tests of the CSV export and import of the HTDB library
+// Every field type must survive a round trip through CSV
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCSVRoundTrip(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	source := createTestTable(t, db, "s", "source", typedFields)
+	target := createTestTable(t, db, "s", "target", typedFields)
+	for _, data := range typedRecords {
+		insertTestRecord(t, tm, source, data)
+	}
+
+	var out bytes.Buffer
+	err := tm.ExportCSV(source, &out, CSVExportOptions{NullToken: "NULL"})
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	imported, err := tm.ImportCSV(target, &out, CSVImportOptions{NullToken: "NULL", EmptyAsDefault: true})
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if imported != len(typedRecords) {
+		t.Errorf("imported %d records, want %d", imported, len(typedRecords))
+	}
+
+	want, got := fieldValues(t, tm, source), fieldValues(t, tm, target)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("imported records = %v, want %v", got, want)
+	}
+}
+
+func TestImportCSVRowErrors(t *testing.T) {
+	input := "key,flag\n1,true\n2,maybe\n3,false\nx,true\n5,true\n"
+
+	t.Run("fail fast", func(t *testing.T) {
+		db := openTestDB(t, MemoryPath)
+		tm := db.GetTableManager()
+		table := createTestTable(t, db, "s", "t", typedFields)
+
+		imported, err := tm.ImportCSV(table, strings.NewReader(input), CSVImportOptions{BatchSize: 2})
+		var rowErr *ImportRowError
+		if !errors.As(err, &rowErr) || rowErr.Line != 3 {
+			t.Fatalf("expected an error on line 3, got %v", err)
+		}
+		// The batch of the failing row is rolled back
+		if imported != 0 || len(fieldValues(t, tm, table)) != 0 {
+			t.Errorf("imported %d records, want none", imported)
+		}
+	})
+
+	t.Run("continue on error", func(t *testing.T) {
+		db := openTestDB(t, MemoryPath)
+		tm := db.GetTableManager()
+		table := createTestTable(t, db, "s", "t", typedFields)
+
+		imported, err := tm.ImportCSV(table, strings.NewReader(input), CSVImportOptions{BatchSize: 2, ContinueOnError: true})
+		var rowErrs ImportErrors
+		if !errors.As(err, &rowErrs) {
+			t.Fatalf("expected ImportErrors, got %v", err)
+		}
+		var lines []int
+		for _, rowErr := range rowErrs {
+			lines = append(lines, rowErr.Line)
+		}
+		if fmt.Sprint(lines) != "[3 5]" {
+			t.Errorf("rows failed on lines %v, want [3 5]", lines)
+		}
+
+		got := fieldValues(t, tm, table)
+		if imported != 3 || len(got) != 3 {
+			t.Fatalf("imported %d records, the table holds %d, want 3", imported, len(got))
+		}
+		if got[3]["flag"] != false || got[5]["flag"] != true {
+			t.Errorf("imported records = %v", got)
+		}
+	})
+}
+
+func TestCSVExportRepeatable(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", typedFields)
+	for _, data := range typedRecords {
+		insertTestRecord(t, tm, table, data)
+	}
+
+	var first []byte
+	for run := 0; run < 20; run++ {
+		var out bytes.Buffer
+		err := tm.ExportCSV(table, &out, CSVExportOptions{})
+		if err != nil {
+			t.Fatalf("failed to export: %v", err)
+		}
+		if run == 0 {
+			first = out.Bytes()
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), first) {
+			t.Fatalf("export %d differs:\n%s\nfirst export:\n%s", run, out.Bytes(), first)
+		}
+	}
+
+	header, _, _ := bytes.Cut(first, []byte("\n"))
+	if want := "id,key,flag,ratio,name,note"; string(header) != want {
+		t.Errorf("export starts with header %q, want %q", header, want)
+	}
+}
@@ -0,0 +1,407 @@
+// ChangeLog.go
+// Description: Change data capture log for the HTDB library
+// Persists every committed insert, update and delete so external consumers can tail them
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	changeLogPrefix            = "changes."       // Segment files are changes.<first position>.htdb in the main path
+	defaultChangeLogSegmentMax = 64 * 1024 * 1024 // Segment size after which a new segment is started
+)
+
+// ChangeOp is the kind of a logged change
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "insert"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Change is a single committed change of a record
+type Change struct {
+	Position      uint64                 `json:"position"` // Increases by one per change, never reused
+	TransactionID uint64                 `json:"transaction_id"`
+	Actor         string                 `json:"actor,omitempty"` // See Transaction.SetActor
+	Tags          map[string]string      `json:"tags,omitempty"`  // See Transaction.SetTag
+	Op            ChangeOp               `json:"op"`
+	Schema        string                 `json:"schema"`
+	Table         string                 `json:"table"`
+	RecordID      int64                  `json:"record_id"`             // Id of the written version
+	PreviousID    int64                  `json:"previous_id,omitempty"` // Id of the version it replaces, for updates and deletes
+	Values        map[string]interface{} `json:"values,omitempty"`      // New field values, null fields as nil
+	Time          time.Time              `json:"time"`                  // Commit time, see Record.CommittedAt
+}
+
+// ChangeLogOptions configures EnableChangeLog
+type ChangeLogOptions struct {
+	SegmentSize int64 // Bytes after which the log rotates to a new segment, defaults to 64 MiB
+}
+
+// changeLog appends changes to size-rotated segment files. Every line of a
+// segment is one JSON encoded Change.
+type changeLog struct {
+	store        Storage
+	dir          string
+	segmentSize  int64
+	lastPosition uint64
+	current      StorageFile // Segment being appended to
+	currentSize  int64
+	mu           sync.RWMutex
+}
+
+// EnableChangeLog starts logging every committed change to segment files in
+// the main path. Existing segments are continued, a partially written last
+// change from a crash is dropped. Changes are logged after their table file
+// was written, so a crash in between can lose the log entry but never logs a
+// change that didn't happen.
+func (db *HTDB) EnableChangeLog(options ChangeLogOptions) error {
+	if db.changes != nil {
+		return fmt.Errorf("change log is already enabled")
+	}
+
+	segmentSize := options.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultChangeLogSegmentMax
+	}
+
+	log := &changeLog{store: db.storage(), dir: db.mainPath, segmentSize: segmentSize}
+	err := log.open()
+	if err != nil {
+		return err
+	}
+
+	db.changes = log
+	return nil
+}
+
+// ChangesSince returns the logged changes after position, oldest first and at
+// most limit of them (all if limit <= 0). Consumers pass the position of the
+// last change they processed, 0 to start at the beginning of the log.
+func (db *HTDB) ChangesSince(position uint64, limit int) ([]Change, error) {
+	if db.changes == nil {
+		return nil, fmt.Errorf("change log is not enabled")
+	}
+	return db.changes.since(position, limit)
+}
+
+// PruneChanges deletes the segments holding only changes at or before position.
+// Call it with the lowest position every consumer has acknowledged.
+func (db *HTDB) PruneChanges(position uint64) error {
+	if db.changes == nil {
+		return fmt.Errorf("change log is not enabled")
+	}
+	return db.changes.prune(position)
+}
+
+// segments returns the first positions of the existing segments, sorted
+func (l *changeLog) segments() ([]uint64, error) {
+	entries, err := l.store.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read change log directory: %v", err)
+	}
+
+	var firsts []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, changeLogPrefix) || !strings.HasSuffix(name, fileEnding) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, changeLogPrefix), fileEnding), 10, 64)
+		if err != nil {
+			continue
+		}
+		firsts = append(firsts, first)
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+	return firsts, nil
+}
+
+// segmentPath returns the path of the segment starting at first
+func (l *changeLog) segmentPath(first uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%020d%s", changeLogPrefix, first, fileEnding))
+}
+
+// open continues the last segment, or starts the first one
+func (l *changeLog) open() error {
+	firsts, err := l.segments()
+	if err != nil {
+		return err
+	}
+	if len(firsts) == 0 {
+		return l.startSegment(1)
+	}
+
+	path := l.segmentPath(firsts[len(firsts)-1])
+	file, err := l.store.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open change log segment: %v", err)
+	}
+
+	// Find the last complete change, a torn line after it is cut off
+	l.lastPosition = firsts[len(firsts)-1] - 1
+	var validSize int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to read change log segment: %v", err)
+		}
+
+		var change Change
+		if json.Unmarshal(line, &change) != nil {
+			break
+		}
+		l.lastPosition = change.Position
+		validSize += int64(len(line))
+	}
+
+	err = file.Truncate(validSize)
+	if err == nil {
+		_, err = file.Seek(validSize, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to repair change log segment: %v", err)
+	}
+
+	l.current = file
+	l.currentSize = validSize
+	return nil
+}
+
+// startSegment closes the current segment and creates the one starting at first
+func (l *changeLog) startSegment(first uint64) error {
+	if l.current != nil {
+		l.current.Close()
+		l.current = nil
+	}
+
+	file, err := l.store.OpenFile(l.segmentPath(first), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create change log segment: %v", err)
+	}
+
+	l.current = file
+	l.currentSize = 0
+	l.lastPosition = first - 1
+	return nil
+}
+
+// appendCommit logs the committed records of a table
+func (l *changeLog) appendCommit(tx *Transaction, table *Table, records []*Record, durability Durability) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.current == nil {
+		return fmt.Errorf("change log is closed")
+	}
+	if l.currentSize >= l.segmentSize {
+		err := l.startSegment(l.lastPosition + 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	schema := filepath.Base(table.SchemaPath)
+	position := l.lastPosition
+	tags := tx.copyTags()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		position++
+		change := Change{
+			Position:      position,
+			TransactionID: tx.ID,
+			Actor:         tx.actor,
+			Tags:          tags,
+			Op:            ChangeInsert,
+			Schema:        schema,
+			Table:         table.TableName,
+			RecordID:      record.ID,
+			PreviousID:    record.previousID,
+			Time:          now,
+		}
+		if record.Metadata.CommittedAt != 0 {
+			change.Time = record.CommittedAt().UTC()
+		}
+		if record.Metadata.IsDeleted {
+			change.Op = ChangeDelete
+		} else {
+			if record.previousID != 0 {
+				change.Op = ChangeUpdate
+			}
+			change.Values = changeValues(record)
+		}
+
+		err := encoder.Encode(change)
+		if err != nil {
+			return fmt.Errorf("failed to encode change: %v", err)
+		}
+	}
+
+	_, err := l.current.Write(buf.Bytes())
+	if err != nil {
+		// A torn line would end the log for readers, later changes follow the last whole one
+		if l.current.Truncate(l.currentSize) == nil {
+			l.current.Seek(l.currentSize, io.SeekStart)
+		}
+		return fmt.Errorf("failed to write change log: %v", err)
+	}
+	if durability >= DurabilityFlush {
+		err = l.current.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync change log: %v", err)
+		}
+	}
+
+	l.currentSize += int64(buf.Len())
+	l.lastPosition = position
+	return nil
+}
+
+// changeValues returns the field values of a record for the log
+func changeValues(record *Record) map[string]interface{} {
+	values := make(map[string]interface{}, len(record.FieldsData))
+	for name, value := range record.FieldsData {
+		if name != "id" {
+			values[name] = value
+		}
+	}
+	for name, meta := range record.FieldsMeta {
+		if meta.IsNull && name != "id" {
+			values[name] = nil
+		}
+	}
+	return values
+}
+
+// since reads the changes after position from the segments
+func (l *changeLog) since(position uint64, limit int) ([]Change, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	firsts, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start at the last segment beginning at or before the wanted position
+	start := 0
+	for i, first := range firsts {
+		if first <= position+1 {
+			start = i
+		}
+	}
+
+	var changes []Change
+	for _, first := range firsts[start:] {
+		done, err := l.readSegment(first, position, limit, &changes)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return changes, nil
+}
+
+// readSegment appends the changes after position in a segment to changes and
+// reports whether the limit was reached
+func (l *changeLog) readSegment(first, position uint64, limit int, changes *[]Change) (bool, error) {
+	file, err := openFile(l.store, l.segmentPath(first))
+	if os.IsNotExist(err) {
+		return false, nil // Pruned meanwhile
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open change log segment: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read change log segment: %v", err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber() // Keep integer values exact
+		var change Change
+		err = decoder.Decode(&change)
+		if err != nil {
+			return false, fmt.Errorf("corrupt change log segment %d: %v", first, err)
+		}
+		if change.Position <= position {
+			continue
+		}
+
+		*changes = append(*changes, change)
+		if limit > 0 && len(*changes) >= limit {
+			return true, nil
+		}
+	}
+}
+
+// prune deletes the segments whose changes all lie at or before position.
+// The segment being appended to is always kept.
+func (l *changeLog) prune(position uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	firsts, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	// A segment ends right before the next one starts
+	for i := 0; i+1 < len(firsts); i++ {
+		if firsts[i+1]-1 > position {
+			break
+		}
+		err = l.store.Remove(l.segmentPath(firsts[i]))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove change log segment: %v", err)
+		}
+	}
+	return nil
+}
+
+// close closes the segment being appended to
+func (l *changeLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.current == nil {
+		return nil
+	}
+	err := l.current.Close()
+	l.current = nil
+	return err
+}
@@ -6,33 +6,141 @@
 package hartoDb_go
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// defaultCopyBufferSize is the buffer size used to copy ref data during cleanup
+const defaultCopyBufferSize = 32 * 1024
+
 // CleanupWorker represents a background worker that periodically cleans up the database
 type CleanupWorker struct {
-	db        *HTDB
-	interval  time.Duration
-	stopChan  chan struct{}
-	wg        sync.WaitGroup
-	isRunning bool
-	mu        sync.Mutex
+	db             *HTDB
+	interval       time.Duration
+	stopChan       chan struct{}
+	triggerChan    chan struct{} // Buffered, coalesces TriggerNow calls
+	compactChan    chan struct{} // Buffered, coalesces scheduled compactions
+	resumeChan     chan struct{} // Buffered, wakes the loop on Resume
+	rescheduleChan chan struct{} // Buffered, wakes the loop to plan its next runs again
+	wg             sync.WaitGroup
+	isRunning      bool
+	isPaused       bool
+	bufferSize     int // Copy buffer size for ref data, see SetCopyBufferSize
+	concurrency    int // Tables compacted in parallel, see WithConcurrency
+	collector      CleanupMetricsCollector
+	scheduled      map[string]bool      // "schema:table" of the tables over their compaction threshold
+	nextRuns       map[string]time.Time // Next periodic cleanup by "schema:table", see CleanupPolicy.Interval
+	mu             sync.Mutex
+
+	// stepHook is called after each step of a compaction. Returning true stops
+	// the compaction right there, leaving the files as a crash would.
+	stepHook func(step compactionStep) bool
+
+	lastReport CleanupReport
+}
+
+// CleanupReport summarizes what a cleanup pass removed
+type CleanupReport struct {
+	TablesCleaned   int            // Number of tables that were compacted
+	RecordsRemoved  int            // Number of outdated or deleted records dropped
+	RecordsArchived int            // Number of the dropped records moved into archives, see CleanupArchive
+	BytesReclaimed  int64          // Bytes freed across table and ref field files
+	InvalidRefs     int            // Ref values dropped because their offsets were out of range
+	Quarantined     int            // Corrupt records moved into quarantine files and dropped
+	Errors          int            // Number of schemas or tables that failed to clean up
+	Duration        time.Duration  // How long the pass took
+	Tables          []TableCleanup // Every table the pass looked at, in schema and table order
+}
+
+// TableCleanup describes what a cleanup pass did with a single table
+type TableCleanup struct {
+	Schema         string
+	Table          string
+	Compacted      bool          // False if the table had nothing to remove or was within its threshold
+	RecordsRemoved int           // Outdated or deleted records dropped, archived ones included
+	BytesReclaimed int64         // Bytes freed across the table and its ref field files
+	Duration       time.Duration // How long the table took, waiting for its lock included
+	Error          string        // Why the table failed to clean up, empty on success
+}
+
+// add adds the counts of a table's report to the pass report
+func (r *CleanupReport) add(table CleanupReport) {
+	r.TablesCleaned += table.TablesCleaned
+	r.RecordsRemoved += table.RecordsRemoved
+	r.RecordsArchived += table.RecordsArchived
+	r.BytesReclaimed += table.BytesReclaimed
+	r.InvalidRefs += table.InvalidRefs
+	r.Quarantined += table.Quarantined
+}
+
+// CleanupMetricsCollector receives cleanup activity at pass boundaries so it can
+// be exported to a monitoring system such as Prometheus or expvar
+type CleanupMetricsCollector interface {
+	CleanupPassStarted()                      // Called before a pass touches any table
+	CleanupPassFinished(report CleanupReport) // Called with the report once a pass ends
+}
+
+// CleanupCounters is a ready-made CleanupMetricsCollector that keeps running totals
+type CleanupCounters struct {
+	PassesRun       atomic.Int64
+	TablesCompacted atomic.Int64
+	RecordsRemoved  atomic.Int64
+	BytesReclaimed  atomic.Int64
+	Errors          atomic.Int64
+	LastPassNanos   atomic.Int64 // Duration of the last finished pass
+}
+
+// CleanupPassStarted implements CleanupMetricsCollector
+func (c *CleanupCounters) CleanupPassStarted() {}
+
+// CleanupPassFinished implements CleanupMetricsCollector
+func (c *CleanupCounters) CleanupPassFinished(report CleanupReport) {
+	c.PassesRun.Add(1)
+	c.TablesCompacted.Add(int64(report.TablesCleaned))
+	c.RecordsRemoved.Add(int64(report.RecordsRemoved))
+	c.BytesReclaimed.Add(report.BytesReclaimed)
+	c.Errors.Add(int64(report.Errors))
+	c.LastPassNanos.Store(int64(report.Duration))
+}
+
+// CleanupOption configures a CleanupWorker
+type CleanupOption func(*CleanupWorker)
+
+// WithConcurrency lets a cleanup pass compact up to n tables in parallel. Each
+// table is still compacted under its own lock, so only commits to the table
+// being compacted wait. Without it the database's cleanup_concurrency config
+// value is used, one table at a time if that isn't set either.
+func WithConcurrency(n int) CleanupOption {
+	return func(w *CleanupWorker) {
+		w.concurrency = n
+	}
 }
 
 // NewCleanupWorker creates a new cleanup worker
-func NewCleanupWorker(db *HTDB, interval time.Duration) *CleanupWorker {
-	return &CleanupWorker{
-		db:        db,
-		interval:  interval,
-		stopChan:  make(chan struct{}),
-		isRunning: false,
+func NewCleanupWorker(db *HTDB, interval time.Duration, options ...CleanupOption) *CleanupWorker {
+	w := &CleanupWorker{
+		db:             db,
+		interval:       interval,
+		stopChan:       make(chan struct{}),
+		triggerChan:    make(chan struct{}, 1),
+		compactChan:    make(chan struct{}, 1),
+		resumeChan:     make(chan struct{}, 1),
+		rescheduleChan: make(chan struct{}, 1),
+		isRunning:      false,
+	}
+	for _, option := range options {
+		option(w)
 	}
+	return w
 }
 
 // Start starts the cleanup worker
@@ -45,18 +153,52 @@ func (w *CleanupWorker) Start() error {
 	}
 
 	w.isRunning = true
+	w.stopChan = make(chan struct{})
+	stopChan := w.stopChan
 	w.wg.Add(1)
 
 	go func() {
 		defer w.wg.Done()
-		ticker := time.NewTicker(w.interval)
-		defer ticker.Stop()
+
+		// Every table runs on its own interval, the worker sleeps until the next is due
+		w.dueTables(time.Now())
+		timer := time.NewTimer(w.untilNextRun(time.Now()))
+		defer timer.Stop()
+
+		// A trigger or scheduled compaction that arrives while paused runs
+		// once the worker resumes
+		pendingTrigger := false
+		pendingCompaction := false
 
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
+				w.performDue(time.Now())
+				timer.Reset(w.untilNextRun(time.Now()))
+			case <-w.rescheduleChan:
+				timer.Reset(w.untilNextRun(time.Now()))
+			case <-w.triggerChan:
+				if w.IsPaused() {
+					pendingTrigger = true
+					continue
+				}
 				w.performCleanup()
-			case <-w.stopChan:
+			case <-w.compactChan:
+				if w.IsPaused() {
+					pendingCompaction = true
+					continue
+				}
+				w.performScheduled()
+			case <-w.resumeChan:
+				if pendingTrigger && !w.IsPaused() {
+					pendingTrigger = false
+					w.performCleanup()
+				}
+				if pendingCompaction && !w.IsPaused() {
+					pendingCompaction = false
+					w.performScheduled()
+				}
+			case <-stopChan:
 				return
 			}
 		}
@@ -65,104 +207,277 @@ func (w *CleanupWorker) Start() error {
 	return nil
 }
 
-// Stop stops the cleanup worker
+// Stop stops the cleanup worker, waiting for a running pass to finish
 func (w *CleanupWorker) Stop() error {
 	w.mu.Lock()
-	defer w.mu.Unlock()
-
 	if !w.isRunning {
+		w.mu.Unlock()
 		return fmt.Errorf("cleanup worker is not running")
 	}
 
 	close(w.stopChan)
-	w.wg.Wait()
 	w.isRunning = false
+	w.mu.Unlock()
+
+	// Wait without holding the mutex, a running pass needs it to store its report
+	w.wg.Wait()
 
 	return nil
 }
 
-// performCleanup performs the actual cleanup operation
+// Pause stops the worker from starting new cleanup passes until Resume is called.
+// A pass that is already running is not interrupted.
+func (w *CleanupWorker) Pause() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.isPaused = true
+}
+
+// Resume lets the worker start cleanup passes again. A TriggerNow that arrived
+// while paused is run right away.
+func (w *CleanupWorker) Resume() {
+	w.mu.Lock()
+	w.isPaused = false
+	w.mu.Unlock()
+
+	select {
+	case w.resumeChan <- struct{}{}:
+	default:
+	}
+}
+
+// IsPaused reports whether the worker is paused
+func (w *CleanupWorker) IsPaused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.isPaused
+}
+
+// TriggerNow requests a cleanup pass without waiting for the next tick.
+// It does not block, multiple triggers before the pass starts are coalesced into one.
+func (w *CleanupWorker) TriggerNow() {
+	select {
+	case w.triggerChan <- struct{}{}:
+	default:
+	}
+}
+
+// SetMetricsCollector sets the collector notified at the start and end of every
+// cleanup pass. Passing nil disables metrics.
+func (w *CleanupWorker) SetMetricsCollector(c CleanupMetricsCollector) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.collector = c
+}
+
+// metricsCollector returns the current metrics collector, or nil
+func (w *CleanupWorker) metricsCollector() CleanupMetricsCollector {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.collector
+}
+
+// LastReport returns the report of the most recent cleanup pass
+func (w *CleanupWorker) LastReport() CleanupReport {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.lastReport
+}
+
+// cleanupPass selects the tables a cleanup pass compacts
+type cleanupPass struct {
+	tables     map[string]bool // "schema:table" of the tables to compact, nil for every table
+	thresholds bool            // Skip tables whose dead ratio is within their compaction threshold
+}
+
+// performCleanup compacts every table with outdated or deleted records
 func (w *CleanupWorker) performCleanup() {
+	w.performPass(cleanupPass{})
+}
+
+// performPass performs the actual cleanup operation
+func (w *CleanupWorker) performPass(pass cleanupPass) {
+	var report CleanupReport
+	collector := w.metricsCollector()
+	if collector != nil {
+		collector.CleanupPassStarted()
+	}
+
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start)
+		w.mu.Lock()
+		w.lastReport = report
+		w.mu.Unlock()
+		w.db.lastCleanup.Store(newCleanupStats(report))
+		if collector != nil {
+			collector.CleanupPassFinished(report)
+		}
+
+		metrics := w.db.metricsSink()
+		metrics.Inc(MetricCleanupPasses, 1)
+		metrics.Inc(MetricCleanupRecordsRemoved, int64(report.RecordsRemoved))
+		metrics.Inc(MetricCleanupRecordsArchived, int64(report.RecordsArchived))
+		metrics.Inc(MetricCleanupBytesReclaimed, report.BytesReclaimed)
+		metrics.Inc(MetricCleanupErrors, int64(report.Errors))
+		metrics.Observe(MetricCleanupDuration, report.Duration.Seconds())
+	}()
+
 	// Get all schemas
 	schemas, err := w.getSchemas()
 	if err != nil {
-		fmt.Printf("Error getting schemas: %v\n", err)
+		w.db.log(slog.LevelError, "cleanup failed", "error", err)
+		report.Errors++
 		return
 	}
 
-	// Process each schema
+	// Collect the tables of every schema
 	for _, schema := range schemas {
-		// Get all tables in the schema
 		tables, err := w.getTables(schema)
 		if err != nil {
-			fmt.Printf("Error getting tables for schema %s: %v\n", schema, err)
+			w.db.log(slog.LevelError, "cleanup failed", "schema", schema, "error", err)
+			report.Errors++
 			continue
 		}
 
-		// Process each table
 		for _, table := range tables {
-			err := w.cleanupTable(schema, table)
-			if err != nil {
-				fmt.Printf("Error cleaning up table %s in schema %s: %v\n", table, schema, err)
+			if pass.tables != nil && !pass.tables[schema+":"+table] {
+				continue
 			}
+			report.Tables = append(report.Tables, TableCleanup{Schema: schema, Table: table})
 		}
 	}
+
+	// Compact them with up to concurrency tables at a time, each under its own lock
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for worker := 0; worker < min(w.passConcurrency(), len(report.Tables)); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				tableReport, err := w.cleanupPassTable(&report.Tables[i], pass.thresholds)
+				mu.Lock()
+				report.add(tableReport)
+				if err != nil {
+					report.Errors++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range report.Tables {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// cleanupPassTable compacts a table of a pass and fills in its entry of the
+// pass report. It returns the counts to add to the pass report.
+func (w *CleanupWorker) cleanupPassTable(entry *TableCleanup, thresholds bool) (CleanupReport, error) {
+	schema, table := entry.Schema, entry.Table
+	threshold := 0.0
+	if thresholds {
+		threshold = w.db.compactionThreshold(schema, table)
+	}
+
+	var report CleanupReport
+	start := time.Now()
+	err := w.cleanupTable(schema, table, threshold, &report)
+	entry.Duration = time.Since(start)
+	if err != nil {
+		entry.Error = err.Error()
+		w.db.log(slog.LevelError, "cleanup failed", "schema", schema, "table", table, "error", err)
+		return report, err
+	}
+
+	entry.Compacted = report.TablesCleaned > 0
+	entry.RecordsRemoved = report.RecordsRemoved
+	entry.BytesReclaimed = report.BytesReclaimed
+	if entry.Compacted {
+		w.db.usage.invalidate(w.db.schemaPath(schema))
+		w.db.log(slog.LevelInfo, "table compacted", "schema", schema, "table", table,
+			"records_removed", report.RecordsRemoved,
+			"records_archived", report.RecordsArchived,
+			"bytes_reclaimed", report.BytesReclaimed,
+			"invalid_refs", report.InvalidRefs,
+			"quarantined", report.Quarantined,
+			"duration", entry.Duration)
+	}
+	return report, nil
+}
+
+// passConcurrency returns how many tables a pass compacts in parallel
+func (w *CleanupWorker) passConcurrency() int {
+	w.mu.Lock()
+	concurrency := w.concurrency
+	w.mu.Unlock()
+
+	if concurrency <= 0 {
+		w.db.configMu.Lock()
+		concurrency = w.db.config.CleanupConcurrency
+		w.db.configMu.Unlock()
+	}
+	return max(concurrency, 1)
 }
 
-// getSchemas returns all schemas in the database
+// getSchemas returns all schemas in the database that may be compacted
 func (w *CleanupWorker) getSchemas() ([]string, error) {
 	// Get all directories in the main path
-	entries, err := os.ReadDir(w.db.mainPath)
+	entries, err := w.db.storage().ReadDir(w.db.mainPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read main directory: %v", err)
 	}
 
 	var schemas []string
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if isSchemaDir(entry) {
 			schemas = append(schemas, entry.Name())
 		}
 	}
 
+	// Read-only attached schemas are left alone
+	for name, attached := range w.db.attachedSchemas() {
+		if !attached.ReadOnly {
+			schemas = append(schemas, name)
+		}
+	}
+
 	return schemas, nil
 }
 
-// getTables returns all tables in a schema
+// getTables returns all tables in a schema. Tables are found by their
+// configuration files like TableNames, so ref files and other files of a
+// table are never taken for tables of their own.
 func (w *CleanupWorker) getTables(schema string) ([]string, error) {
-	schemaPath := filepath.Join(w.db.mainPath, schema)
-
-	// Get all files in the schema directory
-	entries, err := os.ReadDir(schemaPath)
+	tables, err := w.db.TableNames(schema)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read schema directory: %v", err)
 	}
-
-	var tables []string
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			name := entry.Name()
-			// Check if it's a table file (not a config or data file)
-			if filepath.Ext(name) == fileEnding &&
-				!strings.HasSuffix(name, ".conf"+fileEnding) &&
-				!strings.HasSuffix(name, ".data"+fileEnding) {
-				// Remove the extension
-				tableName := name[:len(name)-len(fileEnding)]
-				tables = append(tables, tableName)
-			}
-		}
-	}
-
 	return tables, nil
 }
 
-// cleanupTable cleans up a table by removing outdated and deleted records
-func (w *CleanupWorker) cleanupTable(schema, tableName string) error {
+// cleanupTable cleans up a table by removing outdated and deleted records,
+// unless their share of the table's records is no more than threshold. The
+// table's cleanup policy decides which versions are retained or expired.
+// Records are streamed one at a time from the table file into a temporary file,
+// copying their ref data into compacted ref files on the way, so memory use stays
+// at one record plus the copy buffer regardless of the table size.
+func (w *CleanupWorker) cleanupTable(schema, tableName string, threshold float64, report *CleanupReport) error {
 	// Get the table
-	tableConfPath := filepath.Join(w.db.mainPath, schema, tableName+".conf"+fileEnding)
-	tableDataPath := filepath.Join(w.db.mainPath, schema, tableName+fileEnding)
+	tableConfPath := tableConfPath(w.db.schemaPath(schema), tableName)
+	tableDataPath := tableFilePath(w.db.schemaPath(schema), tableName)
 
 	// Read the table configuration
-	tableConf, err := os.ReadFile(tableConfPath)
+	store := w.db.storage()
+	tableConf, err := readFile(store, tableConfPath)
 	if err != nil {
 		return fmt.Errorf("failed to read table configuration: %v", err)
 	}
@@ -174,154 +489,709 @@ func (w *CleanupWorker) cleanupTable(schema, tableName string) error {
 	}
 
 	// Set the schema path
-	table.SchemaPath = filepath.Join(w.db.mainPath, schema)
+	table.SchemaPath = w.db.schemaPath(schema)
+	table.db = w.db
+	table.schema = schema
+	recordSize := table.RecordSize()
 
-	// Read all records from the table
-	records, err := table.GetAllRecords()
+	// Hold off commits and scans of this table until the compaction is done
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Records written with other fields would be rewritten into garbage
+	err = table.checkLayoutHash(store)
 	if err != nil {
-		return fmt.Errorf("failed to read records: %v", err)
+		return err
 	}
 
-	// Filter out outdated and deleted records
-	var currentRecords []*Record
-	for _, record := range records {
-		if record.Metadata.IsCurrent && !record.Metadata.IsDeleted {
-			currentRecords = append(currentRecords, record)
+	// Check whether there is anything to remove before rewriting any file
+	policy := w.db.cleanupPolicy(schema, tableName)
+	now := time.Now()
+	deadRecords, records, err := countDeadRecords(&table, policy, now)
+	if err != nil {
+		return err
+	}
+	lostRefs, err := table.hasRefGaps()
+	if err != nil {
+		return err
+	}
+	if !lostRefs && (deadRecords == 0 || deadRatio(deadRecords, records) <= threshold) {
+		return nil
+	}
+
+	// Open a compactor for every ref field so surviving records can be given
+	// their new offsets before they are serialized into the table file
+	var compactors []*refCompactor
+	var tempPaths []string
+	var finalPaths []string
+	removeTemps := func() {
+		for _, compactor := range compactors {
+			compactor.close()
+		}
+		for _, path := range tempPaths {
+			store.Remove(path)
 		}
 	}
 
-	// If no records were filtered out, no cleanup needed
-	if len(currentRecords) == len(records) {
-		return nil
+	for _, field := range table.Fields {
+		if field.Type == "ref" {
+			refFilePath := table.RefFilePath(field.Name)
+			compactor, err := newRefCompactor(store, &table, field.Name, w.db.fileMode())
+			if err != nil {
+				removeTemps()
+				return fmt.Errorf("failed to clean up ref field %s: %v", field.Name, err)
+			}
+			if compactor == nil {
+				continue
+			}
+			compactors = append(compactors, compactor)
+			tempPaths = append(tempPaths, compactor.tempPath)
+			finalPaths = append(finalPaths, refFilePath)
+
+			// Values in lost ranges are nulled, the compacted file has none
+			if len(compactor.gaps) > 0 {
+				gapsPath := table.refGapsPath(field.Name)
+				gapsTempPath, err := writeTempFile(store, gapsPath, compactionTempSuffix, []byte("[]"), w.db.fileMode())
+				if err != nil {
+					removeTemps()
+					return fmt.Errorf("failed to clean up ref field %s: %v", field.Name, err)
+				}
+				tempPaths = append(tempPaths, gapsTempPath)
+				finalPaths = append(finalPaths, gapsPath)
+			}
+		}
+	}
+
+	// Outdated and deleted records are moved into the archive instead, see CleanupArchive
+	var archive *archiver
+	if policy.mode == CleanupArchive {
+		archive, err = newArchiver(&table, compactors)
+		if err != nil {
+			removeTemps()
+			return err
+		}
+		defer archive.close()
 	}
 
 	// Create a temporary file for the new table data
-	tempDataPath := tableDataPath + ".temp"
-	tempFile, err := os.Create(tempDataPath)
+	tempFile, tempDataPath, err := createTempFile(store, tableDataPath, compactionTempSuffix, w.db.fileMode())
 	if err != nil {
+		removeTemps()
 		return fmt.Errorf("failed to create temporary file: %v", err)
 	}
 	defer tempFile.Close()
+	tempPaths = append(tempPaths, tempDataPath)
+	finalPaths = append(finalPaths, tableDataPath)
+
+	writer := bufio.NewWriter(tempFile)
+	encoder, err := table.newRecordEncoder(writer)
+	if err != nil {
+		tempFile.Close()
+		removeTemps()
+		return err
+	}
+	copyBuf := make([]byte, w.copyBufferSize())
 
 	// Write current records to the temporary file
-	for _, record := range currentRecords {
-		data, err := record.Serialize(table.Fields)
+	// Corrupt records are skipped like in a tolerant scan and quarantined
+	var oldSize, newSize int64
+	summary := &tableSummary{}
+	recordsRemoved := 0
+	invalidRefs := 0
+	var quarantined []QuarantinedRecord
+	err = table.scanRawRecords(func(recordData []byte) error {
+		offset := oldSize
+		oldSize += int64(recordSize)
+
+		if err := checkRecordData(recordData, table.Layout()); err != nil {
+			quarantined = append(quarantined, newQuarantinedRecord(recordData, offset, err))
+			return nil
+		}
+		if policy.removes(recordData, table.Layout(), now) {
+			recordsRemoved++
+			if archive != nil {
+				return archive.add(recordData, copyBuf)
+			}
+			return nil
+		}
+
+		record, err := deserializeRecordLayout(recordData, table.Layout())
 		if err != nil {
-			return fmt.Errorf("failed to serialize record: %v", err)
+			return fmt.Errorf("failed to deserialize record: %v", err)
+		}
+
+		for _, compactor := range compactors {
+			ok, err := compactor.copyRecord(record, copyBuf)
+			if err != nil {
+				return fmt.Errorf("failed to clean up ref field %s: %v", compactor.fieldName, err)
+			}
+			if !ok {
+				invalidRefs++
+			}
 		}
-		_, err = tempFile.Write(data)
+
+		size, err := encoder.write(record)
 		if err != nil {
 			return fmt.Errorf("failed to write record to temporary file: %v", err)
 		}
+		newSize += int64(size)
+		if isLiveRecord(recordData) {
+			summary.add(record.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		tempFile.Close()
+		removeTemps()
+		return err
+	}
+
+	err = encoder.finish()
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		tempFile.Close()
+		removeTemps()
+		return fmt.Errorf("failed to write record to temporary file: %v", err)
+	}
+
+	// Flush the temporary files to disk before anything is swapped. Compaction
+	// syncs regardless of the durability level, the journal relies on it.
+	err = tempFile.Sync()
+	if err != nil {
+		tempFile.Close()
+		removeTemps()
+		return fmt.Errorf("failed to sync temporary file: %v", err)
+	}
+	for _, compactor := range compactors {
+		err = compactor.dst.Sync()
+		if err != nil {
+			tempFile.Close()
+			removeTemps()
+			return fmt.Errorf("failed to sync temporary ref file: %v", err)
+		}
 	}
 
-	// Close the temporary file
+	// Archived records must be on disk before the table file drops them
+	if archive != nil {
+		err = archive.finish()
+		if err != nil {
+			tempFile.Close()
+			removeTemps()
+			return err
+		}
+	}
+
+	// Close the temporary files
 	tempFile.Close()
 
-	// Replace the old file with the new one
-	err = os.Rename(tempDataPath, tableDataPath)
+	reclaimed := oldSize - newSize
+	for _, compactor := range compactors {
+		reclaimed += compactor.srcSize - compactor.offset
+		compactor.close()
+	}
+
+	// Corrupt records must be safe in the quarantine before the table file drops them
+	if len(quarantined) > 0 {
+		_, err = table.quarantine(quarantined)
+		if err != nil {
+			removeTemps()
+			return err
+		}
+	}
+
+	if w.stopAt(compactionTempsWritten) {
+		return errCompactionInterrupted
+	}
+
+	// Record every pending swap in a journal. Once the journal is on disk the
+	// compaction is committed and recovery rolls it forward, before that it is
+	// rolled back by removing the temporary files.
+	err = w.db.commitCompaction(w.db.schemaPath(schema), tableName, tempPaths, finalPaths, w.stopAt)
 	if err != nil {
-		return fmt.Errorf("failed to replace table file: %v", err)
+		return err
 	}
 
-	// Clean up ref field files
-	for _, field := range table.Fields {
-		if field.Type == "ref" {
-			err := w.cleanupRefField(schema, tableName, field.Name, currentRecords)
+	// Only current records survive, the summary is known without a scan
+	err = table.writeSummary(summary)
+	if err != nil {
+		w.db.log(slog.LevelWarn, "failed to update table summary after compaction",
+			"schema", schema, "table", tableName, "error", err)
+	}
+
+	// The file shrank, queries scan until the indexes are rebuilt
+	err = table.rebuildIndexes()
+	if err != nil {
+		w.db.log(slog.LevelWarn, "failed to rebuild indexes after compaction",
+			"schema", schema, "table", tableName, "error", err)
+	}
+
+	// Statistics of an analyzed table are gathered again while the file is at hand
+	if _, err := store.Stat(table.analysisPath()); err == nil {
+		_, err = table.analyze()
+		if err != nil {
+			w.db.log(slog.LevelWarn, "failed to analyze table after compaction",
+				"schema", schema, "table", tableName, "error", err)
+		}
+	}
+
+	report.TablesCleaned++
+	report.RecordsRemoved += recordsRemoved
+	if archive != nil {
+		report.RecordsArchived += archive.archived
+	}
+	report.BytesReclaimed += reclaimed
+	report.InvalidRefs += invalidRefs
+	report.Quarantined += len(quarantined)
+
+	return nil
+}
+
+// isLiveRecord checks the metadata byte of a serialized record and reports
+// whether the record is current and not deleted
+func isLiveRecord(data []byte) bool {
+	flags := recordFlags(data)
+	return flags&flagCurrent != 0 && flags&flagDeleted == 0
+}
+
+// countDeadRecords scans the metadata of every record in a table file and
+// returns how many of them are corrupt or removed under policy at now and how
+// many records there are
+func countDeadRecords(table *Table, policy cleanupPolicy, now time.Time) (int, int, error) {
+	dead := 0
+	records := 0
+	layout := table.Layout()
+	err := table.scanRawRecords(func(recordData []byte) error {
+		records++
+		if checkRecordData(recordData, layout) != nil || policy.removes(recordData, layout, now) {
+			dead++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return dead, records, nil
+}
+
+// copyBufferSize returns the buffer size used to copy ref data during cleanup
+func (w *CleanupWorker) copyBufferSize() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.bufferSize <= 0 {
+		return defaultCopyBufferSize
+	}
+	return w.bufferSize
+}
+
+// SetCopyBufferSize sets the buffer size used to copy ref data during cleanup.
+// A size of zero or less restores the default.
+func (w *CleanupWorker) SetCopyBufferSize(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.bufferSize = size
+}
+
+// refCompactor copies the ref data still used by surviving records from a ref
+// field file into a compacted temporary file
+type refCompactor struct {
+	fieldName string
+	src       StorageFile
+	srcSize   int64
+	gaps      []refGap // Lost ranges of the source, see ErrRefDataMissing
+	dst       StorageFile
+	tempPath  string
+	offset    int64 // Current end of the compacted file
+}
+
+// newRefCompactor opens the file of a table's ref field for compaction. It
+// returns nil if the file doesn't exist or is empty. When no surviving record
+// references the file the compacted file stays empty and truncates the ref
+// file on swap.
+func newRefCompactor(store Storage, table *Table, fieldName string, perm os.FileMode) (*refCompactor, error) {
+	refFilePath := table.RefFilePath(fieldName)
+	gaps, err := readRefGaps(store, table.refGapsPath(fieldName))
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := openFile(store, refFilePath)
+	if os.IsNotExist(err) {
+		return nil, nil // Nothing to clean up
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ref field file: %v", err)
+	}
+
+	stat, err := src.Stat()
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("failed to get file stats: %v", err)
+	}
+
+	// An empty file has nothing to reclaim
+	if stat.Size() == 0 {
+		src.Close()
+		return nil, nil
+	}
+
+	dst, tempPath, err := createTempFile(store, refFilePath, compactionTempSuffix, perm)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("failed to create temporary ref file: %v", err)
+	}
+
+	return &refCompactor{
+		fieldName: fieldName,
+		src:       src,
+		srcSize:   stat.Size(),
+		gaps:      gaps,
+		dst:       dst,
+		tempPath:  tempPath,
+	}, nil
+}
+
+// copyRecord copies the record's ref data into the compacted file and rewrites
+// its offsets. Offsets that fall outside the current file or into a lost range
+// are dropped and the ref value is nulled, so the record never points past the
+// new end of file; in that case copyRecord returns false.
+func (c *refCompactor) copyRecord(record *Record, buf []byte) (bool, error) {
+	offsets, exists := record.RefOffsets[c.fieldName]
+	if !exists {
+		return true, nil
+	}
+
+	start, end := offsets[0], offsets[1]
+	if start < 0 || end > c.srcSize || start > end || checkRefGaps(c.gaps, c.fieldName, offsets) != nil {
+		delete(record.RefOffsets, c.fieldName)
+		delete(record.FieldsData, c.fieldName)
+		record.FieldsMeta[c.fieldName] = FieldMetadata{IsNull: true}
+		return false, nil
+	}
+	if start == end {
+		record.RefOffsets[c.fieldName] = [2]int64{c.offset, c.offset}
+		return true, nil
+	}
+
+	_, err := c.src.Seek(start, io.SeekStart)
+	if err != nil {
+		return false, fmt.Errorf("failed to seek ref field file: %v", err)
+	}
+
+	n, err := io.CopyBuffer(c.dst, io.LimitReader(c.src, end-start), buf)
+	if err != nil {
+		return false, fmt.Errorf("failed to write ref data to temporary file: %v", err)
+	}
+	if n != end-start {
+		return false, fmt.Errorf("short copy of ref data: %d of %d bytes", n, end-start)
+	}
+
+	record.RefOffsets[c.fieldName] = [2]int64{c.offset, c.offset + n}
+	c.offset += n
+
+	return true, nil
+}
+
+// copyRecords copies the ref data of records like copyRecord and syncs the
+// compacted file. Records without offsets get their value from FieldsData
+// encoded with compression, so records read from an export can be written.
+func (c *refCompactor) copyRecords(records []*Record, compression Compression, buf []byte) error {
+	for _, record := range records {
+		if _, exists := record.RefOffsets[c.fieldName]; exists {
+			_, err := c.copyRecord(record, buf)
 			if err != nil {
-				fmt.Printf("Error cleaning up ref field %s: %v\n", field.Name, err)
+				return err
 			}
+			continue
+		}
+
+		value, ok := record.FieldsData[c.fieldName].(string)
+		if !ok || record.FieldsMeta[c.fieldName].IsNull {
+			continue
+		}
+		entry, err := encodeRefValue(value, compression)
+		if err != nil {
+			return err
 		}
+		_, err = c.dst.Write(entry)
+		if err != nil {
+			return fmt.Errorf("failed to write ref data to temporary file: %v", err)
+		}
+		record.RefOffsets[c.fieldName] = [2]int64{c.offset, c.offset + int64(len(entry))}
+		c.offset += int64(len(entry))
 	}
 
+	err := c.dst.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync temporary ref file: %v", err)
+	}
 	return nil
 }
 
-// cleanupRefField cleans up a ref field file by removing unused data
-func (w *CleanupWorker) cleanupRefField(schema, tableName, fieldName string, records []*Record) error {
-	refFilePath := filepath.Join(w.db.mainPath, schema, tableName+"."+fieldName+".data"+fileEnding)
+// close closes both files of the compactor
+func (c *refCompactor) close() {
+	if c.src != nil {
+		c.src.Close()
+	}
+	c.dst.Close()
+}
+
+// compactionStep identifies a point in a table compaction for the step hook
+type compactionStep int
+
+const (
+	compactionTempsWritten   compactionStep = iota // All temporary files are written and synced
+	compactionJournalWritten                       // The journal is on disk, the compaction is committed
+	compactionFileSwapped                          // One temporary file was renamed into place
+)
+
+// compactionTempSuffix marks temporary files written by a compaction, it is
+// distinct from the suffix WriteRecords uses so recovery never removes those
+const compactionTempSuffix = ".compact.temp"
+
+// errCompactionInterrupted is returned when the step hook stopped a compaction
+var errCompactionInterrupted = fmt.Errorf("compaction interrupted")
+
+// stopAt calls the step hook and reports whether the compaction should stop
+func (w *CleanupWorker) stopAt(step compactionStep) bool {
+	return w.stepHook != nil && w.stepHook(step)
+}
+
+// compactionJournal lists the file swaps of a committed compaction.
+// Temps[i] is renamed to Finals[i].
+type compactionJournal struct {
+	Temps  []string `json:"temps"`
+	Finals []string `json:"finals"`
+}
 
-	// Check if the ref file exists
-	if _, err := os.Stat(refFilePath); os.IsNotExist(err) {
-		return nil // Nothing to clean up
+// compactionJournalPath returns the path of a table's compaction journal
+func compactionJournalPath(schemaPath, tableName string) string {
+	return filepath.Join(schemaPath, tableName+".compact.journal")
+}
+
+// writeCompactionJournal writes the journal and syncs it and its directory
+func writeCompactionJournal(store Storage, journalPath string, journal compactionJournal, perm os.FileMode) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to serialize compaction journal: %v", err)
 	}
 
-	// Read the current ref file
-	refData, err := os.ReadFile(refFilePath)
+	file, err := createFile(store, journalPath, perm)
 	if err != nil {
-		return fmt.Errorf("failed to read ref field file: %v", err)
+		return fmt.Errorf("failed to create compaction journal: %v", err)
 	}
+	defer file.Close()
 
-	// Create a map of used offsets
-	usedRanges := make(map[[2]int64]bool)
-	for _, record := range records {
-		if offsets, exists := record.RefOffsets[fieldName]; exists {
-			usedRanges[offsets] = true
+	_, err = file.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write compaction journal: %v", err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync compaction journal: %v", err)
+	}
+
+	return store.SyncDir(filepath.Dir(journalPath))
+}
+
+// commitCompaction writes the journal of a compaction of the table at
+// schemaPath, which commits it, and renames every temporary file over its
+// final path in order. If the journal can't be written the temporary files are
+// removed; if a rename fails the journal stays for recovery to finish the swap.
+// stopAt is the step hook of the cleanup worker, nil elsewhere. The caller
+// must hold the table's write lock.
+func (db *HTDB) commitCompaction(schemaPath, tableName string, tempPaths, finalPaths []string, stopAt func(compactionStep) bool) error {
+	store := db.storage()
+	journalPath := compactionJournalPath(schemaPath, tableName)
+	err := writeCompactionJournal(store, journalPath, compactionJournal{Temps: tempPaths, Finals: finalPaths}, db.fileMode())
+	if err != nil {
+		store.Remove(journalPath)
+		for _, path := range tempPaths {
+			store.Remove(path)
 		}
+		return err
 	}
 
-	// If all offsets are used, no cleanup needed
-	if len(usedRanges) == 0 {
-		return nil
+	if stopAt != nil && stopAt(compactionJournalWritten) {
+		return errCompactionInterrupted
+	}
+
+	// Swap the files in, with the table file last
+	for i := range tempPaths {
+		err = store.Rename(tempPaths[i], finalPaths[i])
+		if err != nil {
+			// The journal stays in place so recovery can finish the swap
+			return fmt.Errorf("failed to replace %s: %v", filepath.Base(finalPaths[i]), err)
+		}
+		db.files.invalidate(finalPaths[i])
+
+		if stopAt != nil && stopAt(compactionFileSwapped) {
+			return errCompactionInterrupted
+		}
+	}
+
+	// Cached records and record positions of the table are outdated now
+	if db.tableManager != nil {
+		tablePath := tableFilePath(schemaPath, tableName)
+		db.tableManager.recordCache.invalidateTable(tablePath)
+		db.tableManager.primaryKeys.invalidate(tablePath)
 	}
 
-	// Create a temporary file for the new ref data
-	tempRefPath := refFilePath + ".temp"
-	tempFile, err := os.Create(tempRefPath)
+	err = store.SyncDir(schemaPath)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary ref file: %v", err)
+		return err
 	}
-	defer tempFile.Close()
 
-	// Create a map to track new offsets
-	offsetMap := make(map[[2]int64][2]int64)
-	currentOffset := int64(0)
+	// The swap is complete, the journal is no longer needed
+	err = store.Remove(journalPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove compaction journal: %v", err)
+	}
+	return store.SyncDir(schemaPath)
+}
 
-	// Write used data to the temporary file and update offsets
-	for _, record := range records {
-		if offsets, exists := record.RefOffsets[fieldName]; exists {
-			// Check if we've already processed this range
-			if newOffsets, processed := offsetMap[offsets]; processed {
-				record.RefOffsets[fieldName] = newOffsets
-				continue
-			}
+// RecoverCompactions finishes or reverts compactions that were interrupted by a crash.
+// Compactions with a journal are rolled forward, leftover temporary files without
+// a journal are removed.
+func RecoverCompactions(mainPath string) error {
+	return recoverCompactions(OSStorage{}, mainPath, nil)
+}
 
-			// Extract the data
-			start, end := offsets[0], offsets[1]
-			if start < 0 || end > int64(len(refData)) || start > end {
-				continue // Skip invalid offsets
-			}
+// recoverCompactions is RecoverCompactions on a storage that logs its recovery actions to logger
+func recoverCompactions(store Storage, mainPath string, logger *slog.Logger) error {
+	entries, err := store.ReadDir(mainPath)
+	if err != nil {
+		return fmt.Errorf("failed to read main directory: %v", err)
+	}
 
-			data := refData[start:end]
+	for _, entry := range entries {
+		if !isSchemaDir(entry) {
+			continue
+		}
 
-			// Write to the temporary file
-			newStart := currentOffset
-			_, err := tempFile.Write(data)
-			if err != nil {
-				return fmt.Errorf("failed to write ref data to temporary file: %v", err)
-			}
+		err = recoverSchemaCompactions(store, filepath.Join(mainPath, entry.Name()), logger)
+		if err != nil {
+			return err
+		}
+	}
 
-			newEnd := newStart + int64(len(data))
+	return nil
+}
 
-			// Update the record's offsets
-			newOffsets := [2]int64{newStart, newEnd}
-			record.RefOffsets[fieldName] = newOffsets
+// recoverSchemaCompactions finishes or reverts the interrupted compactions of a
+// single schema directory. The files of a compaction all start with the name of
+// its table and are handled under that table's write lock, so a database that
+// is in use waits for the compactions in flight instead of losing their files.
+func recoverSchemaCompactions(store Storage, schemaPath string, logger *slog.Logger) error {
+	files, err := store.ReadDir(schemaPath)
+	if err != nil {
+		return fmt.Errorf("failed to read schema directory: %v", err)
+	}
 
-			// Store the mapping for other records that might use the same range
-			offsetMap[offsets] = newOffsets
+	var tableNames []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".compact.journal") && !strings.HasSuffix(name, compactionTempSuffix) {
+			continue
+		}
+		tableName, _, _ := strings.Cut(name, ".")
+		if !seen[tableName] {
+			seen[tableName] = true
+			tableNames = append(tableNames, tableName)
+		}
+	}
 
-			currentOffset = newEnd
+	for _, tableName := range tableNames {
+		err = recoverTableCompaction(store, schemaPath, tableName, logger)
+		if err != nil {
+			return err
 		}
 	}
 
-	// Close the temporary file
-	tempFile.Close()
+	return store.SyncDir(schemaPath)
+}
+
+// recoverTableCompaction rolls the committed compactions of a table and its
+// archive forward and removes the files of their compactions that never
+// committed
+func recoverTableCompaction(store Storage, schemaPath, tableName string, logger *slog.Logger) error {
+	lock := tableLock(tableFilePath(schemaPath, tableName))
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Roll forward every committed compaction first
+	files, err := store.ReadDir(schemaPath)
+	if err != nil {
+		return fmt.Errorf("failed to read schema directory: %v", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, tableName+".") && strings.HasSuffix(name, ".compact.journal") {
+			err = rollCompactionForward(store, schemaPath, filepath.Join(schemaPath, name), logger)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-	// Replace the old file with the new one
-	err = os.Rename(tempRefPath, refFilePath)
+	// Anything left over belongs to a compaction that never committed
+	files, err = store.ReadDir(schemaPath)
 	if err != nil {
-		return fmt.Errorf("failed to replace ref field file: %v", err)
+		return fmt.Errorf("failed to read schema directory: %v", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, tableName+".") && strings.HasSuffix(name, compactionTempSuffix) {
+			store.Remove(filepath.Join(schemaPath, name))
+			logEvent(logger, slog.LevelInfo, "uncommitted compaction file removed", "file", filepath.Join(schemaPath, name))
+		}
 	}
+	return nil
+}
 
+// rollCompactionForward finishes the swaps listed in a compaction journal and
+// removes it. A torn journal is removed without swapping anything.
+func rollCompactionForward(store Storage, schemaPath, journalPath string, logger *slog.Logger) error {
+	data, err := readFile(store, journalPath)
+	if err != nil {
+		return fmt.Errorf("failed to read compaction journal: %v", err)
+	}
+
+	var journal compactionJournal
+	err = json.Unmarshal(data, &journal)
+	if err != nil || len(journal.Temps) != len(journal.Finals) {
+		// A torn journal means the crash happened before the commit point
+		store.Remove(journalPath)
+		logEvent(logger, slog.LevelInfo, "torn compaction journal removed", "journal", journalPath)
+		return nil
+	}
+
+	for i := range journal.Temps {
+		if _, err := store.Stat(journal.Temps[i]); os.IsNotExist(err) {
+			continue // Already swapped
+		}
+		err = store.Rename(journal.Temps[i], journal.Finals[i])
+		if err != nil {
+			return fmt.Errorf("failed to finish compaction of %s: %v", filepath.Base(journal.Finals[i]), err)
+		}
+	}
+
+	err = store.SyncDir(schemaPath)
+	if err != nil {
+		return err
+	}
+	err = store.Remove(journalPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove compaction journal: %v", err)
+	}
+	logEvent(logger, slog.LevelInfo, "interrupted compaction rolled forward", "journal", journalPath)
 	return nil
 }
@@ -0,0 +1,236 @@
+// CleanupPolicy.go
+// Description: Cleanup policies of the HTDB library
+// Per-schema and per-table cleanup intervals, version retention, record TTLs and cleanup modes
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// CleanupPolicy configures how the cleanup worker treats a schema or table.
+// Empty fields are taken from the next less specific level: a table's policy,
+// then its schema's, then the cleanup settings of Config.
+type CleanupPolicy struct {
+	Interval  string `json:"interval,omitempty"`  // Go duration between cleanups, the worker's interval if empty
+	Retention string `json:"retention,omitempty"` // Go duration, outdated and deleted versions committed within it are kept
+	TTL       string `json:"ttl,omitempty"`       // Go duration, current records not updated within it are removed
+	Mode      string `json:"mode,omitempty"`      // "drop" or "archive", see CleanupMode
+}
+
+// validate checks the values of the policy
+func (p CleanupPolicy) validate() error {
+	if p.Interval != "" {
+		interval, err := time.ParseDuration(p.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid cleanup interval '%s'", p.Interval)
+		}
+	}
+	if p.Retention != "" {
+		retention, err := time.ParseDuration(p.Retention)
+		if err != nil || retention < 0 {
+			return fmt.Errorf("invalid cleanup retention '%s'", p.Retention)
+		}
+	}
+	if p.TTL != "" {
+		ttl, err := time.ParseDuration(p.TTL)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid cleanup ttl '%s'", p.TTL)
+		}
+	}
+	if p.Mode != "" && p.Mode != string(CleanupDrop) && p.Mode != string(CleanupArchive) {
+		return fmt.Errorf("unknown cleanup mode '%s', use drop or archive", p.Mode)
+	}
+	return nil
+}
+
+// merge returns p with every non-empty field of override applied
+func (p CleanupPolicy) merge(override CleanupPolicy) CleanupPolicy {
+	if override.Interval != "" {
+		p.Interval = override.Interval
+	}
+	if override.Retention != "" {
+		p.Retention = override.Retention
+	}
+	if override.TTL != "" {
+		p.TTL = override.TTL
+	}
+	if override.Mode != "" {
+		p.Mode = override.Mode
+	}
+	return p
+}
+
+// SetCleanupPolicy sets the cleanup policy of a table, or of every table of
+// the schema if table is empty, and writes it to the config file. An empty
+// policy removes it.
+func (db *HTDB) SetCleanupPolicy(schema, table string, policy CleanupPolicy) error {
+	config := db.Config()
+	tablePolicies := make(map[string]CleanupPolicy, len(config.TableCleanupPolicies))
+	for key, p := range config.TableCleanupPolicies {
+		tablePolicies[key] = p
+	}
+	schemaPolicies := make(map[string]CleanupPolicy, len(config.SchemaCleanupPolicies))
+	for key, p := range config.SchemaCleanupPolicies {
+		schemaPolicies[key] = p
+	}
+
+	policies, key := schemaPolicies, schema
+	if table != "" {
+		policies, key = tablePolicies, schema+":"+table
+	}
+	if policy == (CleanupPolicy{}) {
+		delete(policies, key)
+	} else {
+		policies[key] = policy
+	}
+
+	config.TableCleanupPolicies = tablePolicies
+	config.SchemaCleanupPolicies = schemaPolicies
+	return db.SetConfig(config)
+}
+
+// cleanupPolicy is a resolved CleanupPolicy
+type cleanupPolicy struct {
+	interval  time.Duration // 0 for the worker's interval
+	retention time.Duration
+	ttl       time.Duration // 0 for no ttl
+	mode      CleanupMode
+}
+
+// cleanupPolicy resolves the cleanup policy of a table, most specific first
+func (db *HTDB) cleanupPolicy(schema, table string) cleanupPolicy {
+	db.configMu.Lock()
+	config := db.config
+	db.configMu.Unlock()
+
+	policy := CleanupPolicy{Mode: config.CleanupMode, Retention: config.CleanupRetention, TTL: config.CleanupTTL}
+	policy = policy.merge(config.SchemaCleanupPolicies[schema])
+	policy = policy.merge(config.TableCleanupPolicies[schema+":"+table])
+
+	// The values were validated when the config was set
+	resolved := cleanupPolicy{mode: CleanupMode(policy.Mode)}
+	resolved.interval, _ = time.ParseDuration(policy.Interval)
+	resolved.retention, _ = time.ParseDuration(policy.Retention)
+	resolved.ttl, _ = time.ParseDuration(policy.TTL)
+	if resolved.mode == "" {
+		resolved.mode = CleanupDrop
+	}
+	return resolved
+}
+
+// removes reports whether cleanup removes a serialized record at now: outdated
+// and deleted versions past their retention and current records past their ttl
+func (p cleanupPolicy) removes(data []byte, layout *RecordLayout, now time.Time) bool {
+	if isLiveRecord(data) {
+		return p.ttl > 0 && recordCommitTime(data, layout) < now.Add(-p.ttl).UnixNano()
+	}
+	return p.retention <= 0 || recordCommitTime(data, layout) < now.Add(-p.retention).UnixNano()
+}
+
+// recordCommitTime returns when a serialized record was committed. Formats
+// without the audit trailer fall back to the id, a timestamp of its creation.
+func recordCommitTime(data []byte, layout *RecordLayout) int64 {
+	if layout.AuditOffset != 0 {
+		if committedAt := int64(binary.LittleEndian.Uint64(data[layout.AuditOffset:])); committedAt != 0 {
+			return committedAt
+		}
+	}
+	return recordID(data)
+}
+
+// tableInterval returns how often the worker cleans up a table
+func (w *CleanupWorker) tableInterval(schema, table string) time.Duration {
+	if interval := w.db.cleanupPolicy(schema, table).interval; interval > 0 {
+		return interval
+	}
+	return w.interval
+}
+
+// reschedule makes the worker plan its next runs again, e.g. after the
+// cleanup intervals changed. It does not block.
+func (w *CleanupWorker) reschedule() {
+	select {
+	case w.rescheduleChan <- struct{}{}:
+	default:
+	}
+}
+
+// dueTables advances the next run of every table and returns the tables that
+// are due at now. Tables seen for the first time are due an interval later.
+func (w *CleanupWorker) dueTables(now time.Time) map[string]bool {
+	schemas, err := w.getSchemas()
+	if err != nil {
+		w.db.log(slog.LevelError, "cleanup failed", "error", err)
+		return nil
+	}
+
+	due := make(map[string]bool)
+	nextRuns := make(map[string]time.Time)
+	w.mu.Lock()
+	previous := w.nextRuns
+	w.mu.Unlock()
+
+	for _, schema := range schemas {
+		tables, err := w.getTables(schema)
+		if err != nil {
+			w.db.log(slog.LevelError, "cleanup failed", "schema", schema, "error", err)
+			continue
+		}
+
+		for _, table := range tables {
+			key := schema + ":" + table
+			interval := w.tableInterval(schema, table)
+			next, exists := previous[key]
+			if !exists || next.After(now.Add(interval)) {
+				next = now.Add(interval) // New table or shortened interval
+			}
+			if !next.After(now) {
+				due[key] = true
+				next = now.Add(interval)
+			}
+			nextRuns[key] = next
+		}
+	}
+
+	// Dropped tables fall out of the schedule
+	w.mu.Lock()
+	w.nextRuns = nextRuns
+	w.mu.Unlock()
+	return due
+}
+
+// untilNextRun returns how long the worker sleeps until the next table is due.
+// It wakes at least every shortest interval to pick up new tables.
+func (w *CleanupWorker) untilNextRun(now time.Time) time.Duration {
+	wait := w.interval
+	config := w.db.Config()
+	for _, policies := range []map[string]CleanupPolicy{config.TableCleanupPolicies, config.SchemaCleanupPolicies} {
+		for _, policy := range policies {
+			if interval, _ := time.ParseDuration(policy.Interval); interval > 0 && interval < wait {
+				wait = interval
+			}
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, next := range w.nextRuns {
+		wait = min(wait, next.Sub(now))
+	}
+	return max(wait, 0)
+}
+
+// performDue compacts the tables whose next run is due. Runs that fall due
+// while the worker is paused are skipped.
+func (w *CleanupWorker) performDue(now time.Time) {
+	due := w.dueTables(now)
+	if len(due) > 0 && !w.IsPaused() {
+		w.performPass(cleanupPass{tables: due, thresholds: true})
+	}
+}
@@ -0,0 +1,335 @@
+// Cleanup_test.go
+// Description: Tests of the cleanup worker of the HTDB library
+// Interrupts compactions at every step like a crash and checks that recovery restores the table,
+// and that recovering a database in use leaves the compactions running in it alone
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompactionCrashRecovery(t *testing.T) {
+	tests := []struct {
+		name       string
+		step       compactionStep
+		occurrence int  // Stop at the n-th time the step is reached
+		compacted  bool // Whether recovery rolls the compaction forward
+	}{
+		{"temps written", compactionTempsWritten, 1, false},
+		{"journal written", compactionJournalWritten, 1, true},
+		{"ref file swapped", compactionFileSwapped, 1, true},
+		{"table file swapped", compactionFileSwapped, 2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db := openTestDB(t, path)
+			tm := db.GetTableManager()
+			table := createTestTable(t, db, "s", "t", noteFields)
+
+			want := make(map[int64]string)
+			for key := int64(0); key < 10; key++ {
+				record := insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "note": "first"})
+				for version := 0; version < 3; version++ {
+					note := fmt.Sprintf("note %d.%d", key, version)
+					var err error
+					record, err = tm.UpdateRecord(table, record, map[string]interface{}{"note": note})
+					if err != nil {
+						t.Fatalf("failed to update record: %v", err)
+					}
+					want[key] = note
+				}
+			}
+
+			worker := NewCleanupWorker(db, time.Hour)
+			reached := 0
+			worker.stepHook = func(step compactionStep) bool {
+				if step == test.step {
+					reached++
+				}
+				return step == test.step && reached == test.occurrence
+			}
+			err := worker.cleanupTable("s", "t", 0, &CleanupReport{})
+			if !errors.Is(err, errCompactionInterrupted) {
+				t.Fatalf("expected the compaction to be interrupted, got %v", err)
+			}
+			db.Close()
+
+			// Open recovers the interrupted compaction
+			db = openTestDB(t, path)
+			tm = db.GetTableManager()
+			table, err = tm.GetTable("s", "t")
+			if err != nil {
+				t.Fatalf("failed to get table: %v", err)
+			}
+
+			got := currentValues(t, tm, table)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("current records after recovery = %v, want %v", got, want)
+			}
+
+			all, err := tm.GetAllRecords(table)
+			if err != nil {
+				t.Fatalf("failed to read records: %v", err)
+			}
+			wantAll := 40
+			if test.compacted {
+				wantAll = 10
+			}
+			if len(all) != wantAll {
+				t.Errorf("table holds %d records after recovery, want %d", len(all), wantAll)
+			}
+
+			report, err := db.Verify()
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			if len(report.Problems) > 0 {
+				t.Errorf("verify found problems after recovery: %+v", report.Problems)
+			}
+
+			entries, err := db.storage().ReadDir(filepath.Join(path, "s"))
+			if err != nil {
+				t.Fatalf("failed to read schema directory: %v", err)
+			}
+			for _, entry := range entries {
+				if strings.HasSuffix(entry.Name(), ".temp") || strings.HasSuffix(entry.Name(), ".journal") {
+					t.Errorf("recovery left %s behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+// Restarting the worker must not touch files of a live database, the
+// compaction temporary files of a running compaction included
+func TestCleanupWorkerStartKeepsFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openTestDB(t, path)
+	tm := db.GetTableManager()
+	createTestTable(t, db, "s", "t", noteFields)
+
+	tempPath := filepath.Join(path, "s", "t.htdb.inflight"+compactionTempSuffix)
+	err := writeFile(db.storage(), tempPath, []byte("in progress"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write temporary file: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = tm.StartCleanupWorker(time.Hour)
+		if err != nil {
+			t.Fatalf("failed to start worker: %v", err)
+		}
+		err = tm.StopCleanupWorker()
+		if err != nil {
+			t.Fatalf("failed to stop worker: %v", err)
+		}
+	}
+
+	if _, err := db.storage().Stat(tempPath); err != nil {
+		t.Errorf("starting the worker removed a compaction file: %v", err)
+	}
+}
+
+// Surviving records must point at their ref values in the compacted ref file
+func TestCleanupKeepsRefContent(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	want := make(map[int64]string)
+	for key := int64(0); key < 60; key++ {
+		note := strings.Repeat(fmt.Sprint(key), int(key%7)+1)
+		record := insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "note": note})
+		switch key % 3 {
+		case 0:
+			err := tm.DeleteRecord(table, record)
+			if err != nil {
+				t.Fatalf("failed to delete record: %v", err)
+			}
+		case 1:
+			note = "updated " + note
+			_, err := tm.UpdateRecord(table, record, map[string]interface{}{"note": note})
+			if err != nil {
+				t.Fatalf("failed to update record: %v", err)
+			}
+			want[key] = note
+		default:
+			want[key] = note
+		}
+	}
+
+	report, err := tm.Compact()
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	if report.RecordsRemoved == 0 {
+		t.Fatalf("compaction removed no records")
+	}
+
+	got := currentValues(t, tm, table)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("current records after compaction = %v, want %v", got, want)
+	}
+	all, err := tm.GetAllRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if len(all) != len(want) {
+		t.Errorf("table holds %d records after compaction, want %d", len(all), len(want))
+	}
+}
+
+// Compaction streams the table, its memory use stays far below the size of
+// the files it rewrites
+func TestCleanupStreamsLargeTables(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	const records, noteSize = 2000, 16384
+	tx := tm.BeginTransaction()
+	for key := 0; key < records; key++ {
+		note := strings.Repeat(string(rune('a'+key%26)), noteSize)
+		_, err := tx.StageInsert(table, map[string]interface{}{"key": key, "note": note})
+		if err != nil {
+			t.Fatalf("failed to stage insert: %v", err)
+		}
+	}
+	err := tm.CommitTransaction(tx)
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	current, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	tx = tm.BeginTransaction()
+	for _, record := range current[:records/2] {
+		err = tx.StageDelete(table, record)
+		if err != nil {
+			t.Fatalf("failed to stage delete: %v", err)
+		}
+	}
+	err = tm.CommitTransaction(tx)
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	worker := NewCleanupWorker(db, time.Hour)
+	worker.SetCopyBufferSize(512)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	err = worker.cleanupTable("s", "t", 0, &CleanupReport{})
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	refSize := int64(records * noteSize)
+	if allocated := int64(after.TotalAlloc - before.TotalAlloc); allocated > refSize/4 {
+		t.Errorf("compaction allocated %d bytes for a ref file of %d bytes", allocated, refSize)
+	}
+	values := currentValues(t, tm, table)
+	if len(values) != records/2 {
+		t.Fatalf("table holds %d current records after compaction, want %d", len(values), records/2)
+	}
+	for key, note := range values {
+		if len(note) != noteSize || note[0] != byte('a'+key%26) {
+			t.Fatalf("record %d reads a note of %d bytes starting with %q", key, len(note), note[:1])
+		}
+	}
+}
+
+// Recover on a database in use waits for the compactions in flight instead of
+// taking their temporary files away
+func TestRecoverDuringCompactions(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	want := make(map[int64]string)
+	for key := int64(0); key < 200; key++ {
+		note := fmt.Sprint("note ", key)
+		insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "note": note})
+		want[key] = note
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 0; round < 20; round++ {
+			records, err := tm.GetCurrentRecords(table)
+			if err != nil {
+				t.Errorf("failed to read records: %v", err)
+				return
+			}
+			for _, record := range records[:20] {
+				_, err = tm.UpdateRecord(table, record, map[string]interface{}{"note": want[record.FieldsData["key"].(int64)]})
+				if err != nil {
+					t.Errorf("failed to update record: %v", err)
+					return
+				}
+			}
+			_, err = tm.Compact()
+			if err != nil {
+				t.Errorf("failed to compact: %v", err)
+				return
+			}
+		}
+	}()
+
+	for recovering := true; recovering; {
+		select {
+		case <-done:
+			recovering = false
+		default:
+		}
+		_, err := db.Recover()
+		if err != nil {
+			t.Fatalf("failed to recover: %v", err)
+		}
+	}
+
+	if got := currentValues(t, tm, table); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("current records after the compactions = %v, want %v", got, want)
+	}
+}
+
+// The journal of an archive rewrite is recovered with its table's files
+func TestRecoverArchiveCompaction(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	table := createTestTable(t, db, "s", "t", noteFields)
+	archive := table.archiveTable()
+	store := db.storage()
+
+	// Committed, but interrupted before the swap
+	final := archive.filePath()
+	temp, err := writeTempFile(store, final, compactionTempSuffix, []byte("archived"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write temporary file: %v", err)
+	}
+	journal := compactionJournal{Temps: []string{temp}, Finals: []string{final}}
+	err = writeCompactionJournal(store, compactionJournalPath(archive.SchemaPath, archive.TableName), journal, 0644)
+	if err != nil {
+		t.Fatalf("failed to write journal: %v", err)
+	}
+
+	_, err = db.Recover()
+	if err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	data, err := readFile(store, final)
+	if err != nil || string(data) != "archived" {
+		t.Errorf("archive file after recovery reads %q, %v, want the committed contents", data, err)
+	}
+}
@@ -0,0 +1,153 @@
+// Collation.go
+// Description: String collation for the HTDB library
+// Orders strings case and accent insensitively for sorting and comparisons, byte-wise by default
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Collation names how strings are ordered. The empty collation and
+// CollationBinary compare byte-wise. Any other name is a language tag such as
+// "en" or "de-AT" and orders strings by their letters first, ignoring case and
+// accents, then byte-wise, so "apple" < "Zebra" and "é" sorts with "e". Every
+// language currently folds the same way.
+type Collation string
+
+const CollationBinary Collation = "binary" // Byte-wise, the default
+
+// Collate sets the collation of the string comparisons and the sort of the
+// query, overriding the collations of the fields
+func (q *Query) Collate(name string) *Query {
+	q.collation = Collation(name)
+	return q
+}
+
+// folds reports whether the collation orders folded strings
+func (c Collation) folds() bool {
+	return c != "" && c != CollationBinary
+}
+
+// validate checks that the collation is binary or a language tag
+func (c Collation) validate() error {
+	if !c.folds() {
+		return nil
+	}
+	for i, part := range strings.Split(string(c), "-") {
+		valid := len(part) >= 1 && len(part) <= 8 && (i > 0 || len(part) >= 2)
+		for _, r := range part {
+			if r > unicode.MaxASCII || !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+				valid = false
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown collation '%s', use binary or a language tag such as en", c)
+		}
+	}
+	return nil
+}
+
+// validateFieldCollations checks that only string and ref fields have a
+// collation and that it is known
+func validateFieldCollations(fields []Field) error {
+	for _, field := range fields {
+		if field.Collation == "" {
+			continue
+		}
+		if field.Type != String && field.Type != "ref" {
+			return fmt.Errorf("field '%s' of type '%s' can't have a collation", field.Name, field.Type)
+		}
+		err := field.Collation.validate()
+		if err != nil {
+			return fmt.Errorf("field '%s': %v", field.Name, err)
+		}
+	}
+	return nil
+}
+
+// key returns the sort key of s. Keys of a folding collation compare
+// byte-wise in collation order and are equal only for equal strings.
+func (c Collation) key(s string) string {
+	if !c.folds() {
+		return s
+	}
+	return foldString(s) + "\x00" + s
+}
+
+// fieldCollation returns the collation of a field in the query
+func (q *Query) fieldCollation(name string) Collation {
+	if q.collation != "" {
+		return q.collation
+	}
+	for _, field := range q.table.Fields {
+		if field.Name == name {
+			return field.Collation
+		}
+	}
+	return ""
+}
+
+// collatedConditions returns the conditions with the collation of their field
+func (q *Query) collatedConditions(conditions []FilterCondition) []FilterCondition {
+	collated := make([]FilterCondition, len(conditions))
+	for i, condition := range conditions {
+		condition.collation = q.fieldCollation(condition.Field)
+		collated[i] = condition
+	}
+	return collated
+}
+
+// foldString lowercases s and strips the accents of Latin letters
+func foldString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		r = unicode.ToLower(r)
+		if folded, ok := foldedRunes[r]; ok {
+			b.WriteString(folded)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// foldedRunes maps lowercase accented Latin letters and ligatures to their base letters
+var foldedRunes = func() map[rune]string {
+	bases := map[string]string{
+		"a":  "àáâãäåāăą",
+		"c":  "çćĉċč",
+		"d":  "ďđð",
+		"e":  "èéêëēĕėęě",
+		"g":  "ĝğġģ",
+		"h":  "ĥħ",
+		"i":  "ìíîïĩīĭįı",
+		"j":  "ĵ",
+		"k":  "ķ",
+		"l":  "ĺļľŀł",
+		"n":  "ñńņňŉ",
+		"o":  "òóôõöøōŏő",
+		"r":  "ŕŗř",
+		"s":  "śŝşšſ",
+		"t":  "ţťŧ",
+		"u":  "ùúûüũūŭůűų",
+		"w":  "ŵ",
+		"y":  "ýÿŷ",
+		"z":  "źżž",
+		"ss": "ß",
+		"ae": "æ",
+		"oe": "œ",
+		"th": "þ",
+	}
+	runes := make(map[rune]string)
+	for base, accented := range bases {
+		for _, r := range accented {
+			runes[r] = base
+		}
+	}
+	return runes
+}()
@@ -0,0 +1,104 @@
+// CommitResult.go
+// Description: Commit summaries for the HTDB library
+// What a committed transaction wrote per table, for instrumentation without querying again
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"sort"
+	"time"
+)
+
+// CommitResult summarizes what a committed transaction wrote, see
+// Transaction.CommitResult
+type CommitResult struct {
+	TransactionID uint64
+	Tables        map[string]TableCommitResult // By schema:table
+	Duration      time.Duration                // Time spent writing the tables
+}
+
+// TableCommitResult is what a commit wrote to a single table
+type TableCommitResult struct {
+	Inserts      int
+	Updates      int
+	Deletes      int
+	BytesWritten int64         // Table file and appended ref data
+	Duration     time.Duration // Time spent on the table, waiting for its lock included
+}
+
+// Records returns the number of records the commit wrote to a table
+func (r TableCommitResult) Records() int {
+	return r.Inserts + r.Updates + r.Deletes
+}
+
+// Records returns the number of records the commit wrote to all tables
+func (r CommitResult) Records() int {
+	records := 0
+	for _, table := range r.Tables {
+		records += table.Records()
+	}
+	return records
+}
+
+// BytesWritten returns the number of bytes the commit wrote to all tables
+func (r CommitResult) BytesWritten() int64 {
+	var written int64
+	for _, table := range r.Tables {
+		written += table.BytesWritten
+	}
+	return written
+}
+
+// TableNames returns the tables the commit wrote to as schema:table, sorted
+func (r CommitResult) TableNames() []string {
+	names := make([]string, 0, len(r.Tables))
+	for name := range r.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CommitResult returns the summary of the transaction's commit. It reports
+// false until the transaction is committed. After-triggers and callers of
+// TableManager.CommitTransaction read it from the transaction.
+func (tx *Transaction) CommitResult() (CommitResult, bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.result == nil {
+		return CommitResult{}, false
+	}
+	return *tx.result, true
+}
+
+// countChanges counts the staged records of a table by operation
+func countChanges(records []*Record) TableCommitResult {
+	var result TableCommitResult
+	for _, record := range records {
+		switch {
+		case record.Metadata.IsDeleted:
+			result.Deletes++
+		case record.previousID != 0:
+			result.Updates++
+		default:
+			result.Inserts++
+		}
+	}
+	return result
+}
+
+// observe reports the counts of a commit to the metrics sink
+func (r CommitResult) observe(metrics MetricsSink) {
+	var inserts, updates, deletes int
+	for _, table := range r.Tables {
+		inserts += table.Inserts
+		updates += table.Updates
+		deletes += table.Deletes
+	}
+	metrics.Inc(MetricRecordsInserted, int64(inserts))
+	metrics.Inc(MetricRecordsUpdated, int64(updates))
+	metrics.Inc(MetricRecordsDeleted, int64(deletes))
+	metrics.Observe(MetricCommitBytes, float64(r.BytesWritten()))
+}
@@ -0,0 +1,164 @@
+// Compression.go
+// Description: Field compression for the HTDB library
+// Compresses long ref payloads in their side files and packs short values of string fields
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Compression selects how the values of a ref field are stored in its side
+// file, or of a string field in its slot
+type Compression string
+
+const (
+	CompressionNone   Compression = ""       // Values are stored as is
+	CompressionGzip   Compression = "gzip"   // Values are gzip compressed, only for ref fields
+	CompressionPacked Compression = "packed" // Values are stored behind their length, only for string fields
+)
+
+// A packed string field stores the length of its value in front of it, the
+// value can be up to the field length minus the prefix long. Values are
+// neither zero filled nor trimmed, they keep trailing zero bytes.
+const (
+	packedLengthSize = 2
+	maxPackedLength  = maxStringLength
+)
+
+// compressedHeaderSize is the size of the uncompressed length stored in front of
+// every compressed entry
+const compressedHeaderSize = 8
+
+// validateFieldCompression checks that gzip is only used on ref fields, packing
+// only on string fields with room for the length prefix
+func validateFieldCompression(fields []Field) error {
+	for _, f := range fields {
+		switch f.Compression {
+		case CompressionNone:
+		case CompressionGzip:
+			if f.Type != "ref" {
+				return fmt.Errorf("field '%s' of type '%s' can't be compressed, only ref fields can", f.Name, f.Type)
+			}
+		case CompressionPacked:
+			if f.Type != String {
+				return fmt.Errorf("field '%s' of type '%s' can't be packed, only string fields can", f.Name, f.Type)
+			}
+			if f.Length <= packedLengthSize || f.Length > maxPackedLength {
+				return fmt.Errorf("packed field '%s' must have a length of %d to %d bytes", f.Name, packedLengthSize+1, maxPackedLength)
+			}
+		default:
+			return fmt.Errorf("field '%s' uses unknown compression '%s'", f.Name, f.Compression)
+		}
+	}
+	return nil
+}
+
+// capacity returns how many bytes long the values of a field can be
+func (f Field) capacity() uint {
+	if f.Compression == CompressionPacked {
+		return f.Length - packedLengthSize
+	}
+	return f.Length
+}
+
+// putPackedString writes a value of a packed string field into its slot,
+// cut off at the field's capacity like unpacked values
+func putPackedString(slot []byte, value string) {
+	length := min(len(value), len(slot)-packedLengthSize)
+	binary.LittleEndian.PutUint16(slot, uint16(length))
+	copy(slot[packedLengthSize:], value[:length])
+}
+
+// packedStringLength returns the length of the value in the slot of a packed
+// string field, or false if it doesn't fit the slot
+func packedStringLength(slot []byte) (int, bool) {
+	length := int(binary.LittleEndian.Uint16(slot))
+	return length, length <= len(slot)-packedLengthSize
+}
+
+// encodeRefValue turns a ref value into the bytes stored in the side file.
+// Compressed entries start with the uncompressed length.
+func encodeRefValue(value string, compression Compression) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return []byte(value), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		header := make([]byte, compressedHeaderSize)
+		binary.LittleEndian.PutUint64(header, uint64(len(value)))
+		buf.Write(header)
+
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write([]byte(value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress ref value: %v", err)
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress ref value: %v", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", compression)
+	}
+}
+
+// decodeRefValue turns the bytes stored in the side file back into the ref value
+func decodeRefValue(data []byte, compression Compression) (string, error) {
+	switch compression {
+	case CompressionNone:
+		return string(data), nil
+	case CompressionGzip:
+		if len(data) < compressedHeaderSize {
+			return "", fmt.Errorf("compressed ref entry is too short")
+		}
+		length := binary.LittleEndian.Uint64(data[:compressedHeaderSize])
+
+		reader, err := gzip.NewReader(bytes.NewReader(data[compressedHeaderSize:]))
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress ref value: %v", err)
+		}
+		defer reader.Close()
+
+		value, err := io.ReadAll(reader)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress ref value: %v", err)
+		}
+		if uint64(len(value)) != length {
+			return "", fmt.Errorf("decompressed ref value has %d bytes, expected %d", len(value), length)
+		}
+		return string(value), nil
+	default:
+		return "", fmt.Errorf("unknown compression '%s'", compression)
+	}
+}
+
+// refFieldCompression reads the compression of a ref field from the table configuration.
+// A table without a readable configuration is treated as uncompressed.
+func refFieldCompression(schema, tableName, fieldName string) Compression {
+	tableConf, err := os.ReadFile(tableConfPath(schema, tableName))
+	if err != nil {
+		return CompressionNone
+	}
+
+	var table Table
+	err = json.Unmarshal(tableConf, &table)
+	if err != nil {
+		return CompressionNone
+	}
+
+	for _, field := range table.Fields {
+		if field.Name == fieldName {
+			return field.Compression
+		}
+	}
+	return CompressionNone
+}
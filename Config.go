@@ -0,0 +1,436 @@
+// Config.go
+// Description: Database-level configuration file of the HTDB library
+// Settings persisted in db.conf.htdb at the main path and applied by Open
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	configFileName       = "db.conf" + fileEnding
+	defaultSchemaName    = "testSchema" // Schema of table names without one when none is configured
+	durabilityNoneName   = "none"
+	durabilityFlushName  = "flush"
+	durabilityFsyncName  = "fsync"
+	configFileTempSuffix = ".temp"
+)
+
+// Config holds the settings of a database. Empty fields keep the built-in
+// defaults. Keys of the file this version doesn't know are kept when it is
+// written back, so a newer version's settings survive.
+type Config struct {
+	DefaultSchema      string `json:"default_schema,omitempty"`       // Schema of table names without one, "testSchema" if empty
+	Durability         string `json:"durability,omitempty"`           // "none", "flush" or "fsync"
+	CleanupInterval    string `json:"cleanup_interval,omitempty"`     // Go duration such as "1h", starts the cleanup worker on Open
+	CleanupMode        string `json:"cleanup_mode,omitempty"`         // "drop" or "archive", see CleanupMode
+	CleanupRetention   string `json:"cleanup_retention,omitempty"`    // Go duration, see CleanupPolicy.Retention
+	CleanupTTL         string `json:"cleanup_ttl,omitempty"`          // Go duration, see CleanupPolicy.TTL
+	CleanupConcurrency int    `json:"cleanup_concurrency,omitempty"`  // Tables compacted in parallel, see WithConcurrency
+	RecordCacheRecords int    `json:"record_cache_records,omitempty"` // See RecordCacheOptions.MaxRecords
+	RecordCacheBytes   int64  `json:"record_cache_bytes,omitempty"`   // See RecordCacheOptions.MaxBytes
+	MaxOpenFiles       int    `json:"max_open_files,omitempty"`       // See SetMaxOpenFiles
+	FileMode           string `json:"file_mode,omitempty"`            // Octal mode of new files such as "0600", see SetPermissions
+	DirMode            string `json:"dir_mode,omitempty"`             // Octal mode of new directories such as "0700", see SetPermissions
+
+	TableQuotas  map[string]int64 `json:"table_quotas,omitempty"`  // Bytes by "schema:table", see SetQuota
+	SchemaQuotas map[string]int64 `json:"schema_quotas,omitempty"` // Bytes by schema, see SetQuota
+
+	TableCleanupPolicies  map[string]CleanupPolicy `json:"table_cleanup_policies,omitempty"`  // By "schema:table", see SetCleanupPolicy
+	SchemaCleanupPolicies map[string]CleanupPolicy `json:"schema_cleanup_policies,omitempty"` // By schema, see SetCleanupPolicy
+
+	CompactionThreshold       float64            `json:"compaction_threshold,omitempty"`        // Dead record ratio, see SetCompactionThreshold
+	TableCompactionThresholds map[string]float64 `json:"table_compaction_thresholds,omitempty"` // Dead record ratio by "schema:table"
+
+	StagingLimit int `json:"staging_limit,omitempty"` // Staged records per table kept in memory, see SetStagingLimit
+
+	LayoutVersion int `json:"layout_version,omitempty"` // Set by Open and Migrate, see LayoutVersion
+
+	AttachedSchemas map[string]AttachedSchema `json:"attached_schemas,omitempty"` // Set by AttachSchema and DetachSchema
+
+	extra map[string]json.RawMessage // Unknown keys of the file
+}
+
+// configKeys are the JSON keys of the Config fields
+var configKeys = []string{"default_schema", "durability", "cleanup_interval", "cleanup_mode", "cleanup_retention",
+	"cleanup_ttl", "cleanup_concurrency", "record_cache_records", "record_cache_bytes", "max_open_files", "file_mode",
+	"dir_mode", "table_quotas", "schema_quotas", "table_cleanup_policies", "schema_cleanup_policies",
+	"compaction_threshold", "table_compaction_thresholds",
+	"staging_limit", "layout_version", "attached_schemas"}
+
+// configFields is Config without its methods, for encoding the known keys
+type configFields Config
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	known, err := json.Marshal(configFields(c))
+	if err != nil {
+		return nil, err
+	}
+	if len(c.extra) == 0 {
+		return known, nil
+	}
+
+	merged := make(map[string]json.RawMessage, len(c.extra))
+	for key, value := range c.extra {
+		merged[key] = value
+	}
+	err = json.Unmarshal(known, &merged)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(merged)
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	var fields configFields
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range configKeys {
+		delete(all, key)
+	}
+
+	*c = Config(fields)
+	if len(all) > 0 {
+		c.extra = all
+	}
+	return nil
+}
+
+// validate checks the values that must be parsed
+func (c Config) validate() error {
+	if c.Durability != "" {
+		if _, err := parseDurability(c.Durability); err != nil {
+			return err
+		}
+	}
+	if c.CleanupInterval != "" {
+		interval, err := time.ParseDuration(c.CleanupInterval)
+		if err != nil || interval < 0 {
+			return fmt.Errorf("invalid cleanup interval '%s'", c.CleanupInterval)
+		}
+	}
+	err := CleanupPolicy{Mode: c.CleanupMode, Retention: c.CleanupRetention, TTL: c.CleanupTTL}.validate()
+	if err != nil {
+		return err
+	}
+	for _, policies := range []map[string]CleanupPolicy{c.TableCleanupPolicies, c.SchemaCleanupPolicies} {
+		for name, policy := range policies {
+			if err := policy.validate(); err != nil {
+				return fmt.Errorf("cleanup policy of '%s': %w", name, err)
+			}
+		}
+	}
+	if c.CleanupConcurrency < 0 {
+		return fmt.Errorf("cleanup concurrency %d must not be negative", c.CleanupConcurrency)
+	}
+	if c.RecordCacheRecords < 0 || c.RecordCacheBytes < 0 || c.MaxOpenFiles < 0 {
+		return fmt.Errorf("cache sizes must not be negative")
+	}
+	for _, mode := range []string{c.FileMode, c.DirMode} {
+		if mode != "" {
+			if _, err := parseMode(mode); err != nil {
+				return err
+			}
+		}
+	}
+	for _, quotas := range []map[string]int64{c.TableQuotas, c.SchemaQuotas} {
+		for name, limit := range quotas {
+			if limit < 0 {
+				return fmt.Errorf("quota of '%s' must not be negative", name)
+			}
+		}
+	}
+	if c.CompactionThreshold < 0 || c.CompactionThreshold > 1 {
+		return fmt.Errorf("compaction threshold %v must be between 0 and 1", c.CompactionThreshold)
+	}
+	for name, threshold := range c.TableCompactionThresholds {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("compaction threshold of '%s' must be between 0 and 1", name)
+		}
+	}
+	if c.StagingLimit < 0 {
+		return fmt.Errorf("staging limit %d must not be negative", c.StagingLimit)
+	}
+	for name, attached := range c.AttachedSchemas {
+		if attached.Path == "" {
+			return fmt.Errorf("attached schema '%s' has no path", name)
+		}
+	}
+	return nil
+}
+
+// merge returns c with every non-empty field of override applied. The layout
+// version and the attached schemas are not settings and stay the ones of c.
+func (c Config) merge(override Config) Config {
+	if override.DefaultSchema != "" {
+		c.DefaultSchema = override.DefaultSchema
+	}
+	if override.Durability != "" {
+		c.Durability = override.Durability
+	}
+	if override.CleanupInterval != "" {
+		c.CleanupInterval = override.CleanupInterval
+	}
+	if override.CleanupMode != "" {
+		c.CleanupMode = override.CleanupMode
+	}
+	if override.CleanupRetention != "" {
+		c.CleanupRetention = override.CleanupRetention
+	}
+	if override.CleanupTTL != "" {
+		c.CleanupTTL = override.CleanupTTL
+	}
+	if override.CleanupConcurrency != 0 {
+		c.CleanupConcurrency = override.CleanupConcurrency
+	}
+	if override.RecordCacheRecords != 0 {
+		c.RecordCacheRecords = override.RecordCacheRecords
+	}
+	if override.RecordCacheBytes != 0 {
+		c.RecordCacheBytes = override.RecordCacheBytes
+	}
+	if override.MaxOpenFiles != 0 {
+		c.MaxOpenFiles = override.MaxOpenFiles
+	}
+	if override.FileMode != "" {
+		c.FileMode = override.FileMode
+	}
+	if override.DirMode != "" {
+		c.DirMode = override.DirMode
+	}
+	if override.TableQuotas != nil {
+		c.TableQuotas = override.TableQuotas
+	}
+	if override.SchemaQuotas != nil {
+		c.SchemaQuotas = override.SchemaQuotas
+	}
+	if override.TableCleanupPolicies != nil {
+		c.TableCleanupPolicies = override.TableCleanupPolicies
+	}
+	if override.SchemaCleanupPolicies != nil {
+		c.SchemaCleanupPolicies = override.SchemaCleanupPolicies
+	}
+	if override.CompactionThreshold != 0 {
+		c.CompactionThreshold = override.CompactionThreshold
+	}
+	if override.TableCompactionThresholds != nil {
+		c.TableCompactionThresholds = override.TableCompactionThresholds
+	}
+	if override.StagingLimit != 0 {
+		c.StagingLimit = override.StagingLimit
+	}
+	return c
+}
+
+// parseDurability parses the name of a durability level
+func parseDurability(name string) (Durability, error) {
+	switch name {
+	case durabilityNoneName:
+		return DurabilityNone, nil
+	case durabilityFlushName:
+		return DurabilityFlush, nil
+	case durabilityFsyncName:
+		return DurabilityFsync, nil
+	}
+	return DurabilityNone, fmt.Errorf("unknown durability '%s', use none, flush or fsync", name)
+}
+
+// Config returns the settings the database runs with
+func (db *HTDB) Config() Config {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	return db.config
+}
+
+// SetConfig applies config to the database and writes it to the config file,
+// replacing the file's settings. Unknown keys read from the file are kept.
+// Empty fields leave the running setting as it is.
+func (db *HTDB) SetConfig(config Config) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	if config.extra == nil {
+		config.extra = db.config.extra
+	}
+	config.LayoutVersion = db.config.LayoutVersion
+	config.AttachedSchemas = db.config.AttachedSchemas
+	err = writeConfig(db.storage(), db.mainPath, config, db.GetDurability())
+	if err != nil {
+		return err
+	}
+	return db.applyConfigLocked(config)
+}
+
+// loadConfig reads the config file, writes it on first use, and applies it
+// with override on top. The file is only rewritten with the override if save is set.
+func (db *HTDB) loadConfig(override *Config, save bool) error {
+	store := db.storage()
+	config, exists, err := readConfig(store, db.mainPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		config.LayoutVersion, err = db.detectLayoutVersion()
+		if err != nil {
+			return err
+		}
+	}
+
+	var merged Config
+	if override != nil {
+		err = override.validate()
+		if err != nil {
+			return err
+		}
+		merged = config.merge(*override)
+	} else {
+		merged = config
+	}
+
+	if !exists || save {
+		err = writeConfig(store, db.mainPath, merged, DurabilityFlush)
+		if err != nil && !errors.Is(err, ErrReadOnly) {
+			return err
+		}
+	}
+
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	return db.applyConfigLocked(merged)
+}
+
+// applyConfigLocked makes config the running configuration. The caller must hold configMu.
+func (db *HTDB) applyConfigLocked(config Config) error {
+	if config.Durability != "" {
+		durability, _ := parseDurability(config.Durability)
+		db.SetDurability(durability)
+	}
+	if config.MaxOpenFiles != 0 {
+		db.SetMaxOpenFiles(config.MaxOpenFiles)
+	}
+	if config.RecordCacheRecords != 0 || config.RecordCacheBytes != 0 {
+		db.tableManager.SetRecordCache(RecordCacheOptions{
+			MaxRecords: config.RecordCacheRecords,
+			MaxBytes:   config.RecordCacheBytes,
+		})
+	}
+
+	if config.CleanupInterval != "" && config.CleanupInterval != db.config.CleanupInterval {
+		interval, _ := time.ParseDuration(config.CleanupInterval)
+		tm := db.tableManager
+		if tm.cleanupWorker.Load() != nil {
+			err := tm.StopCleanupWorker()
+			if err != nil {
+				return err
+			}
+		}
+		if interval > 0 {
+			err := tm.StartCleanupWorker(interval)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	db.setAttached(config.AttachedSchemas)
+	db.usage.reset() // Usage isn't tracked without quotas, it may be outdated
+	db.config = config
+
+	// Cleanup intervals may have changed, the worker plans its next runs again
+	if worker := db.tableManager.cleanupWorker.Load(); worker != nil {
+		worker.reschedule()
+	}
+	return nil
+}
+
+// defaultSchema returns the schema of table names without one
+func (db *HTDB) defaultSchema() string {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	if db.config.DefaultSchema == "" {
+		return defaultSchemaName
+	}
+	return db.config.DefaultSchema
+}
+
+// readConfig reads the config file of a database, reporting whether it exists
+func readConfig(store Storage, mainPath string) (Config, bool, error) {
+	var config Config
+	data, err := readFile(store, filepath.Join(mainPath, configFileName))
+	if os.IsNotExist(err) {
+		return config, false, nil
+	}
+	if err != nil {
+		return config, false, fmt.Errorf("failed to read database configuration: %w", err)
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, true, fmt.Errorf("%w: invalid database configuration: %v", ErrCorrupt, err)
+	}
+	err = config.validate()
+	if err != nil {
+		return config, true, fmt.Errorf("%w: invalid database configuration: %v", ErrCorrupt, err)
+	}
+	return config, true, nil
+}
+
+// writeConfig replaces the config file of a database through a temporary file
+func writeConfig(store Storage, mainPath string, config Config, durability Durability) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode database configuration: %w", err)
+	}
+
+	path := filepath.Join(mainPath, configFileName)
+	tempPath := path + configFileTempSuffix
+	file, err := createFile(store, tempPath, config.fileMode())
+	if err != nil {
+		return fmt.Errorf("failed to write database configuration: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil && durability >= DurabilityFlush {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = store.Rename(tempPath, path)
+	}
+	if err == nil && durability >= DurabilityFsync {
+		err = store.SyncDir(mainPath)
+	}
+	if err != nil {
+		store.Remove(tempPath)
+		return fmt.Errorf("failed to write database configuration: %w", err)
+	}
+	return nil
+}
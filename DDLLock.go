@@ -0,0 +1,195 @@
+// DDLLock.go
+// Description: Locking of table definitions for the HTDB library
+// Structure changes wait for in-flight commits on their table and block new ones
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultDDLTimeout is how long a structure change waits for commits unless SetDDLTimeout was called
+const defaultDDLTimeout = 30 * time.Second
+
+// ddlLocks coordinates structure changes (CreateTable, AlterTable, dropping a
+// table) with commits. A commit holds its tables shared from the first written
+// record to the last, a structure change holds its table exclusively. Every
+// structure change bumps the table's generation, so records staged against an
+// older definition are refused at commit instead of being written in the
+// wrong layout.
+type ddlLocks struct {
+	tables map[string]*ddlState // By cleaned table file path, see tableCacheKey
+	mu     sync.Mutex
+}
+
+// ddlState is the lock state of a single table
+type ddlState struct {
+	commits    int           // Commits writing the table right now
+	ddl        bool          // A structure change holds or waits for the table
+	generation uint64        // Number of structure changes so far
+	changed    chan struct{} // Closed and replaced whenever commits or ddl change
+}
+
+// newDDLLocks creates the DDL locks of a database
+func newDDLLocks() *ddlLocks {
+	return &ddlLocks{tables: make(map[string]*ddlState)}
+}
+
+// SetDDLTimeout sets how long CreateTable, AlterTable and dropping a table wait
+// for commits on the table to finish. Zero (the default) waits 30 seconds.
+func (db *HTDB) SetDDLTimeout(timeout time.Duration) {
+	db.ddlTimeout.Store(int64(timeout))
+}
+
+// stateLocked returns the state of a table, creating it. The mutex must be held.
+func (l *ddlLocks) stateLocked(key string) *ddlState {
+	state, exists := l.tables[key]
+	if !exists {
+		state = &ddlState{changed: make(chan struct{})}
+		l.tables[key] = state
+	}
+	return state
+}
+
+// signalLocked wakes everyone waiting for a change of state. The mutex must be held.
+func (s *ddlState) signalLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// generation returns the number of structure changes of a table so far
+func (l *ddlLocks) generation(key string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stateLocked(key).generation
+}
+
+// beginCommit holds the tables shared for a commit, waiting while a structure
+// change holds or waits for any of them. It returns the generation of every
+// table. endCommit must be called afterwards.
+func (l *ddlLocks) beginCommit(keys []string) map[string]uint64 {
+	for {
+		l.mu.Lock()
+		var wait chan struct{}
+		for _, key := range keys {
+			state := l.stateLocked(key)
+			if state.ddl {
+				wait = state.changed
+				break
+			}
+		}
+		if wait == nil {
+			generations := make(map[string]uint64, len(keys))
+			for _, key := range keys {
+				state := l.stateLocked(key)
+				state.commits++
+				generations[key] = state.generation
+			}
+			l.mu.Unlock()
+			return generations
+		}
+		l.mu.Unlock()
+		<-wait
+	}
+}
+
+// endCommit releases the tables held by beginCommit
+func (l *ddlLocks) endCommit(keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		state := l.stateLocked(key)
+		state.commits--
+		if state.commits == 0 {
+			state.signalLocked()
+		}
+	}
+}
+
+// lockTable holds a table exclusively for a structure change. New commits on
+// the table are blocked right away, then it waits up to timeout for the running
+// ones to finish. The returned function releases the table and bumps its generation.
+func (l *ddlLocks) lockTable(key string, timeout time.Duration) (func(), error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	l.mu.Lock()
+	state := l.stateLocked(key)
+	claimed := false
+	for {
+		if !claimed && !state.ddl {
+			state.ddl = true // Keep new commits out while the running ones drain
+			claimed = true
+		}
+		if claimed && state.commits == 0 {
+			break
+		}
+
+		wait := state.changed
+		l.mu.Unlock()
+		select {
+		case <-wait:
+			l.mu.Lock()
+		case <-timer.C:
+			l.mu.Lock()
+			if claimed {
+				state.ddl = false
+				state.signalLocked()
+			}
+			commits := state.commits
+			l.mu.Unlock()
+			return nil, fmt.Errorf("%w: %d commits still running after %v", ErrDDLTimeout, commits, timeout)
+		}
+	}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			state.ddl = false
+			state.generation++
+			state.signalLocked()
+		})
+	}, nil
+}
+
+// lockTableDDL holds the table of a structure change, see ddlLocks.lockTable
+func (db *HTDB) lockTableDDL(tablePath string) (func(), error) {
+	timeout := time.Duration(db.ddlTimeout.Load())
+	if timeout <= 0 {
+		timeout = defaultDDLTimeout
+	}
+	unlock, err := db.ddl.lockTable(filepath.Clean(tablePath), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		unlock()
+		db.usage.invalidate(filepath.Dir(tablePath)) // The tables of the schema changed
+	}, nil
+}
+
+// commitKeys returns the sorted, distinct DDL lock keys of the staged tables
+func (tx *Transaction) commitKeys() []string {
+	seen := make(map[string]bool, len(tx.stagedTables))
+	keys := make([]string, 0, len(tx.stagedTables))
+	for _, table := range tx.stagedTables {
+		key := tableCacheKey(table)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
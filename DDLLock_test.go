@@ -0,0 +1,136 @@
+// DDLLock_test.go
+// Description: Tests of the table definition locks of the HTDB library
+// Structure changes interleaved with inserts must leave every table consistent,
+// index changes refuse records staged before them like any other change
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStructureChangesDuringInserts(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	createTestTable(t, db, "s", "t", noteFields)
+
+	const writers, inserts = 4, 30
+	want := make(map[int64]string)
+	var wantMu sync.Mutex
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < inserts; i++ {
+				key := int64(writer*inserts + i)
+				note := fmt.Sprintf("note %d", key)
+				for {
+					table, err := tm.GetTable("s", "t")
+					if err != nil {
+						t.Errorf("failed to get table: %v", err)
+						return
+					}
+					_, err = tm.InsertRecord(table, map[string]interface{}{"key": key, "note": note})
+					if errors.Is(err, ErrSchemaChanged) {
+						continue // Staged against the definition before a change
+					}
+					if err != nil {
+						t.Errorf("failed to insert record: %v", err)
+						return
+					}
+					break
+				}
+				wantMu.Lock()
+				want[key] = note
+				wantMu.Unlock()
+			}
+		}(writer)
+	}
+
+	extra := Field{Name: "extra", Type: Int, Length: 8}
+	for round := 0; round < 10; round++ {
+		table, err := tm.GetTable("s", "t")
+		if err != nil {
+			t.Fatalf("failed to get table: %v", err)
+		}
+		fields := noteFields
+		if round%2 == 0 {
+			fields = append(append([]Field{}, noteFields...), extra)
+		}
+		err = tm.alterTable(table, fields)
+		if err != nil {
+			t.Fatalf("failed to alter table: %v", err)
+		}
+
+		table, err = tm.GetTable("s", "t")
+		if err != nil {
+			t.Fatalf("failed to get table: %v", err)
+		}
+		kind := IndexFullText
+		if round%2 == 1 {
+			kind = IndexNone
+		}
+		err = tm.CreateIndex(table, "note", kind)
+		if err != nil {
+			t.Fatalf("failed to change index: %v", err)
+		}
+	}
+	wg.Wait()
+
+	table, err := tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	got := currentValues(t, tm, table)
+	if len(got) != writers*inserts || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("table holds %d records after the changes, want %d", len(got), writers*inserts)
+	}
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if len(report.Problems) > 0 {
+		t.Errorf("verify found problems: %+v", report.Problems)
+	}
+}
+
+// Commits keep the indexes of the definition they were staged against, a
+// record staged before an index change is refused instead of missing from it
+func TestIndexChangeRefusesStagedRecords(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	tx := tm.BeginTransaction()
+	_, err := tx.StageInsert(table, map[string]interface{}{"key": 1, "note": "staged before"})
+	if err != nil {
+		t.Fatalf("failed to stage insert: %v", err)
+	}
+	indexed, err := tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	err = tm.CreateIndex(indexed, "note", IndexFullText)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	err = tm.CommitTransaction(tx)
+	if !errors.Is(err, ErrSchemaChanged) {
+		t.Errorf("commit staged before the index change returned %v, want %v", err, ErrSchemaChanged)
+	}
+
+	insertTestRecord(t, tm, indexed, map[string]interface{}{"key": 2, "note": "inserted after"})
+	records, err := tm.Select(indexed).Match("note", "inserted").GetAll()
+	if err != nil {
+		t.Fatalf("failed to match records: %v", err)
+	}
+	if len(records) != 1 || records[0].FieldsData["key"] != int64(2) {
+		t.Errorf("match returned %d records, want the one inserted after the change", len(records))
+	}
+}
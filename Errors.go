@@ -0,0 +1,179 @@
+// Errors.go
+// Description: Error values of the HTDB library
+// Sentinels to test for with errors.Is and error types carrying the context of a failure
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// Sentinel errors, test for them with errors.Is
+var (
+	ErrNotFound           = errors.New("record not found")
+	ErrTableNotFound      = errors.New("table not found")
+	ErrSchemaNotFound     = errors.New("schema not found")
+	ErrFieldNotFound      = errors.New("field not found")
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrLocked             = errors.New("record is locked")
+	ErrTxNotActive        = errors.New("transaction is not active")
+	ErrWriteConflict      = errors.New("write conflict")
+	ErrCorrupt            = errors.New("data is corrupt")
+	ErrValidation         = errors.New("validation failed") // Matched by every ValidationError
+	ErrTruncatedTable     = errors.New("table file ends in a partial record")
+	ErrClosed             = errors.New("database is closed")
+	ErrDDLTimeout         = errors.New("timed out waiting for commits on the table")
+	ErrUnsupportedVersion = errors.New("unsupported layout version")
+	ErrQuotaExceeded      = errors.New("quota exceeded")
+	ErrSnapshotNotFound   = errors.New("snapshot not found")
+	ErrSchemaMismatch     = errors.New("table configuration doesn't match its records")
+	ErrTemplateNotFound   = errors.New("template not found")
+	ErrOutOfScope         = errors.New("record is outside of the scope") // See TableManager.Scoped
+	ErrInvalidHandle      = errors.New("invalid record handle")          // See Record.Handle
+	ErrRefDataMissing     = errors.New("ref data is missing")            // The ref file lost the value, e.g. it was deleted
+	ErrSchemaChanged      = errors.New("table definition changed")       // The table changed after records were staged for it
+)
+
+// ErrReadOnly is returned for writes to a read-only storage, it also matches fs.ErrPermission
+var ErrReadOnly error = &aliasError{message: "storage is read-only", alias: fs.ErrPermission}
+
+// ErrVersionMismatch is returned for updates and deletes of a record version
+// that is no longer the stored one, see Record.Version. It also matches ErrWriteConflict.
+var ErrVersionMismatch error = &aliasError{message: "record version mismatch", alias: ErrWriteConflict}
+
+// aliasError is a sentinel that also matches another sentinel with errors.Is
+type aliasError struct {
+	message string
+	alias   error
+}
+
+func (e *aliasError) Error() string {
+	return e.message
+}
+
+func (e *aliasError) Is(target error) bool {
+	return target == e.alias
+}
+
+// TableError is a failure concerning a table
+type TableError struct {
+	Schema string
+	Table  string
+	Err    error
+}
+
+func (e *TableError) Error() string {
+	return fmt.Sprintf("table '%s' in schema '%s': %v", e.Table, e.Schema, e.Err)
+}
+
+func (e *TableError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is a failure concerning a field of a table
+type FieldError struct {
+	Schema string
+	Table  string
+	Field  string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field '%s' of table '%s': %v", e.Field, e.Table, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// RecordError is a failure concerning a single record of a table
+type RecordError struct {
+	Schema string
+	Table  string
+	ID     int64
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("record %d: %v", e.ID, e.Err)
+	}
+	return fmt.Sprintf("record %d of table '%s': %v", e.ID, e.Table, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// LockError is returned when a record is locked by another transaction. It matches ErrLocked.
+type LockError struct {
+	ID            int64  // Id of the locked record
+	TransactionID uint64 // Transaction holding the lock
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("record is locked by another transaction: %d", e.TransactionID)
+}
+
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// TruncatedTableError is returned by scans of a table file that ends in a
+// partial record, most likely a torn write. The whole records before it were
+// returned. It matches ErrTruncatedTable, Recover truncates the partial record.
+type TruncatedTableError struct {
+	Schema   string
+	Table    string
+	Offset   int64 // Byte offset of the partial record
+	Leftover int64 // Length of the partial record in bytes
+}
+
+func (e *TruncatedTableError) Error() string {
+	return fmt.Sprintf("table '%s' in schema '%s' ends in a partial record of %d bytes at offset %d",
+		e.Table, e.Schema, e.Leftover, e.Offset)
+}
+
+func (e *TruncatedTableError) Is(target error) bool {
+	return target == ErrTruncatedTable
+}
+
+// QuotaError is returned by a commit that would make a table or a schema
+// exceed its quota, see SetQuota. It matches ErrQuotaExceeded.
+type QuotaError struct {
+	Schema string
+	Table  string // Empty if the quota of the schema was exceeded
+	Limit  int64  // Quota in bytes
+	Usage  int64  // Bytes used before the commit
+	Added  int64  // Bytes the commit would have added
+}
+
+func (e *QuotaError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("quota of schema '%s' exceeded: %d of %d bytes used, commit adds %d", e.Schema, e.Usage, e.Limit, e.Added)
+	}
+	return fmt.Sprintf("quota of table '%s' in schema '%s' exceeded: %d of %d bytes used, commit adds %d",
+		e.Table, e.Schema, e.Usage, e.Limit, e.Added)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// newTableError wraps err with the schema and table of t
+func newTableError(t *Table, err error) error {
+	return &TableError{Schema: t.schemaName(), Table: t.TableName, Err: err}
+}
+
+// newFieldError wraps err with the schema, table and field it concerns
+func newFieldError(t *Table, field string, err error) error {
+	return &FieldError{Schema: t.schemaName(), Table: t.TableName, Field: field, Err: err}
+}
+
+// newRecordError wraps err with the schema, table and id of the record it concerns
+func newRecordError(t *Table, id int64, err error) error {
+	return &RecordError{Schema: t.schemaName(), Table: t.TableName, ID: id, Err: err}
+}
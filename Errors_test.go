@@ -0,0 +1,120 @@
+// Errors_test.go
+// Description: Tests of the error values of the HTDB library
+// Failures of the public API match their sentinel with errors.Is and carry their context
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPublicErrorsMatchSentinels(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	record := insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "value"})
+
+	tests := []struct {
+		name     string
+		call     func() error
+		sentinel error
+	}{
+		{"missing schema", func() error {
+			_, err := db.Schema("nope")
+			return err
+		}, ErrSchemaNotFound},
+		{"missing table", func() error {
+			_, err := tm.GetTable("s", "nope")
+			return err
+		}, ErrTableNotFound},
+		{"existing table", func() error {
+			s, _ := db.Schema("s")
+			return s.CreateTable("t", noteFields)
+		}, ErrAlreadyExists},
+		{"missing record", func() error {
+			_, err := tm.GetRecordByID(table, record.ID+1)
+			return err
+		}, ErrNotFound},
+		{"unknown field", func() error {
+			_, err := tm.InsertRecord(table, map[string]interface{}{"key": 2, "nope": 1})
+			return err
+		}, ErrFieldNotFound},
+		{"invalid value", func() error {
+			_, err := tm.InsertRecord(table, map[string]interface{}{"key": "two"})
+			return err
+		}, ErrValidation},
+		{"locked record", func() error {
+			owner := tm.BeginTransaction()
+			defer owner.Rollback()
+			err := owner.LockRecord(table, record)
+			if err != nil {
+				return err
+			}
+			tx := tm.BeginTransaction()
+			defer tx.Rollback()
+			return tx.LockRecord(table, record)
+		}, ErrLocked},
+		{"committed transaction", func() error {
+			tx := tm.BeginTransaction()
+			err := tx.Commit()
+			if err != nil {
+				return err
+			}
+			_, err = tx.StageInsert(table, map[string]interface{}{"key": 2})
+			return err
+		}, ErrTxNotActive},
+		{"outdated version", func() error {
+			version := record.Version()
+			_, err := tm.UpdateRecord(table, record, map[string]interface{}{"note": "first"})
+			if err != nil {
+				return err
+			}
+			_, err = tm.UpdateRecordIfVersion(table, record, map[string]interface{}{"note": "second"}, version)
+			return err
+		}, ErrWriteConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if !errors.Is(err, test.sentinel) {
+				t.Errorf("expected %v, got %v", test.sentinel, err)
+			}
+		})
+	}
+}
+
+func TestRecordErrorContext(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	_, err := tm.GetRecordByID(table, 42)
+	var recordErr *RecordError
+	if !errors.As(err, &recordErr) {
+		t.Fatalf("expected a RecordError, got %v", err)
+	}
+	if recordErr.Schema != "s" || recordErr.Table != "t" || recordErr.ID != 42 {
+		t.Errorf("record error carries %+v, want record 42 of s:t", recordErr)
+	}
+}
+
+func TestResponseUnwrapsToSentinel(t *testing.T) {
+	for status, sentinel := range map[int]error{
+		StatusSchenaDoesntExist:  ErrSchemaNotFound,
+		StatusTableDoesntExist:   ErrTableNotFound,
+		StatusRecordDoesntExist:  ErrNotFound,
+		StatusTableAlreadyExists: ErrAlreadyExists,
+		StatusConflict:           ErrWriteConflict,
+		StatusLocked:             ErrLocked,
+	} {
+		var err error = NewResponse(status, "message")
+		if !errors.Is(err, sentinel) {
+			t.Errorf("response %d doesn't match %v", status, sentinel)
+		}
+		if StatusOf(err) != status {
+			t.Errorf("StatusOf(response %d) = %d", status, StatusOf(err))
+		}
+	}
+}
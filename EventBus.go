@@ -0,0 +1,342 @@
+// EventBus.go
+// Description: Post-commit publish/subscribe for the HTDB library
+// Hands committed changes to in-process subscribers filtered by "schema:table" patterns
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultSubscriptionBuffer = 256 // Events buffered per subscriber when no size is set
+
+// ChangeEvent is a committed change of a record delivered to subscribers
+type ChangeEvent struct {
+	TransactionID uint64
+	Actor         string            // See Transaction.SetActor
+	Tags          map[string]string // See Transaction.SetTag, shared by the events of a transaction and must not be modified
+	Op            ChangeOp
+	Schema        string
+	Table         string
+	RecordID      int64                  // Id of the written version
+	PreviousID    int64                  // Id of the version it replaces, for updates and deletes
+	Values        map[string]interface{} // New field values, null fields as nil. Nil for deletes and with OmitValues.
+	Time          time.Time              // When the transaction committed
+}
+
+// QualifiedTable returns the table of the change as "schema:table"
+func (e ChangeEvent) QualifiedTable() string {
+	return e.Schema + ":" + e.Table
+}
+
+// StaleID returns the id a cache keyed by record id has to drop. Every write
+// gives the record a new id, so this is the replaced version for updates and
+// deletes and the written one for inserts.
+func (e ChangeEvent) StaleID() int64 {
+	if e.Op == ChangeInsert {
+		return e.RecordID
+	}
+	return e.PreviousID
+}
+
+// SubscribeOptions configures Subscribe and SubscribeSync
+type SubscribeOptions struct {
+	BufferSize int  // Events buffered for the subscriber, defaults to 256. Unused by SubscribeSync.
+	OmitValues bool // Leave Values nil, the events only tell which records changed
+}
+
+// Subscription is a registered subscriber of the event bus
+type Subscription struct {
+	bus        *eventBus
+	pattern    subscriptionPattern
+	handler    func(ChangeEvent)
+	omitValues bool
+	sync       bool             // Called by the committing goroutine, see SubscribeSync
+	events     chan ChangeEvent // Nil for synchronous subscriptions
+	done       chan struct{}    // Closed once the delivery goroutine returned
+	dropped    atomic.Uint64
+	panics     atomic.Uint64
+	closed     bool // Guarded by the bus mutex
+}
+
+// subscriptionPattern is a parsed "schema:table" pattern
+type subscriptionPattern struct {
+	schema string
+	table  string
+}
+
+// eventBus holds the subscriptions of a database
+type eventBus struct {
+	db            *HTDB
+	subscriptions []*Subscription
+	mu            sync.RWMutex
+}
+
+// newEventBus creates the event bus of a database
+func newEventBus(db *HTDB) *eventBus {
+	return &eventBus{db: db}
+}
+
+// Subscribe calls handler for every committed change of the tables matching
+// pattern. A pattern is "schema:table" where either side may be a glob such as
+// "*", e.g. "shop:*" or "*:orders". "*" alone matches every table.
+//
+// Events are delivered once the transaction is committed and its files were
+// written with the configured durability, in commit order, on a goroutine of
+// the subscription. Each subscriber has its own buffer; when it is full the
+// event is dropped for that subscriber and counted in Dropped, so a slow
+// subscriber never stalls commits. A panicking handler is recovered and the
+// subscription keeps running.
+func (db *HTDB) Subscribe(pattern string, options SubscribeOptions, handler func(ChangeEvent)) (*Subscription, error) {
+	return db.subscribe(pattern, options, handler, false)
+}
+
+// SubscribeSync calls handler for every committed change of the tables
+// matching pattern like Subscribe, but on the goroutine committing the
+// transaction, for callers that must invalidate caches before a commit is
+// acknowledged. For a transaction the order is:
+//
+//  1. its files are written with the configured durability
+//  2. the synchronous handlers run, in commit order and never concurrently
+//  3. its events are queued for the subscribers of Subscribe
+//  4. CommitTransaction returns, then the after-triggers run
+//
+// So a reader that saw CommitTransaction return, or got the change from
+// Subscribe, never finds a cache the handler hasn't invalidated yet. Commits
+// of every table wait for the handlers, which must be quick and must not
+// commit, roll back, subscribe or close subscriptions themselves. A panic is
+// recovered and counted in Panics, the commit still succeeds.
+func (db *HTDB) SubscribeSync(pattern string, options SubscribeOptions, handler func(ChangeEvent)) (*Subscription, error) {
+	return db.subscribe(pattern, options, handler, true)
+}
+
+// subscribe registers a subscription, see Subscribe and SubscribeSync
+func (db *HTDB) subscribe(pattern string, options SubscribeOptions, handler func(ChangeEvent), synchronous bool) (*Subscription, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("subscription handler is nil")
+	}
+	parsed, err := parseSubscriptionPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{
+		bus:        db.events,
+		pattern:    parsed,
+		handler:    handler,
+		omitValues: options.OmitValues,
+		sync:       synchronous,
+		done:       make(chan struct{}),
+	}
+	if synchronous {
+		close(sub.done)
+	} else {
+		bufferSize := options.BufferSize
+		if bufferSize <= 0 {
+			bufferSize = defaultSubscriptionBuffer
+		}
+		sub.events = make(chan ChangeEvent, bufferSize)
+		go sub.deliver()
+	}
+
+	db.events.mu.Lock()
+	db.events.subscriptions = append(db.events.subscriptions, sub)
+	db.events.mu.Unlock()
+	return sub, nil
+}
+
+// parseSubscriptionPattern splits and checks a "schema:table" pattern
+func parseSubscriptionPattern(pattern string) (subscriptionPattern, error) {
+	if pattern == "*" {
+		return subscriptionPattern{schema: "*", table: "*"}, nil
+	}
+
+	schema, table, found := strings.Cut(pattern, ":")
+	if !found || schema == "" || table == "" || strings.Contains(table, ":") {
+		return subscriptionPattern{}, fmt.Errorf("invalid subscription pattern '%s', expected schema:table", pattern)
+	}
+	for _, part := range []string{schema, table} {
+		if _, err := path.Match(part, ""); err != nil {
+			return subscriptionPattern{}, fmt.Errorf("invalid subscription pattern '%s': %v", pattern, err)
+		}
+	}
+	return subscriptionPattern{schema: schema, table: table}, nil
+}
+
+// matches reports whether the pattern covers a table
+func (p subscriptionPattern) matches(schema, table string) bool {
+	schemaMatch, _ := path.Match(p.schema, schema)
+	tableMatch, _ := path.Match(p.table, table)
+	return schemaMatch && tableMatch
+}
+
+// deliver hands buffered events to the handler until the subscription is closed
+func (s *Subscription) deliver() {
+	defer close(s.done)
+	for event := range s.events {
+		s.call(event)
+	}
+}
+
+// call runs the handler for a single event, recovering from panics
+func (s *Subscription) call(event ChangeEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.panics.Add(1)
+			s.bus.db.log(slog.LevelError, "subscriber panicked",
+				"schema", event.Schema, "table", event.Table, "error", fmt.Sprint(r))
+		}
+	}()
+	s.handler(event)
+}
+
+// Dropped returns the number of events dropped because the buffer was full,
+// always zero for synchronous subscriptions
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Panics returns the number of events whose handler panicked
+func (s *Subscription) Panics() uint64 {
+	return s.panics.Load()
+}
+
+// Close unsubscribes. Events published before Close are still delivered and
+// Close waits until the handler has processed them, so it must not be called
+// from the handler itself. Closing twice is a no-op.
+func (s *Subscription) Close() error {
+	s.bus.mu.Lock()
+	if s.closed {
+		s.bus.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	s.closed = true
+	for i, sub := range s.bus.subscriptions {
+		if sub == s {
+			s.bus.subscriptions = append(s.bus.subscriptions[:i], s.bus.subscriptions[i+1:]...)
+			break
+		}
+	}
+	if s.events != nil {
+		close(s.events)
+	}
+	s.bus.mu.Unlock()
+
+	<-s.done
+	return nil
+}
+
+// publish hands the changes of a committed transaction to the matching
+// subscribers, the synchronous ones first
+func (b *eventBus) publish(tx *Transaction) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.subscriptions) == 0 {
+		return
+	}
+
+	// Values are only collected if a subscriber wants them
+	withValues := false
+	for _, sub := range b.subscriptions {
+		withValues = withValues || !sub.omitValues
+	}
+	events := changeEvents(tx, withValues)
+
+	for _, synchronous := range []bool{true, false} {
+		for _, event := range events {
+			for _, sub := range b.subscriptions {
+				if sub.sync != synchronous || !sub.pattern.matches(event.Schema, event.Table) {
+					continue
+				}
+				delivered := event
+				if sub.omitValues {
+					delivered.Values = nil
+				}
+				if synchronous {
+					sub.call(delivered)
+					continue
+				}
+				select {
+				case sub.events <- delivered:
+				default:
+					sub.dropped.Add(1)
+				}
+			}
+		}
+	}
+}
+
+// closeAll closes every subscription
+func (b *eventBus) closeAll() {
+	b.mu.RLock()
+	subscriptions := append([]*Subscription(nil), b.subscriptions...)
+	b.mu.RUnlock()
+
+	for _, sub := range subscriptions {
+		sub.Close()
+	}
+}
+
+// changeEvents builds the events of a committed transaction, ordered by schema,
+// table name and then by staging order
+func changeEvents(tx *Transaction, withValues bool) []ChangeEvent {
+	tableNames := make([]string, 0, len(tx.StagedRecords))
+	for tableName := range tx.StagedRecords {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+
+	now := time.Now().UTC()
+	tx.mu.Lock()
+	actor, tags := tx.actor, tx.copyTags()
+	tx.mu.Unlock()
+
+	var events []ChangeEvent
+	for _, tableName := range tableNames {
+		table := tx.stagedTables[tableName]
+		if table == nil {
+			continue
+		}
+		schema := filepath.Base(table.SchemaPath)
+
+		for _, record := range tx.StagedRecords[tableName] {
+			event := ChangeEvent{
+				TransactionID: tx.ID,
+				Actor:         actor,
+				Tags:          tags,
+				Op:            ChangeInsert,
+				Schema:        schema,
+				Table:         table.TableName,
+				RecordID:      record.ID,
+				PreviousID:    record.previousID,
+				Time:          now,
+			}
+			if record.Metadata.IsDeleted {
+				event.Op = ChangeDelete
+			} else {
+				if record.previousID != 0 {
+					event.Op = ChangeUpdate
+				}
+				if withValues {
+					event.Values = changeValues(record)
+				}
+			}
+			events = append(events, event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,108 @@
+// EventBus_test.go
+// Description: Tests of the event bus of the HTDB library
+// Synchronous handlers run before the commit returns, before asynchronous delivery and after-triggers, and survive panics
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventOrder records the order in which the steps of a commit happen
+type eventOrder struct {
+	steps []string
+	mu    sync.Mutex
+}
+
+func (o *eventOrder) add(step string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.steps = append(o.steps, step)
+}
+
+// index returns the position of the first step with the given name, -1 if it never happened
+func (o *eventOrder) index(step string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, s := range o.steps {
+		if s == step {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestSubscribeSyncOrder(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	order := &eventOrder{}
+
+	async, err := db.Subscribe("s:t", SubscribeOptions{}, func(ChangeEvent) { order.add("async") })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer async.Close()
+	syncSub, err := db.SubscribeSync("s:t", SubscribeOptions{}, func(ChangeEvent) {
+		// Slow enough for anything started before the handler to show up first
+		time.Sleep(10 * time.Millisecond)
+		order.add("sync")
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer syncSub.Close()
+	err = tm.RegisterTrigger("s", "t", AfterInsert, func(*Transaction, *Record) error {
+		order.add("trigger")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to register trigger: %v", err)
+	}
+
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "created"})
+	order.add("returned")
+	async.Close() // Waits for the delivery of the event
+
+	handled := order.index("sync")
+	if handled < 0 {
+		t.Fatalf("synchronous handler never ran, steps %v", order.steps)
+	}
+	for _, step := range []string{"async", "trigger", "returned"} {
+		if i := order.index(step); i < handled {
+			t.Errorf("%s happened before the synchronous handler, steps %v", step, order.steps)
+		}
+	}
+}
+
+func TestSubscribeSyncPanic(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	calls := 0
+	sub, err := db.SubscribeSync("s:*", SubscribeOptions{}, func(event ChangeEvent) {
+		calls++
+		panic(fmt.Sprint("handler failed for record ", event.RecordID))
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	// Every commit calls the handler again, and every one succeeds
+	for key := int64(1); key <= 2; key++ {
+		insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "note": "created"})
+	}
+	if calls != 2 || sub.Panics() != 2 {
+		t.Errorf("handler called %d times with %d panics, want 2 and 2", calls, sub.Panics())
+	}
+	want := fmt.Sprint(map[int64]string{1: "created", 2: "created"})
+	if got := fmt.Sprint(currentValues(t, tm, table)); got != want {
+		t.Errorf("current records = %s, want %s", got, want)
+	}
+}
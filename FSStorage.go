@@ -0,0 +1,132 @@
+// FSStorage.go
+// Description: Read-only fs.FS storage backend for the HTDB library
+// Serves databases from any fs.FS, e.g. datasets embedded into a binary
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fsStorage serves the files of an fs.FS. Every write fails with ErrReadOnly.
+type fsStorage struct {
+	fsys fs.FS
+}
+
+// NewFSStorage creates a read-only storage backed by fsys. Open the database
+// with NewHTDBWithStorage and a main path inside fsys, "." for its root.
+func NewFSStorage(fsys fs.FS) Storage {
+	return &fsStorage{fsys: fsys}
+}
+
+// fsName converts a database path into a valid fs.FS path
+func fsName(name string) string {
+	name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (s *fsStorage) OpenFile(name string, flag int, perm fs.FileMode) (StorageFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, storagePathError("open", name, ErrReadOnly)
+	}
+
+	file, err := s.fsys.Open(fsName(name))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Files that can seek and read at offsets are used as they are, others
+	// are read into memory once
+	if seekable, ok := file.(fsSeekableFile); ok {
+		return &fsFile{fsSeekableFile: seekable, name: name, info: stat}, nil
+	}
+
+	var data []byte
+	if !stat.IsDir() {
+		data, err = io.ReadAll(file)
+	}
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{fsSeekableFile: &fsBufferedFile{Reader: bytes.NewReader(data)}, name: name, info: stat}, nil
+}
+
+func (s *fsStorage) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, fsName(name))
+}
+
+func (s *fsStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(s.fsys, fsName(name))
+}
+
+func (s *fsStorage) Mkdir(name string, perm fs.FileMode) error {
+	return storagePathError("mkdir", name, ErrReadOnly)
+}
+
+func (s *fsStorage) Remove(name string) error {
+	return storagePathError("remove", name, ErrReadOnly)
+}
+
+func (s *fsStorage) Rename(oldPath, newPath string) error {
+	return storagePathError("rename", oldPath, ErrReadOnly)
+}
+
+func (s *fsStorage) SyncDir(name string) error {
+	return nil
+}
+
+// fsSeekableFile is an fs.File that supports the reads of the database
+type fsSeekableFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// fsBufferedFile serves the contents of a file read into memory
+type fsBufferedFile struct {
+	*bytes.Reader
+}
+
+func (f *fsBufferedFile) Close() error {
+	return nil
+}
+
+// fsFile is an open read-only file of an fsStorage
+type fsFile struct {
+	fsSeekableFile
+	name string
+	info fs.FileInfo
+}
+
+func (f *fsFile) Write(p []byte) (int, error) {
+	return 0, storagePathError("write", f.name, ErrReadOnly)
+}
+
+func (f *fsFile) Sync() error {
+	return nil
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fsFile) Truncate(size int64) error {
+	return storagePathError("truncate", f.name, ErrReadOnly)
+}
@@ -0,0 +1,204 @@
+// FileCache.go
+// Description: File handle cache for the HTDB library
+// Keeps table files open between operations instead of reopening them every time
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// defaultMaxOpenFiles is the number of file handles kept open when no limit is set
+const defaultMaxOpenFiles = 64
+
+// fileCache keeps read handles for table files open with LRU eviction.
+// Handles of block compressed files read the decompressed records.
+// Files replaced through a rename (WriteRecords, compaction, DDL) must be
+// invalidated, which bumps the path's generation so the next get reopens it.
+type fileCache struct {
+	store       Storage
+	maxOpen     int
+	entries     map[string]*list.Element
+	lru         *list.List // Front is the most recently used entry
+	generations map[string]uint64
+	closed      bool // Set by closeAll
+	mu          sync.Mutex
+}
+
+// cachedFile is a single open handle in the cache
+type cachedFile struct {
+	path       string
+	file       StorageFile
+	generation uint64 // Generation of the path when the handle was opened
+	refs       int    // Number of callers currently using the handle
+	evicted    bool   // Close once the last caller releases it
+}
+
+// newFileCache creates a new file cache holding at most maxOpen handles of a storage
+func newFileCache(store Storage, maxOpen int) *fileCache {
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenFiles
+	}
+	return &fileCache{
+		store:       store,
+		maxOpen:     maxOpen,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		generations: make(map[string]uint64),
+	}
+}
+
+// get returns an open read handle for path. The returned release function must
+// be called once the caller is done with the handle. Reads should use ReadAt so
+// concurrent callers don't share a file offset.
+func (c *fileCache) get(path string) (StorageFile, func(), error) {
+	path = filepath.Clean(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, nil, ErrClosed
+	}
+	generation := c.generations[path]
+
+	if element, exists := c.entries[path]; exists {
+		entry := element.Value.(*cachedFile)
+		if entry.generation == generation {
+			entry.refs++
+			c.lru.MoveToFront(element)
+			return entry.file, c.releaseFunc(entry), nil
+		}
+
+		// The file was replaced since the handle was opened, it points at the old inode
+		c.removeLocked(element)
+	}
+
+	file, err := openTableFile(c.store, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := &cachedFile{
+		path:       path,
+		file:       file,
+		generation: generation,
+		refs:       1,
+	}
+	c.entries[path] = c.lru.PushFront(entry)
+
+	// Evict the least recently used handles above the limit
+	for c.lru.Len() > c.maxOpen {
+		c.removeLocked(c.lru.Back())
+	}
+
+	return file, c.releaseFunc(entry), nil
+}
+
+// releaseFunc returns the function that hands a handle back to the cache
+func (c *fileCache) releaseFunc(entry *cachedFile) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			entry.refs--
+			if entry.evicted && entry.refs == 0 {
+				entry.file.Close()
+			}
+		})
+	}
+}
+
+// removeLocked drops an entry from the cache, closing it if no caller uses it.
+// The cache mutex must be held.
+func (c *fileCache) removeLocked(element *list.Element) {
+	entry := element.Value.(*cachedFile)
+	c.lru.Remove(element)
+	delete(c.entries, entry.path)
+
+	entry.evicted = true
+	if entry.refs == 0 {
+		entry.file.Close()
+	}
+}
+
+// invalidate marks path as replaced so cached handles for it are reopened
+func (c *fileCache) invalidate(path string) {
+	path = filepath.Clean(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[path]++
+	if element, exists := c.entries[path]; exists {
+		c.removeLocked(element)
+	}
+}
+
+// setMaxOpen changes the handle limit, evicting handles above it
+func (c *fileCache) setMaxOpen(maxOpen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenFiles
+	}
+	c.maxOpen = maxOpen
+	for c.lru.Len() > c.maxOpen {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// openCount returns the number of handles currently held by the cache
+func (c *fileCache) openCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// closeAll closes every cached handle. Handles still in use are closed when
+// released, getting a handle afterwards fails with ErrClosed.
+func (c *fileCache) closeAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return c.closeHandlesLocked()
+}
+
+// flush closes every cached handle like closeAll, but the files are opened
+// again on their next use
+func (c *fileCache) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closeHandlesLocked()
+}
+
+// closeHandlesLocked closes every cached handle. The caller must hold mu.
+func (c *fileCache) closeHandlesLocked() error {
+	var firstErr error
+	for c.lru.Len() > 0 {
+		element := c.lru.Back()
+		entry := element.Value.(*cachedFile)
+		c.lru.Remove(element)
+		delete(c.entries, entry.path)
+
+		entry.evicted = true
+		if entry.refs == 0 {
+			err := entry.file.Close()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to close %s: %v", entry.path, err)
+			}
+		}
+	}
+
+	return firstErr
+}
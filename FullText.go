@@ -0,0 +1,475 @@
+// FullText.go
+// Description: Full-text indexes for the HTDB library
+// Inverted indexes over string and ref fields that power Query.Match
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// IndexKind selects the index kept for a field
+type IndexKind string
+
+const (
+	IndexNone     IndexKind = ""         // The field isn't indexed
+	IndexFullText IndexKind = "fulltext" // Inverted index of the words of a string or ref field, see Query.Match
+)
+
+// fullTextIndex is the content of a full-text index file. The postings only
+// describe the table file of the recorded size, an index of a table file with
+// another size is stale and queries scan instead.
+type fullTextIndex struct {
+	TableSize int64              `json:"table_size"` // Size of the table file the postings describe
+	Postings  map[string][]int64 `json:"postings"`   // Ids of the current records containing each term, ascending
+}
+
+// validateFieldIndexes checks that only string and ref fields are indexed and
+// only with a known kind
+func validateFieldIndexes(fields []Field) error {
+	for _, f := range fields {
+		switch f.Index {
+		case IndexNone:
+			continue
+		case IndexFullText:
+		default:
+			return fmt.Errorf("field '%s' uses unknown index '%s'", f.Name, f.Index)
+		}
+		if f.Type != String && f.Type != "ref" {
+			return fmt.Errorf("field '%s' of type '%s' can't have a full-text index, only string and ref fields can", f.Name, f.Type)
+		}
+	}
+	return nil
+}
+
+// tokenize splits text into its distinct lowercase words, in order of their
+// first appearance. Everything but letters and digits separates words.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]bool, len(words))
+	terms := words[:0]
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// containsTerms reports whether text contains every term
+func containsTerms(text string, terms []string) bool {
+	words := make(map[string]bool)
+	for _, word := range tokenize(text) {
+		words[word] = true
+	}
+	for _, term := range terms {
+		if !words[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateIndex adds an index of the given kind to a field and builds it from
+// the table's records. Commits keep the index up to date and compaction
+// rebuilds it. The index is part of the field definition in the table's
+// configuration.
+func (tm *TableManager) CreateIndex(table *Table, fieldName string, kind IndexKind) error {
+	return tm.setFieldIndex(table, fieldName, kind)
+}
+
+// DropIndex removes the index of a field
+func (tm *TableManager) DropIndex(table *Table, fieldName string) error {
+	return tm.setFieldIndex(table, fieldName, IndexNone)
+}
+
+// setFieldIndex changes the index of a field in the table's configuration and
+// builds or removes the index file. Commits keep the indexes of the definition
+// they were staged against, so the change drains them like any other structure
+// change and records staged before it are refused.
+func (tm *TableManager) setFieldIndex(table *Table, fieldName string, kind IndexKind) error {
+	if err := tm.db.checkOpen(); err != nil {
+		return err
+	}
+	err := table.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	fields := append([]Field{}, table.Fields...)
+	position := -1
+	for i, field := range fields {
+		if field.Name == fieldName {
+			position = i
+		}
+	}
+	if position < 0 {
+		return fmt.Errorf("field '%s' doesn't exist in table '%s'", fieldName, table.TableName)
+	}
+	fields[position].Index = kind
+	err = validateFieldIndexes(fields[position : position+1])
+	if err != nil {
+		return err
+	}
+
+	// Commits on the table finish first, the index is built from all of their records
+	unlock, err := tm.db.lockTableDDL(tableCacheKey(table))
+	if err != nil {
+		return newTableError(table, err)
+	}
+	defer unlock()
+
+	store := table.storage()
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	updated := *table
+	updated.Fields = fields
+	updated.layout = nil
+	if kind == IndexNone {
+		path := table.fullTextIndexPath(fieldName)
+		err = store.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove index of field '%s': %v", fieldName, err)
+		}
+	} else {
+		records, err := table.allRecords()
+		if err != nil {
+			return fmt.Errorf("failed to read records of table '%s': %v", table.TableName, err)
+		}
+		err = updated.buildFullTextIndex(fields[position], records)
+		if err != nil {
+			return err
+		}
+	}
+
+	confJSON, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize table to JSON: %v", err)
+	}
+	confPath := table.confPath()
+	err = writeFile(store, confPath+".temp", confJSON, tm.db.fileMode())
+	if err == nil {
+		err = store.Rename(confPath+".temp", confPath)
+	}
+	if err != nil {
+		store.Remove(confPath + ".temp")
+		return fmt.Errorf("failed to write table configuration: %v", err)
+	}
+
+	unlock()
+	table.Fields = fields
+	table.layout = nil
+	table.generation = tm.db.ddl.generation(tableCacheKey(table))
+
+	tm.db.log(slog.LevelInfo, "index changed",
+		"schema", table.schemaName(), "table", table.TableName, "field", fieldName, "kind", string(kind))
+	return nil
+}
+
+// buildFullTextIndex writes the full-text index of a field from every current
+// record of the table. The caller must hold the table's lock and pass all of
+// the table file's records.
+func (t *Table) buildFullTextIndex(field Field, records []*Record) error {
+	index := &fullTextIndex{
+		TableSize: int64(len(records) * t.RecordSize()),
+		Postings:  make(map[string][]int64),
+	}
+
+	refs := newRefReader(t)
+	defer refs.close()
+	for _, record := range records {
+		if !record.Metadata.IsCurrent || record.Metadata.IsDeleted {
+			continue
+		}
+		text, err := indexedText(refs, record, field)
+		if err != nil {
+			return fmt.Errorf("failed to index record %d: %v", record.ID, err)
+		}
+		index.add(record.ID, text)
+	}
+	index.sort()
+	return t.writeFullTextIndex(field.Name, index)
+}
+
+// updateIndexes brings the full-text indexes of the table up to date after a
+// commit wrote records. previousCount is the number of records in the table
+// file before the commit, records are all records of the file afterwards. An
+// index that missed an earlier write is rebuilt from scratch, a missing one
+// was dropped or isn't built yet and is left alone. The caller must hold the
+// table's lock.
+func (t *Table) updateIndexes(previousCount int, records []*Record) error {
+	for _, field := range t.Fields {
+		if field.Index != IndexFullText {
+			continue
+		}
+
+		index, err := t.readFullTextIndex(field.Name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil || index.TableSize != int64(previousCount*t.RecordSize()) {
+			err = t.buildFullTextIndex(field, records)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Versions replaced or deleted by the commit leave the postings
+		live := make(map[int64]bool, len(records))
+		for _, record := range records {
+			if record.Metadata.IsCurrent && !record.Metadata.IsDeleted {
+				live[record.ID] = true
+			}
+		}
+		for term, ids := range index.Postings {
+			kept := ids[:0]
+			for _, id := range ids {
+				if live[id] {
+					kept = append(kept, id)
+				}
+			}
+			if len(kept) == 0 {
+				delete(index.Postings, term)
+			} else {
+				index.Postings[term] = kept
+			}
+		}
+
+		// Only the written records are new. Updates that kept a ref value only
+		// carry its offsets, it is read back from the ref file.
+		refs := newRefReader(t)
+		for _, record := range records[previousCount:] {
+			if !live[record.ID] {
+				continue
+			}
+			text, err := indexedText(refs, record, field)
+			if err != nil {
+				refs.close()
+				return fmt.Errorf("failed to index record %d: %v", record.ID, err)
+			}
+			index.add(record.ID, text)
+		}
+		refs.close()
+		index.sort()
+		index.TableSize = int64(len(records) * t.RecordSize())
+
+		err = t.writeFullTextIndex(field.Name, index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildIndexes rebuilds every full-text index of the table from the table
+// file, used after compaction. The caller must hold the table's lock.
+func (t *Table) rebuildIndexes() error {
+	var records []*Record
+	for _, field := range t.Fields {
+		if field.Index != IndexFullText {
+			continue
+		}
+		if records == nil {
+			var err error
+			records, err = t.allRecords()
+			if err != nil {
+				return err
+			}
+		}
+		err := t.buildFullTextIndex(field, records)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedText returns the text of a record's field, reading ref values that
+// aren't in memory from the ref file
+func indexedText(refs *refReader, record *Record, field Field) (string, error) {
+	if record.FieldsMeta[field.Name].IsNull {
+		return "", nil
+	}
+	if text, ok := record.FieldsData[field.Name].(string); ok {
+		return text, nil
+	}
+	if field.Type == "ref" {
+		if _, exists := record.RefOffsets[field.Name]; exists {
+			return refs.read(record, field)
+		}
+	}
+	return "", nil
+}
+
+// add adds the terms of text to the postings of id
+func (idx *fullTextIndex) add(id int64, text string) {
+	for _, term := range tokenize(text) {
+		idx.Postings[term] = append(idx.Postings[term], id)
+	}
+}
+
+// sort puts the ids of every term in ascending order without duplicates
+func (idx *fullTextIndex) sort() {
+	for term, ids := range idx.Postings {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		unique := ids[:0]
+		for i, id := range ids {
+			if i == 0 || id != ids[i-1] {
+				unique = append(unique, id)
+			}
+		}
+		idx.Postings[term] = unique
+	}
+}
+
+// lookup returns the ids of the records containing every term
+func (idx *fullTextIndex) lookup(terms []string) map[int64]bool {
+	var result map[int64]bool
+	for _, term := range terms {
+		matches := make(map[int64]bool)
+		for _, id := range idx.Postings[term] {
+			if result == nil || result[id] {
+				matches[id] = true
+			}
+		}
+		result = matches
+	}
+	return result
+}
+
+// readFullTextIndex reads the full-text index of a field
+func (t *Table) readFullTextIndex(fieldName string) (*fullTextIndex, error) {
+	data, err := readFile(t.storage(), t.fullTextIndexPath(fieldName))
+	if err != nil {
+		return nil, err
+	}
+	var index fullTextIndex
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid index of field '%s': %v", ErrCorrupt, fieldName, err)
+	}
+	if index.Postings == nil {
+		index.Postings = make(map[string][]int64)
+	}
+	return &index, nil
+}
+
+// writeFullTextIndex replaces the full-text index of a field through a temporary file
+func (t *Table) writeFullTextIndex(fieldName string, index *fullTextIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode index of field '%s': %v", fieldName, err)
+	}
+
+	store := t.storage()
+	path := t.fullTextIndexPath(fieldName)
+	err = writeFile(store, path+".temp", data, t.db.fileMode())
+	if err == nil {
+		err = store.Rename(path+".temp", path)
+	}
+	if err != nil {
+		store.Remove(path + ".temp")
+		return fmt.Errorf("failed to write index of field '%s': %v", fieldName, err)
+	}
+	return nil
+}
+
+// Match adds a condition matching records whose field contains every word of
+// text, compared in lowercase. A full-text index of the field is used while it
+// is up to date, otherwise the table is scanned. Text without words matches
+// every record.
+func (q *Query) Match(field, text string) *Query {
+	q.conditions = append(q.conditions, FilterCondition{
+		Field:    field,
+		Operator: matchOperator,
+		Value:    text,
+	})
+	return q
+}
+
+// matchOperator is the operator of the conditions added by Query.Match
+const matchOperator = "match"
+
+// fullTextCandidates answers the Match conditions that have an up-to-date
+// full-text index. It returns the ids of the records matching all of them, or
+// nil if no index could be used, and the conditions left to check on every record.
+func (q *Query) fullTextCandidates() (map[int64]bool, []FilterCondition) {
+	size, err := q.table.dataSize()
+	if err != nil {
+		return nil, q.conditions
+	}
+
+	var candidates map[int64]bool
+	var remaining []FilterCondition
+	for _, condition := range q.conditions {
+		text, isText := condition.Value.(string)
+		field, indexed := q.table.fullTextField(condition.Field)
+		if condition.Operator != matchOperator || !isText || !indexed {
+			remaining = append(remaining, condition)
+			continue
+		}
+
+		index, err := q.table.readFullTextIndex(field.Name)
+		if err != nil || index.TableSize != size {
+			remaining = append(remaining, condition) // Stale, scan instead
+			continue
+		}
+		terms := tokenize(text)
+		if len(terms) == 0 {
+			continue
+		}
+
+		matches := index.lookup(terms)
+		if candidates != nil {
+			for id := range candidates {
+				if !matches[id] {
+					delete(candidates, id)
+				}
+			}
+		} else {
+			candidates = matches
+		}
+	}
+	return candidates, remaining
+}
+
+// fullTextField returns the field of the table with a full-text index of that name
+func (t *Table) fullTextField(name string) (Field, bool) {
+	for _, field := range t.Fields {
+		if field.Name == name && field.Index == IndexFullText {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// matchRefFields returns the ref fields of Match conditions, their values
+// have to be read from the ref files before the conditions can be checked
+func (q *Query) matchRefFields(conditions []FilterCondition) []Field {
+	var fields []Field
+	for _, condition := range conditions {
+		if condition.Operator != matchOperator {
+			continue
+		}
+		for _, field := range q.table.Fields {
+			if field.Name == condition.Field && field.Type == "ref" {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
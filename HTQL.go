@@ -0,0 +1,730 @@
+// HTQL.go
+// Description: Textual query language for the HTDB library
+// Compiles SQL-ish statements into Query builders and TableManager operations
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Supported statements:
+//
+//	SELECT * | field, ... FROM [schema:]table [WHERE cond [AND cond ...]] [ORDER BY field [ASC|DESC]] [LIMIT n]
+//	INSERT INTO [schema:]table (field, ...) VALUES (value, ...)[, (value, ...) ...]
+//	UPDATE [schema:]table SET field = value[, field = value ...] [WHERE ...]
+//	DELETE FROM [schema:]table [WHERE ...]
+//
+// A condition is "field operator value" with the operators of Query.Where.
+// Values are 'strings', integers, floats, TRUE, FALSE and NULL.
+
+// ExecResult is the result of a statement run by Exec
+type ExecResult struct {
+	Records  []*Record // Selected, inserted or updated records
+	Affected int       // Number of records the statement selected or changed
+	Fields   []string  // Fields of the records besides the id in schema order, the selected ones for SELECT
+}
+
+// ParseError is returned by Exec for statements that can't be parsed
+type ParseError struct {
+	Position int // 1-based position of the offending input
+	Message  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Position, e.Message)
+}
+
+// Exec parses and runs a single statement
+func (db *HTDB) Exec(statement string) (*ExecResult, error) {
+	tokens, err := lexHTQL(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &htqlParser{tokens: tokens}
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	return stmt.run(db)
+}
+
+// --- Lexer ---
+
+type htqlTokenKind int
+
+const (
+	htqlEOF htqlTokenKind = iota
+	htqlIdent
+	htqlNumber
+	htqlString
+	htqlSymbol
+)
+
+type htqlToken struct {
+	kind  htqlTokenKind
+	text  string
+	value interface{} // Literal value of number and string tokens
+	pos   int         // 1-based position in the statement
+}
+
+// lexHTQL splits a statement into tokens
+func lexHTQL(input string) ([]htqlToken, error) {
+	var tokens []htqlToken
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		start := i
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '_' || unicode.IsLetter(rune(c)):
+			for i < len(input) && (input[i] == '_' || unicode.IsLetter(rune(input[i])) || unicode.IsDigit(rune(input[i]))) {
+				i++
+			}
+			tokens = append(tokens, htqlToken{kind: htqlIdent, text: input[start:i], pos: start + 1})
+
+		case unicode.IsDigit(rune(c)) || c == '-' && i+1 < len(input) && unicode.IsDigit(rune(input[i+1])):
+			i++
+			isFloat := false
+			for i < len(input) && (unicode.IsDigit(rune(input[i])) || input[i] == '.') {
+				if input[i] == '.' {
+					isFloat = true
+				}
+				i++
+			}
+			text := input[start:i]
+			var value interface{}
+			var err error
+			if isFloat {
+				value, err = strconv.ParseFloat(text, 64)
+			} else {
+				value, err = strconv.ParseInt(text, 10, 64)
+			}
+			if err != nil {
+				return nil, &ParseError{Position: start + 1, Message: fmt.Sprintf("invalid number '%s'", text)}
+			}
+			tokens = append(tokens, htqlToken{kind: htqlNumber, text: text, value: value, pos: start + 1})
+
+		case c == '\'':
+			// Strings are single quoted, a doubled quote escapes a quote
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(input) {
+					return nil, &ParseError{Position: start + 1, Message: "unterminated string"}
+				}
+				if input[i] == '\'' {
+					if i+1 < len(input) && input[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteByte(input[i])
+				i++
+			}
+			tokens = append(tokens, htqlToken{kind: htqlString, text: input[start:i], value: sb.String(), pos: start + 1})
+
+		default:
+			// Two character operators first
+			if i+1 < len(input) {
+				switch input[i : i+2] {
+				case "!=", ">=", "<=", "<>":
+					text := input[i : i+2]
+					if text == "<>" {
+						text = "!="
+					}
+					tokens = append(tokens, htqlToken{kind: htqlSymbol, text: text, pos: start + 1})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune(",()*=<>:;", rune(c)) {
+				return nil, &ParseError{Position: start + 1, Message: fmt.Sprintf("unexpected character '%c'", c)}
+			}
+			tokens = append(tokens, htqlToken{kind: htqlSymbol, text: string(c), pos: start + 1})
+			i++
+		}
+	}
+
+	tokens = append(tokens, htqlToken{kind: htqlEOF, pos: len(input) + 1})
+	return tokens, nil
+}
+
+// --- Parser ---
+
+type htqlParser struct {
+	tokens []htqlToken
+	pos    int
+}
+
+// htqlStatement is a parsed statement
+type htqlStatement struct {
+	kind       string // SELECT, INSERT, UPDATE or DELETE
+	table      string
+	fields     []string               // Selected fields, or the columns of an INSERT
+	rows       [][]interface{}        // Values of an INSERT
+	updates    map[string]interface{} // SET clause of an UPDATE
+	conditions []FilterCondition
+	sortField  string
+	ascending  bool
+	limit      int
+}
+
+func (p *htqlParser) peek() htqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *htqlParser) next() htqlToken {
+	token := p.tokens[p.pos]
+	if token.kind != htqlEOF {
+		p.pos++
+	}
+	return token
+}
+
+// errorf builds a parse error at the current token
+func (p *htqlParser) errorf(format string, args ...interface{}) error {
+	token := p.peek()
+	message := fmt.Sprintf(format, args...)
+	if token.kind == htqlEOF {
+		message += ", got end of input"
+	} else {
+		message += fmt.Sprintf(", got '%s'", token.text)
+	}
+	return &ParseError{Position: token.pos, Message: message}
+}
+
+// isKeyword reports whether the current token is the given keyword
+func (p *htqlParser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token.kind == htqlIdent && strings.EqualFold(token.text, keyword)
+}
+
+// keyword consumes the given keyword
+func (p *htqlParser) keyword(keyword string) error {
+	if !p.isKeyword(keyword) {
+		return p.errorf("expected %s", keyword)
+	}
+	p.next()
+	return nil
+}
+
+// symbol consumes the given symbol
+func (p *htqlParser) symbol(symbol string) error {
+	token := p.peek()
+	if token.kind != htqlSymbol || token.text != symbol {
+		return p.errorf("expected '%s'", symbol)
+	}
+	p.next()
+	return nil
+}
+
+// isSymbol reports whether the current token is the given symbol
+func (p *htqlParser) isSymbol(symbol string) bool {
+	token := p.peek()
+	return token.kind == htqlSymbol && token.text == symbol
+}
+
+// ident consumes an identifier
+func (p *htqlParser) ident(what string) (string, error) {
+	token := p.peek()
+	if token.kind != htqlIdent {
+		return "", p.errorf("expected %s", what)
+	}
+	p.next()
+	return token.text, nil
+}
+
+// tableName consumes a table name, optionally qualified with its schema
+func (p *htqlParser) tableName() (string, error) {
+	name, err := p.ident("table name")
+	if err != nil {
+		return "", err
+	}
+	if p.isSymbol(":") {
+		p.next()
+		table, err := p.ident("table name")
+		if err != nil {
+			return "", err
+		}
+		name += ":" + table
+	}
+	return name, nil
+}
+
+// literal consumes a value
+func (p *htqlParser) literal() (interface{}, error) {
+	token := p.peek()
+	switch token.kind {
+	case htqlNumber, htqlString:
+		p.next()
+		return token.value, nil
+	case htqlIdent:
+		switch strings.ToUpper(token.text) {
+		case "NULL":
+			p.next()
+			return nil, nil
+		case "TRUE":
+			p.next()
+			return true, nil
+		case "FALSE":
+			p.next()
+			return false, nil
+		}
+	}
+	return nil, p.errorf("expected a value")
+}
+
+func (p *htqlParser) parseStatement() (*htqlStatement, error) {
+	var stmt *htqlStatement
+	var err error
+
+	switch {
+	case p.isKeyword("SELECT"):
+		stmt, err = p.parseSelect()
+	case p.isKeyword("INSERT"):
+		stmt, err = p.parseInsert()
+	case p.isKeyword("UPDATE"):
+		stmt, err = p.parseUpdate()
+	case p.isKeyword("DELETE"):
+		stmt, err = p.parseDelete()
+	default:
+		return nil, p.errorf("expected SELECT, INSERT, UPDATE or DELETE")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// An optional semicolon ends the statement
+	if p.isSymbol(";") {
+		p.next()
+	}
+	if p.peek().kind != htqlEOF {
+		return nil, p.errorf("expected end of statement")
+	}
+	return stmt, nil
+}
+
+func (p *htqlParser) parseSelect() (*htqlStatement, error) {
+	p.next()
+	stmt := &htqlStatement{kind: "SELECT", ascending: true, limit: -1}
+
+	if p.isSymbol("*") {
+		p.next()
+	} else {
+		for {
+			field, err := p.ident("field name")
+			if err != nil {
+				return nil, err
+			}
+			stmt.fields = append(stmt.fields, field)
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	err := p.keyword("FROM")
+	if err != nil {
+		return nil, err
+	}
+	stmt.table, err = p.tableName()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.parseWhere(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("ORDER") {
+		p.next()
+		err = p.keyword("BY")
+		if err != nil {
+			return nil, err
+		}
+		stmt.sortField, err = p.ident("field name")
+		if err != nil {
+			return nil, err
+		}
+		if p.isKeyword("ASC") {
+			p.next()
+		} else if p.isKeyword("DESC") {
+			p.next()
+			stmt.ascending = false
+		}
+	}
+
+	if p.isKeyword("LIMIT") {
+		p.next()
+		token := p.peek()
+		limit, ok := token.value.(int64)
+		if token.kind != htqlNumber || !ok || limit < 0 {
+			return nil, p.errorf("expected a non-negative integer limit")
+		}
+		p.next()
+		stmt.limit = int(limit)
+	}
+
+	return stmt, nil
+}
+
+func (p *htqlParser) parseInsert() (*htqlStatement, error) {
+	p.next()
+	stmt := &htqlStatement{kind: "INSERT"}
+
+	err := p.keyword("INTO")
+	if err != nil {
+		return nil, err
+	}
+	stmt.table, err = p.tableName()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.symbol("(")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.ident("field name")
+		if err != nil {
+			return nil, err
+		}
+		stmt.fields = append(stmt.fields, field)
+		if !p.isSymbol(",") {
+			break
+		}
+		p.next()
+	}
+	err = p.symbol(")")
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.keyword("VALUES")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rowStart := p.peek()
+		err = p.symbol("(")
+		if err != nil {
+			return nil, err
+		}
+		var row []interface{}
+		for {
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, value)
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+		err = p.symbol(")")
+		if err != nil {
+			return nil, err
+		}
+		if len(row) != len(stmt.fields) {
+			return nil, &ParseError{Position: rowStart.pos, Message: fmt.Sprintf("expected %d values, got %d", len(stmt.fields), len(row))}
+		}
+		stmt.rows = append(stmt.rows, row)
+
+		if !p.isSymbol(",") {
+			break
+		}
+		p.next()
+	}
+
+	return stmt, nil
+}
+
+func (p *htqlParser) parseUpdate() (*htqlStatement, error) {
+	p.next()
+	stmt := &htqlStatement{kind: "UPDATE", updates: make(map[string]interface{})}
+
+	var err error
+	stmt.table, err = p.tableName()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.keyword("SET")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.ident("field name")
+		if err != nil {
+			return nil, err
+		}
+		err = p.symbol("=")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		stmt.updates[field] = value
+		if !p.isSymbol(",") {
+			break
+		}
+		p.next()
+	}
+
+	err = p.parseWhere(stmt)
+	if err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *htqlParser) parseDelete() (*htqlStatement, error) {
+	p.next()
+	stmt := &htqlStatement{kind: "DELETE"}
+
+	err := p.keyword("FROM")
+	if err != nil {
+		return nil, err
+	}
+	stmt.table, err = p.tableName()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.parseWhere(stmt)
+	if err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseWhere parses an optional WHERE clause of conditions joined by AND
+func (p *htqlParser) parseWhere(stmt *htqlStatement) error {
+	if !p.isKeyword("WHERE") {
+		return nil
+	}
+	p.next()
+
+	for {
+		field, err := p.ident("field name")
+		if err != nil {
+			return err
+		}
+
+		token := p.peek()
+		switch token.text {
+		case "=", "!=", ">", ">=", "<", "<=":
+		default:
+			return p.errorf("expected a comparison operator")
+		}
+		if token.kind != htqlSymbol {
+			return p.errorf("expected a comparison operator")
+		}
+		p.next()
+
+		value, err := p.literal()
+		if err != nil {
+			return err
+		}
+		stmt.conditions = append(stmt.conditions, FilterCondition{Field: field, Operator: token.text, Value: value})
+
+		if !p.isKeyword("AND") {
+			return nil
+		}
+		p.next()
+	}
+}
+
+// --- Execution ---
+
+// run executes a parsed statement against the database
+func (stmt *htqlStatement) run(db *HTDB) (*ExecResult, error) {
+	table, err := db.getTable(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	tm := db.tableManager
+
+	if stmt.kind == "INSERT" {
+		tx := tm.BeginTransaction()
+		var records []*Record
+		for _, row := range stmt.rows {
+			data := make(map[string]interface{}, len(row))
+			for i, name := range stmt.fields {
+				value, err := coerceHTQLValue(table, name, row[i])
+				if err != nil {
+					tm.RollbackTransaction(tx)
+					return nil, err
+				}
+				data[name] = value
+			}
+			record, err := tx.StageInsert(table, data)
+			if err != nil {
+				tm.RollbackTransaction(tx)
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		err = tm.CommitTransaction(tx)
+		if err != nil {
+			return nil, err
+		}
+		return &ExecResult{Records: records, Affected: len(records), Fields: resultFields(table, nil)}, nil
+	}
+
+	// The other statements start by selecting the matching records, unknown
+	// fields would select nothing instead of failing
+	err = checkHTQLFields(table, stmt)
+	if err != nil {
+		return nil, err
+	}
+	query := tm.Select(table)
+	for _, condition := range stmt.conditions {
+		query.Where(condition.Field, condition.Operator, condition.Value)
+	}
+
+	if stmt.kind == "SELECT" {
+		if len(stmt.fields) > 0 {
+			query.Fields(stmt.fields...)
+		}
+		if stmt.sortField != "" {
+			query.Sort(stmt.sortField, stmt.ascending)
+		}
+		query.Limit(stmt.limit)
+
+		records, err := query.GetAll()
+		if err != nil {
+			return nil, err
+		}
+		return &ExecResult{Records: records, Affected: len(records), Fields: resultFields(table, query)}, nil
+	}
+
+	records, err := query.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	updateNames := make([]string, 0, len(stmt.updates))
+	for name := range stmt.updates {
+		updateNames = append(updateNames, name)
+	}
+	schemaOrder(table, updateNames)
+
+	tx := tm.BeginTransaction()
+	var changed []*Record
+	for _, record := range records {
+		if stmt.kind == "DELETE" {
+			err = tx.StageDelete(table, record)
+		} else {
+			updates := make(map[string]interface{}, len(stmt.updates))
+			for _, name := range updateNames {
+				updates[name], err = coerceHTQLValue(table, name, stmt.updates[name])
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				var updated *Record
+				updated, err = tx.StageUpdate(table, record, updates)
+				changed = append(changed, updated)
+			}
+		}
+		if err != nil {
+			tm.RollbackTransaction(tx)
+			return nil, err
+		}
+	}
+	err = tm.CommitTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExecResult{Records: changed, Affected: len(records), Fields: resultFields(table, nil)}, nil
+}
+
+// checkHTQLFields returns ErrFieldNotFound for the first field a statement
+// selects, filters or sorts by that the table doesn't have
+func checkHTQLFields(table *Table, stmt *htqlStatement) error {
+	names := append([]string{}, stmt.fields...)
+	for _, condition := range stmt.conditions {
+		names = append(names, condition.Field)
+	}
+	if stmt.sortField != "" {
+		names = append(names, stmt.sortField)
+	}
+	for _, name := range names {
+		if _, exists := tableField(table, name); !exists {
+			return newFieldError(table, name, ErrFieldNotFound)
+		}
+	}
+	return nil
+}
+
+// resultFields returns the names of the fields a statement returns, see ExecResult.Fields
+func resultFields(table *Table, query *Query) []string {
+	var names []string
+	for _, field := range exportFields(table, query) {
+		if field.Name != "id" {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// schemaOrder sorts field names in the order of the table's fields, unknown
+// names last by name, so errors are reported the same way every run
+func schemaOrder(table *Table, names []string) []string {
+	position := func(name string) int {
+		for i, field := range table.Fields {
+			if field.Name == name {
+				return i
+			}
+		}
+		return len(table.Fields)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := position(names[i]), position(names[j])
+		if a != b {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// coerceHTQLValue converts a literal to the type stored in a field, so an
+// integer literal can be written to a float field
+func coerceHTQLValue(table *Table, fieldName string, value interface{}) (interface{}, error) {
+	for _, field := range table.Fields {
+		if field.Name != fieldName {
+			continue
+		}
+		if field.Type == Float {
+			if n, ok := value.(int64); ok {
+				return float64(n), nil
+			}
+		}
+		return value, nil
+	}
+	return nil, newFieldError(table, fieldName, ErrFieldNotFound)
+}
@@ -0,0 +1,89 @@
+// HTQL_test.go
+// Description: Tests of the HTQL statements of the HTDB library
+// Statements naming fields the table doesn't have must fail instead of selecting nothing
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExecUnknownFields(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	createTestTable(t, db, "s", "t", []Field{{Name: "key", Type: Int, Length: 8}})
+	_, err := db.Exec("INSERT INTO s:t (key) VALUES (1), (2)")
+	if err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	statements := []string{
+		"SELECT nope FROM s:t",
+		"SELECT key, nope FROM s:t",
+		"SELECT * FROM s:t WHERE nope = 1",
+		"SELECT * FROM s:t ORDER BY nope",
+		"UPDATE s:t SET key = 3 WHERE nope = 1",
+		"DELETE FROM s:t WHERE nope = 1",
+	}
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if !errors.Is(err, ErrFieldNotFound) {
+			t.Errorf("%s: expected ErrFieldNotFound, got %v", statement, err)
+		}
+	}
+
+	result, err := db.Exec("SELECT key FROM s:t WHERE key > 1 ORDER BY key")
+	if err != nil {
+		t.Fatalf("failed to select: %v", err)
+	}
+	if len(result.Records) != 1 || result.Records[0].FieldsData["key"] != int64(2) {
+		t.Errorf("selected %v, want the record with key 2", result.Records)
+	}
+}
+
+// Results and errors of statements come in schema order, whatever order the
+// statement names the fields in
+func TestExecSchemaOrder(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	createTestTable(t, db, "s", "t", typedFields)
+	_, err := db.Exec("INSERT INTO s:t (key, name) VALUES (1, 'first')")
+	if err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	result, err := db.Exec("SELECT * FROM s:t")
+	if err != nil {
+		t.Fatalf("failed to select: %v", err)
+	}
+	if got, want := fmt.Sprint(result.Fields), "[key flag ratio name note]"; got != want {
+		t.Errorf("SELECT * returns fields %s, want %s", got, want)
+	}
+	result, err = db.Exec("SELECT name, key FROM s:t")
+	if err != nil {
+		t.Fatalf("failed to select: %v", err)
+	}
+	if got, want := fmt.Sprint(result.Fields), "[key name]"; got != want {
+		t.Errorf("SELECT name, key returns fields %s, want %s", got, want)
+	}
+
+	var first string
+	for run := 0; run < 20; run++ {
+		_, err := db.Exec("UPDATE s:t SET ratio = 'half', key = 'one' WHERE key = 1")
+		if err == nil {
+			t.Fatalf("expected the update to fail")
+		}
+		if run == 0 {
+			first = err.Error()
+			continue
+		}
+		if err.Error() != first {
+			t.Fatalf("run %d fails with %q, the first with %q", run, err, first)
+		}
+	}
+	if strings.Index(first, "'key'") > strings.Index(first, "'ratio'") {
+		t.Errorf("update reports ratio before key: %s", first)
+	}
+}
@@ -0,0 +1,85 @@
+// Handle.go
+// Description: Record handles of the HTDB library
+// Opaque tokens that find a record again across updates and compactions
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LogicalID returns the id of the record's first version. It stays the same
+// across updates, while every version gets a new ID.
+func (r *Record) LogicalID() int64 {
+	if r.Metadata.OriginID != 0 {
+		return r.Metadata.OriginID
+	}
+	return r.ID
+}
+
+// Handle returns an opaque token for this version of the record. Unlike the
+// id it stays valid across compactions, see TableManager.ResolveHandle.
+func (r *Record) Handle() string {
+	return strconv.FormatInt(r.LogicalID(), 36) + "-" + r.Version()
+}
+
+// ResolveHandle returns the record version a handle was taken from. If that
+// version was superseded by an update it returns the current version and
+// reports true. Deleted records fail with ErrNotFound, malformed handles
+// with ErrInvalidHandle.
+func (tm *TableManager) ResolveHandle(table *Table, handle string) (*Record, bool, error) {
+	logicalID, id, version, err := parseHandle(handle)
+	if err != nil {
+		return nil, false, err
+	}
+
+	record, err := tm.lookupRecord(table, id)
+	if err != nil {
+		return nil, false, err
+	}
+	if record != nil && !record.Metadata.IsDeleted && record.Version() == version {
+		return record, false, nil
+	}
+
+	// Find the latest version of the record through the primary key index
+	position, indexed, err := tm.primaryKeys.lookupLatest(table, logicalID)
+	if err != nil {
+		return nil, false, err
+	}
+	if indexed {
+		latest, err := table.readRecordAt(position)
+		if err != nil {
+			return nil, false, err
+		}
+		if latest != nil && latest.LogicalID() == logicalID && latest.Metadata.IsCurrent && !latest.Metadata.IsDeleted {
+			return latest, latest.ID != id, nil
+		}
+	}
+
+	return nil, false, newRecordError(table, id, ErrNotFound)
+}
+
+// parseHandle splits a handle into the logical id, the version id and the version token
+func parseHandle(handle string) (int64, int64, string, error) {
+	parts := strings.Split(handle, "-")
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("%w: %q", ErrInvalidHandle, handle)
+	}
+
+	logicalID, err := strconv.ParseInt(parts[0], 36, 64)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("%w: %q", ErrInvalidHandle, handle)
+	}
+	if _, err := strconv.ParseInt(parts[1], 36, 64); err != nil {
+		return 0, 0, "", fmt.Errorf("%w: %q", ErrInvalidHandle, handle)
+	}
+	id, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("%w: %q", ErrInvalidHandle, handle)
+	}
+
+	return logicalID, id, parts[1] + "-" + parts[2], nil
+}
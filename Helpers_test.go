@@ -0,0 +1,163 @@
+// Helpers_test.go
+// Description: Shared helpers of the HTDB library tests
+// Opens throwaway databases and creates tables for the tests of this package
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"testing"
+)
+
+// openTestDB opens the database at path, created if missing, and closes it when the test ends
+func openTestDB(t testing.TB, path string) *HTDB {
+	t.Helper()
+	db, err := Open(path, OpenOptions{Create: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		err := db.Close()
+		if err != nil && !errors.Is(err, ErrClosed) {
+			t.Errorf("failed to close database: %v", err)
+		}
+	})
+	return db
+}
+
+// createTestTable creates a table, and its schema if it is missing
+func createTestTable(t testing.TB, db *HTDB, schema, name string, fields []Field) *Table {
+	t.Helper()
+	s, err := db.Schema(schema)
+	if errors.Is(err, ErrSchemaNotFound) {
+		s, err = db.CreateSchema(schema)
+	}
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	response := s.CreateTable(name, fields)
+	if response.StatusCode != StatusOK {
+		t.Fatalf("failed to create table: %v", response.Message)
+	}
+	table, err := db.GetTableManager().GetTable(schema, name)
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	return table
+}
+
+// insertTestRecord inserts a record and fails the test on errors
+func insertTestRecord(t testing.TB, tm *TableManager, table *Table, data map[string]interface{}) *Record {
+	t.Helper()
+	record, err := tm.InsertRecord(table, data)
+	if err != nil {
+		t.Fatalf("failed to insert record: %v", err)
+	}
+	return record
+}
+
+// currentValues returns the current records of a table keyed by their int field key,
+// with the values of the ref field note read from the ref file
+func currentValues(t testing.TB, tm *TableManager, table *Table) map[int64]string {
+	t.Helper()
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	values := make(map[int64]string, len(records))
+	for _, record := range records {
+		key, _ := asInt64(record.FieldsData["key"])
+		note, err := table.ReadRef(record, "note")
+		if err != nil {
+			t.Fatalf("failed to read ref of record %d: %v", key, err)
+		}
+		values[key] = note
+	}
+	return values
+}
+
+// noteFields are the fields of the tables used with currentValues
+var noteFields = []Field{
+	{Name: "key", Type: Int, Length: 8},
+	{Name: "note", Type: "ref", Length: refFieldLength},
+}
+
+// typedFields hold a field of every value type, for round trips through
+// exports and imports
+var typedFields = []Field{
+	{Name: "key", Type: Int, Length: 8},
+	{Name: "flag", Type: Bool, Length: 1},
+	{Name: "ratio", Type: Float, Length: 8},
+	{Name: "name", Type: String, Length: 16},
+	{Name: "note", Type: "ref", Length: refFieldLength},
+}
+
+// typedRecords are values for typedFields, with nulls and zero values
+var typedRecords = []map[string]interface{}{
+	{"key": int64(1), "flag": true, "ratio": 0.25, "name": "first", "note": "a longer note"},
+	{"key": int64(2), "flag": false, "ratio": -3.5, "name": "", "note": ""},
+	{"key": int64(3), "flag": nil, "ratio": nil, "name": nil, "note": nil},
+}
+
+// fieldValues returns the values of the current records of a table keyed by
+// their int field key, nil for null fields and ref fields read from the ref file
+func fieldValues(t testing.TB, tm *TableManager, table *Table) map[int64]map[string]interface{} {
+	t.Helper()
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	values := make(map[int64]map[string]interface{}, len(records))
+	for _, record := range records {
+		key, _ := asInt64(record.FieldsData["key"])
+		fields := make(map[string]interface{})
+		for _, field := range table.Fields {
+			if field.Type == TimeID {
+				continue
+			}
+			switch {
+			case record.FieldsMeta[field.Name].IsNull:
+				fields[field.Name] = nil
+			case field.Type == "ref":
+				value, err := table.ReadRef(record, field.Name)
+				if err != nil {
+					t.Fatalf("failed to read ref of record %d: %v", key, err)
+				}
+				fields[field.Name] = value
+			default:
+				fields[field.Name] = record.FieldsData[field.Name]
+			}
+		}
+		values[key] = fields
+	}
+	return values
+}
+
+// appendBenchmarkRecords appends count current records straight to the table
+// file, much faster than commits for filling tables of benchmarks. data
+// returns the values of the i-th record, ref fields stay null.
+func appendBenchmarkRecords(b *testing.B, table *Table, count int, data func(i int) map[string]interface{}) {
+	b.Helper()
+	file, err := table.storage().OpenFile(table.filePath(), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		b.Fatalf("failed to open table file: %v", err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for i := 0; i < count; i++ {
+		serialized, err := NewRecord(int64(i+1), data(i)).serializeLayout(table.Layout())
+		if err != nil {
+			b.Fatalf("failed to serialize record: %v", err)
+		}
+		w.Write(serialized)
+	}
+	err = w.Flush()
+	if err != nil {
+		b.Fatalf("failed to write records: %v", err)
+	}
+	table.db.files.invalidate(table.filePath())
+}
@@ -0,0 +1,151 @@
+// IDGenerator.go
+// Description: Record id generation for the HTDB library
+// Hands out strictly increasing timestamp ids that survive clock steps and restarts
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	idsFileName = "db.ids" + fileEnding
+	idReserve   = int64(time.Second) // Ids handed out before the high-water mark is persisted again
+)
+
+// idGenerator hands out timestamp ids. Every id is greater than the one before,
+// even if the clock goes backwards.
+type idGenerator struct {
+	last     int64                  // Highest id handed out or seen
+	reserved int64                  // Persisted high-water mark, ids up to it need no write
+	persist  func(mark int64) error // Writes the high-water mark, nil if it isn't persisted
+	mu       sync.Mutex
+}
+
+// processIDs generates the ids of records without a database, see HTDB.nextID
+var processIDs = &idGenerator{}
+
+// next returns a new id, max(now, last id + 1)
+func (g *idGenerator) next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := time.Now().UnixNano()
+	if id <= g.last {
+		id = g.last + 1
+	}
+	g.last = id
+
+	// Persist ahead, so ids handed out before a crash are never handed out again
+	if g.persist != nil && id > g.reserved {
+		err := g.persist(id + idReserve)
+		if err == nil {
+			g.reserved = id + idReserve
+		}
+	}
+	return id
+}
+
+// observe makes sure later ids are greater than id
+func (g *idGenerator) observe(id int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if id > g.last {
+		g.last = id
+	}
+}
+
+// highWater returns the highest id handed out or seen
+func (g *idGenerator) highWater() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.last
+}
+
+// nextID returns a new record id of the database
+func (db *HTDB) nextID() int64 {
+	if db == nil || db.ids == nil {
+		return processIDs.next()
+	}
+	return db.ids.next()
+}
+
+// loadIDs starts the id generator above the persisted high-water mark and
+// above every id in the tables, and persists the mark from now on
+func (db *HTDB) loadIDs() error {
+	store := db.storage()
+	data, err := readFile(store, filepath.Join(db.mainPath, idsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) == 8 {
+		db.ids.observe(int64(binary.LittleEndian.Uint64(data)))
+	}
+
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return err
+	}
+	for _, schema := range schemas {
+		tables, err := db.TableNames(schema)
+		if err != nil {
+			return err
+		}
+		for _, tableName := range tables {
+			table, err := db.getTable(schema + ":" + tableName)
+			if errors.Is(err, ErrSchemaMismatch) {
+				continue // The record size isn't known
+			}
+			if err != nil {
+				return err
+			}
+			err = table.streamRawRecords(func(data []byte) error {
+				db.ids.observe(recordID(data))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	db.ids.mu.Lock()
+	db.ids.persist = db.persistIDs
+	db.ids.mu.Unlock()
+	return nil
+}
+
+// persistIDs writes the high-water mark of the id generator
+func (db *HTDB) persistIDs(mark int64) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(mark))
+	err := writeFile(db.storage(), filepath.Join(db.mainPath, idsFileName), data, db.fileMode())
+	if err != nil {
+		db.log(slog.LevelWarn, "failed to persist the id high-water mark", "error", err)
+	}
+	return err
+}
+
+// saveIDs persists the exact high-water mark, used by Close
+func (db *HTDB) saveIDs() error {
+	db.ids.mu.Lock()
+	defer db.ids.mu.Unlock()
+
+	if db.ids.persist == nil {
+		return nil
+	}
+	mark := db.ids.last
+	if db.ids.reserved > mark {
+		mark = db.ids.reserved
+	}
+	return db.ids.persist(mark)
+}
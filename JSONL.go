@@ -0,0 +1,268 @@
+// JSONL.go
+// Description: JSON Lines export and import for the HTDB library
+// Moves typed records between HTDB instances and other systems, one JSON object per line
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const jsonlMetadataKey = "_metadata" // Key of the record metadata in exported objects
+
+// JSONLExportOptions configures ExportJSONL
+type JSONLExportOptions struct {
+	Query           *Query // Only export the records matching this query, nil exports every current record
+	IncludeMetadata bool   // Add the record metadata under "_metadata"
+}
+
+// JSONLImportOptions configures ImportJSONL
+type JSONLImportOptions struct {
+	BatchSize       int  // Records inserted per transaction, defaults to 500
+	ContinueOnError bool // Skip lines that fail and keep importing instead of stopping at the first one
+}
+
+// ExportJSONL writes the current records of a table to w as JSON Lines. Every
+// field appears in each object in schema order with its typed value, null
+// fields as null. Ref fields are inlined, timeID fields are nanoseconds.
+func (tm *TableManager) ExportJSONL(table *Table, w io.Writer, options JSONLExportOptions) error {
+	if options.Query != nil && tableCacheKey(options.Query.table) != tableCacheKey(table) {
+		return fmt.Errorf("query doesn't select from table '%s'", table.TableName)
+	}
+	fields := exportFields(table, options.Query)
+
+	refs := newRefReader(table)
+	defer refs.close()
+
+	writer := bufio.NewWriter(w)
+	var line bytes.Buffer
+
+	writeRecord := func(record *Record) error {
+		line.Reset()
+		line.WriteByte('{')
+		for i, field := range fields {
+			value, present, err := exportValue(record, field, refs)
+			if err != nil {
+				return fmt.Errorf("failed to export record %d: %v", record.ID, err)
+			}
+			if !present {
+				value = nil
+			}
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			err = writeJSONMember(&line, field.Name, value)
+			if err != nil {
+				return err
+			}
+		}
+		if options.IncludeMetadata {
+			if len(fields) > 0 {
+				line.WriteByte(',')
+			}
+			err := writeJSONMember(&line, jsonlMetadataKey, record.Metadata)
+			if err != nil {
+				return err
+			}
+		}
+		line.WriteString("}\n")
+
+		_, err := writer.Write(line.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to write JSON Lines: %v", err)
+		}
+		return nil
+	}
+
+	var err error
+	if options.Query != nil {
+		err = options.Query.Stream(writeRecord)
+	} else {
+		err = table.StreamRecordsWith(ScanOptions{}, writeRecord)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write JSON Lines: %v", err)
+	}
+	return nil
+}
+
+// writeJSONMember appends "name":value to an object being built
+func writeJSONMember(buf *bytes.Buffer, name string, value interface{}) error {
+	key, err := json.Marshal(name)
+	if err != nil {
+		return fmt.Errorf("failed to encode field '%s': %v", name, err)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode field '%s': %v", name, err)
+	}
+
+	buf.Write(key)
+	buf.WriteByte(':')
+	buf.Write(encoded)
+	return nil
+}
+
+// ImportJSONL inserts the objects of a JSON Lines stream into a table and
+// returns how many were inserted. Every object is validated against the schema,
+// id and "_metadata" are ignored as records get new ids. A key set to null
+// inserts a null, a missing key leaves the field unset. Errors are handled
+// like in ImportCSV, with the line number of the failing object.
+func (tm *TableManager) ImportJSONL(table *Table, r io.Reader, options JSONLImportOptions) (int, error) {
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	reader := bufio.NewReader(r)
+	batch := newImportBatch(tm, table, batchSize)
+	var rowErrors ImportErrors
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			batch.rollback()
+			return batch.inserted, fmt.Errorf("failed to read JSON Lines: %v", err)
+		}
+		atEOF := err == io.EOF
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			data, err := parseJSONLObject(line, table)
+			if err == nil {
+				err = batch.add(data)
+			}
+			if err != nil {
+				rowErr := &ImportRowError{Line: lineNumber, Err: err}
+				if !options.ContinueOnError {
+					batch.rollback()
+					return batch.inserted, rowErr
+				}
+				rowErrors = append(rowErrors, rowErr)
+			} else if batch.full() {
+				err = batch.commit()
+				if err != nil {
+					return batch.inserted, err
+				}
+			}
+		}
+
+		if atEOF {
+			break
+		}
+	}
+
+	err := batch.commit()
+	if err != nil {
+		return batch.inserted, err
+	}
+
+	if len(rowErrors) > 0 {
+		return batch.inserted, rowErrors
+	}
+	return batch.inserted, nil
+}
+
+// ParseJSONValues decodes a JSON object of field values, as sent by API
+// clients, into the typed values StageInsert and StageUpdate expect. Unknown
+// fields and values of the wrong type are rejected, id is ignored.
+func (t *Table) ParseJSONValues(data []byte) (map[string]interface{}, error) {
+	return parseJSONLObject(data, t)
+}
+
+// parseJSONLObject decodes a line and converts its values to the field types
+func parseJSONLObject(line []byte, table *Table) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber() // Keep integers exact instead of going through float64
+
+	var object map[string]interface{}
+	err := decoder.Decode(&object)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON object: %v", err)
+	}
+	if object == nil {
+		return nil, errors.New("line is not a JSON object")
+	}
+
+	data := make(map[string]interface{}, len(object))
+	for name, value := range object {
+		if name == "id" || name == jsonlMetadataKey {
+			continue
+		}
+
+		var field *Field
+		for i := range table.Fields {
+			if table.Fields[i].Name == name {
+				field = &table.Fields[i]
+				break
+			}
+		}
+		if field == nil {
+			return nil, fmt.Errorf("'%s' is not a field of table '%s'", name, table.TableName)
+		}
+
+		converted, err := parseJSONValue(value, *field)
+		if err != nil {
+			return nil, err
+		}
+		data[name] = converted
+	}
+	return data, nil
+}
+
+// parseJSONValue converts a decoded JSON value to the type of its field
+func parseJSONValue(value interface{}, field Field) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch field.Type {
+	case String, "ref":
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a string value", field.Name)
+		}
+		if field.Type == String && uint(len(str)) > field.capacity() {
+			return nil, fmt.Errorf("value of field '%s' is longer than %d bytes", field.Name, field.capacity())
+		}
+		return str, nil
+	case Int, TimeID:
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires an integer value", field.Name)
+		}
+		integer, err := strconv.ParseInt(number.String(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires an integer value: %v", field.Name, err)
+		}
+		return integer, nil
+	case Float:
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a number value", field.Name)
+		}
+		float, err := number.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires a number value: %v", field.Name, err)
+		}
+		return float, nil
+	case Bool:
+		boolean, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a bool value", field.Name)
+		}
+		return boolean, nil
+	}
+	return nil, fmt.Errorf("unsupported field type '%s'", field.Type)
+}
@@ -0,0 +1,77 @@
+// JSONL_test.go
+// Description: Tests of the JSON Lines export and import of the HTDB library
+// Every field type must survive a round trip through JSON Lines, nulls included
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestJSONLRoundTrip(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	source := createTestTable(t, db, "s", "source", typedFields)
+	target := createTestTable(t, db, "s", "target", typedFields)
+	for _, data := range typedRecords {
+		insertTestRecord(t, tm, source, data)
+	}
+
+	var out bytes.Buffer
+	err := tm.ExportJSONL(source, &out, JSONLExportOptions{})
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	imported, err := tm.ImportJSONL(target, &out, JSONLImportOptions{})
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if imported != len(typedRecords) {
+		t.Errorf("imported %d records, want %d", imported, len(typedRecords))
+	}
+
+	want, got := fieldValues(t, tm, source), fieldValues(t, tm, target)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("imported records = %v, want %v", got, want)
+	}
+}
+
+// Exports are compared against golden files, the same table must export to
+// the same bytes every time with the fields in schema order
+func TestJSONLExportRepeatable(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", typedFields)
+	for _, data := range typedRecords {
+		insertTestRecord(t, tm, table, data)
+	}
+
+	var first []byte
+	for run := 0; run < 20; run++ {
+		var out bytes.Buffer
+		err := tm.ExportJSONL(table, &out, JSONLExportOptions{IncludeMetadata: true})
+		if err != nil {
+			t.Fatalf("failed to export: %v", err)
+		}
+		if run == 0 {
+			first = out.Bytes()
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), first) {
+			t.Fatalf("export %d differs:\n%s\nfirst export:\n%s", run, out.Bytes(), first)
+		}
+	}
+
+	line, _, _ := bytes.Cut(first, []byte("\n"))
+	previous := -1
+	for _, field := range typedFields {
+		at := bytes.Index(line, []byte(`"`+field.Name+`":`))
+		if at <= previous {
+			t.Errorf("field %s is out of schema order in %s", field.Name, line)
+		}
+		previous = at
+	}
+}
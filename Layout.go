@@ -0,0 +1,422 @@
+// Layout.go
+// Description: Binary record layout for the HTDB library
+// Single source of truth for record size and field offsets
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The fixed record header: the id, one byte of metadata flags and the
+// transaction id. Serialize, DeserializeRecord and every raw scan read the
+// header through these, the fields follow at recordHeaderSize.
+const (
+	recordIDOffset    = 0 // 8 bytes, little endian
+	recordIDSize      = 8
+	recordFlagsOffset = recordIDOffset + recordIDSize // 1 byte, see flagCurrent
+	recordTxIDOffset  = recordFlagsOffset + 1         // 3 bytes, little endian
+	recordTxIDSize    = 3
+	recordHeaderSize  = recordTxIDOffset + recordTxIDSize
+
+	fieldMetaSize = 1 // isNull byte in front of every field
+)
+
+// The audit trailer following the fields from layout version 2 on: when the
+// version was committed and by which transaction. From version 4 on it ends
+// in the id of the record's first version, see Record.LogicalID.
+const (
+	recordCommitTimeSize = 8 // UnixNano, little endian
+	recordCommitTxSize   = 8 // Transaction id, little endian
+	recordAuditSize      = recordCommitTimeSize + recordCommitTxSize
+	recordOriginSize     = 8 // Id, little endian, 0 for first versions
+
+	auditLayoutVersion  = 2 // First layout version with the audit trailer
+	originLayoutVersion = 4 // First layout version with the origin id
+	floatLayoutVersion  = 5 // First layout version storing float fields as IEEE 754 bits
+)
+
+// Metadata flags of a record
+const (
+	flagCurrent byte = 1 << iota
+	flagDeleted
+	flagLocked
+
+	knownFlags = flagCurrent | flagDeleted | flagLocked
+)
+
+// RecordLayout describes where every field of a table lives inside a serialized record
+type RecordLayout struct {
+	Size         int           // Total size of a serialized record in bytes
+	Fields       []FieldLayout // Layout of every stored field, in table order (without id)
+	AuditOffset  int           // Offset of the commit time and transaction id, 0 in formats without them
+	OriginOffset int           // Offset of the origin id, 0 in formats without it
+
+	fieldIndex map[string]int // Index into Fields by field name
+	floatBits  bool           // Float fields hold IEEE 754 bits, older formats the value cut to a uint64
+}
+
+// FieldLayout describes the position of a single field inside a serialized record
+type FieldLayout struct {
+	Field      Field // The field definition
+	MetaOffset int   // Offset of the field's metadata byte (isNull)
+	DataOffset int   // Offset of the field's data, Field.Length bytes long
+}
+
+// NewRecordLayout computes the record layout for a list of fields in the
+// current format. The id field is part of the record header and has no entry
+// in Fields.
+func NewRecordLayout(fields []Field) *RecordLayout {
+	return newRecordLayout(fields, layoutVersion)
+}
+
+// newRecordLayout computes the record layout for a list of fields in the
+// format of the given layout version
+func newRecordLayout(fields []Field, version int) *RecordLayout {
+	layout := &RecordLayout{fieldIndex: make(map[string]int)}
+	offset := recordHeaderSize
+
+	for _, field := range fields {
+		if field.Name == "id" {
+			continue // Stored in the header
+		}
+
+		layout.fieldIndex[field.Name] = len(layout.Fields)
+		layout.Fields = append(layout.Fields, FieldLayout{
+			Field:      field,
+			MetaOffset: offset,
+			DataOffset: offset + fieldMetaSize,
+		})
+		offset += fieldMetaSize + int(field.Length)
+	}
+
+	if version >= auditLayoutVersion {
+		layout.AuditOffset = offset
+		offset += recordAuditSize
+	}
+	if version >= originLayoutVersion {
+		layout.OriginOffset = offset
+		offset += recordOriginSize
+	}
+	layout.floatBits = version >= floatLayoutVersion
+
+	layout.Size = offset
+	return layout
+}
+
+// Layout returns the record layout of the table in the format of its file,
+// computing it on first use
+func (t *Table) Layout() *RecordLayout {
+	if t.layout == nil {
+		t.layout = newRecordLayout(t.Fields, t.FormatVersion)
+	}
+	return t.layout
+}
+
+// RecordSize returns the size in bytes of a single serialized record
+func (t *Table) RecordSize() int {
+	return t.Layout().Size
+}
+
+// Parts of a serialized record, see LayoutEntry
+const (
+	LayoutHeader = "header" // The id, metadata flags and transaction id
+	LayoutField  = "field"  // A field of the table
+	LayoutAudit  = "audit"  // The commit time and transaction, from layout version 2 on
+)
+
+// LayoutEntry is a byte range of a serialized record, for tools that inspect
+// raw table files
+type LayoutEntry struct {
+	Part           string     // LayoutHeader, LayoutField or LayoutAudit
+	FieldName      string     // Field name, or id, flags, transaction_id, committed_at, committed_by and origin_id
+	Type           FieldTypes // Field type, empty for the parts that aren't fields
+	Offset         int        // Offset of the data
+	Length         int        // Length of the data in bytes
+	MetaByteOffset int        // Offset of the isNull byte of a field, -1 for the other parts
+}
+
+// Entries returns every byte range of a serialized record in file order, the
+// header, the fields and the audit trailer
+func (l *RecordLayout) Entries() []LayoutEntry {
+	entries := []LayoutEntry{
+		{Part: LayoutHeader, FieldName: "id", Type: TimeID, Offset: recordIDOffset, Length: recordIDSize, MetaByteOffset: -1},
+		{Part: LayoutHeader, FieldName: "flags", Offset: recordFlagsOffset, Length: 1, MetaByteOffset: -1},
+		{Part: LayoutHeader, FieldName: "transaction_id", Offset: recordTxIDOffset, Length: recordTxIDSize, MetaByteOffset: -1},
+	}
+	for _, field := range l.Fields {
+		entries = append(entries, LayoutEntry{
+			Part:           LayoutField,
+			FieldName:      field.Field.Name,
+			Type:           field.Field.Type,
+			Offset:         field.DataOffset,
+			Length:         int(field.Field.Length),
+			MetaByteOffset: field.MetaOffset,
+		})
+	}
+	if l.AuditOffset != 0 {
+		entries = append(entries,
+			LayoutEntry{Part: LayoutAudit, FieldName: "committed_at", Offset: l.AuditOffset, Length: recordCommitTimeSize, MetaByteOffset: -1},
+			LayoutEntry{Part: LayoutAudit, FieldName: "committed_by", Offset: l.AuditOffset + recordCommitTimeSize, Length: recordCommitTxSize, MetaByteOffset: -1})
+	}
+	if l.OriginOffset != 0 {
+		entries = append(entries, LayoutEntry{Part: LayoutAudit, FieldName: "origin_id", Offset: l.OriginOffset, Length: recordOriginSize, MetaByteOffset: -1})
+	}
+	return entries
+}
+
+// DumpRecord renders a serialized record of the table for debugging, one line
+// per byte range of Entries with its offset, length, decoded value and bytes.
+// A record that can't be decoded is dumped with the reason appended.
+func (t *Table) DumpRecord(data []byte) (string, error) {
+	layout := t.Layout()
+	if len(data) < layout.Size {
+		return "", fmt.Errorf("%w: record has %d bytes, table '%s' needs %d", ErrCorrupt, len(data), t.TableName, layout.Size)
+	}
+	data = data[:layout.Size]
+
+	record := &Record{}
+	decodeErr := record.DeserializeInto(data, layout)
+
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "record of table '%s', %d bytes\n", t.TableName, layout.Size)
+	fmt.Fprintf(&dump, "%6s %4s  %-24s %-8s %-32s %s\n", "OFFSET", "LEN", "NAME", "TYPE", "VALUE", "BYTES")
+	line := func(offset, length int, name string, fieldType FieldTypes, value string) {
+		fmt.Fprintf(&dump, "%6d %4d  %-24s %-8s %-32s %s\n",
+			offset, length, name, fieldType, value, dumpBytes(data[offset:offset+length]))
+	}
+
+	for _, entry := range layout.Entries() {
+		if entry.MetaByteOffset >= 0 {
+			null := "set"
+			if data[entry.MetaByteOffset] == 1 {
+				null = "null"
+			}
+			line(entry.MetaByteOffset, fieldMetaSize, entry.FieldName+" (meta)", "", null)
+		}
+
+		value := ""
+		if decodeErr == nil {
+			value = dumpValue(record, entry)
+		}
+		line(entry.Offset, entry.Length, entry.FieldName, entry.Type, value)
+	}
+
+	if decodeErr != nil {
+		fmt.Fprintf(&dump, "record can't be decoded: %v\n", decodeErr)
+	}
+	return dump.String(), nil
+}
+
+// dumpValue returns the decoded value of a byte range of a record for DumpRecord
+func dumpValue(record *Record, entry LayoutEntry) string {
+	switch entry.Part {
+	case LayoutHeader:
+		switch entry.FieldName {
+		case "id":
+			return strconv.FormatInt(record.ID, 10)
+		case "flags":
+			var flags []string
+			if record.Metadata.IsCurrent {
+				flags = append(flags, "current")
+			}
+			if record.Metadata.IsDeleted {
+				flags = append(flags, "deleted")
+			}
+			if record.Metadata.IsLocked {
+				flags = append(flags, "locked")
+			}
+			return strings.Join(flags, ",")
+		}
+		return strconv.FormatUint(record.Metadata.TransactionID, 10)
+	case LayoutAudit:
+		switch entry.FieldName {
+		case "committed_at":
+			return time.Unix(0, record.Metadata.CommittedAt).UTC().Format(time.RFC3339Nano)
+		case "origin_id":
+			return strconv.FormatInt(record.Metadata.OriginID, 10)
+		}
+		return strconv.FormatUint(record.Metadata.CommittedBy, 10)
+	}
+
+	value, exists := record.FieldsData[entry.FieldName]
+	switch {
+	case record.FieldsMeta[entry.FieldName].IsNull:
+		return "NULL"
+	case entry.Type == "ref":
+		offsets := record.RefOffsets[entry.FieldName]
+		return fmt.Sprintf("ref [%d, %d)", offsets[0], offsets[1])
+	case !exists:
+		return "" // Not decoded for the type
+	case entry.Type == String:
+		return strconv.Quote(fmt.Sprint(value))
+	}
+	return fmt.Sprint(value)
+}
+
+// dumpBytes returns the hex of up to 16 bytes, longer ranges are cut off
+func dumpBytes(data []byte) string {
+	const maxDumpBytes = 16
+	if len(data) > maxDumpBytes {
+		return hex.EncodeToString(data[:maxDumpBytes]) + "..."
+	}
+	return hex.EncodeToString(data)
+}
+
+// putRecordHeader writes the id and metadata into the header of a serialized record
+func putRecordHeader(data []byte, id int64, metadata RecordMetadata) {
+	binary.LittleEndian.PutUint64(data[recordIDOffset:recordIDOffset+recordIDSize], uint64(id))
+
+	flags := byte(0)
+	if metadata.IsCurrent {
+		flags |= flagCurrent
+	}
+	if metadata.IsDeleted {
+		flags |= flagDeleted
+	}
+	if metadata.IsLocked {
+		flags |= flagLocked
+	}
+	data[recordFlagsOffset] = flags
+
+	txID := metadata.TransactionID
+	for i := 0; i < recordTxIDSize; i++ {
+		data[recordTxIDOffset+i] = byte(txID >> (8 * i))
+	}
+}
+
+// readRecordHeader reads the id and metadata from the header of a serialized record
+func readRecordHeader(data []byte) (int64, RecordMetadata) {
+	flags := recordFlags(data)
+	metadata := RecordMetadata{
+		IsCurrent: flags&flagCurrent != 0,
+		IsDeleted: flags&flagDeleted != 0,
+		IsLocked:  flags&flagLocked != 0,
+	}
+	for i := 0; i < recordTxIDSize; i++ {
+		metadata.TransactionID |= uint64(data[recordTxIDOffset+i]) << (8 * i)
+	}
+	return recordID(data), metadata
+}
+
+// putRecordAudit writes the commit time, transaction and origin id into the
+// audit trailer of a serialized record, as far as its format has them
+func putRecordAudit(data []byte, layout *RecordLayout, metadata RecordMetadata) {
+	if layout.AuditOffset == 0 {
+		return
+	}
+	offset := layout.AuditOffset
+	binary.LittleEndian.PutUint64(data[offset:offset+recordCommitTimeSize], uint64(metadata.CommittedAt))
+	offset += recordCommitTimeSize
+	binary.LittleEndian.PutUint64(data[offset:offset+recordCommitTxSize], metadata.CommittedBy)
+
+	if layout.OriginOffset != 0 {
+		binary.LittleEndian.PutUint64(data[layout.OriginOffset:layout.OriginOffset+recordOriginSize], uint64(metadata.OriginID))
+	}
+}
+
+// readRecordAudit reads the audit trailer of a serialized record into metadata
+func readRecordAudit(data []byte, layout *RecordLayout, metadata *RecordMetadata) {
+	if layout.AuditOffset == 0 {
+		return
+	}
+	offset := layout.AuditOffset
+	metadata.CommittedAt = int64(binary.LittleEndian.Uint64(data[offset : offset+recordCommitTimeSize]))
+	offset += recordCommitTimeSize
+	metadata.CommittedBy = binary.LittleEndian.Uint64(data[offset : offset+recordCommitTxSize])
+
+	if layout.OriginOffset != 0 {
+		metadata.OriginID = recordOrigin(data, layout)
+	}
+}
+
+// recordOrigin returns the stored origin id of a serialized record, 0 for
+// first versions and formats without it
+func recordOrigin(data []byte, layout *RecordLayout) int64 {
+	if layout.OriginOffset == 0 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(data[layout.OriginOffset : layout.OriginOffset+recordOriginSize]))
+}
+
+// recordID returns the id of a serialized record
+func recordID(data []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(data[recordIDOffset : recordIDOffset+recordIDSize]))
+}
+
+// recordFlags returns the metadata flags of a serialized record
+func recordFlags(data []byte) byte {
+	return data[recordFlagsOffset]
+}
+
+// layoutHashEnding is the ending of the file holding the layout hash of a
+// table's records. Not fileEnding, so it is never taken for a table.
+const layoutHashEnding = ".layout.sha256"
+
+// Hash returns a hex SHA-256 of the name, type and length of every field in
+// record order, and whether it is packed. Records can only be read with a
+// layout of the same hash.
+func (l *RecordLayout) Hash() string {
+	hash := sha256.New()
+	for _, field := range l.Fields {
+		if field.Field.Compression == CompressionPacked {
+			fmt.Fprintf(hash, "%s\x00%s\x00%d\x00packed\n", field.Field.Name, field.Field.Type, field.Field.Length)
+			continue
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%d\n", field.Field.Name, field.Field.Type, field.Field.Length)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeLayoutHash records the layout the table's records are written with,
+// unless the file already holds it
+func (t *Table) writeLayoutHash(store Storage) error {
+	hash := t.Layout().Hash()
+	path := t.layoutHashPath()
+	current, err := readFile(store, path)
+	if err == nil && string(current) == hash {
+		return nil
+	}
+
+	err = writeFile(store, path+".temp", []byte(hash), t.db.fileMode())
+	if err == nil {
+		err = store.Rename(path+".temp", path)
+	}
+	if err != nil {
+		store.Remove(path + ".temp")
+		return fmt.Errorf("failed to write layout hash: %w", err)
+	}
+	return nil
+}
+
+// checkLayoutHash returns ErrSchemaMismatch if the table's records were
+// written with a different layout than its configuration describes, e.g.
+// after a field was added to the configuration by hand. Tables written before
+// the hash was recorded and empty tables are not checked.
+func (t *Table) checkLayoutHash(store Storage) error {
+	recorded, err := readFile(store, t.layoutHashPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read layout hash: %w", err)
+	}
+	if string(recorded) == t.Layout().Hash() {
+		return nil
+	}
+
+	info, err := store.Stat(t.filePath())
+	if os.IsNotExist(err) || err == nil && info.Size() == 0 {
+		return nil // Nothing was written with the old layout
+	}
+	return fmt.Errorf("%w: the records were written with other fields than the configuration describes, "+
+		"restore the previous configuration and change the fields through ImportSchema with AlterExisting", ErrSchemaMismatch)
+}
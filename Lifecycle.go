@@ -0,0 +1,347 @@
+// Lifecycle.go
+// Description: Opening and closing of an HTDB database
+// Open validates and recovers a database directory, Close and Shutdown shut it down cleanly
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// States of a database, see HTDB.state
+const (
+	dbOpen    int32 = iota // Usable
+	dbClosing              // Close was called, no new transactions are begun
+	dbClosed               // Every API returns ErrClosed
+)
+
+// ClosePolicy decides what Close does with transactions that are still active
+type ClosePolicy int
+
+const (
+	CloseAbort ClosePolicy = iota // Roll back active transactions (default)
+	CloseWait                     // Wait until active transactions commit or roll back
+)
+
+// OpenOptions configures Open
+type OpenOptions struct {
+	Create      bool        // Create the directory if it doesn't exist
+	Storage     Storage     // Where the files live, defaults to the local disk (process memory for MemoryPath)
+	ClosePolicy ClosePolicy // What Close does with active transactions
+	Config      *Config     // Settings overriding the config file for this process
+	SaveConfig  bool        // Write the settings of Config into the config file
+	Migrate     bool        // Upgrade a database of an older layout version, see Migrate
+	FileMode    os.FileMode // Mode of new files, kept in the config file, see SetPermissions
+	DirMode     os.FileMode // Mode of new directories, kept in the config file, see SetPermissions
+}
+
+// Open opens the database in the directory at path. Unlike NewHTDB it checks
+// the directory up front: it must exist (or is created with Create), must not
+// be open in another process or another Open of this process, and must hold a
+// valid database layout. Interrupted compactions and torn trailing records are
+// recovered before Open returns. The settings of the config file db.conf.htdb
+// are applied, the file is written with options.Config on first use. Call
+// Close when done.
+//
+// Data written by a newer version of the library is refused with
+// ErrUnsupportedVersion. A database of an older layout version is opened as
+// it is, call Migrate or set Migrate to upgrade it.
+func Open(path string, options OpenOptions) (*HTDB, error) {
+	store := options.Storage
+	if store == nil {
+		store = OSStorage{}
+		if path == MemoryPath {
+			store = NewMemoryStorage()
+			options.Create = true // A new memory database is always empty
+		}
+	}
+
+	stat, err := store.Stat(path)
+	if os.IsNotExist(err) && options.Create {
+		dirMode := options.DirMode
+		if dirMode == 0 {
+			dirMode = defaultDirMode
+		}
+		err = createMainDir(store, path, dirMode)
+		if err == nil {
+			stat, err = store.Stat(path)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database '%s': %w", path, err)
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("failed to open database '%s': not a directory", path)
+	}
+
+	lock, err := acquireProcessLock(store, path)
+	if err != nil {
+		return nil, err
+	}
+
+	db := NewHTDBWithStorage(path, store)
+	db.lock = lock
+	db.closePolicy = options.ClosePolicy
+
+	// Nothing may be written to data of a newer version, recovery included
+	config, _, err := readConfig(store, path)
+	if err == nil {
+		err = checkLayoutVersion(config.LayoutVersion)
+	}
+	if err == nil {
+		db.setAttached(config.AttachedSchemas)
+		err = db.loadSchemas()
+	}
+	if err == nil {
+		_, err = db.Recover()
+	}
+	if err == nil {
+		err = db.loadConfig(options.Config, options.SaveConfig)
+	}
+	if err == nil && (options.FileMode != 0 || options.DirMode != 0) {
+		err = db.SetPermissions(options.FileMode, options.DirMode)
+	}
+	if err == nil {
+		err = db.loadIDs()
+	}
+	if err == nil && db.LayoutVersion() < layoutVersion {
+		if options.Migrate {
+			_, err = db.Migrate()
+		} else {
+			db.log(slog.LevelWarn, "database has an older layout version, call Migrate",
+				"version", db.LayoutVersion(), "current", layoutVersion)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database '%s': %w", path, err)
+	}
+	return db, nil
+}
+
+// createMainDir creates the directory of a new database and its parents
+func createMainDir(store Storage, path string, perm os.FileMode) error {
+	if _, ok := store.(OSStorage); ok {
+		return os.MkdirAll(path, perm)
+	}
+	if memory, ok := store.(*memoryStorage); ok {
+		memory.mkdirAll(path)
+		return nil
+	}
+	return store.Mkdir(path, perm)
+}
+
+// loadSchemas checks that every schema has its index and every table
+// configuration can be read
+func (db *HTDB) loadSchemas() error {
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return err
+	}
+
+	for _, schema := range schemas {
+		_, err := db.storage().Stat(schemaIndexPath(db.schemaPath(schema)))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: directory '%s' is not a schema, it has no index", ErrCorrupt, schema)
+		}
+		if err != nil {
+			return err
+		}
+
+		tables, err := db.TableNames(schema)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			_, err := db.getTable(schema + ":" + table)
+			if errors.Is(err, ErrSchemaMismatch) {
+				// Only the table is unusable, it can be repaired once the database is open
+				db.log(slog.LevelError, "table configuration doesn't match its records", "schema", schema, "table", table)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close shuts the database down: the cleanup worker is stopped, active
+// transactions are rolled back or waited for according to the close policy,
+// queued asynchronous inserts are written, subscriptions and the change log
+// are closed and every file handle and the directory lock are released.
+// Afterwards every API returns ErrClosed, closing again included.
+func (db *HTDB) Close() error {
+	if !db.state.CompareAndSwap(dbOpen, dbClosing) {
+		return ErrClosed
+	}
+
+	return db.close(func(tm *TableManager) error {
+		return tm.endTransactions(db.closePolicy)
+	})
+}
+
+// ShutdownReport is the result of Shutdown
+type ShutdownReport struct {
+	Aborted  []AbortedTransaction // Transactions still active when the context ended, rolled back
+	Duration time.Duration        // How long the shutdown took
+}
+
+// AbortedTransaction describes a transaction rolled back by Shutdown
+type AbortedTransaction struct {
+	ID        uint64
+	StartTime time.Time
+	Tables    []string // Tables with staged records, as schema:table
+	Records   int      // Number of staged records that were discarded
+}
+
+// Shutdown shuts the database down gracefully, e.g. on SIGTERM. No new
+// transactions are begun, the cleanup worker is stopped and queued
+// asynchronous inserts are written. Active transactions may commit or roll
+// back until ctx is done, the ones still active then are rolled back, which
+// releases their record locks. Ref values they staged are dropped by the next
+// compaction. Then everything is flushed and closed like Close does. The report
+// lists the rolled back transactions, ctx.Err() is not returned as an error.
+func (db *HTDB) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	if !db.state.CompareAndSwap(dbOpen, dbClosing) {
+		return nil, ErrClosed
+	}
+
+	start := time.Now()
+	report := &ShutdownReport{}
+	err := db.close(func(tm *TableManager) error {
+		tm.waitTransactions(ctx)
+		aborted, err := tm.abortTransactions()
+		report.Aborted = aborted
+		return err
+	})
+	report.Duration = time.Since(start)
+
+	if len(report.Aborted) > 0 {
+		db.log(slog.LevelWarn, "transactions aborted by shutdown", "transactions", len(report.Aborted), "duration", report.Duration)
+	}
+	return report, err
+}
+
+// close releases everything of a database whose state was set to closing.
+// endTransactions ends the active transactions once no new work is queued.
+func (db *HTDB) close(endTransactions func(tm *TableManager) error) error {
+	var errs []error
+	tm := db.tableManager
+	if tm != nil {
+		if tm.cleanupWorker.Load() != nil {
+			errs = append(errs, tm.StopCleanupWorker())
+		}
+		tm.CloseAsync()
+		errs = append(errs, endTransactions(tm))
+	}
+
+	db.events.closeAll()
+	if db.changes != nil {
+		errs = append(errs, db.changes.close())
+	}
+	errs = append(errs, db.saveIDs())
+
+	db.state.Store(dbClosed)
+	errs = append(errs, db.files.closeAll())
+	if db.lock != nil {
+		errs = append(errs, db.lock.release())
+	}
+	return errors.Join(errs...)
+}
+
+// endTransactions rolls back or waits for the active transactions
+func (tm *TableManager) endTransactions(policy ClosePolicy) error {
+	if policy == CloseWait {
+		tm.waitTransactions(context.Background())
+		return nil
+	}
+
+	_, err := tm.abortTransactions()
+	return err
+}
+
+// waitTransactions waits until there are no active transactions or ctx is done
+func (tm *TableManager) waitTransactions(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		tm.transactionsMu.Lock()
+		active := len(tm.transactions)
+		tm.transactionsMu.Unlock()
+		if active == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// abortTransactions rolls back every active transaction and returns what was discarded
+func (tm *TableManager) abortTransactions() ([]AbortedTransaction, error) {
+	tm.transactionsMu.Lock()
+	active := make([]*Transaction, 0, len(tm.transactions))
+	for _, tx := range tm.transactions {
+		active = append(active, tx)
+	}
+	tm.transactionsMu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+
+	var aborted []AbortedTransaction
+	var errs []error
+	for _, tx := range active {
+		info := tx.info()
+		summary := AbortedTransaction{ID: info.ID, StartTime: info.StartTime, Tables: info.Tables, Records: info.Records}
+
+		err := tm.RollbackTransaction(tx)
+		if errors.Is(err, ErrTxNotActive) {
+			continue // Ended on its own meanwhile
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		aborted = append(aborted, summary)
+	}
+	return aborted, errors.Join(errs...)
+}
+
+// checkOpen returns ErrClosed once the database is closed
+func (db *HTDB) checkOpen() error {
+	if db != nil && db.state.Load() == dbClosed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// checkAccepting returns ErrClosed once Close was called
+func (db *HTDB) checkAccepting() error {
+	if db != nil && db.state.Load() != dbOpen {
+		return ErrClosed
+	}
+	return nil
+}
+
+// closedStorage is the storage of a closed database, it fails every operation
+type closedStorage struct{}
+
+func (closedStorage) OpenFile(string, int, fs.FileMode) (StorageFile, error) { return nil, ErrClosed }
+func (closedStorage) Stat(string) (fs.FileInfo, error)                       { return nil, ErrClosed }
+func (closedStorage) ReadDir(string) ([]fs.DirEntry, error)                  { return nil, ErrClosed }
+func (closedStorage) Mkdir(string, fs.FileMode) error                        { return ErrClosed }
+func (closedStorage) Remove(string) error                                    { return ErrClosed }
+func (closedStorage) Rename(string, string) error                            { return ErrClosed }
+func (closedStorage) SyncDir(string) error                                   { return ErrClosed }
@@ -0,0 +1,73 @@
+// Listing.go
+// Description: Paginated schema and table listings for the HTDB library
+// Filters the names of a single directory read by prefix and splits them into pages
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"sort"
+	"strings"
+)
+
+// ListOptions selects a page of a listing, see ListSchemas and ListTables
+type ListOptions struct {
+	Prefix string // Only names starting with Prefix
+	Limit  int    // Most names of a page, 0 for all
+	After  string // Next of the previous page, empty for the first page
+}
+
+// ListPage is a page of names in sorted order
+type ListPage struct {
+	Names []string `json:"names"`
+	Next  string   `json:"next,omitempty"` // After of the next page, empty on the last page
+}
+
+// ListSchemas returns a page of the schema names, attached ones included.
+// Pages continue after the last name of the previous one, so schemas created
+// or dropped meanwhile never make a page repeat or skip the others.
+func (db *HTDB) ListSchemas(options ListOptions) (ListPage, error) {
+	names, err := db.SchemaNames()
+	if err != nil {
+		return ListPage{}, err
+	}
+	return listPage(names, options)
+}
+
+// ListTables returns a page of the table names of a schema, see ListSchemas
+func (db *HTDB) ListTables(schema string, options ListOptions) (ListPage, error) {
+	names, err := db.TableNames(schema)
+	if err != nil {
+		return ListPage{}, err
+	}
+	return listPage(names, options)
+}
+
+// listPage cuts the page options selects out of sorted names
+func listPage(names []string, options ListOptions) (ListPage, error) {
+	if options.Limit < 0 {
+		return ListPage{}, NewResponse(StatusBadRequest, "limit must not be negative")
+	}
+
+	// The names with the prefix follow each other
+	start := sort.SearchStrings(names, options.Prefix)
+	if options.After >= options.Prefix {
+		start = sort.SearchStrings(names, options.After)
+		if start < len(names) && names[start] == options.After {
+			start++
+		}
+	}
+
+	page := ListPage{Names: []string{}}
+	for _, name := range names[start:] {
+		if !strings.HasPrefix(name, options.Prefix) {
+			break
+		}
+		if options.Limit > 0 && len(page.Names) == options.Limit {
+			page.Next = page.Names[len(page.Names)-1]
+			break
+		}
+		page.Names = append(page.Names, name)
+	}
+	return page, nil
+}
@@ -0,0 +1,119 @@
+// Listing_test.go
+// Description: Tests of the paginated listings of the HTDB library
+// Pages filter by prefix and never repeat or skip names while tables are created, run with -race
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestListTablesPrefix(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	for _, name := range []string{"gamma", "beta2", "alpha", "beta3", "beta1"} {
+		createTestTable(t, db, "s", name, noteFields)
+	}
+
+	pages := []struct {
+		options ListOptions
+		want    string
+	}{
+		{ListOptions{}, "[alpha beta1 beta2 beta3 gamma] "},
+		{ListOptions{Prefix: "beta", Limit: 2}, "[beta1 beta2] beta2"},
+		{ListOptions{Prefix: "beta", Limit: 2, After: "beta2"}, "[beta3] "},
+		{ListOptions{Prefix: "beta", Limit: 3}, "[beta1 beta2 beta3] "},
+		{ListOptions{Prefix: "delta"}, "[] "},
+		{ListOptions{After: "beta1", Limit: 1}, "[beta2] beta2"},
+	}
+	for _, page := range pages {
+		got, err := db.ListTables("s", page.options)
+		if err != nil {
+			t.Fatalf("failed to list tables: %v", err)
+		}
+		if fmt.Sprint(got.Names, " ", got.Next) != page.want {
+			t.Errorf("ListTables(%+v) = %v %q, want %s", page.options, got.Names, got.Next, page.want)
+		}
+	}
+
+	_, err := db.ListTables("s", ListOptions{Limit: -1})
+	if err == nil {
+		t.Errorf("expected an error for a negative limit")
+	}
+	_, err = db.ListTables("missing", ListOptions{})
+	if err == nil {
+		t.Errorf("expected an error for a missing schema")
+	}
+}
+
+// listAllTables pages through the tables of a schema and checks that the
+// pages follow each other in order
+func listAllTables(t *testing.T, db *HTDB, schema string, options ListOptions) []string {
+	t.Helper()
+	var names []string
+	for {
+		page, err := db.ListTables(schema, options)
+		if err != nil {
+			t.Fatalf("failed to list tables: %v", err)
+		}
+		for _, name := range page.Names {
+			if len(names) > 0 && name <= names[len(names)-1] {
+				t.Fatalf("%s listed after %s", name, names[len(names)-1])
+			}
+			names = append(names, name)
+		}
+		if page.Next == "" {
+			return names
+		}
+		options.After = page.Next
+	}
+}
+
+// Paging through the tables while others are created lists every table that
+// existed before once, in order
+func TestListTablesDuringCreates(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	const tables = 60
+	for i := 0; i < tables; i += 2 {
+		createTestTable(t, db, "s", fmt.Sprintf("t%03d", i), noteFields)
+	}
+	schema, err := db.Schema("s")
+	if err != nil {
+		t.Fatalf("failed to get schema: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < tables; i += 2 {
+			response := schema.CreateTable(fmt.Sprintf("t%03d", i), noteFields)
+			if response.StatusCode != StatusOK {
+				t.Errorf("failed to create table: %v", response.Message)
+				return
+			}
+		}
+	}()
+
+	options := ListOptions{Prefix: "t", Limit: 7}
+	for creating := true; creating; {
+		select {
+		case <-done:
+			creating = false
+		default:
+		}
+		listed := make(map[string]bool)
+		for _, name := range listAllTables(t, db, "s", options) {
+			listed[name] = true
+		}
+		for i := 0; i < tables; i += 2 {
+			if name := fmt.Sprintf("t%03d", i); !listed[name] {
+				t.Fatalf("%s was skipped", name)
+			}
+		}
+	}
+
+	if names := listAllTables(t, db, "s", options); len(names) != tables {
+		t.Errorf("listed %d tables after the creates, want %d", len(names), tables)
+	}
+}
@@ -0,0 +1,58 @@
+// Logging.go
+// Description: Structured logging for the HTDB library
+// Events are emitted through an optional *slog.Logger, nothing is logged without one
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Events use these attribute keys so they can be aggregated:
+//
+//	schema, table    the table an event is about
+//	transaction      transaction id
+//	records          number of records written or returned
+//	scanned          number of records a query read
+//	duration         how long the operation took
+//	error            the error of a failed operation
+
+// SetLogger sets the logger receiving the database's events. Commits and
+// rollbacks are logged at debug level, DDL, compactions and recovery actions
+// at info level, slow queries and commits as warnings. A nil logger (the default) disables logging.
+func (db *HTDB) SetLogger(logger *slog.Logger) {
+	db.logger.Store(logger)
+}
+
+// SetSlowQueryThreshold logs queries that take at least threshold as warnings
+// with their conditions and the records scanned, and counts them as
+// MetricSlowQueries. Zero (the default) disables slow query logging.
+func (db *HTDB) SetSlowQueryThreshold(threshold time.Duration) {
+	db.slowQueryThreshold.Store(int64(threshold))
+}
+
+// SetSlowCommitThreshold logs commits that take at least threshold as
+// warnings with their tables and records written, and counts them as
+// MetricSlowCommits. Zero (the default) disables slow commit logging.
+func (db *HTDB) SetSlowCommitThreshold(threshold time.Duration) {
+	db.slowCommitThreshold.Store(int64(threshold))
+}
+
+// log emits an event if a logger is set
+func (db *HTDB) log(level slog.Level, msg string, args ...any) {
+	if db == nil {
+		return
+	}
+	logEvent(db.logger.Load(), level, msg, args...)
+}
+
+// logEvent emits an event on logger, a nil logger drops it
+func logEvent(logger *slog.Logger, level slog.Level, msg string, args ...any) {
+	if logger == nil || !logger.Enabled(context.Background(), level) {
+		return
+	}
+	logger.Log(context.Background(), level, msg, args...)
+}
@@ -0,0 +1,490 @@
+// MemoryStorage.go
+// Description: In-memory storage backend for the HTDB library
+// Keeps every file in process memory, e.g. for fast unit tests
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryPath is the main path that selects the in-memory storage in NewHTDB
+const MemoryPath = ":memory:"
+
+// memoryStorage keeps files and directories in a map by their cleaned path.
+// Open files keep their node, so like on disk a renamed-over file stays
+// readable through handles opened before the rename.
+type memoryStorage struct {
+	nodes map[string]*memoryNode
+	mu    sync.RWMutex
+}
+
+// memoryNode is a single file or directory
+type memoryNode struct {
+	dir     bool
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+	mu      sync.RWMutex // Guards data and modTime
+}
+
+// NewMemoryStorage creates an empty in-memory storage for NewHTDBWithStorage.
+// The main path of a database is created in it on demand.
+func NewMemoryStorage() Storage {
+	return newMemoryStorage(".")
+}
+
+// newMemoryStorage creates an in-memory storage holding only the root directory
+func newMemoryStorage(root string) *memoryStorage {
+	s := &memoryStorage{nodes: make(map[string]*memoryNode)}
+	s.nodes[memoryName(root)] = &memoryNode{dir: true, mode: fs.ModeDir | 0777, modTime: time.Now()}
+	return s
+}
+
+// memoryName converts a database path into the key of its node
+func memoryName(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// mkdirAll creates a directory and all its missing parents
+func (s *memoryStorage) mkdirAll(name string) {
+	name = memoryName(name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for dir := name; ; dir = path.Dir(dir) {
+		if _, exists := s.nodes[dir]; exists {
+			break
+		}
+		s.nodes[dir] = &memoryNode{dir: true, mode: fs.ModeDir | 0777, modTime: time.Now()}
+		if path.Dir(dir) == dir {
+			break
+		}
+	}
+}
+
+func (s *memoryStorage) OpenFile(name string, flag int, perm fs.FileMode) (StorageFile, error) {
+	name = memoryName(name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[name]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, storagePathError("open", name, fs.ErrExist)
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, storagePathError("open", name, fs.ErrNotExist)
+	case !exists:
+		parent, parentExists := s.nodes[path.Dir(name)]
+		if !parentExists || !parent.dir {
+			return nil, storagePathError("open", name, fs.ErrNotExist)
+		}
+		node = &memoryNode{mode: perm, modTime: time.Now()}
+		s.nodes[name] = node
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if node.dir && writable {
+		return nil, storagePathError("open", name, fmt.Errorf("is a directory"))
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		node.mu.Lock()
+		node.data = nil
+		node.modTime = time.Now()
+		node.mu.Unlock()
+	}
+
+	return &memoryFile{
+		name:     name,
+		node:     node,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (s *memoryStorage) Stat(name string) (fs.FileInfo, error) {
+	name = memoryName(name)
+
+	s.mu.RLock()
+	node, exists := s.nodes[name]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, storagePathError("stat", name, fs.ErrNotExist)
+	}
+	return node.info(name), nil
+}
+
+func (s *memoryStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = memoryName(name)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, exists := s.nodes[name]
+	if !exists {
+		return nil, storagePathError("readdir", name, fs.ErrNotExist)
+	}
+	if !node.dir {
+		return nil, storagePathError("readdir", name, fmt.Errorf("not a directory"))
+	}
+
+	var entries []fs.DirEntry
+	for childPath, child := range s.nodes {
+		if childPath != name && path.Dir(childPath) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(child.info(childPath)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *memoryStorage) Mkdir(name string, perm fs.FileMode) error {
+	name = memoryName(name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.nodes[name]; exists {
+		return storagePathError("mkdir", name, fs.ErrExist)
+	}
+	if parent, exists := s.nodes[path.Dir(name)]; !exists || !parent.dir {
+		return storagePathError("mkdir", name, fs.ErrNotExist)
+	}
+	s.nodes[name] = &memoryNode{dir: true, mode: fs.ModeDir | perm, modTime: time.Now()}
+	return nil
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	name = memoryName(name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[name]
+	if !exists {
+		return storagePathError("remove", name, fs.ErrNotExist)
+	}
+	if node.dir {
+		for childPath := range s.nodes {
+			if strings.HasPrefix(childPath, name+"/") {
+				return storagePathError("remove", name, fmt.Errorf("directory not empty"))
+			}
+		}
+	}
+	delete(s.nodes, name)
+	return nil
+}
+
+func (s *memoryStorage) Rename(oldPath, newPath string) error {
+	oldPath = memoryName(oldPath)
+	newPath = memoryName(newPath)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[oldPath]
+	if !exists {
+		return storagePathError("rename", oldPath, fs.ErrNotExist)
+	}
+	if parent, exists := s.nodes[path.Dir(newPath)]; !exists || !parent.dir {
+		return storagePathError("rename", newPath, fs.ErrNotExist)
+	}
+
+	delete(s.nodes, oldPath)
+	s.nodes[newPath] = node
+
+	// A directory takes everything below it along
+	if node.dir {
+		for childPath, child := range s.nodes {
+			if strings.HasPrefix(childPath, oldPath+"/") {
+				delete(s.nodes, childPath)
+				s.nodes[newPath+strings.TrimPrefix(childPath, oldPath)] = child
+			}
+		}
+	}
+	return nil
+}
+
+// Chmod changes the mode of a file or directory
+func (s *memoryStorage) Chmod(name string, mode fs.FileMode) error {
+	name = memoryName(name)
+
+	s.mu.RLock()
+	node, exists := s.nodes[name]
+	s.mu.RUnlock()
+	if !exists {
+		return storagePathError("chmod", name, fs.ErrNotExist)
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.mode = node.mode&fs.ModeType | mode&^fs.ModeType
+	return nil
+}
+
+// Link makes newPath share the node of the file at oldPath, like a hard link
+func (s *memoryStorage) Link(oldPath, newPath string) error {
+	oldPath = memoryName(oldPath)
+	newPath = memoryName(newPath)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[oldPath]
+	if !exists {
+		return storagePathError("link", oldPath, fs.ErrNotExist)
+	}
+	if node.dir {
+		return storagePathError("link", oldPath, fmt.Errorf("is a directory"))
+	}
+	if _, exists := s.nodes[newPath]; exists {
+		return storagePathError("link", newPath, fs.ErrExist)
+	}
+	if parent, exists := s.nodes[path.Dir(newPath)]; !exists || !parent.dir {
+		return storagePathError("link", newPath, fs.ErrNotExist)
+	}
+
+	s.nodes[newPath] = node
+	return nil
+}
+
+func (s *memoryStorage) SyncDir(name string) error {
+	return nil // Nothing to make durable
+}
+
+// snapshot returns a deep copy of every node
+func (s *memoryStorage) snapshot() map[string]*memoryNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nodes := make(map[string]*memoryNode, len(s.nodes))
+	for name, node := range s.nodes {
+		nodes[name] = node.clone()
+	}
+	return nodes
+}
+
+// restore replaces every node with a deep copy of a snapshot
+func (s *memoryStorage) restore(nodes map[string]*memoryNode) {
+	copied := make(map[string]*memoryNode, len(nodes))
+	for name, node := range nodes {
+		copied[name] = node.clone()
+	}
+
+	s.mu.Lock()
+	s.nodes = copied
+	s.mu.Unlock()
+}
+
+// clone returns a copy of the node with its own data
+func (n *memoryNode) clone() *memoryNode {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return &memoryNode{
+		dir:     n.dir,
+		data:    append([]byte(nil), n.data...),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// info returns the file info of the node at name
+func (n *memoryNode) info(name string) fs.FileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return memoryFileInfo{name: path.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memoryFileInfo describes a node of the in-memory storage
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memoryFileInfo) Name() string       { return i.name }
+func (i memoryFileInfo) Size() int64        { return i.size }
+func (i memoryFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memoryFileInfo) ModTime() time.Time { return i.modTime }
+func (i memoryFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
+
+// memoryFile is an open handle of a node
+type memoryFile struct {
+	name     string
+	node     *memoryNode
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+	mu       sync.Mutex // Guards offset and closed
+}
+
+func (f *memoryFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed || !f.readable {
+		return 0, storagePathError("read", f.name, fs.ErrClosed)
+	}
+	n, err := f.node.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memoryFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+
+	if closed || !f.readable {
+		return 0, storagePathError("read", f.name, fs.ErrClosed)
+	}
+	n, err := f.node.readAt(p, offset)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed || !f.writable {
+		return 0, storagePathError("write", f.name, fs.ErrClosed)
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:end], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.node.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, storagePathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return storagePathError("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memoryFile) Sync() error {
+	return nil
+}
+
+func (f *memoryFile) Stat() (fs.FileInfo, error) {
+	return f.node.info(f.name), nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if !f.writable {
+		return storagePathError("truncate", f.name, fs.ErrPermission)
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// readAt copies the node's data at offset into p
+func (n *memoryNode) readAt(p []byte, offset int64) (int, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if offset >= int64(len(n.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, n.data[offset:]), nil
+}
+
+// MemorySnapshot is a copy of every file of an in-memory database
+type MemorySnapshot struct {
+	nodes map[string]*memoryNode
+}
+
+// SnapshotMemory copies every file of an in-memory database, e.g. to reset a
+// test fixture with RestoreMemory between tests
+func (db *HTDB) SnapshotMemory() (*MemorySnapshot, error) {
+	store, ok := db.store.(*memoryStorage)
+	if !ok {
+		return nil, fmt.Errorf("database is not in memory")
+	}
+	return &MemorySnapshot{nodes: store.snapshot()}, nil
+}
+
+// RestoreMemory resets an in-memory database to a snapshot. No transaction
+// may be running and the change log must not be enabled.
+func (db *HTDB) RestoreMemory(snapshot *MemorySnapshot) error {
+	store, ok := db.store.(*memoryStorage)
+	if !ok {
+		return fmt.Errorf("database is not in memory")
+	}
+	if db.changes != nil {
+		return fmt.Errorf("can't restore a snapshot while the change log is enabled")
+	}
+
+	store.restore(snapshot.nodes)
+
+	// Handles, records and positions of the replaced files are stale
+	err := db.files.flush()
+	db.tableManager.recordCache.clear()
+	db.tableManager.primaryKeys.clear()
+	return err
+}
@@ -0,0 +1,109 @@
+// Metrics.go
+// Description: Metrics for the HTDB library
+// Counters and observations of core operations, reported to a pluggable sink
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Metric names reported to a MetricsSink. Durations are observed in seconds.
+const (
+	MetricTransactionsBegun      = "transactions_begun"
+	MetricTransactionsCommitted  = "transactions_committed"
+	MetricTransactionsRolledBack = "transactions_rolled_back"
+	MetricCommitDuration         = "commit_duration_seconds"
+	MetricCommitBytes            = "commit_bytes"
+	MetricRecordsInserted        = "records_inserted"
+	MetricRecordsUpdated         = "records_updated"
+	MetricRecordsDeleted         = "records_deleted"
+	MetricRecordsWritten         = "records_written"
+	MetricBytesWritten           = "bytes_written"
+	MetricQueryScans             = "query_scans"
+	MetricScanDuration           = "scan_duration_seconds"
+	MetricSlowQueries            = "slow_queries"
+	MetricSlowCommits            = "slow_commits"
+	MetricCacheHits              = "cache_hits"
+	MetricLockConflicts          = "lock_conflicts"
+	MetricRecordLockWaits        = "record_lock_waits"
+	MetricRecordLockWait         = "record_lock_wait_seconds"
+	MetricTableLockWait          = "table_lock_wait_seconds"
+	MetricCleanupPasses          = "cleanup_passes"
+	MetricCleanupRecordsRemoved  = "cleanup_records_removed"
+	MetricCleanupBytesReclaimed  = "cleanup_bytes_reclaimed"
+	MetricCleanupRecordsArchived = "cleanup_records_archived"
+	MetricCleanupErrors          = "cleanup_errors"
+	MetricCleanupDuration        = "cleanup_duration_seconds"
+	MetricRecordsQuarantined     = "records_quarantined"
+	MetricDuplicateVersions      = "duplicate_current_versions"
+)
+
+// MetricsSink receives the metrics of a database. Implementations must be safe
+// for concurrent use and should return quickly, they are called on hot paths.
+type MetricsSink interface {
+	Inc(name string, delta int64)       // Add delta to a counter
+	Observe(name string, value float64) // Record a value of a histogram
+}
+
+// noopMetrics is the sink used until SetMetricsSink is called
+type noopMetrics struct{}
+
+func (noopMetrics) Inc(string, int64)       {}
+func (noopMetrics) Observe(string, float64) {}
+
+// metricsHolder wraps the sink so it can be swapped atomically
+type metricsHolder struct {
+	sink MetricsSink
+}
+
+// SetMetricsSink sets the sink receiving the database's metrics, nil restores the no-op default
+func (db *HTDB) SetMetricsSink(sink MetricsSink) {
+	if sink == nil {
+		sink = noopMetrics{}
+	}
+	db.metrics.Store(&metricsHolder{sink: sink})
+}
+
+// metricsSink returns the sink of the database, a no-op sink if none is set
+func (db *HTDB) metricsSink() MetricsSink {
+	if db == nil {
+		return noopMetrics{}
+	}
+	holder := db.metrics.Load()
+	if holder == nil {
+		return noopMetrics{}
+	}
+	return holder.sink
+}
+
+// ExpvarMetrics is a MetricsSink publishing the metrics as an expvar map.
+// Counters appear under their name, observations as <name>_count and <name>_sum.
+type ExpvarMetrics struct {
+	vars *expvar.Map
+}
+
+var expvarMetricsMu sync.Mutex // Guards publishing expvar maps
+
+// NewExpvarMetrics publishes the metrics under the given expvar name. Calling
+// it again with the same name reuses the published map.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	expvarMetricsMu.Lock()
+	defer expvarMetricsMu.Unlock()
+
+	if vars, ok := expvar.Get(name).(*expvar.Map); ok {
+		return &ExpvarMetrics{vars: vars}
+	}
+	return &ExpvarMetrics{vars: expvar.NewMap(name)}
+}
+
+func (m *ExpvarMetrics) Inc(name string, delta int64) {
+	m.vars.Add(name, delta)
+}
+
+func (m *ExpvarMetrics) Observe(name string, value float64) {
+	m.vars.Add(name+"_count", 1)
+	m.vars.AddFloat(name+"_sum", value)
+}
@@ -0,0 +1,144 @@
+// Metrics_test.go
+// Description: Tests of the metrics of the HTDB library
+// Core operations report their counters and observations to the sink
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMetrics is a MetricsSink remembering what it was given
+type testMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	observed map[string]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{counters: make(map[string]int64), observed: make(map[string]int)}
+}
+
+func (m *testMetrics) Inc(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *testMetrics) Observe(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observed[name]++
+}
+
+func (m *testMetrics) counter(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+func (m *testMetrics) observations(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.observed[name]
+}
+
+func TestMetricsOfCoreOperations(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	metrics := newTestMetrics()
+	db.SetMetricsSink(metrics)
+
+	tx := tm.BeginTransaction()
+	for key := 0; key < 3; key++ {
+		_, err := tx.StageInsert(table, map[string]interface{}{"key": key, "note": "value"})
+		if err != nil {
+			t.Fatalf("failed to stage insert: %v", err)
+		}
+	}
+	err := tm.CommitTransaction(tx)
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	err = tm.RollbackTransaction(tm.BeginTransaction())
+	if err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	records, err := tm.Select(table).GetAll()
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	err = tm.DeleteRecord(table, records[0])
+	if err != nil {
+		t.Fatalf("failed to delete record: %v", err)
+	}
+	_, err = tm.Compact()
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+
+	counters := []struct {
+		name string
+		want int64
+	}{
+		{MetricTransactionsBegun, 3},
+		{MetricTransactionsCommitted, 2},
+		{MetricTransactionsRolledBack, 1},
+		{MetricRecordsInserted, 3},
+		{MetricRecordsDeleted, 1},
+		{MetricQueryScans, 1},
+		{MetricCleanupPasses, 1},
+		{MetricCleanupRecordsRemoved, 2},
+	}
+	for _, counter := range counters {
+		if got := metrics.counter(counter.name); got != counter.want {
+			t.Errorf("counter %s = %d, want %d", counter.name, got, counter.want)
+		}
+	}
+	for _, name := range []string{MetricRecordsWritten, MetricBytesWritten} {
+		if metrics.counter(name) == 0 {
+			t.Errorf("counter %s wasn't increased", name)
+		}
+	}
+	for _, name := range []string{MetricCommitDuration, MetricScanDuration, MetricCleanupDuration} {
+		if metrics.observations(name) == 0 {
+			t.Errorf("nothing was observed for %s", name)
+		}
+	}
+
+	// A nil sink restores the no-op default
+	db.SetMetricsSink(nil)
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 9, "note": "value"})
+	if got := metrics.counter(MetricRecordsInserted); got != 3 {
+		t.Errorf("removed sink still counted inserts, %d", got)
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	// Published variables live as long as the process, every run gets its own
+	name := fmt.Sprintf("htdb_test_metrics_%d", time.Now().UnixNano())
+	metrics := NewExpvarMetrics(name)
+	metrics.Inc(MetricRecordsWritten, 2)
+	metrics.Observe(MetricScanDuration, 0.5)
+	metrics.Observe(MetricScanDuration, 1.5)
+
+	// The published map is shared by sinks of the same name
+	vars := expvar.Get(name).(*expvar.Map)
+	NewExpvarMetrics(name).Inc(MetricRecordsWritten, 1)
+	checks := map[string]string{
+		MetricRecordsWritten:          "3",
+		MetricScanDuration + "_count": "2",
+		MetricScanDuration + "_sum":   "2",
+	}
+	for name, want := range checks {
+		if got := vars.Get(name); got == nil || got.String() != want {
+			t.Errorf("expvar %s = %v, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Migration.go
+// Description: On-disk layout versions of the HTDB library
+// Detects databases written by older or newer versions and upgrades old ones in place
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// layoutVersion is the version of the directory layout and record format
+// written by this version of the library. Databases and tables without a
+// recorded version have version 0, written before versions were recorded.
+// Version 2 added the audit trailer, see Record.CommittedAt, version 3 packed
+// string fields, see CompressionPacked, and block compressed table files, see
+// SetBlockCompression, version 4 the origin id, see Record.LogicalID, version 5
+// stores float fields as IEEE 754 bits instead of whole numbers.
+const layoutVersion = 5
+
+// tableMigrations upgrade the records of a table from the version of their key
+// to the next one. The records are written in the current format afterwards.
+var tableMigrations = map[int]func(table *Table, records []*Record) ([]*Record, error){
+	// Version 1 only started recording the version, the records are unchanged
+	0: func(table *Table, records []*Record) ([]*Record, error) { return records, nil },
+	// Version 2 records are written with an audit trailer, unknown for the old records
+	1: func(table *Table, records []*Record) ([]*Record, error) { return records, nil },
+	// Version 3 only allows packed string fields and block compression, older libraries can't read them
+	2: func(table *Table, records []*Record) ([]*Record, error) { return records, nil },
+	// Version 4 records carry the id of their first version, the old records count as first versions
+	3: func(table *Table, records []*Record) ([]*Record, error) { return records, nil },
+	// Version 5 stores the bits of floats, the old whole numbers are read as floats and written that way
+	4: func(table *Table, records []*Record) ([]*Record, error) { return records, nil },
+}
+
+// MigrationReport is the result of Migrate
+type MigrationReport struct {
+	FromVersion int      // Layout version of the database before
+	ToVersion   int      // Layout version of the database now
+	Tables      []string // Tables that were upgraded, as "schema:table"
+}
+
+// LayoutVersion returns the on-disk layout version of the database. It is
+// lower than the version of the library until Migrate upgraded the database.
+func (db *HTDB) LayoutVersion() int {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	return db.config.LayoutVersion
+}
+
+// Migrate upgrades every table written with an older layout version to the
+// current one. A table is rewritten through a temporary file renamed into
+// place, then its configuration records the new version, so an interrupted
+// migration just continues with the remaining tables when run again. The
+// version of the database is raised once every table is upgraded. Tables of
+// read-only attached schemas are left as they are.
+func (db *HTDB) Migrate() (*MigrationReport, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{FromVersion: db.LayoutVersion(), ToVersion: layoutVersion}
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range schemas {
+		if db.isReadOnlySchema(schema) {
+			continue // Upgraded by the database it belongs to
+		}
+		tables, err := db.schemaTables(schema)
+		if err != nil {
+			return report, err
+		}
+		for _, table := range tables {
+			if table.FormatVersion >= layoutVersion {
+				continue
+			}
+			from := table.FormatVersion
+			err = db.migrateTable(table)
+			if err != nil {
+				return report, fmt.Errorf("failed to migrate table '%s:%s': %w", schema, table.TableName, err)
+			}
+			db.log(slog.LevelInfo, "table migrated", "schema", schema, "table", table.TableName,
+				"from", from, "to", layoutVersion)
+			report.Tables = append(report.Tables, schema+":"+table.TableName)
+		}
+	}
+
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	// The file is updated as it is, the running settings may differ from it
+	config, _, err := readConfig(db.storage(), db.mainPath)
+	if err != nil {
+		return report, err
+	}
+	if config.LayoutVersion < layoutVersion {
+		config.LayoutVersion = layoutVersion
+		err = writeConfig(db.storage(), db.mainPath, config, DurabilityFlush)
+		if err != nil {
+			return report, err
+		}
+	}
+	db.config.LayoutVersion = layoutVersion
+	return report, nil
+}
+
+// migrateTable upgrades a single table and its archive to the current layout version
+func (db *HTDB) migrateTable(table *Table) error {
+	unlock, err := db.lockTableDDL(tableCacheKey(table))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	records, err := table.allRecords()
+	if err != nil {
+		return fmt.Errorf("failed to read records: %w", err)
+	}
+	for version := table.FormatVersion; version < layoutVersion; version++ {
+		migrate, exists := tableMigrations[version]
+		if !exists {
+			return fmt.Errorf("no migration from layout version %d", version)
+		}
+		records, err = migrate(table, records)
+		if err != nil {
+			return err
+		}
+	}
+
+	archive := table.archiveTable()
+	archiveLock := archive.lock()
+	archiveLock.Lock()
+	defer archiveLock.Unlock()
+
+	archived, err := archivedRecords(archive)
+	if err != nil {
+		return fmt.Errorf("failed to read archived records: %w", err)
+	}
+
+	migrated := *table
+	migrated.FormatVersion = layoutVersion
+	migrated.layout = nil
+	confJSON, err := json.MarshalIndent(&migrated, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize table to JSON: %v", err)
+	}
+
+	// The records change their format with the configuration, so both are
+	// swapped in together through a compaction journal
+	store := db.storage()
+	var tempPaths, finalPaths []string
+	removeTemps := func() {
+		for _, path := range tempPaths {
+			store.Remove(path)
+		}
+	}
+
+	tempPath, err := migrated.writeRecordsTemp(store, table.filePath(), records)
+	if err == nil {
+		tempPaths = append(tempPaths, tempPath)
+		finalPaths = append(finalPaths, table.filePath())
+	}
+	if err == nil && archived != nil {
+		tempPath, err = migrated.archiveTable().writeRecordsTemp(store, archive.filePath(), archived)
+		if err == nil {
+			tempPaths = append(tempPaths, tempPath)
+			finalPaths = append(finalPaths, archive.filePath())
+		}
+	}
+	if err == nil {
+		tempPath, err = writeTempFile(store, table.confPath(), compactionTempSuffix, confJSON, db.fileMode())
+		if err == nil {
+			tempPaths = append(tempPaths, tempPath)
+			finalPaths = append(finalPaths, table.confPath())
+		}
+	}
+	if err != nil {
+		removeTemps()
+		return fmt.Errorf("failed to write migrated table: %v", err)
+	}
+
+	// Record positions may have moved if a partial record was dropped, the
+	// swap invalidates them
+	err = db.commitCompaction(table.SchemaPath, table.TableName, tempPaths, finalPaths, nil)
+	if err != nil {
+		return err
+	}
+	table.FormatVersion = layoutVersion
+	table.layout = nil
+	return nil
+}
+
+// archivedRecords reads the records of a table's archive, nil if it has none.
+// A partial record left by an interrupted cleanup is dropped. The caller must
+// hold the archive's lock.
+func archivedRecords(archive *Table) ([]*Record, error) {
+	if _, err := archive.storage().Stat(archive.filePath()); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	layout := archive.Layout()
+	records := []*Record{}
+	err := archive.scanRawRecords(func(data []byte) error {
+		record, err := deserializeRecordLayout(data, layout)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize record: %w", err)
+		}
+		records = append(records, record)
+		return nil
+	})
+	var truncated *TruncatedTableError
+	if errors.As(err, &truncated) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// detectLayoutVersion returns the layout version of a database without a
+// config file: a new, empty one gets the current version, one with schemas
+// was written before versions were recorded.
+func (db *HTDB) detectLayoutVersion() (int, error) {
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return 0, err
+	}
+	if len(schemas) > 0 {
+		return 0, nil
+	}
+	return layoutVersion, nil
+}
+
+// checkLayoutVersion refuses data written by a newer version of the library
+func checkLayoutVersion(version int) error {
+	if version > layoutVersion {
+		return fmt.Errorf("%w %d, this library supports up to %d, upgrade the library", ErrUnsupportedVersion, version, layoutVersion)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Paths.go
+// Description: File paths of the HTDB library
+// Every path of a schema, table, configuration or ref file is built here with filepath.Join
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"path/filepath"
+	"unicode"
+)
+
+// validName reports whether a schema, table or field name can be part of a file name.
+// Only letters, digits, '_' and '-' are allowed: a dot would make the files of
+// one table look like those of another, "users.conf" and the conf of "users"
+// or field "b" of "a.x" and field "x.b" of "a".
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidName reports whether name can name a schema, table or field. Names
+// taken from outside, such as the paths of HTTP requests, are checked with it
+// before they reach the file system.
+func ValidName(name string) bool {
+	return validName(name)
+}
+
+// tableFilePath returns the path of the file holding a table's records
+func tableFilePath(schemaPath, tableName string) string {
+	return filepath.Join(schemaPath, tableName+fileEnding)
+}
+
+// tableConfPath returns the path of a table's configuration
+func tableConfPath(schemaPath, tableName string) string {
+	return filepath.Join(schemaPath, tableName+".conf"+fileEnding)
+}
+
+// schemaIndexPath returns the path of the index file marking a directory as a schema
+func schemaIndexPath(schemaPath string) string {
+	return filepath.Join(schemaPath, "index.conf"+fileEnding)
+}
+
+// filePath returns the path of the table's file
+func (t *Table) filePath() string {
+	return tableFilePath(t.SchemaPath, t.TableName)
+}
+
+// confPath returns the path of the table's configuration
+func (t *Table) confPath() string {
+	return tableConfPath(t.SchemaPath, t.TableName)
+}
+
+// layoutHashPath returns the path of the file holding the layout hash of the table's records
+func (t *Table) layoutHashPath() string {
+	return filepath.Join(t.SchemaPath, t.TableName+layoutHashEnding)
+}
+
+// RefFilePath returns the path of the file holding the values of a ref field.
+// Every reader and writer of ref data, compactions included, derives the path
+// from here, so they always agree on the file.
+func (t *Table) RefFilePath(field string) string {
+	return filepath.Join(t.SchemaPath, t.TableName+"."+field+".data"+fileEnding)
+}
+
+// refGapsPath returns the path of the lost ranges of a ref field's file, see ErrRefDataMissing
+func (t *Table) refGapsPath(field string) string {
+	return filepath.Join(t.SchemaPath, t.TableName+"."+field+".missing"+fileEnding)
+}
+
+// fullTextIndexPath returns the path of the full-text index of a field
+func (t *Table) fullTextIndexPath(field string) string {
+	return filepath.Join(t.SchemaPath, t.TableName+"."+field+".fulltext"+fileEnding)
+}
+
+// analysisPath returns the path of the value statistics of the table, see AnalyzeTable
+func (t *Table) analysisPath() string {
+	return filepath.Join(t.SchemaPath, t.TableName+".stats"+fileEnding)
+}
+
+// summaryPath returns the path of the record count and id range of the table, see Table.Count
+func (t *Table) summaryPath() string {
+	return filepath.Join(t.SchemaPath, t.TableName+".summary"+fileEnding)
+}
+
+// tableAt returns a table carrying only its location, for the APIs that take
+// the schema path and table name as strings
+func tableAt(schemaPath, tableName string) *Table {
+	return &Table{SchemaPath: schemaPath, TableName: tableName}
+}
@@ -0,0 +1,181 @@
+// Paths_test.go
+// Description: Tests of the file paths of the HTDB library
+// Writers, readers and compactions agree on every file, whatever the names and main path
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// schemaFiles returns the names of the files in a schema directory
+func schemaFiles(t *testing.T, schemaPath string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(schemaPath)
+	if err != nil {
+		t.Fatalf("failed to read schema directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// Every file of a table is found at the path its helper builds
+func TestTableFilesAtHelperPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openTestDB(t, path)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "value"})
+
+	schemaPath := filepath.Join(path, "s")
+	want := []string{
+		schemaIndexPath(schemaPath),
+		tableConfPath(schemaPath, "t"),
+		tableFilePath(schemaPath, "t"),
+		table.layoutHashPath(),
+		table.summaryPath(),
+		table.RefFilePath("note"),
+	}
+	var names []string
+	for _, file := range want {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("no file at %s: %v", file, err)
+		}
+		names = append(names, filepath.Base(file))
+	}
+	sort.Strings(names)
+	if got := schemaFiles(t, schemaPath); fmt.Sprint(got) != fmt.Sprint(names) {
+		t.Errorf("schema holds files %v, want %v", got, names)
+	}
+}
+
+// A relative main path must lead writers and compactions to the same ref file
+func TestRelativeMainPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %v", err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db := openTestDB(t, "db")
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	tx := tm.BeginTransaction()
+	var records []*Record
+	for key := 0; key < 20; key++ {
+		record, err := tx.StageInsert(table, map[string]interface{}{"key": key, "note": strings.Repeat("x", 100)})
+		if err != nil {
+			t.Fatalf("failed to stage insert: %v", err)
+		}
+		records = append(records, record)
+	}
+	err = tm.CommitTransaction(tx)
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	refInfo, err := os.Stat(table.RefFilePath("note"))
+	if err != nil {
+		t.Fatalf("ref data wasn't written to %s: %v", table.RefFilePath("note"), err)
+	}
+	for _, record := range records[:10] {
+		err = tm.DeleteRecord(table, record)
+		if err != nil {
+			t.Fatalf("failed to delete record: %v", err)
+		}
+	}
+
+	_, err = tm.Compact()
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	compacted, err := os.Stat(table.RefFilePath("note"))
+	if err != nil {
+		t.Fatalf("failed to stat ref file: %v", err)
+	}
+	if compacted.Size() != refInfo.Size()/2 {
+		t.Errorf("ref file has %d bytes after compaction, want %d", compacted.Size(), refInfo.Size()/2)
+	}
+	for key, note := range currentValues(t, tm, table) {
+		if note != strings.Repeat("x", 100) {
+			t.Errorf("record %d reads note %q", key, note)
+		}
+	}
+	var refFiles []string
+	for _, name := range schemaFiles(t, filepath.Join("db", "s")) {
+		if strings.HasSuffix(name, ".data"+fileEnding) {
+			refFiles = append(refFiles, name)
+		}
+	}
+	if fmt.Sprint(refFiles) != "[t.note.data.htdb]" {
+		t.Errorf("schema holds ref files %v, want only t.note.data.htdb", refFiles)
+	}
+	if got := schemaFiles(t, "."); fmt.Sprint(got) != "[db]" {
+		t.Errorf("files were written next to the database: %v", got)
+	}
+}
+
+func TestAmbiguousNamesRejected(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	schema, err := db.CreateSchema("s")
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+
+	for _, name := range []string{"users.conf", "a.x", "../t", "a/b", "a b", ""} {
+		response := schema.CreateTable(name, noteFields)
+		if response.StatusCode != StatusInvalidName {
+			t.Errorf("table %q answered %d %s, want %d", name, response.StatusCode, response.Message, StatusInvalidName)
+		}
+	}
+	for _, name := range []string{"x.b", "data/x", "a b"} {
+		response := schema.CreateTable("t", []Field{{Name: name, Type: Int, Length: 8}})
+		if response.StatusCode != StatusInvalidName {
+			t.Errorf("field %q answered %d %s, want %d", name, response.StatusCode, response.Message, StatusInvalidName)
+		}
+	}
+}
+
+// Schemas and tables are looked up by names that may come from outside, they
+// must not lead out of the main path
+func TestTraversalNamesRejected(t *testing.T) {
+	dir := t.TempDir()
+	createTestTable(t, openTestDB(t, filepath.Join(dir, "other")), "secret", "t", noteFields)
+	db := openTestDB(t, filepath.Join(dir, "db"))
+	tm := db.GetTableManager()
+	createTestTable(t, db, "s", "t", noteFields)
+
+	for _, name := range []string{"../other/secret", "..", "a/b", ".snapshots", ""} {
+		_, err := db.Schema(name)
+		if StatusOf(err) != StatusInvalidName {
+			t.Errorf("Schema(%q) = %v, want an invalid name", name, err)
+		}
+		_, err = db.CreateSchema(name)
+		if StatusOf(err) != StatusInvalidName {
+			t.Errorf("CreateSchema(%q) = %v, want an invalid name", name, err)
+		}
+		_, err = tm.GetTable(name, "t")
+		if StatusOf(err) != StatusInvalidName {
+			t.Errorf("GetTable(%q, t) = %v, want an invalid name", name, err)
+		}
+	}
+	for _, name := range []string{"../../other/secret/t", "../t", "a.conf"} {
+		_, err := tm.GetTable("s", name)
+		if StatusOf(err) != StatusInvalidName {
+			t.Errorf("GetTable(s, %q) = %v, want an invalid name", name, err)
+		}
+	}
+}
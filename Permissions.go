@@ -0,0 +1,169 @@
+// Permissions.go
+// Description: File and directory permissions of the HTDB library
+// Modes of the files and directories a database creates, persisted in the config file
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	defaultFileMode os.FileMode = 0666 // Mode of new files, before the umask like os.Create
+	defaultDirMode  os.FileMode = 0777 // Mode of new directories, before the umask like os.Mkdir
+)
+
+// chmodStorage is a storage that can change the mode of files, see ApplyPermissions
+type chmodStorage interface {
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// SetPermissions sets the modes of the files and directories the database
+// creates from now on: schema directories, table, configuration, index and
+// ref files and the temporary files they are written through. A directory
+// mode with os.ModeSetgid makes new files inherit the group of the directory.
+// Zero keeps the current mode. Existing files keep their mode until
+// ApplyPermissions is called. The modes are kept in the config file.
+func (db *HTDB) SetPermissions(fileMode, dirMode os.FileMode) error {
+	config := db.Config()
+	if fileMode != 0 {
+		config.FileMode = formatMode(fileMode)
+	}
+	if dirMode != 0 {
+		config.DirMode = formatMode(dirMode)
+	}
+	return db.SetConfig(config)
+}
+
+// ApplyPermissions changes the mode of every existing file and directory of
+// the database, the main path and writable attached schemas, to the modes set
+// with SetPermissions. Read-only attached schemas are left as they are.
+func (db *HTDB) ApplyPermissions() error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	store, canChmod := db.store.(chmodStorage)
+	if !canChmod {
+		return fmt.Errorf("can't change permissions: %w", ErrReadOnly)
+	}
+
+	fileMode, dirMode := db.fileMode(), db.dirMode()
+	roots := []string{db.mainPath}
+	for _, attached := range db.attachedSchemas() {
+		if !attached.ReadOnly {
+			roots = append(roots, attached.Path)
+		}
+	}
+	for _, root := range roots {
+		err := applyPermissions(db.storage(), store, root, fileMode, dirMode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPermissions changes the mode of a directory and everything below it
+func applyPermissions(store Storage, chmod chmodStorage, dir string, fileMode, dirMode os.FileMode) error {
+	err := chmod.Chmod(dir, dirMode)
+	if err != nil {
+		return fmt.Errorf("failed to change permissions of '%s': %w", dir, err)
+	}
+
+	entries, err := store.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory '%s': %w", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			err = applyPermissions(store, chmod, path, fileMode, dirMode)
+		} else {
+			err = chmod.Chmod(path, fileMode)
+			if os.IsNotExist(err) {
+				err = nil // Removed since the directory was listed
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to change permissions of '%s': %w", path, err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileMode returns the mode of new files
+func (db *HTDB) fileMode() os.FileMode {
+	if db == nil {
+		return defaultFileMode
+	}
+	return db.Config().fileMode()
+}
+
+// dirMode returns the mode of new directories
+func (db *HTDB) dirMode() os.FileMode {
+	if db == nil {
+		return defaultDirMode
+	}
+	return db.Config().dirMode()
+}
+
+// fileMode returns the mode of new files set in the config
+func (c Config) fileMode() os.FileMode {
+	mode, err := parseMode(c.FileMode)
+	if err != nil || c.FileMode == "" {
+		return defaultFileMode
+	}
+	return mode
+}
+
+// dirMode returns the mode of new directories set in the config
+func (c Config) dirMode() os.FileMode {
+	mode, err := parseMode(c.DirMode)
+	if err != nil || c.DirMode == "" {
+		return defaultDirMode
+	}
+	return mode
+}
+
+// parseMode parses an octal Unix mode such as "0640" or "2770"
+func parseMode(mode string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("invalid mode '%s', use octal digits like 0640", mode)
+	}
+
+	result := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		result |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		result |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		result |= os.ModeSticky
+	}
+	return result, nil
+}
+
+// formatMode formats a mode as the octal Unix mode parseMode reads
+func formatMode(mode os.FileMode) string {
+	bits := uint64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
@@ -0,0 +1,171 @@
+// PrimaryKeyIndex.go
+// Description: Primary key index for the HTDB library
+// Maps record ids to their position in the table file so lookups can seek directly
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// primaryKeyIndex keeps an id -> record position map for every table that was
+// looked up by id. A table's map is built by a scan on first use (cold), kept
+// up to date by commits, and dropped whenever the table file is compacted.
+type primaryKeyIndex struct {
+	tables map[string]*tablePrimaryKeys
+	mu     sync.Mutex
+}
+
+// tablePrimaryKeys is the index of a single table file
+type tablePrimaryKeys struct {
+	positions map[int64]int64 // Record id -> record number in the file
+	origins   map[int64]int64 // Logical id -> record number of the latest version in the file
+	count     int64           // Number of records in the file
+}
+
+// newPrimaryKeyIndex creates a new, empty primary key index
+func newPrimaryKeyIndex() *primaryKeyIndex {
+	return &primaryKeyIndex{
+		tables: make(map[string]*tablePrimaryKeys),
+	}
+}
+
+// lookup returns the record number of id in the table file, building the
+// table's index first if it is cold
+func (idx *primaryKeyIndex) lookup(table *Table, id int64) (int64, bool, error) {
+	keys, err := idx.resident(table)
+	if err != nil {
+		return 0, false, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	position, found := keys.positions[id]
+	return position, found, nil
+}
+
+// lookupLatest returns the record number of the latest version of a logical
+// record in the table file, see Record.LogicalID
+func (idx *primaryKeyIndex) lookupLatest(table *Table, logicalID int64) (int64, bool, error) {
+	keys, err := idx.resident(table)
+	if err != nil {
+		return 0, false, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	position, found := keys.origins[logicalID]
+	return position, found, nil
+}
+
+// resident returns the index of a table, building it first if it is cold
+func (idx *primaryKeyIndex) resident(table *Table) (*tablePrimaryKeys, error) {
+	key := tableCacheKey(table)
+
+	idx.mu.Lock()
+	keys, exists := idx.tables[key]
+	idx.mu.Unlock()
+
+	if !exists {
+		var err error
+		keys, err = buildTablePrimaryKeys(table)
+		if err != nil {
+			return nil, err
+		}
+
+		idx.mu.Lock()
+		if current, exists := idx.tables[key]; exists {
+			keys = current // Built concurrently, keep the one already in place
+		} else {
+			idx.tables[key] = keys
+		}
+		idx.mu.Unlock()
+	}
+	return keys, nil
+}
+
+// appended records that records were written to the end of a table file that
+// held previousCount records before. Tables without a resident index are skipped.
+func (idx *primaryKeyIndex) appended(table *Table, previousCount int, records []*Record) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	keys, exists := idx.tables[tableCacheKey(table)]
+	if !exists {
+		return
+	}
+
+	// The index doesn't match the file the commit started from, rebuild it on next use
+	if keys.count != int64(previousCount) {
+		delete(idx.tables, tableCacheKey(table))
+		return
+	}
+
+	for _, record := range records {
+		keys.positions[record.ID] = keys.count
+		keys.origins[record.LogicalID()] = keys.count
+		keys.count++
+	}
+}
+
+// snapshot returns a copy of a table's resident index, it reports false if the
+// table has none
+func (idx *primaryKeyIndex) snapshot(table *Table) (map[int64]int64, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	keys, exists := idx.tables[tableCacheKey(table)]
+	if !exists {
+		return nil, false
+	}
+
+	positions := make(map[int64]int64, len(keys.positions))
+	for id, position := range keys.positions {
+		positions[id] = position
+	}
+	return positions, true
+}
+
+// invalidate drops the index of a table file, it is rebuilt on next use
+func (idx *primaryKeyIndex) invalidate(tablePath string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.tables, filepath.Clean(tablePath))
+}
+
+// clear drops the index of every table
+func (idx *primaryKeyIndex) clear() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.tables = make(map[string]*tablePrimaryKeys)
+}
+
+// buildTablePrimaryKeys scans a table file and records the position of every
+// id and of the latest version of every logical record
+func buildTablePrimaryKeys(table *Table) (*tablePrimaryKeys, error) {
+	keys := &tablePrimaryKeys{positions: make(map[int64]int64), origins: make(map[int64]int64)}
+	layout := table.Layout()
+
+	err := table.streamRawRecords(func(data []byte) error {
+		id := recordID(data)
+		keys.positions[id] = keys.count
+		if origin := recordOrigin(data, layout); origin != 0 {
+			keys.origins[origin] = keys.count
+		} else {
+			keys.origins[id] = keys.count
+		}
+		keys.count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
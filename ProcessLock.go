@@ -0,0 +1,86 @@
+// ProcessLock.go
+// Description: Exclusive use of a database directory
+// Keeps two Opens, in this process or in others, from using the same directory
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const lockFileName = "db.lock"
+
+// processLock is held by an opened database until it is closed
+type processLock struct {
+	key  string
+	file *os.File // Locked lock file on the local disk, nil for other storages
+}
+
+// lockedPaths holds the directories opened by this process
+var lockedPaths = struct {
+	keys map[string]bool
+	mu   sync.Mutex
+}{keys: make(map[string]bool)}
+
+// acquireProcessLock locks the database directory at mainPath. Directories on
+// the local disk are also locked against other processes, storages other than
+// the local disk and process memory aren't locked.
+func acquireProcessLock(store Storage, mainPath string) (*processLock, error) {
+	var key string
+	switch s := store.(type) {
+	case OSStorage:
+		absPath, err := filepath.Abs(mainPath)
+		if err != nil {
+			return nil, err
+		}
+		key = absPath
+	case *memoryStorage:
+		key = fmt.Sprintf("memory:%p:%s", s, mainPath)
+	default:
+		return &processLock{}, nil
+	}
+
+	lockedPaths.mu.Lock()
+	defer lockedPaths.mu.Unlock()
+	if lockedPaths.keys[key] {
+		return nil, fmt.Errorf("%w: database '%s' is already open", ErrLocked, mainPath)
+	}
+
+	lock := &processLock{key: key}
+	if _, ok := store.(OSStorage); ok {
+		file, err := os.OpenFile(filepath.Join(mainPath, lockFileName), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+		err = lockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%w: database '%s' is open in another process", ErrLocked, mainPath)
+		}
+		lock.file = file
+	}
+
+	lockedPaths.keys[key] = true
+	return lock, nil
+}
+
+// release unlocks the directory
+func (l *processLock) release() error {
+	if l.key == "" {
+		return nil
+	}
+
+	lockedPaths.mu.Lock()
+	delete(lockedPaths.keys, l.key)
+	lockedPaths.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	unlockFile(l.file)
+	return l.file.Close()
+}
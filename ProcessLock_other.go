@@ -0,0 +1,20 @@
+// ProcessLock_other.go
+// Description: Lock file locking on systems without flock
+// Only Opens within this process are kept apart there
+// Author: harto.dev
+
+//go:build !unix
+
+package hartoDb_go
+
+import "os"
+
+// lockFile doesn't lock anything, there is no portable file lock
+func lockFile(file *os.File) error {
+	return nil
+}
+
+// unlockFile releases the lock of lockFile
+func unlockFile(file *os.File) error {
+	return nil
+}
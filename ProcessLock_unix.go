@@ -0,0 +1,23 @@
+// ProcessLock_unix.go
+// Description: Lock file locking on Unix systems
+// Uses flock, the lock is released by the kernel if the process dies
+// Author: harto.dev
+
+//go:build unix
+
+package hartoDb_go
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile locks a file exclusively without blocking
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// unlockFile releases the lock of lockFile
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,144 @@
+// Quarantine.go
+// Description: Quarantine of corrupt records for the HTDB library
+// Tolerant scans move records that fail to decode into a per-table quarantine file
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const quarantineEnding = ".quarantine.jsonl" // Not fileEnding, so it is never taken for a table
+
+// QuarantinedRecord is a corrupt record set aside by a tolerant scan
+type QuarantinedRecord struct {
+	Offset int64     `json:"offset"` // Byte offset of the record in the table file when it was found
+	Reason string    `json:"reason"` // Why the record couldn't be decoded
+	Data   []byte    `json:"data"`   // The raw record bytes
+	Time   time.Time `json:"time"`   // When it was quarantined
+}
+
+// quarantinePath returns the path of a table's quarantine file
+func quarantinePath(t *Table) string {
+	return filepath.Join(t.SchemaPath, t.TableName+quarantineEnding)
+}
+
+// QuarantinedRecords returns the records quarantined for the table, oldest first
+func (t *Table) QuarantinedRecords() ([]QuarantinedRecord, error) {
+	path := quarantinePath(t)
+	lock := tableLock(path)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return readQuarantine(t.storage(), path)
+}
+
+// readQuarantine reads a quarantine file, a missing file holds no records
+func readQuarantine(store Storage, path string) ([]QuarantinedRecord, error) {
+	data, err := readFile(store, path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quarantine file: %w", err)
+	}
+
+	var records []QuarantinedRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var record QuarantinedRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid quarantine entry: %v", ErrCorrupt, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// quarantine appends corrupt records to the table's quarantine file. Records
+// already quarantined at the same offset with the same bytes are skipped, so
+// repeated scans of a damaged file don't pile up copies. It returns the number
+// of records added.
+func (t *Table) quarantine(records []QuarantinedRecord) (int, error) {
+	path := quarantinePath(t)
+	lock := tableLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	store := t.storage()
+	existing, err := readQuarantine(store, path)
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[int64][][]byte)
+	for _, record := range existing {
+		seen[record.Offset] = append(seen[record.Offset], record.Data)
+	}
+
+	var buf bytes.Buffer
+	added := 0
+	for _, record := range records {
+		duplicate := false
+		for _, data := range seen[record.Offset] {
+			if bytes.Equal(data, record.Data) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode quarantined record: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+
+	file, err := store.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, t.db.fileMode())
+	if err != nil {
+		return 0, fmt.Errorf("failed to open quarantine file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("failed to write quarantine file: %w", err)
+	}
+	if t.durability() >= DurabilityFlush {
+		err = file.Sync()
+		if err != nil {
+			return 0, fmt.Errorf("failed to sync quarantine file: %w", err)
+		}
+	}
+
+	t.db.metricsSink().Inc(MetricRecordsQuarantined, int64(added))
+	t.db.log(slog.LevelWarn, "records quarantined", "schema", t.schemaName(), "table", t.TableName, "records", added)
+	return added, nil
+}
+
+// newQuarantinedRecord copies a corrupt serialized record for the quarantine
+func newQuarantinedRecord(data []byte, offset int64, reason error) QuarantinedRecord {
+	return QuarantinedRecord{
+		Offset: offset,
+		Reason: reason.Error(),
+		Data:   bytes.Clone(data),
+		Time:   time.Now().UTC(),
+	}
+}
@@ -6,8 +6,14 @@
 package hartoDb_go
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 )
 
 // FilterCondition represents a single filter condition for a query
@@ -15,16 +21,24 @@ type FilterCondition struct {
 	Field    string
 	Operator string
 	Value    interface{}
+
+	collation Collation // Set by the scan, see Collate
 }
 
+const queryContextCheckInterval = 256 // Records scanned between context checks
+
 // Query represents a database query with builder pattern
 type Query struct {
-	table         *Table
-	db            *HTDB
-	limitCount    int
-	sortField     string
-	sortAscending bool
-	conditions    []FilterCondition
+	table           *Table
+	db              *HTDB
+	limitCount      int
+	sortField       string
+	sortAscending   bool
+	conditions      []FilterCondition
+	fields          []string // Projection, empty decodes every field
+	archived        bool     // Query the archived versions instead, see QueryArchive
+	collation       Collation
+	revealSensitive bool // See RevealSensitive
 }
 
 // Select creates a new query for the specified table
@@ -53,8 +67,16 @@ func (q *Query) Limit(count int) *Query {
 	return q
 }
 
+// Fields restricts the fields decoded for the returned records. Fields used by
+// Where and Sort are decoded as well. Projected records don't carry the other
+// fields and must not be written back to the table.
+func (q *Query) Fields(fields ...string) *Query {
+	q.fields = fields
+	return q
+}
+
 // Where adds a filter condition to the query
-// Supported operators: "=", "!=", ">", ">=", "<", "<="
+// Supported operators: "=", "!=", ">", ">=", "<", "<=", see Match for "match"
 func (q *Query) Where(field string, operator string, value interface{}) *Query {
 	q.conditions = append(q.conditions, FilterCondition{
 		Field:    field,
@@ -67,45 +89,257 @@ func (q *Query) Where(field string, operator string, value interface{}) *Query {
 // GetAll executes the query and returns all matching records
 // applying any filtering, sorting, and limits that were set
 func (q *Query) GetAll() ([]*Record, error) {
-	// Get all records from the table
-	records, err := q.table.GetAllRecords()
+	return q.GetAllContext(context.Background())
+}
+
+// GetAllContext is GetAll that gives up with the context's error once ctx is done
+func (q *Query) GetAllContext(ctx context.Context) ([]*Record, error) {
+	err := ctx.Err()
 	if err != nil {
 		return nil, err
 	}
+	var stats scanStats
+	defer q.logIfSlow(time.Now(), &stats)
 
-	// Filter to current records only
-	var currentRecords []*Record
-	for _, record := range records {
-		if record.Metadata.IsCurrent && !record.Metadata.IsDeleted {
-			currentRecords = append(currentRecords, record)
+	// A lookup of a single id can use the record cache instead of a scan
+	if id, ok := q.idLookup(); ok && !q.archived && q.db.tableManager != nil {
+		record, err := q.db.tableManager.lookupRecord(q.table, id)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || record.Metadata.IsDeleted {
+			return nil, nil
 		}
+		stats.matched = 1
+		return []*Record{q.redact(record)}, nil
 	}
 
-	// Apply where conditions if any
-	if len(q.conditions) > 0 {
-		var filteredRecords []*Record
-		for _, record := range currentRecords {
-			if matchesConditions(record, q.conditions) {
-				filteredRecords = append(filteredRecords, record)
-			}
-		}
-		currentRecords = filteredRecords
+	// Stream the table and keep only current records matching the conditions
+	var currentRecords []*Record
+	err = q.scan(ctx, &stats, func(record *Record) error {
+		currentRecords = append(currentRecords, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !q.archived {
+		currentRecords = latestVersions(q.table, currentRecords)
 	}
 
-	// Apply sorting if a sort field is specified
+	// Apply sorting if a sort field is specified. A reverse scan returns the
+	// records by insertion order, ids of concurrent commits may interleave.
 	if q.sortField != "" {
 		// Sort the records based on the specified field and direction
-		sortRecords(currentRecords, q.sortField, q.sortAscending)
+		sortRecords(currentRecords, q.sortField, q.sortAscending, q.fieldCollation(q.sortField))
 	}
 
 	// Apply limit if set
 	if q.limitCount > 0 && len(currentRecords) > q.limitCount {
-		return currentRecords[:q.limitCount], nil
+		currentRecords = currentRecords[:q.limitCount]
 	}
 
+	for i, record := range currentRecords {
+		currentRecords[i] = q.redact(record)
+	}
 	return currentRecords, nil
 }
 
+// Stream calls fn for every record matching the query. Without Sort the records
+// are streamed straight from the table file in constant memory, a sorted query
+// has to collect its result first. Returning ErrStopStreaming from fn stops early.
+func (q *Query) Stream(fn func(*Record) error) error {
+	return q.StreamContext(context.Background(), fn)
+}
+
+// StreamContext is Stream that gives up with the context's error once ctx is done
+func (q *Query) StreamContext(ctx context.Context, fn func(*Record) error) error {
+	if _, ok := q.idLookup(); q.sortField == "" && (!ok || q.archived) {
+		var stats scanStats
+		defer q.logIfSlow(time.Now(), &stats)
+		return q.scan(ctx, &stats, func(record *Record) error {
+			return fn(q.redact(record))
+		})
+	}
+
+	records, err := q.GetAllContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		err = fn(record)
+		if errors.Is(err, ErrStopStreaming) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan streams the current records matching the conditions to fn. Without
+// sorting, or sorted by id descending and read from the end of the table, the
+// first matches are the result, so the scan stops at the limit.
+func (q *Query) scan(ctx context.Context, stats *scanStats, fn func(*Record) error) error {
+	err := q.collation.validate()
+	if err != nil {
+		return err
+	}
+
+	metrics := q.db.metricsSink()
+	metrics.Inc(MetricQueryScans, 1)
+	start := time.Now()
+	defer func() {
+		metrics.Observe(MetricScanDuration, time.Since(start).Seconds())
+	}()
+
+	// Match conditions with an up-to-date index narrow the scan to their ids
+	candidates, conditions := q.fullTextCandidates()
+	if q.archived {
+		candidates, conditions = nil, q.conditions // The indexes only cover the table
+	}
+	conditions = q.collatedConditions(conditions)
+	refFields := q.matchRefFields(conditions)
+	var refs *refReader
+	if len(refFields) > 0 {
+		refs = newRefReader(q.table)
+		defer refs.close()
+	}
+
+	options := ScanOptions{Fields: q.decodedFields()}
+	stream := q.table.StreamRecordsWith
+	if q.archived {
+		options.IncludeDeleted = true
+		options.IncludeHistory = true
+		stream = func(options ScanOptions, fn func(*Record) error) error {
+			return q.table.streamArchive(options, make(map[int64]bool), fn)
+		}
+	}
+
+	// Newest first, the first matches are the latest records. The first
+	// version seen of a logical record is its latest.
+	var seen map[int64]bool
+	if q.reversed() {
+		stream = q.table.StreamRecordsReverse
+		seen = make(map[int64]bool)
+	}
+
+	return stream(options, func(record *Record) error {
+		// Checking the context on every record would dominate cheap scans
+		stats.scanned++
+		if stats.scanned%queryContextCheckInterval == 0 {
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Checked before the conditions, an older version must not match in place of the latest
+		if seen != nil {
+			if seen[record.LogicalID()] {
+				return nil
+			}
+			seen[record.LogicalID()] = true
+		}
+		if candidates != nil && !candidates[record.ID] {
+			return nil
+		}
+		for _, field := range refFields {
+			text, err := indexedText(refs, record, field)
+			if err != nil {
+				return err
+			}
+			record.FieldsData[field.Name] = text
+		}
+		if len(conditions) > 0 && !matchesConditions(record, conditions) {
+			return nil
+		}
+		err := fn(record)
+		if err != nil {
+			return err
+		}
+
+		stats.matched++
+		if (q.sortField == "" || q.reversed()) && q.limitCount > 0 && stats.matched >= q.limitCount {
+			return ErrStopStreaming
+		}
+		return nil
+	})
+}
+
+// scanStats counts the records of a scan, for slow query logging
+type scanStats struct {
+	scanned int // Records read from the table file
+	matched int // Records passed to the scan's callback
+}
+
+// logIfSlow logs the query as slow and counts it if it took longer than the
+// database's threshold
+func (q *Query) logIfSlow(start time.Time, stats *scanStats) {
+	if q.db == nil {
+		return
+	}
+	threshold := time.Duration(q.db.slowQueryThreshold.Load())
+	duration := time.Since(start)
+	if threshold <= 0 || duration < threshold {
+		return
+	}
+
+	q.db.metricsSink().Inc(MetricSlowQueries, 1)
+	q.db.log(slog.LevelWarn, "slow query",
+		"schema", filepath.Base(q.table.SchemaPath), "table", q.table.TableName,
+		"conditions", q.conditionSummary(), "sort", q.sortField, "limit", q.limitCount,
+		"scanned", stats.scanned, "matched", stats.matched, "duration", duration)
+}
+
+// conditionSummary describes the conditions of the query for logs, such as
+// "age > 30 AND name = Bob"
+func (q *Query) conditionSummary() string {
+	parts := make([]string, len(q.conditions))
+	for i, condition := range q.conditions {
+		parts[i] = fmt.Sprintf("%s %s %v", condition.Field, condition.Operator, condition.Value)
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// decodedFields returns the fields a scan has to decode for the projection,
+// or nil if every field is needed
+func (q *Query) decodedFields() []string {
+	if len(q.fields) == 0 {
+		return nil
+	}
+
+	fields := append([]string{}, q.fields...)
+	for _, condition := range q.conditions {
+		fields = append(fields, condition.Field)
+	}
+	if q.sortField != "" {
+		fields = append(fields, q.sortField)
+	}
+	return fields
+}
+
+// idLookup reports whether the query is a plain lookup by id and returns that id
+func (q *Query) idLookup() (int64, bool) {
+	if len(q.conditions) != 1 {
+		return 0, false
+	}
+
+	condition := q.conditions[0]
+	if condition.Field != "id" || condition.Operator != "=" {
+		return 0, false
+	}
+
+	switch id := condition.Value.(type) {
+	case int64:
+		return id, true
+	case int:
+		return int64(id), true
+	}
+	return 0, false
+}
+
 // matchesConditions checks if a record matches all the filter conditions
 func matchesConditions(record *Record, conditions []FilterCondition) bool {
 	for _, condition := range conditions {
@@ -114,6 +348,14 @@ func matchesConditions(record *Record, conditions []FilterCondition) bool {
 			return false // Field doesn't exist in the record
 		}
 
+		// Strings of a folding collation are compared by their sort keys
+		if text, isText := fieldValue.(string); isText && condition.collation.folds() && condition.Operator != matchOperator {
+			if value, ok := condition.Value.(string); ok {
+				fieldValue = condition.collation.key(text)
+				condition.Value = condition.collation.key(value)
+			}
+		}
+
 		// Compare based on the operator and types
 		switch condition.Operator {
 		case "=":
@@ -140,6 +382,12 @@ func matchesConditions(record *Record, conditions []FilterCondition) bool {
 			if !lessThanOrEqual(fieldValue, condition.Value) {
 				return false
 			}
+		case matchOperator:
+			text, isText := fieldValue.(string)
+			query, _ := condition.Value.(string)
+			if !isText || !containsTerms(text, tokenize(query)) {
+				return false
+			}
 		default:
 			return false // Unsupported operator
 		}
@@ -154,20 +402,9 @@ func equals(a, b interface{}) bool {
 		if bVal, ok := b.(string); ok {
 			return aVal == bVal
 		}
-	case int:
-		switch bVal := b.(type) {
-		case int:
-			return aVal == bVal
-		case float64:
-			return float64(aVal) == bVal
-		}
-	case float64:
-		switch bVal := b.(type) {
-		case float64:
-			return aVal == bVal
-		case int:
-			return aVal == float64(bVal)
-		}
+	case int, int64, float64:
+		result, ok := compareNumbers(a, b)
+		return ok && result == 0
 	case bool:
 		if bVal, ok := b.(bool); ok {
 			return aVal == bVal
@@ -183,22 +420,65 @@ func greaterThan(a, b interface{}) bool {
 		if bVal, ok := b.(string); ok {
 			return aVal > bVal
 		}
-	case int:
-		switch bVal := b.(type) {
-		case int:
-			return aVal > bVal
-		case float64:
-			return float64(aVal) > bVal
+	case int, int64, float64:
+		result, ok := compareNumbers(a, b)
+		return ok && result > 0
+	}
+	return false
+}
+
+// compareNumbers compares two numeric values of type int, int64 or float64.
+// Integers are compared exactly, mixed with floats as float64. It reports
+// false if either value isn't a number.
+func compareNumbers(a, b interface{}) (int, bool) {
+	aInt, aIsInt := asInt64(a)
+	bInt, bIsInt := asInt64(b)
+	if aIsInt && bIsInt {
+		switch {
+		case aInt < bInt:
+			return -1, true
+		case aInt > bInt:
+			return 1, true
 		}
+		return 0, true
+	}
+
+	aFloat, aOk := asFloat64(a)
+	bFloat, bOk := asFloat64(b)
+	if !aOk || !bOk {
+		return 0, false
+	}
+	switch {
+	case aFloat < bFloat:
+		return -1, true
+	case aFloat > bFloat:
+		return 1, true
+	}
+	return 0, true
+}
+
+// asInt64 returns an int or int64 value as int64
+func asInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// asFloat64 returns a numeric value as float64
+func asFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
 	case float64:
-		switch bVal := b.(type) {
-		case float64:
-			return aVal > bVal
-		case int:
-			return aVal > float64(bVal)
-		}
+		return n, true
 	}
-	return false
+	return 0, false
 }
 
 // greaterThanOrEqual checks if a >= b
@@ -213,20 +493,9 @@ func lessThan(a, b interface{}) bool {
 		if bVal, ok := b.(string); ok {
 			return aVal < bVal
 		}
-	case int:
-		switch bVal := b.(type) {
-		case int:
-			return aVal < bVal
-		case float64:
-			return float64(aVal) < bVal
-		}
-	case float64:
-		switch bVal := b.(type) {
-		case float64:
-			return aVal < bVal
-		case int:
-			return aVal < float64(bVal)
-		}
+	case int, int64, float64:
+		result, ok := compareNumbers(a, b)
+		return ok && result < 0
 	}
 	return false
 }
@@ -236,8 +505,20 @@ func lessThanOrEqual(a, b interface{}) bool {
 	return lessThan(a, b) || equals(a, b)
 }
 
-// sortRecords sorts the records by the specified field in the specified direction
-func sortRecords(records []*Record, field string, ascending bool) {
+// sortRecords sorts the records by the specified field in the specified
+// direction, strings in the order of collation
+func sortRecords(records []*Record, field string, ascending bool, collation Collation) {
+	// Sort keys are computed once, not on every comparison
+	var keys map[*Record]string
+	if collation.folds() {
+		keys = make(map[*Record]string, len(records))
+		for _, record := range records {
+			if text, ok := record.FieldsData[field].(string); ok {
+				keys[record] = collation.key(text)
+			}
+		}
+	}
+
 	// Define a less function that compares records based on the field
 	less := func(i, j int) bool {
 		// Get the values to compare
@@ -262,17 +543,14 @@ func sortRecords(records []*Record, field string, ascending bool) {
 			// String comparison
 			strI, _ := valI.(string)
 			strJ, _ := valJ.(string)
+			if keys != nil {
+				strI, strJ = keys[records[i]], keys[records[j]]
+			}
 			result = strI < strJ
-		case int:
-			// Integer comparison
-			intI, _ := valI.(int)
-			intJ, _ := valJ.(int)
-			result = intI < intJ
-		case float64:
-			// Float comparison
-			floatI, _ := valI.(float64)
-			floatJ, _ := valJ.(float64)
-			result = floatI < floatJ
+		case int, int64, float64:
+			// Numeric comparison
+			compared, _ := compareNumbers(valI, valJ)
+			result = compared < 0
 		default:
 			// Default to string comparison for other types
 			result = fmt.Sprintf("%v", valI) < fmt.Sprintf("%v", valJ)
@@ -0,0 +1,134 @@
+// QueryInfo.go
+// Description: Query introspection for the HTDB library
+// Read-only views of a query's conditions, sort and limit, and canonical fingerprints for caches
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SortKey is a field a query sorts by
+type SortKey struct {
+	Field     string
+	Ascending bool
+}
+
+// Conditions returns a copy of the query's conditions in the order they were
+// added. A record matches if it matches every condition.
+func (q *Query) Conditions() []FilterCondition {
+	conditions := make([]FilterCondition, len(q.conditions))
+	for i, condition := range q.conditions {
+		conditions[i] = FilterCondition{Field: condition.Field, Operator: condition.Operator, Value: condition.Value}
+	}
+	return conditions
+}
+
+// SortKeys returns the fields the query sorts by, none if it is unsorted
+func (q *Query) SortKeys() []SortKey {
+	if q.sortField == "" {
+		return nil
+	}
+	return []SortKey{{Field: q.sortField, Ascending: q.sortAscending}}
+}
+
+// LimitValue returns the maximum number of records the query returns, it
+// reports false if the query has no limit
+func (q *Query) LimitValue() (int, bool) {
+	if q.limitCount < 0 {
+		return 0, false
+	}
+	return q.limitCount, true
+}
+
+// Fingerprint returns a canonical description of the query's shape: its
+// table, conditions without their values, sort, limit, projection and
+// options. Queries that differ only in the order of their conditions or
+// projected fields, or in condition values, have the same fingerprint.
+func (q *Query) Fingerprint() string {
+	return q.fingerprint(false)
+}
+
+// FingerprintWithValues is Fingerprint including the condition values, so it
+// tells apart queries that return different records, e.g. for cache keys.
+// Numbers of equal value are equal regardless of their Go type.
+func (q *Query) FingerprintWithValues() string {
+	return q.fingerprint(true)
+}
+
+// fingerprint builds Fingerprint, with the condition values if withValues is set
+func (q *Query) fingerprint(withValues bool) string {
+	conditions := make([]string, len(q.conditions))
+	for i, condition := range q.conditions {
+		value := "?"
+		if withValues {
+			value = fingerprintValue(condition.Value)
+		}
+		conditions[i] = strconv.Quote(condition.Field) + " " + condition.Operator + " " + value
+	}
+	sort.Strings(conditions)
+
+	parts := []string{strconv.Quote(q.table.schemaName()) + "." + strconv.Quote(q.table.TableName)}
+	if len(conditions) > 0 {
+		parts = append(parts, "where "+strings.Join(conditions, " and "))
+	}
+	if q.sortField != "" {
+		direction := "asc"
+		if !q.sortAscending {
+			direction = "desc"
+		}
+		parts = append(parts, "sort "+strconv.Quote(q.sortField)+" "+direction)
+	}
+	if q.limitCount >= 0 {
+		parts = append(parts, "limit "+strconv.Itoa(q.limitCount))
+	}
+	if len(q.fields) > 0 {
+		fields := make([]string, 0, len(q.fields))
+		seen := make(map[string]bool, len(q.fields))
+		for _, field := range q.fields {
+			if !seen[field] {
+				seen[field] = true
+				fields = append(fields, strconv.Quote(field))
+			}
+		}
+		sort.Strings(fields)
+		parts = append(parts, "fields "+strings.Join(fields, ","))
+	}
+	if q.collation != "" {
+		parts = append(parts, "collate "+strconv.Quote(string(q.collation)))
+	}
+	if q.archived {
+		parts = append(parts, "archived")
+	}
+	if q.revealSensitive {
+		parts = append(parts, "sensitive")
+	}
+	return strings.Join(parts, " ")
+}
+
+// fingerprintValue encodes a condition value for a fingerprint. Numbers are
+// encoded by value, as conditions compare them regardless of their type.
+func fingerprintValue(value interface{}) string {
+	if n, ok := asInt64(value); ok {
+		return strconv.FormatInt(n, 10)
+	}
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprintf("%T(%v)", value, value)
+}
@@ -0,0 +1,103 @@
+// Query_test.go
+// Description: Tests and benchmarks of queries of the HTDB library
+// Newest first queries return each record once, projected queries skip the bytes of the fields they don't select
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"testing"
+)
+
+// An updated record is returned once, in its latest version, by queries that
+// read the table newest first
+func TestSortIDDescendingAfterUpdate(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	first := insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "created"})
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 2, "note": "created"})
+	_, err := tm.UpdateRecord(table, first, map[string]interface{}{"note": "updated"})
+	if err != nil {
+		t.Fatalf("failed to update record: %v", err)
+	}
+
+	for _, limit := range []int{0, 2} {
+		records, err := tm.Select(table).Sort("id", false).Limit(limit).GetAll()
+		if err != nil {
+			t.Fatalf("failed to select records: %v", err)
+		}
+		var got []string
+		for _, record := range records {
+			note, err := table.ReadRef(record, "note")
+			if err != nil {
+				t.Fatalf("failed to read note: %v", err)
+			}
+			got = append(got, fmt.Sprint(record.FieldsData["key"], " ", note))
+		}
+		// The update gave record 1 the newest id
+		if want := "[1 updated 2 created]"; fmt.Sprint(got) != want {
+			t.Errorf("limit %d: id desc returns %v, want %s", limit, got, want)
+		}
+	}
+}
+
+func BenchmarkProjection(b *testing.B) {
+	var fields []Field
+	for i := 0; i < 30; i++ {
+		field := Field{Name: fmt.Sprintf("c%02d", i), Type: Int, Length: 8}
+		switch i % 3 {
+		case 1:
+			field.Type, field.Length = Float, 8
+		case 2:
+			field.Type, field.Length = String, 16
+		}
+		fields = append(fields, field)
+	}
+
+	db := openTestDB(b, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(b, db, "s", "wide", fields)
+	const records = 100000
+	appendBenchmarkRecords(b, table, records, func(i int) map[string]interface{} {
+		data := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			switch field.Type {
+			case Int:
+				data[field.Name] = i
+			case Float:
+				data[field.Name] = float64(i) / 7
+			default:
+				data[field.Name] = "value"
+			}
+		}
+		return data
+	})
+
+	queries := []struct {
+		name   string
+		fields []string
+	}{
+		{"all fields", nil},
+		{"two fields", []string{"c00", "c01"}},
+	}
+	for _, query := range queries {
+		b.Run(query.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				count := 0
+				err := tm.Select(table).Fields(query.fields...).Stream(func(*Record) error {
+					count++
+					return nil
+				})
+				if err != nil {
+					b.Fatalf("failed to stream records: %v", err)
+				}
+				if count != records {
+					b.Fatalf("streamed %d records, want %d", count, records)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Quota.go
+// Description: Size quotas of the HTDB library
+// Limits the bytes of table and ref files per table and per schema, checked at commit time
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// usageTracker keeps the bytes used by the tables of a schema, so a commit
+// doesn't have to stat every table of the schema to check its quota
+type usageTracker struct {
+	schemas map[string]map[string]int64 // Cleaned schema directory, cleaned table file path, bytes
+	mu      sync.Mutex
+}
+
+// newUsageTracker creates an empty usage tracker
+func newUsageTracker() *usageTracker {
+	return &usageTracker{schemas: make(map[string]map[string]int64)}
+}
+
+// SetQuota limits the bytes of the table and ref files of a table, or of all
+// tables of a schema together if table is empty. Commits that would exceed a
+// quota fail with a *QuotaError before the table file is written. Zero removes
+// the quota. Quotas are kept in the config file.
+func (db *HTDB) SetQuota(schema, table string, maxBytes int64) error {
+	config := db.Config()
+	tableQuotas := make(map[string]int64, len(config.TableQuotas))
+	for key, limit := range config.TableQuotas {
+		tableQuotas[key] = limit
+	}
+	schemaQuotas := make(map[string]int64, len(config.SchemaQuotas))
+	for key, limit := range config.SchemaQuotas {
+		schemaQuotas[key] = limit
+	}
+
+	quotas, key := schemaQuotas, schema
+	if table != "" {
+		quotas, key = tableQuotas, schema+":"+table
+	}
+	if maxBytes == 0 {
+		delete(quotas, key)
+	} else {
+		quotas[key] = maxBytes
+	}
+
+	config.TableQuotas = tableQuotas
+	config.SchemaQuotas = schemaQuotas
+	return db.SetConfig(config)
+}
+
+// quotas returns the quota of a table and of its schema, zero if there is none
+func (db *HTDB) quotas(schema, table string) (int64, int64) {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	return db.config.TableQuotas[schema+":"+table], db.config.SchemaQuotas[schema]
+}
+
+// hasQuotas reports whether any quota is set
+func (db *HTDB) hasQuotas() bool {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	return len(db.config.TableQuotas) > 0 || len(db.config.SchemaQuotas) > 0
+}
+
+// checkQuotas returns a *QuotaError if appending added bytes to the table files
+// of tables would exceed a quota. Ref values were written while staging, so
+// they are part of the current usage.
+func (db *HTDB) checkQuotas(tables []*Table, added []int64) error {
+	if !db.hasQuotas() {
+		return nil
+	}
+
+	schemaAdded := make(map[string]int64)
+	schemaTables := make(map[string]*Table)
+	for i, table := range tables {
+		schema := table.schemaName()
+		usage, err := db.usage.refresh(table)
+		if err != nil {
+			return err
+		}
+
+		tableQuota, _ := db.quotas(schema, table.TableName)
+		if tableQuota > 0 && usage+added[i] > tableQuota {
+			return &QuotaError{Schema: schema, Table: table.TableName, Limit: tableQuota, Usage: usage, Added: added[i]}
+		}
+		schemaAdded[schema] += added[i]
+		schemaTables[schema] = table
+	}
+
+	schemas := make([]string, 0, len(schemaAdded))
+	for schema := range schemaAdded {
+		schemas = append(schemas, schema)
+	}
+	sort.Strings(schemas)
+	for _, schema := range schemas {
+		_, schemaQuota := db.quotas(schema, "")
+		if schemaQuota <= 0 {
+			continue
+		}
+		usage, err := db.usage.schemaUsage(db, schema, schemaTables[schema].SchemaPath)
+		if err != nil {
+			return err
+		}
+		if usage+schemaAdded[schema] > schemaQuota {
+			return &QuotaError{Schema: schema, Limit: schemaQuota, Usage: usage, Added: schemaAdded[schema]}
+		}
+	}
+	return nil
+}
+
+// refresh measures the usage of a table and updates it in the schema's usage if that is loaded
+func (u *usageTracker) refresh(table *Table) (int64, error) {
+	fileBytes, refBytes, err := tableFileSizes(table.storage(), table)
+	if err != nil {
+		return 0, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if tables, loaded := u.schemas[filepath.Clean(table.SchemaPath)]; loaded {
+		tables[tableCacheKey(table)] = fileBytes + refBytes
+	}
+	return fileBytes + refBytes, nil
+}
+
+// schemaUsage returns the bytes used by every table of a schema, measuring
+// them on first use
+func (u *usageTracker) schemaUsage(db *HTDB, schema, schemaPath string) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := filepath.Clean(schemaPath)
+	tables, loaded := u.schemas[key]
+	if !loaded {
+		all, err := db.schemaTables(schema)
+		if err != nil {
+			return 0, err
+		}
+		tables = make(map[string]int64, len(all))
+		for _, table := range all {
+			fileBytes, refBytes, err := tableFileSizes(db.storage(), table)
+			if err != nil {
+				return 0, err
+			}
+			tables[tableCacheKey(table)] = fileBytes + refBytes
+		}
+		u.schemas[key] = tables
+	}
+
+	var usage int64
+	for _, bytes := range tables {
+		usage += bytes
+	}
+	return usage, nil
+}
+
+// invalidate drops the usage of a schema, it is measured again on next use
+func (u *usageTracker) invalidate(schemaPath string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.schemas, filepath.Clean(schemaPath))
+}
+
+// reset drops every measured usage
+func (u *usageTracker) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.schemas = make(map[string]map[string]int64)
+}
+
+// tableFileSizes returns the size of a table's file and the total size of its ref files
+func tableFileSizes(store Storage, table *Table) (int64, int64, error) {
+	var fileBytes, refBytes int64
+	for _, field := range table.Fields {
+		if field.Type != "ref" {
+			continue
+		}
+		info, err := store.Stat(table.RefFilePath(field.Name))
+		if err == nil {
+			refBytes += info.Size()
+		} else if !os.IsNotExist(err) {
+			return 0, 0, err
+		}
+	}
+
+	info, err := store.Stat(table.filePath())
+	if err == nil {
+		fileBytes = info.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	return fileBytes, refBytes, nil
+}
@@ -8,7 +8,12 @@ package hartoDb_go
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,6 +24,10 @@ type RecordMetadata struct {
 	IsDeleted     bool   `json:"is_deleted"`     // true if the record was explicitly deleted
 	IsLocked      bool   `json:"is_locked"`      // true if the record is locked by a transaction
 	TransactionID uint64 `json:"transaction_id"` // The transaction ID currently owning this record
+
+	CommittedAt int64  `json:"committed_at,omitempty"` // UnixNano of the commit that wrote this version, 0 before layout version 2
+	CommittedBy uint64 `json:"committed_by,omitempty"` // ID of the transaction that committed this version
+	OriginID    int64  `json:"origin_id,omitempty"`    // ID of the record's first version, 0 for the first version itself, see Record.LogicalID
 }
 
 // FieldMetadata contains the metadata for a field
@@ -28,12 +37,16 @@ type FieldMetadata struct {
 
 // Record represents a record in a table
 type Record struct {
-	ID         int64                    `json:"id"`          // Primary key (timeID)
-	Metadata   RecordMetadata           `json:"metadata"`    // Record metadata
-	FieldsData map[string]interface{}   `json:"fields_data"` // Field values
-	FieldsMeta map[string]FieldMetadata `json:"fields_meta"` // Field metadata
-	RefOffsets map[string][2]int64      `json:"ref_offsets"` // Offsets for ref fields [start, end]
-	mu         sync.Mutex               // Mutex for concurrent access
+	ID              int64                    `json:"id"`          // Primary key (timeID)
+	Metadata        RecordMetadata           `json:"metadata"`    // Record metadata
+	FieldsData      map[string]interface{}   `json:"fields_data"` // Field values
+	FieldsMeta      map[string]FieldMetadata `json:"fields_meta"` // Field metadata
+	RefOffsets      map[string][2]int64      `json:"ref_offsets"` // Offsets for ref fields [start, end]
+	previousID      int64                    // Id of the version a staged clone was made from
+	pendingRefs     map[string]bool          // Staged ref values written to the ref files at commit
+	expectedVersion string                   // Version the replaced record must still have at commit, see StageUpdateIfVersion
+	withheld        *Record                  // Sensitive fields removed by Table.Redact, restored by clones
+	mu              sync.Mutex               // Mutex for concurrent access
 }
 
 // NewRecord creates a new record with default metadata
@@ -72,7 +85,7 @@ func (r *Record) Lock(transactionID uint64) error {
 	defer r.mu.Unlock()
 
 	if r.Metadata.IsLocked && r.Metadata.TransactionID != transactionID {
-		return fmt.Errorf("record is locked by another transaction: %d", r.Metadata.TransactionID)
+		return &LockError{ID: r.ID, TransactionID: r.Metadata.TransactionID}
 	}
 
 	r.Metadata.IsLocked = true
@@ -95,24 +108,44 @@ func (r *Record) MarkDeleted(transactionID uint64) error {
 	defer r.mu.Unlock()
 
 	if r.Metadata.IsLocked && r.Metadata.TransactionID != transactionID {
-		return fmt.Errorf("record is locked by another transaction: %d", r.Metadata.TransactionID)
+		return &LockError{ID: r.ID, TransactionID: r.Metadata.TransactionID}
 	}
 
 	r.Metadata.IsDeleted = true
 	return nil
 }
 
-// Clone creates a staging copy of the record for updates
-func (r *Record) Clone(transactionID uint64) (*Record, error) {
+// CommittedAt returns when this version was committed, the zero time if it
+// was written before the record format kept it
+func (r *Record) CommittedAt() time.Time {
+	if r.Metadata.CommittedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, r.Metadata.CommittedAt)
+}
+
+// CommittedBy returns the ID of the transaction that committed this version,
+// 0 if it was written before the record format kept it
+func (r *Record) CommittedBy() uint64 {
+	return r.Metadata.CommittedBy
+}
+
+// Clone creates a staging copy of the record for updates. The copy gets a new
+// id from the generator of db, so it sorts after every id of the database.
+func (r *Record) Clone(db *HTDB, transactionID uint64) (*Record, error) {
+	return r.cloneWithID(transactionID, db.nextID())
+}
+
+// cloneWithID creates a staging copy of the record with the id newID
+func (r *Record) cloneWithID(transactionID uint64, newID int64) (*Record, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if r.Metadata.IsLocked && r.Metadata.TransactionID != transactionID {
-		return nil, fmt.Errorf("record is locked by another transaction: %d", r.Metadata.TransactionID)
+		return nil, &LockError{ID: r.ID, TransactionID: r.Metadata.TransactionID}
 	}
 
 	// Create a new record with a new ID but same data
-	newID := time.Now().UnixNano() // New timestamp ID
 	clone := &Record{
 		ID: newID,
 		Metadata: RecordMetadata{
@@ -120,10 +153,12 @@ func (r *Record) Clone(transactionID uint64) (*Record, error) {
 			IsDeleted:     r.Metadata.IsDeleted,
 			IsLocked:      true,
 			TransactionID: transactionID,
+			OriginID:      r.LogicalID(),
 		},
 		FieldsData: make(map[string]interface{}),
 		FieldsMeta: make(map[string]FieldMetadata),
 		RefOffsets: make(map[string][2]int64),
+		previousID: r.ID,
 	}
 
 	// Copy data
@@ -131,6 +166,11 @@ func (r *Record) Clone(transactionID uint64) (*Record, error) {
 		clone.FieldsData[k] = v
 	}
 
+	// Fields withheld from a redacted record are written back unchanged
+	if r.withheld != nil {
+		r.withheld.copyFieldsTo(clone)
+	}
+
 	// Update ID in FieldsData to match the new ID
 	clone.FieldsData["id"] = newID
 
@@ -142,62 +182,32 @@ func (r *Record) Clone(transactionID uint64) (*Record, error) {
 	// Ensure ID metadata is set
 	clone.FieldsMeta["id"] = FieldMetadata{IsNull: false}
 
-	// Copy ref offsets
+	// Copy ref offsets, values of the transaction that aren't written yet stay pending
 	for k, v := range r.RefOffsets {
 		clone.RefOffsets[k] = v
 	}
+	for k := range r.pendingRefs {
+		clone.setRefPending(k)
+	}
 
 	return clone, nil
 }
 
 // Serialize serializes the record to binary format
 func (r *Record) Serialize(fields []Field) ([]byte, error) {
-	// Calculate the size of the record
-	recordSize := 8 // ID (int64)
-	recordSize += 4 // Metadata (4 bytes for booleans and transaction ID)
-
-	// Add field sizes
-	for _, field := range fields {
-		if field.Name == "id" {
-			continue // Already counted
-		}
-		recordSize += int(field.Length)
-		recordSize += 1 // Field metadata (1 byte for isNull)
-	}
+	return r.serializeLayout(NewRecordLayout(fields))
+}
 
+// serializeLayout serializes the record using a precomputed layout
+func (r *Record) serializeLayout(layout *RecordLayout) ([]byte, error) {
 	// Create the binary data
-	data := make([]byte, recordSize)
-	offset := 0
-
-	// Write ID
-	binary.LittleEndian.PutUint64(data[offset:offset+8], uint64(r.ID))
-	offset += 8
-
-	// Write metadata
-	metaByte := byte(0)
-	if r.Metadata.IsCurrent {
-		metaByte |= 1
-	}
-	if r.Metadata.IsDeleted {
-		metaByte |= 2
-	}
-	if r.Metadata.IsLocked {
-		metaByte |= 4
-	}
-	data[offset] = metaByte
-	offset++
-
-	// Write transaction ID (3 bytes)
-	binary.LittleEndian.PutUint16(data[offset:offset+2], uint16(r.Metadata.TransactionID))
-	offset += 2
-	data[offset] = byte(r.Metadata.TransactionID >> 16)
-	offset++
+	data := make([]byte, layout.Size)
+	putRecordHeader(data, r.ID, r.Metadata)
+	putRecordAudit(data, layout, r.Metadata)
 
 	// Write fields
-	for _, field := range fields {
-		if field.Name == "id" {
-			continue // Already written
-		}
+	for _, fieldLayout := range layout.Fields {
+		field := fieldLayout.Field
 
 		// Write field metadata
 		fieldMeta, exists := r.FieldsMeta[field.Name]
@@ -205,17 +215,20 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 			fieldMeta = FieldMetadata{IsNull: true}
 		}
 		if fieldMeta.IsNull {
-			data[offset] = 1
+			data[fieldLayout.MetaOffset] = 1
 		} else {
-			data[offset] = 0
+			data[fieldLayout.MetaOffset] = 0
 		}
-		offset++
+		offset := fieldLayout.DataOffset
 
-		// Write field data
+		// Write field data. Ref fields only need their offsets, records read
+		// back from disk don't carry the ref value in FieldsData.
 		value, exists := r.FieldsData[field.Name]
+		if field.Type == "ref" {
+			_, exists = r.RefOffsets[field.Name]
+		}
 		if !exists || fieldMeta.IsNull {
-			// Write zeros for null fields
-			offset += int(field.Length)
+			// Null fields stay zeroed
 			continue
 		}
 
@@ -225,7 +238,7 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 			if !ok {
 				return nil, fmt.Errorf("field '%s' requires an int64 value", field.Name)
 			}
-			binary.LittleEndian.PutUint64(data[offset:offset+int(field.Length)], uint64(v))
+			putFixedInt(data[offset:offset+int(field.Length)], v)
 		case Int:
 			// Handle both int and int64 types
 			var intValue int64
@@ -236,18 +249,34 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 			} else {
 				return nil, fmt.Errorf("field '%s' requires an int or int64 value", field.Name)
 			}
-			binary.LittleEndian.PutUint64(data[offset:offset+int(field.Length)], uint64(intValue))
+			putFixedInt(data[offset:offset+int(field.Length)], intValue)
 		case Float:
 			v, ok := value.(float64)
 			if !ok {
 				return nil, fmt.Errorf("field '%s' requires a float64 value", field.Name)
 			}
-			binary.LittleEndian.PutUint64(data[offset:offset+int(field.Length)], uint64(v))
+			bits := math.Float64bits(v)
+			if !layout.floatBits {
+				bits = uint64(v) // Unmigrated tables keep the format of their file
+			}
+			putFixedInt(data[offset:offset+int(field.Length)], int64(bits))
+		case Bool:
+			v, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("field '%s' requires a bool value", field.Name)
+			}
+			if v {
+				data[offset] = 1
+			}
 		case String:
 			v, ok := value.(string)
 			if !ok {
 				return nil, fmt.Errorf("field '%s' requires a string value", field.Name)
 			}
+			if field.Compression == CompressionPacked {
+				putPackedString(data[offset:offset+int(field.Length)], v)
+				continue
+			}
 			copy(data[offset:offset+int(field.Length)], v)
 		case "ref":
 			// For ref fields, we store the offsets
@@ -260,8 +289,6 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 		default:
 			return nil, fmt.Errorf("unsupported field type '%s'", field.Type)
 		}
-
-		offset += int(field.Length)
 	}
 
 	return data, nil
@@ -269,129 +296,389 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 
 // Deserialize deserializes binary data into a record
 func DeserializeRecord(data []byte, fields []Field) (*Record, error) {
-	if len(data) < 12 { // Minimum size: 8 (ID) + 4 (metadata)
-		return nil, fmt.Errorf("data too short to be a valid record")
+	return deserializeRecordLayout(data, NewRecordLayout(fields))
+}
+
+// deserializeRecordLayout deserializes binary data into a record using a precomputed layout
+func deserializeRecordLayout(data []byte, layout *RecordLayout) (*Record, error) {
+	record := &Record{}
+	err := record.DeserializeInto(data, layout)
+	if err != nil {
+		return nil, err
 	}
 
-	record := &Record{
-		FieldsData: make(map[string]interface{}),
-		FieldsMeta: make(map[string]FieldMetadata),
-		RefOffsets: make(map[string][2]int64),
+	return record, nil
+}
+
+// Reset clears the record so it can be reused, keeping its allocated maps
+func (r *Record) Reset() {
+	r.ID = 0
+	r.Metadata = RecordMetadata{}
+	if r.FieldsData == nil {
+		r.FieldsData = make(map[string]interface{})
+	} else {
+		clear(r.FieldsData)
+	}
+	if r.FieldsMeta == nil {
+		r.FieldsMeta = make(map[string]FieldMetadata)
+	} else {
+		clear(r.FieldsMeta)
 	}
+	if r.RefOffsets == nil {
+		r.RefOffsets = make(map[string][2]int64)
+	} else {
+		clear(r.RefOffsets)
+	}
+}
 
-	offset := 0
+// DeserializeInto decodes binary data into an existing record, reusing its maps
+// instead of allocating new ones. If fields are given only those fields are
+// decoded, the header (id and metadata) is always decoded.
+func (r *Record) DeserializeInto(data []byte, layout *RecordLayout, fields ...string) error {
+	err := checkRecordData(data, layout)
+	if err != nil {
+		return err
+	}
 
-	// Read ID
-	record.ID = int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
-	offset += 8
+	r.Reset()
 
-	// Read metadata
-	metaByte := data[offset]
-	record.Metadata.IsCurrent = (metaByte & 1) != 0
-	record.Metadata.IsDeleted = (metaByte & 2) != 0
-	record.Metadata.IsLocked = (metaByte & 4) != 0
-	offset++
+	r.ID, r.Metadata = readRecordHeader(data)
+	readRecordAudit(data, layout, &r.Metadata)
 
-	// Read transaction ID (3 bytes)
-	txID := uint64(binary.LittleEndian.Uint16(data[offset : offset+2]))
-	offset += 2
-	txID |= uint64(data[offset]) << 16
-	record.Metadata.TransactionID = txID
-	offset++
+	// The id lives in the header
+	r.FieldsData["id"] = r.ID
+	r.FieldsMeta["id"] = FieldMetadata{IsNull: false}
 
-	// Read fields
-	for _, field := range fields {
-		if field.Name == "id" {
-			record.FieldsData["id"] = record.ID
-			record.FieldsMeta["id"] = FieldMetadata{IsNull: false}
-			continue
+	// Read only the requested fields if there is a projection
+	if len(fields) > 0 {
+		for _, name := range fields {
+			if index, exists := layout.fieldIndex[name]; exists {
+				r.decodeField(data, layout, layout.Fields[index])
+			}
 		}
+		return nil
+	}
 
-		// Read field metadata
-		isNull := data[offset] == 1
-		record.FieldsMeta[field.Name] = FieldMetadata{IsNull: isNull}
-		offset++
+	// Read fields
+	for _, fieldLayout := range layout.Fields {
+		r.decodeField(data, layout, fieldLayout)
+	}
 
-		if isNull {
-			// Skip null fields
-			offset += int(field.Length)
-			continue
+	return nil
+}
+
+// checkRecordData checks a serialized record for damage that can be detected
+// without decoding it: a short record, unknown metadata flags or null flags
+// and bool values other than 0 and 1. The error wraps ErrCorrupt.
+func checkRecordData(data []byte, layout *RecordLayout) error {
+	if len(data) < layout.Size {
+		return fmt.Errorf("%w: data too short to be a valid record", ErrCorrupt)
+	}
+	if flags := recordFlags(data); flags&^knownFlags != 0 {
+		return fmt.Errorf("%w: unknown metadata flags %#x", ErrCorrupt, flags)
+	}
+	for _, fieldLayout := range layout.Fields {
+		if data[fieldLayout.MetaOffset] > 1 {
+			return fmt.Errorf("%w: invalid null flag %d for field '%s'", ErrCorrupt, data[fieldLayout.MetaOffset], fieldLayout.Field.Name)
+		}
+		field := fieldLayout.Field
+		if field.Type == Bool && data[fieldLayout.DataOffset] > 1 {
+			return fmt.Errorf("%w: invalid bool value %d for field '%s'", ErrCorrupt, data[fieldLayout.DataOffset], field.Name)
+		}
+		if field.Compression == CompressionPacked && data[fieldLayout.MetaOffset] == 0 {
+			slot := data[fieldLayout.DataOffset : fieldLayout.DataOffset+int(field.Length)]
+			if length, ok := packedStringLength(slot); !ok {
+				return fmt.Errorf("%w: packed value of field '%s' is %d bytes long, the field holds %d", ErrCorrupt, field.Name, length, field.capacity())
+			}
 		}
+	}
+	return nil
+}
 
-		// Read field data
-		switch field.Type {
-		case TimeID, Int:
-			value := int64(binary.LittleEndian.Uint64(data[offset : offset+int(field.Length)]))
-			record.FieldsData[field.Name] = value
-		case Float:
-			bits := binary.LittleEndian.Uint64(data[offset : offset+int(field.Length)])
-			record.FieldsData[field.Name] = float64(bits)
-		case String:
-			str := string(data[offset : offset+int(field.Length)])
-			// Trim null bytes
-			record.FieldsData[field.Name] = string([]byte(str))
-		case "ref":
-			start := int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
-			end := int64(binary.LittleEndian.Uint64(data[offset+8 : offset+16]))
-			record.RefOffsets[field.Name] = [2]int64{start, end}
+// decodeField reads a single field's metadata and value into the record
+func (r *Record) decodeField(data []byte, layout *RecordLayout, fieldLayout FieldLayout) {
+	field := fieldLayout.Field
+
+	// Read field metadata
+	isNull := data[fieldLayout.MetaOffset] == 1
+	r.FieldsMeta[field.Name] = FieldMetadata{IsNull: isNull}
+	offset := fieldLayout.DataOffset
+
+	if isNull {
+		// Skip null fields
+		return
+	}
+
+	// Read field data
+	switch field.Type {
+	case TimeID, Int:
+		value := fixedInt(data[offset : offset+int(field.Length)])
+		r.FieldsData[field.Name] = value
+	case Float:
+		bits := uint64(fixedInt(data[offset : offset+int(field.Length)]))
+		if !layout.floatBits {
+			r.FieldsData[field.Name] = float64(bits)
+			return
+		}
+		r.FieldsData[field.Name] = math.Float64frombits(bits)
+	case Bool:
+		r.FieldsData[field.Name] = data[offset] == 1
+	case String:
+		slot := data[offset : offset+int(field.Length)]
+		if field.Compression == CompressionPacked {
+			length, _ := packedStringLength(slot) // Checked by checkRecordData
+			r.FieldsData[field.Name] = string(slot[packedLengthSize : packedLengthSize+length])
+			return
 		}
+		// Strings are zero padded to the field length
+		r.FieldsData[field.Name] = strings.TrimRight(string(slot), "\x00")
+	case "ref":
+		start := int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
+		end := int64(binary.LittleEndian.Uint64(data[offset+8 : offset+16]))
+		r.RefOffsets[field.Name] = [2]int64{start, end}
+	}
+}
 
-		offset += int(field.Length)
+// putFixedInt stores v little endian in the slot of a numeric field, keeping
+// as many low bytes as the slot holds
+func putFixedInt(slot []byte, v int64) {
+	for i := range slot {
+		if i < 8 {
+			slot[i] = byte(v >> (8 * i))
+		} else {
+			slot[i] = 0
+		}
 	}
+}
 
-	return record, nil
+// fixedInt reads the value putFixedInt stored, sign extended from the slot width
+func fixedInt(slot []byte) int64 {
+	width := min(len(slot), 8)
+	var v int64
+	for i := 0; i < width; i++ {
+		v |= int64(slot[i]) << (8 * i)
+	}
+	if width == 0 {
+		return 0
+	}
+	shift := 64 - 8*width
+	return v << shift >> shift
 }
 
-// WriteRefData writes data for a ref field to the appropriate file
+// WriteRefData writes data for a ref field to the appropriate file,
+// compressing it if the field is configured to be compressed
 func (r *Record) WriteRefData(schema, tableName, fieldName string, value string) error {
-	refFilePath := fmt.Sprintf("%s/%s.%s.data%s", schema, tableName, fieldName, fileEnding)
+	compression := refFieldCompression(schema, tableName, fieldName)
+	refFilePath := tableAt(schema, tableName).RefFilePath(fieldName)
+	return r.writeRefData(OSStorage{}, refFilePath, fieldName, value, compression, DurabilityNone)
+}
 
-	refFile, err := os.OpenFile(refFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+// writeRefData appends data for a ref field to its file at refFilePath, see
+// Table.RefFilePath, and syncs it according to durability
+func (r *Record) writeRefData(store Storage, refFilePath, fieldName string, value string, compression Compression, durability Durability) error {
+	entry, err := encodeRefValue(value, compression)
 	if err != nil {
-		return fmt.Errorf("failed to open ref field file: %v", err)
+		return err
 	}
-	defer refFile.Close()
 
-	// Get current file size as start offset
-	stat, err := refFile.Stat()
+	start, err := appendRefData(store, refFilePath, entry, durability)
 	if err != nil {
-		return fmt.Errorf("failed to get file stats: %v", err)
+		return err
 	}
-
-	start := stat.Size()
-
-	// Write the data
-	_, err = refFile.Write([]byte(value))
-	if err != nil {
-		return fmt.Errorf("failed to write to ref field file: %v", err)
+	if durability >= DurabilityFsync {
+		err = store.SyncDir(filepath.Dir(refFilePath))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Store the offsets
-	r.RefOffsets[fieldName] = [2]int64{start, start + int64(len(value))}
+	r.RefOffsets[fieldName] = [2]int64{start, start + int64(len(entry))}
 
 	return nil
 }
 
-// ReadRefData reads data for a ref field from the appropriate file
+// ReadRefData reads data for a ref field from the appropriate file.
+// Only the referenced range is read, not the whole file.
 func (r *Record) ReadRefData(schema, tableName, fieldName string) (string, error) {
 	offsets, exists := r.RefOffsets[fieldName]
 	if !exists {
 		return "", fmt.Errorf("no ref offsets found for field '%s'", fieldName)
 	}
 
-	refFilePath := fmt.Sprintf("%s/%s.%s.data%s", schema, tableName, fieldName, fileEnding)
+	refFilePath := tableAt(schema, tableName).RefFilePath(fieldName)
+
+	refFile, err := os.Open(refFilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read ref field file: %w", err)
+	}
+	defer refFile.Close()
+
+	stat, err := refFile.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to get file stats: %w", err)
+	}
+
+	gaps, err := readRefGaps(OSStorage{}, tableAt(schema, tableName).refGapsPath(fieldName))
+	if err != nil {
+		return "", err
+	}
+	err = checkRefGaps(gaps, fieldName, offsets)
+	if err != nil {
+		return "", err
+	}
+
+	compression := refFieldCompression(schema, tableName, fieldName)
+	return readRefRange(refFile, stat.Size(), fieldName, offsets, compression)
+}
+
+// ReadRef reads the value a record's ref field points to. Unlike ReadRefData
+// it works for every storage backend, including in-memory databases.
+func (t *Table) ReadRef(record *Record, fieldName string) (string, error) {
+	for _, field := range t.Fields {
+		if field.Name == fieldName && field.Type == "ref" {
+			refs := newRefReader(t)
+			defer refs.close()
+			return refs.read(record, field)
+		}
+	}
+	return "", fmt.Errorf("field '%s' is not a ref field of table '%s'", fieldName, t.TableName)
+}
+
+// PreloadRefData reads the ref field values of several records at once and
+// stores them in each record's FieldsData. The ranges are read in file order
+// through a single handle.
+func PreloadRefData(schema, tableName, fieldName string, records []*Record) error {
+	var pending []*Record
+	for _, record := range records {
+		if _, exists := record.RefOffsets[fieldName]; exists {
+			pending = append(pending, record)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Read in ascending offset order so the file is read front to back
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].RefOffsets[fieldName][0] < pending[j].RefOffsets[fieldName][0]
+	})
+
+	refFilePath := tableAt(schema, tableName).RefFilePath(fieldName)
+
+	refFile, err := os.Open(refFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read ref field file: %w", err)
+	}
+	defer refFile.Close()
+
+	stat, err := refFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file stats: %w", err)
+	}
 
-	// Read the file
-	data, err := os.ReadFile(refFilePath)
+	gaps, err := readRefGaps(OSStorage{}, tableAt(schema, tableName).refGapsPath(fieldName))
 	if err != nil {
-		return "", fmt.Errorf("failed to read ref field file: %v", err)
+		return err
+	}
+
+	compression := refFieldCompression(schema, tableName, fieldName)
+	for _, record := range pending {
+		err := checkRefGaps(gaps, fieldName, record.RefOffsets[fieldName])
+		if err != nil {
+			return fmt.Errorf("record %d: %w", record.ID, err)
+		}
+		value, err := readRefRange(refFile, stat.Size(), fieldName, record.RefOffsets[fieldName], compression)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", record.ID, err)
+		}
+		record.FieldsData[fieldName] = value
+	}
+
+	return nil
+}
+
+// refReader reads ref field values of a table, keeping one handle per ref file
+// open for the whole scan instead of reopening it for every record
+type refReader struct {
+	table *Table
+	files map[string]StorageFile
+	sizes map[string]int64
+	gaps  map[string][]refGap // Lost ranges by field, see ErrRefDataMissing
+}
+
+// newRefReader creates a ref reader for a table, it must be closed after use
+func newRefReader(table *Table) *refReader {
+	return &refReader{
+		table: table,
+		files: make(map[string]StorageFile),
+		sizes: make(map[string]int64),
+		gaps:  make(map[string][]refGap),
+	}
+}
+
+// read returns the value a record's ref field points to
+func (rr *refReader) read(record *Record, field Field) (string, error) {
+	offsets, exists := record.RefOffsets[field.Name]
+	if !exists {
+		return "", fmt.Errorf("no ref offsets found for field '%s'", field.Name)
+	}
+
+	refFile, exists := rr.files[field.Name]
+	if !exists {
+		refFilePath := rr.table.RefFilePath(field.Name)
+
+		gaps, err := readRefGaps(rr.table.storage(), rr.table.refGapsPath(field.Name))
+		if err != nil {
+			return "", err
+		}
+		refFile, err = openFile(rr.table.storage(), refFilePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read ref field file: %w", err)
+		}
+		stat, err := refFile.Stat()
+		if err != nil {
+			refFile.Close()
+			return "", fmt.Errorf("failed to get file stats: %w", err)
+		}
+
+		rr.files[field.Name] = refFile
+		rr.sizes[field.Name] = stat.Size()
+		rr.gaps[field.Name] = gaps
 	}
 
+	if err := checkRefGaps(rr.gaps[field.Name], field.Name, offsets); err != nil {
+		return "", err
+	}
+	return readRefRange(refFile, rr.sizes[field.Name], field.Name, offsets, field.Compression)
+}
+
+// close closes every ref file the reader opened
+func (rr *refReader) close() {
+	for _, refFile := range rr.files {
+		refFile.Close()
+	}
+}
+
+// readRefRange reads the entry between offsets from an open ref field file of the given size
+// and decodes it
+func readRefRange(refFile StorageFile, size int64, fieldName string, offsets [2]int64, compression Compression) (string, error) {
 	// Check bounds
-	if offsets[0] < 0 || offsets[1] > int64(len(data)) || offsets[0] > offsets[1] {
+	if offsets[0] < 0 || offsets[1] > size || offsets[0] > offsets[1] {
 		return "", fmt.Errorf("invalid ref offsets for field '%s'", fieldName)
 	}
 
+	_, err := refFile.Seek(offsets[0], io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("failed to seek ref field file: %w", err)
+	}
+
 	// Extract the data
-	return string(data[offsets[0]:offsets[1]]), nil
+	data := make([]byte, offsets[1]-offsets[0])
+	_, err = io.ReadFull(refFile, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to read ref field file: %w", err)
+	}
+
+	return decodeRefValue(data, compression)
 }
@@ -0,0 +1,91 @@
+// RecordBatch.go
+// Description: Batched record operations of the HTDB library
+// Looks up and deletes a known set of records by id in one go
+// Author: harto.dev
+
+package hartoDb_go
+
+import "sort"
+
+// GetRecordsByIDs gets the current records with the given ids, keyed by id.
+// Ids of deleted records and ids without a record are left out. The
+// records come from the record cache or are read through the primary key index.
+func (tm *TableManager) GetRecordsByIDs(table *Table, ids []int64) (map[int64]*Record, error) {
+	records := make(map[int64]*Record, len(ids))
+	for _, id := range ids {
+		if _, exists := records[id]; exists {
+			continue
+		}
+		record, err := tm.lookupRecord(table, id)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil && !record.Metadata.IsDeleted {
+			records[id] = record
+		}
+	}
+	return records, nil
+}
+
+// DeleteRecordsByIDs deletes the records with the given ids in one
+// transaction. Ids without a current record don't fail the batch, they are
+// returned as missing. Any other error, such as a record locked by another
+// transaction, deletes nothing.
+func (tm *TableManager) DeleteRecordsByIDs(table *Table, ids []int64) (deleted int, missing []int64, err error) {
+	return tm.deleteRecordsByIDs(table, ids, nil)
+}
+
+// DeleteRecordsByIDsIfVersions deletes records like DeleteRecordsByIDs, the
+// ids are the keys of versions. The batch fails with ErrVersionMismatch and
+// deletes nothing unless every record is still stored as its version.
+func (tm *TableManager) DeleteRecordsByIDsIfVersions(table *Table, versions map[int64]string) (deleted int, missing []int64, err error) {
+	ids := make([]int64, 0, len(versions))
+	for id := range versions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return tm.deleteRecordsByIDs(table, ids, versions)
+}
+
+// deleteRecordsByIDs stages the deletes of a batch and commits them once
+func (tm *TableManager) deleteRecordsByIDs(table *Table, ids []int64, versions map[int64]string) (int, []int64, error) {
+	records, err := tm.GetRecordsByIDs(table, ids)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var missing []int64
+	tx := tm.BeginTransaction()
+	seen := make(map[int64]bool, len(ids))
+	staged := 0
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		record, exists := records[id]
+		if !exists {
+			missing = append(missing, id)
+			continue
+		}
+
+		err = tx.stageDelete(table, record, versions[id])
+		if err != nil {
+			tm.RollbackTransaction(tx)
+			return 0, nil, err
+		}
+		staged++
+	}
+
+	if staged == 0 {
+		tm.RollbackTransaction(tx)
+		return 0, missing, nil
+	}
+
+	err = tm.CommitTransaction(tx)
+	if err != nil {
+		tm.rollbackUnapplied(tx)
+		return 0, nil, err
+	}
+	return staged, missing, nil
+}
@@ -0,0 +1,236 @@
+// RecordCache.go
+// Description: In-memory record cache for the HTDB library
+// Keeps recently read current records so they don't have to be deserialized again
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"container/list"
+	"path/filepath"
+	"sync"
+)
+
+// RecordCacheOptions limits the size of the record cache. A zero limit means
+// no limit on that dimension, both zero disables the cache.
+type RecordCacheOptions struct {
+	MaxRecords int   // Maximum number of cached records
+	MaxBytes   int64 // Maximum size of cached records, counted by their serialized size
+}
+
+// RecordCacheStats contains counters of the record cache
+type RecordCacheStats struct {
+	Hits    uint64 // Lookups answered from the cache
+	Misses  uint64 // Lookups that had to read the table
+	Records int    // Records currently cached
+	Bytes   int64  // Serialized size of the records currently cached
+}
+
+// recordCacheKey identifies a record in a specific table file
+type recordCacheKey struct {
+	table string // Cleaned path of the table file
+	id    int64
+}
+
+// recordCacheEntry is a single cached record
+type recordCacheEntry struct {
+	key    recordCacheKey
+	record *Record
+	size   int64
+}
+
+// recordCache is an LRU cache of current records shared by all tables of a TableManager
+type recordCache struct {
+	options RecordCacheOptions
+	entries map[recordCacheKey]*list.Element
+	lru     *list.List // Front is the most recently used entry
+	stats   RecordCacheStats
+	mu      sync.Mutex
+}
+
+// newRecordCache creates a new, disabled record cache
+func newRecordCache() *recordCache {
+	return &recordCache{
+		entries: make(map[recordCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// tableCacheKey returns the key under which a table's records are cached
+func tableCacheKey(table *Table) string {
+	return table.filePath()
+}
+
+// enabled reports whether the cache holds anything at all. The mutex must be held.
+func (c *recordCache) enabled() bool {
+	return c.options.MaxRecords > 0 || c.options.MaxBytes > 0
+}
+
+// configure sets the size limits, evicting records above them
+func (c *recordCache) configure(options RecordCacheOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.options = options
+	if !c.enabled() {
+		c.clearLocked()
+		return
+	}
+	c.evictLocked()
+}
+
+// get returns a copy of a cached record
+func (c *recordCache) get(table *Table, id int64) (*Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.enabled() {
+		return nil, false
+	}
+
+	element, exists := c.entries[recordCacheKey{tableCacheKey(table), id}]
+	if !exists {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(element)
+	return copyRecord(element.Value.(*recordCacheEntry).record), true
+}
+
+// put stores a copy of a current record
+func (c *recordCache) put(table *Table, record *Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.enabled() || !record.Metadata.IsCurrent {
+		return
+	}
+
+	key := recordCacheKey{tableCacheKey(table), record.ID}
+	if element, exists := c.entries[key]; exists {
+		c.removeLocked(element)
+	}
+
+	entry := &recordCacheEntry{
+		key:    key,
+		record: copyRecord(record),
+		size:   int64(table.RecordSize()),
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.Records++
+	c.stats.Bytes += entry.size
+
+	c.evictLocked()
+}
+
+// invalidateIDs drops the given record ids from every table
+func (c *recordCache) invalidateIDs(ids []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) == 0 {
+		return
+	}
+
+	drop := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	for key, element := range c.entries {
+		if drop[key.id] {
+			c.removeLocked(element)
+		}
+	}
+}
+
+// invalidateTable drops every cached record of a table file
+func (c *recordCache) invalidateTable(tablePath string) {
+	tablePath = filepath.Clean(tablePath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if key.table == tablePath {
+			c.removeLocked(element)
+		}
+	}
+}
+
+// clear drops every cached record
+func (c *recordCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clearLocked()
+}
+
+// snapshot returns the current counters
+func (c *recordCache) snapshot() RecordCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// limits returns the configured size limits
+func (c *recordCache) limits() RecordCacheOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.options
+}
+
+// evictLocked removes the least recently used records above the limits.
+// The mutex must be held.
+func (c *recordCache) evictLocked() {
+	for c.lru.Len() > 0 {
+		overRecords := c.options.MaxRecords > 0 && c.stats.Records > c.options.MaxRecords
+		overBytes := c.options.MaxBytes > 0 && c.stats.Bytes > c.options.MaxBytes
+		if !overRecords && !overBytes {
+			return
+		}
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// removeLocked removes a single entry. The mutex must be held.
+func (c *recordCache) removeLocked(element *list.Element) {
+	entry := element.Value.(*recordCacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.stats.Records--
+	c.stats.Bytes -= entry.size
+}
+
+// clearLocked removes every entry. The mutex must be held.
+func (c *recordCache) clearLocked() {
+	c.entries = make(map[recordCacheKey]*list.Element)
+	c.lru.Init()
+	c.stats.Records = 0
+	c.stats.Bytes = 0
+}
+
+// copyRecord returns a deep copy of a record with the same ID, so cached
+// records can't be changed through the pointers handed to callers
+func copyRecord(r *Record) *Record {
+	c := &Record{
+		ID:         r.ID,
+		Metadata:   r.Metadata,
+		FieldsData: make(map[string]interface{}, len(r.FieldsData)),
+		FieldsMeta: make(map[string]FieldMetadata, len(r.FieldsMeta)),
+		RefOffsets: make(map[string][2]int64, len(r.RefOffsets)),
+	}
+	for k, v := range r.FieldsData {
+		c.FieldsData[k] = v
+	}
+	for k, v := range r.FieldsMeta {
+		c.FieldsMeta[k] = v
+	}
+	for k, v := range r.RefOffsets {
+		c.RefOffsets[k] = v
+	}
+	return c
+}
@@ -0,0 +1,151 @@
+// RecordDiff.go
+// Description: Differences between record versions for the HTDB library
+// Compares two versions of a record field by field for audit views and plans
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"strings"
+)
+
+// FieldDiff is a field whose value differs between two versions of a record
+type FieldDiff struct {
+	Field   string      `json:"field"`
+	Old     interface{} `json:"old"` // Nil if the field was null
+	New     interface{} `json:"new"` // Nil if the field is null
+	WasNull bool        `json:"was_null"`
+	IsNull  bool        `json:"is_null"`
+}
+
+// NullChanged reports whether the field became null or stopped being null
+func (d FieldDiff) NullChanged() bool {
+	return d.WasNull != d.IsNull
+}
+
+// DiffRecords returns the fields whose values differ between the versions a
+// and b, in the order of fields. Values are normalized before they are
+// compared: strings lose the zero padding of the table file and ints of any
+// size compare equal to the same int64. A nil record counts as every field
+// null, so inserts and deletes can be diffed too. The id is skipped, every
+// version has its own. Ref fields are compared by their values if both
+// records carry them, see PreloadRefData, otherwise by their offsets in the
+// ref file; use Table.DiffRecordContent to compare the stored values.
+func DiffRecords(a, b *Record, fields []Field) []FieldDiff {
+	var diffs []FieldDiff
+	for _, field := range fields {
+		if field.Name == "id" {
+			continue
+		}
+
+		oldValue, wasNull := diffValue(a, field)
+		newValue, isNull := diffValue(b, field)
+		if wasNull && isNull {
+			continue
+		}
+		if wasNull == isNull && sameDiffValue(a, b, field, oldValue, newValue) {
+			continue
+		}
+
+		diffs = append(diffs, FieldDiff{
+			Field:   field.Name,
+			Old:     oldValue,
+			New:     newValue,
+			WasNull: wasNull,
+			IsNull:  isNull,
+		})
+	}
+	return diffs
+}
+
+// DiffRecordContent works like DiffRecords for two versions of a record of
+// the table, but reads the values of ref fields from the ref files first, so
+// a value written again with the same content is no difference.
+func (t *Table) DiffRecordContent(a, b *Record) ([]FieldDiff, error) {
+	refs := newRefReader(t)
+	defer refs.close()
+
+	loaded := make([]*Record, 0, 2)
+	for _, record := range []*Record{a, b} {
+		if record == nil {
+			loaded = append(loaded, nil)
+			continue
+		}
+
+		copied := &Record{ID: record.ID, Metadata: record.Metadata, FieldsData: make(map[string]interface{}),
+			FieldsMeta: record.FieldsMeta, RefOffsets: record.RefOffsets}
+		for name, value := range record.FieldsData {
+			copied.FieldsData[name] = value
+		}
+		for _, field := range t.Fields {
+			if field.Type != "ref" || record.FieldsMeta[field.Name].IsNull {
+				continue
+			}
+			if _, isText := copied.FieldsData[field.Name].(string); isText {
+				continue
+			}
+			if _, exists := record.RefOffsets[field.Name]; !exists {
+				continue
+			}
+			value, err := refs.read(record, field)
+			if err != nil {
+				return nil, newRecordError(t, record.ID, err)
+			}
+			copied.FieldsData[field.Name] = value
+		}
+		loaded = append(loaded, copied)
+	}
+	return DiffRecords(loaded[0], loaded[1], t.Fields), nil
+}
+
+// diffValue returns the normalized value of a field and whether it is null
+func diffValue(record *Record, field Field) (interface{}, bool) {
+	if record == nil || record.FieldsMeta[field.Name].IsNull {
+		return nil, true
+	}
+	value, exists := record.FieldsData[field.Name]
+	if !exists || value == nil {
+		if _, hasRef := record.RefOffsets[field.Name]; field.Type == "ref" && hasRef {
+			return nil, false // Stored in the ref file, not loaded
+		}
+		return nil, true
+	}
+	return normalizeValue(value), false
+}
+
+// normalizeValue converts a field value to the type it is read back from the
+// table file with, so equal values compare equal
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimRight(v, "\x00")
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+// sameDiffValue reports whether two non-null normalized values of a field are equal
+func sameDiffValue(a, b *Record, field Field, oldValue, newValue interface{}) bool {
+	if field.Type == "ref" && (oldValue == nil || newValue == nil) {
+		// A value isn't loaded, the same offsets point to the same stored value
+		oldOffsets, oldExists := a.RefOffsets[field.Name]
+		newOffsets, newExists := b.RefOffsets[field.Name]
+		return oldExists && newExists && oldOffsets == newOffsets
+	}
+	return oldValue == newValue
+}
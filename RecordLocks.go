@@ -0,0 +1,215 @@
+// RecordLocks.go
+// Description: Record locks of the HTDB library
+// Locks records for transactions, waiters are granted the lock in arrival order
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// recordLockKey identifies a record, tables by their cache key, see tableCacheKey
+type recordLockKey struct {
+	table string
+	id    int64
+}
+
+// recordLockWaiter is a transaction queued for a locked record
+type recordLockWaiter struct {
+	transactionID uint64
+	granted       chan struct{} // Closed once the waiter owns the lock
+}
+
+// recordLockState is the owner of a locked record and its queue of waiters
+type recordLockState struct {
+	owner uint64
+	queue []*recordLockWaiter // In arrival order
+}
+
+// recordLocks holds the record locks of a database. A released lock is handed
+// to the waiter that has waited the longest, so a stream of short transactions
+// can't starve a long one. Locks are released when their transaction ends.
+type recordLocks struct {
+	locks map[recordLockKey]*recordLockState
+	owned map[uint64][]recordLockKey // Locks by owning transaction
+	mu    sync.Mutex
+}
+
+// newRecordLocks creates the record locks of a database
+func newRecordLocks() *recordLocks {
+	return &recordLocks{
+		locks: make(map[recordLockKey]*recordLockState),
+		owned: make(map[uint64][]recordLockKey),
+	}
+}
+
+// tryLock locks the record for a transaction if it is free or already held
+// by it. Otherwise it returns the transaction holding the lock.
+func (l *recordLocks) tryLock(key recordLockKey, transactionID uint64) (uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, exists := l.locks[key]
+	if !exists {
+		l.grantLocked(key, transactionID)
+		return transactionID, true
+	}
+	return state.owner, state.owner == transactionID
+}
+
+// lock locks the record for a transaction, waiting behind earlier waiters
+// until it is released. A waiter leaves the queue when ctx is done, the
+// context's error is returned. waited reports whether the lock was held by
+// another transaction.
+func (l *recordLocks) lock(ctx context.Context, key recordLockKey, transactionID uint64) (waited bool, err error) {
+	l.mu.Lock()
+	state, exists := l.locks[key]
+	if !exists {
+		l.grantLocked(key, transactionID)
+		l.mu.Unlock()
+		return false, nil
+	}
+	if state.owner == transactionID {
+		l.mu.Unlock()
+		return false, nil
+	}
+
+	waiter := &recordLockWaiter{transactionID: transactionID, granted: make(chan struct{})}
+	state.queue = append(state.queue, waiter)
+	l.mu.Unlock()
+
+	select {
+	case <-waiter.granted:
+		return true, nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.granted:
+		// Granted while giving up, pass it on
+		l.releaseLocked(key, transactionID)
+		l.dropOwnedLocked(transactionID, key)
+	default:
+		for i, queued := range state.queue {
+			if queued == waiter {
+				state.queue = append(state.queue[:i], state.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	return true, ctx.Err()
+}
+
+// unlock releases a single lock of a transaction
+func (l *recordLocks) unlock(key recordLockKey, transactionID uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseLocked(key, transactionID)
+	l.dropOwnedLocked(transactionID, key)
+}
+
+// releaseAll releases every lock of a transaction
+func (l *recordLocks) releaseAll(transactionID uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys := l.owned[transactionID]
+	delete(l.owned, transactionID)
+	for _, key := range keys {
+		l.releaseLocked(key, transactionID)
+	}
+}
+
+// grantLocked makes a transaction the owner of a record. The mutex must be held.
+func (l *recordLocks) grantLocked(key recordLockKey, transactionID uint64) {
+	state, exists := l.locks[key]
+	if !exists {
+		state = &recordLockState{}
+		l.locks[key] = state
+	}
+	state.owner = transactionID
+	l.owned[transactionID] = append(l.owned[transactionID], key)
+}
+
+// releaseLocked hands a lock held by a transaction to the first waiter or
+// frees it. The mutex must be held, the owned list is left to the caller.
+func (l *recordLocks) releaseLocked(key recordLockKey, transactionID uint64) {
+	state, exists := l.locks[key]
+	if !exists || state.owner != transactionID {
+		return
+	}
+	if len(state.queue) == 0 {
+		delete(l.locks, key)
+		return
+	}
+
+	next := state.queue[0]
+	state.queue = state.queue[1:]
+	l.grantLocked(key, next.transactionID)
+	close(next.granted)
+}
+
+// dropOwnedLocked removes a key from the locks owned by a transaction. The mutex must be held.
+func (l *recordLocks) dropOwnedLocked(transactionID uint64, key recordLockKey) {
+	keys := l.owned[transactionID]
+	for i, owned := range keys {
+		if owned == key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(l.owned, transactionID)
+	} else {
+		l.owned[transactionID] = keys
+	}
+}
+
+// LockRecordWait locks a record for this transaction like LockRecord, but
+// waits while another transaction holds it instead of failing. Waiters get
+// the lock in the order they started waiting. It gives up with the context's
+// error once ctx is done, two transactions waiting for each other's records
+// wait until one of their contexts ends. Waits are reported as
+// MetricRecordLockWaits and MetricRecordLockWait, and logged with the record
+// at debug level.
+func (tx *Transaction) LockRecordWait(ctx context.Context, table *Table, record *Record) error {
+	tx.mu.Lock()
+	err := tx.checkActive()
+	tx.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	key := recordLockKey{table: tableCacheKey(table), id: record.ID}
+	start := time.Now()
+	waited, err := tx.db.recordLocks.lock(ctx, key, tx.ID)
+	if waited {
+		wait := time.Since(start)
+		metrics := tx.db.metricsSink()
+		metrics.Inc(MetricRecordLockWaits, 1)
+		metrics.Observe(MetricRecordLockWait, wait.Seconds())
+		tx.db.log(slog.LevelDebug, "waited for record lock",
+			"transaction", tx.ID, "schema", table.schemaName(), "table", table.TableName,
+			"record", record.ID, "duration", wait, "error", err)
+	}
+	if err != nil {
+		return newRecordError(table, record.ID, err)
+	}
+
+	// The transaction may have ended while it waited, its locks were released already
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	err = tx.checkActive()
+	if err != nil {
+		tx.db.recordLocks.unlock(key, tx.ID)
+		return err
+	}
+	return tx.lockRecordInternal(table, record)
+}
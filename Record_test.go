@@ -0,0 +1,377 @@
+// Record_test.go
+// Description: Tests of the record format of the HTDB library
+// Values must read back as they were written, tables of older formats are migrated without loss,
+// and clones take their ids from their database
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var floatFields = []Field{
+	{Name: "key", Type: Int, Length: 8},
+	{Name: "value", Type: Float, Length: 8},
+}
+
+func TestFloatFieldsRoundTrip(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", floatFields)
+
+	values := []float64{0, 1.5, -2.25, 0.1, -1e300, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(-1)}
+	for key, value := range values {
+		insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "value": value})
+	}
+
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if len(records) != len(values) {
+		t.Fatalf("table holds %d records, want %d", len(records), len(values))
+	}
+	for _, record := range records {
+		key := record.FieldsData["key"].(int64)
+		if got := record.FieldsData["value"]; got != values[key] {
+			t.Errorf("record %d reads back as %v, want %v", key, got, values[key])
+		}
+	}
+}
+
+func TestIntFieldRange(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", []Field{{Name: "small", Type: Int, Length: 1}})
+
+	insertTestRecord(t, tm, table, map[string]interface{}{"small": -128})
+	insertTestRecord(t, tm, table, map[string]interface{}{"small": 127})
+
+	_, err := tm.InsertRecord(table, map[string]interface{}{"small": 128})
+	var problems ValidationErrors
+	if !errors.As(err, &problems) || len(problems) != 1 || problems[0].Constraint != CheckRange {
+		t.Fatalf("expected a range problem, got %v", err)
+	}
+
+	_, err = tm.InsertRecord(table, map[string]interface{}{"small": "one"})
+	if !errors.As(err, &problems) || len(problems) != 1 || problems[0].Constraint != CheckType {
+		t.Fatalf("expected a type problem, got %v", err)
+	}
+	if want := "requires a value of type 'int', got string"; problems[0].Message != want {
+		t.Errorf("type problem reads %q, want %q", problems[0].Message, want)
+	}
+}
+
+// Tables of layout version 4 stored floats as whole numbers, they stay
+// readable until Migrate rewrites them with the bits of the value
+func TestMigrateFloatFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openTestDB(t, path)
+	table := createTestTable(t, db, "s", "t", floatFields)
+
+	old := *table
+	old.FormatVersion = floatLayoutVersion - 1
+	old.layout = nil
+	records := []*Record{
+		NewRecord(1, map[string]interface{}{"key": int64(1), "value": 42.0}),
+		NewRecord(2, map[string]interface{}{"key": int64(2), "value": 7.9}), // Cut to 7 by the old format
+	}
+	err := old.WriteRecords(records)
+	if err != nil {
+		t.Fatalf("failed to write records: %v", err)
+	}
+	confJSON, err := json.Marshal(&old)
+	if err != nil {
+		t.Fatalf("failed to serialize table: %v", err)
+	}
+	err = writeFile(db.storage(), old.confPath(), confJSON, 0644)
+	if err != nil {
+		t.Fatalf("failed to write table configuration: %v", err)
+	}
+	db.Close()
+
+	db = openTestDB(t, path)
+	tm := db.GetTableManager()
+	want := map[int64]float64{1: 42, 2: 7}
+	check := func(stage string) {
+		t.Helper()
+		table, err := tm.GetTable("s", "t")
+		if err != nil {
+			t.Fatalf("failed to get table: %v", err)
+		}
+		records, err := tm.GetCurrentRecords(table)
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+		for _, record := range records {
+			key := record.FieldsData["key"].(int64)
+			if got := record.FieldsData["value"]; got != want[key] {
+				t.Errorf("%s: record %d reads as %v, want %v", stage, key, got, want[key])
+			}
+		}
+	}
+	check("before migration")
+
+	// Until then values the old format would cut are rejected
+	table, err = tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	for _, value := range []float64{7.9, -1, 1 << 64} {
+		_, err = tm.InsertRecord(table, map[string]interface{}{"key": 3, "value": value})
+		var problems ValidationErrors
+		if !errors.As(err, &problems) || len(problems) != 1 || problems[0].Constraint != CheckRange {
+			t.Errorf("inserting %v into the unmigrated table: expected a range problem, got %v", value, err)
+		}
+	}
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 3, "value": 9.0})
+	want[3] = 9
+	check("after insert before migration")
+
+	report, err := db.Migrate()
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if len(report.Tables) != 1 {
+		t.Fatalf("migrated tables %v, want s:t", report.Tables)
+	}
+	check("after migration")
+
+	table, err = tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	if table.FormatVersion != layoutVersion {
+		t.Errorf("table has layout version %d after migration, want %d", table.FormatVersion, layoutVersion)
+	}
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 4, "value": -0.5})
+	want[4] = -0.5
+	check("after insert")
+}
+
+func TestBoolFieldsRoundTrip(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", typedFields)
+	for _, data := range typedRecords {
+		insertTestRecord(t, tm, table, data)
+	}
+
+	got := fieldValues(t, tm, table)
+	for _, data := range typedRecords {
+		key := data["key"].(int64)
+		if got[key]["flag"] != data["flag"] {
+			t.Errorf("record %d reads flag %v, want %v", key, got[key]["flag"], data["flag"])
+		}
+	}
+}
+
+func TestCorruptBoolValue(t *testing.T) {
+	layout := NewRecordLayout(typedFields)
+	data, err := NewRecord(1, typedRecords[0]).serializeLayout(layout)
+	if err != nil {
+		t.Fatalf("failed to serialize record: %v", err)
+	}
+	data[layout.Fields[layout.fieldIndex["flag"]].DataOffset] = 2
+
+	_, err = deserializeRecordLayout(data, layout)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt for a bool value of 2, got %v", err)
+	}
+}
+
+// A serialized record has the size the table computes for its file, for every
+// kind of field and whatever fields are null
+func TestSerializedRecordSize(t *testing.T) {
+	schemas := map[string][]Field{
+		"ints":   {{Name: "small", Type: Int, Length: 1}, {Name: "large", Type: Int, Length: 8}},
+		"floats": floatFields,
+		"refs":   noteFields,
+		"typed":  typedFields,
+		"wide": {
+			{Name: "flag", Type: Bool, Length: 1},
+			{Name: "name", Type: String, Length: 200},
+			{Name: "first", Type: "ref", Length: refFieldLength},
+			{Name: "second", Type: "ref", Length: refFieldLength},
+		},
+	}
+
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	for name, fields := range schemas {
+		table := createTestTable(t, db, "s", name, fields)
+		insertTestRecord(t, tm, table, map[string]interface{}{})
+		if name == "typed" {
+			for _, data := range typedRecords {
+				insertTestRecord(t, tm, table, data)
+			}
+		}
+
+		records, err := tm.GetAllRecords(table)
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+		info, err := db.storage().Stat(tableFilePath(table.SchemaPath, table.TableName))
+		if err != nil {
+			t.Fatalf("failed to stat table file: %v", err)
+		}
+		if want := int64(len(records) * table.RecordSize()); info.Size() != want {
+			t.Errorf("%s: file of %d records holds %d bytes, want %d", name, len(records), info.Size(), want)
+		}
+
+		records = append(records, NewRecord(1, map[string]interface{}{}))
+		for _, record := range records {
+			data, err := record.Serialize(table.Fields)
+			if err != nil {
+				t.Fatalf("%s: failed to serialize record %d: %v", name, record.ID, err)
+			}
+			if len(data) != table.RecordSize() {
+				t.Errorf("%s: record %d serializes to %d bytes, the table computes %d", name, record.ID, len(data), table.RecordSize())
+			}
+			read, err := DeserializeRecord(data, table.Fields)
+			if err != nil {
+				t.Fatalf("%s: failed to deserialize record %d: %v", name, record.ID, err)
+			}
+			if read.ID != record.ID {
+				t.Errorf("%s: record %d reads back with id %d", name, record.ID, read.ID)
+			}
+		}
+	}
+}
+
+// Problems are reported in schema order, unknown fields last by name
+func TestValidationErrorOrder(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", typedFields)
+
+	data := map[string]interface{}{"zeta": 1, "alpha": 2, "name": 5, "key": "one", "ratio": "half"}
+	want := "[key ratio name alpha zeta]"
+	for run := 0; run < 20; run++ {
+		_, err := tm.InsertRecord(table, data)
+		var problems ValidationErrors
+		if !errors.As(err, &problems) {
+			t.Fatalf("expected validation errors, got %v", err)
+		}
+		fields := make([]string, len(problems))
+		for i, problem := range problems {
+			fields[i] = problem.Field
+		}
+		if got := fmt.Sprint(fields); got != want {
+			t.Fatalf("run %d reports problems of %s, want %s", run, got, want)
+		}
+	}
+}
+
+func BenchmarkScan1M(b *testing.B) {
+	db := openTestDB(b, MemoryPath)
+	table := createTestTable(b, db, "s", "t", typedFields)
+	appendBenchmarkRecords(b, table, 1000000, func(i int) map[string]interface{} {
+		return map[string]interface{}{"key": i, "flag": i%2 == 0, "ratio": float64(i) / 3, "name": "name"}
+	})
+
+	count := 0
+	countRecord := func(*Record) error {
+		count++
+		return nil
+	}
+	scans := []struct {
+		name string
+		scan func() error
+	}{
+		{"StreamRecords", func() error { return table.StreamRecords(countRecord) }},
+		{"ScanInto", func() error { return table.ScanInto(&Record{}, countRecord) }},
+		{"ScanInto two fields", func() error { return table.ScanInto(&Record{}, countRecord, "key", "flag") }},
+	}
+	for _, scan := range scans {
+		b.Run(scan.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				count = 0
+				err := scan.scan()
+				if err != nil {
+					b.Fatalf("failed to scan: %v", err)
+				}
+				if count != 1000000 {
+					b.Fatalf("scanned %d records, want 1000000", count)
+				}
+			}
+		})
+	}
+}
+
+// Compressed tables read far fewer bytes per scan and pay for it with the
+// time to decompress every block
+func BenchmarkScanCompression(b *testing.B) {
+	for _, compressor := range []string{"", BlockCompressorFlate} {
+		name := compressor
+		if name == "" {
+			name = "plain"
+		}
+		b.Run(name, func(b *testing.B) {
+			db := openTestDB(b, filepath.Join(b.TempDir(), "db"))
+			tm := db.GetTableManager()
+			table := createTestTable(b, db, "s", "t", typedFields)
+			appendBenchmarkRecords(b, table, 1000000, func(i int) map[string]interface{} {
+				return map[string]interface{}{"key": i, "flag": i%2 == 0, "ratio": float64(i) / 3, "name": "name"}
+			})
+			if compressor != "" {
+				err := tm.SetBlockCompression(table, compressor, 0)
+				if err != nil {
+					b.Fatalf("failed to compress table: %v", err)
+				}
+			}
+			info, err := table.storage().Stat(table.filePath())
+			if err != nil {
+				b.Fatalf("failed to stat table file: %v", err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				count := 0
+				err := table.StreamRecords(func(*Record) error {
+					count++
+					return nil
+				})
+				if err != nil {
+					b.Fatalf("failed to scan: %v", err)
+				}
+				if count != 1000000 {
+					b.Fatalf("scanned %d records, want 1000000", count)
+				}
+			}
+			b.ReportMetric(float64(info.Size()), "file-bytes")
+		})
+	}
+}
+
+// A clone takes its id from the generator of its database, which has seen
+// every id of its tables, not from a generator that has seen none of them
+func TestCloneUsesDatabaseIDs(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	record := insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "created"})
+
+	// Ids written under a clock that ran ahead
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	db.ids.observe(ahead)
+	clone, err := record.Clone(db, 1)
+	if err != nil {
+		t.Fatalf("failed to clone record: %v", err)
+	}
+	if clone.ID <= ahead {
+		t.Errorf("clone got id %d, not after the database's %d", clone.ID, ahead)
+	}
+	if clone.Metadata.OriginID != record.ID {
+		t.Errorf("clone has origin %d, want %d", clone.Metadata.OriginID, record.ID)
+	}
+}
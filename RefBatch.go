@@ -0,0 +1,276 @@
+// RefBatch.go
+// Description: Batched ref data writes for the HTDB library
+// Staged ref values are appended to their field files once per commit, whole side files rewritten at once
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// setRefPending marks a ref value of a staged record to be written at commit
+func (r *Record) setRefPending(fieldName string) {
+	if r.pendingRefs == nil {
+		r.pendingRefs = make(map[string]bool)
+	}
+	r.pendingRefs[fieldName] = true
+	delete(r.RefOffsets, fieldName)
+}
+
+// writePendingRefs appends the pending ref values of the staged records to
+// the ref files, with a single write and sync per field file, and sets their
+// offsets. It returns the number of bytes appended. The caller must hold the table's write lock, so compaction can't
+// swap a file meanwhile. A failed commit leaves unused data behind, which the
+// next cleanup drops.
+func (t *Table) writePendingRefs(records []*Record) (int64, error) {
+	store := t.storage()
+	durability := t.durability()
+	var written int64
+
+	for _, field := range t.Fields {
+		if field.Type != "ref" {
+			continue
+		}
+
+		var pending []*Record
+		var entries [][]byte
+		size := 0
+		for _, record := range records {
+			if !record.pendingRefs[field.Name] || record.FieldsMeta[field.Name].IsNull {
+				continue
+			}
+			value, ok := record.FieldsData[field.Name].(string)
+			if !ok {
+				return written, fmt.Errorf("field '%s' requires a string value", field.Name)
+			}
+			entry, err := encodeRefValue(value, field.Compression)
+			if err != nil {
+				return written, err
+			}
+			pending = append(pending, record)
+			entries = append(entries, entry)
+			size += len(entry)
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		err := t.prepareRefFile(field.Name)
+		if err != nil {
+			return written, err
+		}
+
+		buf := make([]byte, 0, size)
+		for _, entry := range entries {
+			buf = append(buf, entry...)
+		}
+
+		start, err := appendRefData(store, t.RefFilePath(field.Name), buf, durability)
+		if err != nil {
+			return written, err
+		}
+		written += int64(len(buf))
+
+		for i, record := range pending {
+			end := start + int64(len(entries[i]))
+			record.RefOffsets[field.Name] = [2]int64{start, end}
+			start = end
+		}
+	}
+
+	if written > 0 && durability >= DurabilityFsync {
+		return written, store.SyncDir(filepath.Dir(t.filePath()))
+	}
+	return written, nil
+}
+
+// RewriteRefData replaces the table file with records and the side file of a
+// ref field with their values, written one after another, in one step
+// journaled like a compaction. Stored values are copied as they are, records
+// without offsets but with a value in FieldsData, such as records read from an
+// export, get it written. Values of records left out are gone afterwards.
+// Offsets outside of the current file null the value like a cleanup does. The
+// side files of other ref fields are kept, the records must hold valid offsets
+// into them. The offsets of records are updated on the way, if it fails the
+// files are left as they were and records have to be read again.
+func (t *Table) RewriteRefData(records []*Record, fieldName string) error {
+	var refField *Field
+	for i, field := range t.Fields {
+		if field.Name == fieldName && field.Type == "ref" {
+			refField = &t.Fields[i]
+		}
+	}
+	if refField == nil {
+		return fmt.Errorf("field '%s' is not a ref field of table '%s'", fieldName, t.TableName)
+	}
+
+	lock := t.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Records written with other fields would be rewritten into garbage
+	err := t.checkLayoutHash(t.storage())
+	if err != nil {
+		return err
+	}
+	err = t.rewriteRecords(records, []Field{*refField})
+	if err != nil {
+		return err
+	}
+
+	err = t.writeSummary(t.summarize(records))
+	if err != nil {
+		t.db.log(slog.LevelWarn, "failed to update table summary after ref rewrite",
+			"schema", t.schemaName(), "table", t.TableName, "error", err)
+	}
+	err = t.rebuildIndexes()
+	if err != nil {
+		t.db.log(slog.LevelWarn, "failed to rebuild indexes after ref rewrite",
+			"schema", t.schemaName(), "table", t.TableName, "error", err)
+	}
+	return nil
+}
+
+// refFields returns the ref fields of the table
+func (t *Table) refFields() []Field {
+	var fields []Field
+	for _, field := range t.Fields {
+		if field.Type == "ref" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// rebuildRefFiles rewrites the side files of every ref field of the table
+// with the values its records use, dropping the rest
+func (t *Table) rebuildRefFiles() error {
+	refFields := t.refFields()
+	if len(refFields) == 0 {
+		return nil
+	}
+
+	lock := t.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := t.checkLayoutHash(t.storage())
+	if err != nil {
+		return err
+	}
+	records, err := t.allRecords()
+	if err != nil {
+		return fmt.Errorf("failed to read records: %w", err)
+	}
+	// The records keep their order, ids and flags, so do the summary and indexes
+	return t.rewriteRecords(records, refFields)
+}
+
+// rewriteRecords replaces the table file with records and the side files of
+// refFields with the values of records, swapped in through a compaction
+// journal. The caller must hold the table's write lock.
+func (t *Table) rewriteRecords(records []*Record, refFields []Field) error {
+	store := t.storage()
+	mode := t.db.fileMode()
+
+	var compactors []*refCompactor
+	var tempPaths, finalPaths []string
+	removeTemps := func() {
+		for _, compactor := range compactors {
+			compactor.close()
+		}
+		for _, path := range tempPaths {
+			store.Remove(path)
+		}
+	}
+
+	buf := make([]byte, defaultCopyBufferSize)
+	for _, field := range refFields {
+		refFilePath := t.RefFilePath(field.Name)
+		compactor, err := newRefCompactor(store, t, field.Name, mode)
+		if err != nil {
+			removeTemps()
+			return err
+		}
+		if compactor == nil {
+			// Nothing to copy, the values all come from FieldsData
+			dst, tempPath, err := createTempFile(store, refFilePath, compactionTempSuffix, mode)
+			if err != nil {
+				removeTemps()
+				return fmt.Errorf("failed to create temporary ref file: %w", err)
+			}
+			compactor = &refCompactor{fieldName: field.Name, dst: dst, tempPath: tempPath}
+		}
+		compactors = append(compactors, compactor)
+		tempPaths = append(tempPaths, compactor.tempPath)
+		finalPaths = append(finalPaths, refFilePath)
+
+		err = compactor.copyRecords(records, field.Compression, buf)
+		if err != nil {
+			removeTemps()
+			return err
+		}
+
+		// Values in lost ranges were nulled, the new file has none
+		if len(compactor.gaps) > 0 {
+			gapsPath := t.refGapsPath(field.Name)
+			gapsTempPath, err := writeTempFile(store, gapsPath, compactionTempSuffix, []byte("[]"), mode)
+			if err != nil {
+				removeTemps()
+				return err
+			}
+			tempPaths = append(tempPaths, gapsTempPath)
+			finalPaths = append(finalPaths, gapsPath)
+		}
+	}
+
+	tablePath := t.filePath()
+	tempPath, err := t.writeRecordsTemp(store, tablePath, records)
+	if err != nil {
+		removeTemps()
+		return err
+	}
+	tempPaths = append(tempPaths, tempPath)
+	finalPaths = append(finalPaths, tablePath)
+	for _, compactor := range compactors {
+		compactor.close()
+	}
+
+	return t.db.commitCompaction(t.SchemaPath, t.TableName, tempPaths, finalPaths, nil)
+}
+
+// appendRefData appends data to a ref field file and syncs it according to
+// durability. It returns the offset the data starts at.
+func appendRefData(store Storage, refFilePath string, data []byte, durability Durability) (int64, error) {
+	// The file is created with its table, a missing one has lost the values
+	// that records hold offsets into, see Table.prepareRefFile
+	refFile, err := store.OpenFile(refFilePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to open ref field file: %w: %w", ErrRefDataMissing, err)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open ref field file: %w", err)
+	}
+	defer refFile.Close()
+
+	stat, err := refFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file stats: %w", err)
+	}
+
+	_, err = refFile.Write(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write to ref field file: %w", err)
+	}
+
+	if durability >= DurabilityFlush {
+		err = refFile.Sync()
+		if err != nil {
+			return 0, fmt.Errorf("failed to sync ref field file: %w", err)
+		}
+	}
+	return stat.Size(), nil
+}
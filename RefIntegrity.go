@@ -0,0 +1,177 @@
+// RefIntegrity.go
+// Description: Ref side file integrity for the HTDB library
+// Detects lost or truncated ref files so old offsets fail instead of reading newer data
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// checkedRefFiles holds the paths of the ref files checked against their
+// table by prepareRefFile in this process
+var checkedRefFiles sync.Map
+
+// refGap is a byte range of a ref file whose data was lost. The range is kept
+// free so new values never land on offsets that old records still hold.
+type refGap [2]int64
+
+// readRefGaps reads the lost ranges of a ref file, none if the file is intact
+func readRefGaps(store Storage, path string) ([]refGap, error) {
+	data, err := readFile(store, path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lost ref ranges: %w", err)
+	}
+
+	var gaps []refGap
+	err = json.Unmarshal(data, &gaps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse lost ref ranges: %w", err)
+	}
+	return gaps, nil
+}
+
+// checkRefGaps fails with ErrRefDataMissing if the offsets overlap a lost range
+func checkRefGaps(gaps []refGap, fieldName string, offsets [2]int64) error {
+	for _, gap := range gaps {
+		if offsets[0] < gap[1] && offsets[1] > gap[0] {
+			return fmt.Errorf("%w: field '%s' at [%d, %d]", ErrRefDataMissing, fieldName, offsets[0], offsets[1])
+		}
+	}
+	return nil
+}
+
+// refOffsetsAt returns the ref offsets of a field of a serialized record, ok
+// is false for null values
+func refOffsetsAt(data []byte, fieldLayout FieldLayout) ([2]int64, bool) {
+	if data[fieldLayout.MetaOffset] != 0 {
+		return [2]int64{}, false
+	}
+	offset := fieldLayout.DataOffset
+	return [2]int64{
+		int64(binary.LittleEndian.Uint64(data[offset : offset+8])),
+		int64(binary.LittleEndian.Uint64(data[offset+8 : offset+16])),
+	}, true
+}
+
+// maxRefEnd returns the highest end offset the records of the table file hold
+// for a ref field. The caller must hold the table's lock.
+func (t *Table) maxRefEnd(fieldName string) (int64, error) {
+	layout := t.Layout()
+	index, exists := layout.fieldIndex[fieldName]
+	if !exists {
+		return 0, nil
+	}
+	fieldLayout := layout.Fields[index]
+
+	var maxEnd int64
+	err := t.scanRawRecords(func(data []byte) error {
+		if offsets, ok := refOffsetsAt(data, fieldLayout); ok && offsets[1] > maxEnd {
+			maxEnd = offsets[1]
+		}
+		return nil
+	})
+	return maxEnd, err
+}
+
+// prepareRefFile makes sure the ref file of a field can be appended to. The
+// first append of the process, and any append to a missing file, checks the
+// file against the offsets of the table's records. Data found lost is recorded
+// as a gap, see ErrRefDataMissing, and the file is extended past it. The
+// caller must hold the table's write lock.
+func (t *Table) prepareRefFile(fieldName string) error {
+	store := t.storage()
+	path := t.RefFilePath(fieldName)
+
+	size := int64(-1)
+	stat, err := store.Stat(path)
+	if err == nil {
+		size = stat.Size()
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to get file stats: %w", err)
+	}
+	if _, checked := checkedRefFiles.Load(path); checked && size >= 0 {
+		return nil
+	}
+
+	maxEnd, err := t.maxRefEnd(fieldName)
+	if err != nil {
+		return err
+	}
+	if size < 0 || size < maxEnd {
+		refFile, err := store.OpenFile(path, os.O_CREATE|os.O_WRONLY, t.db.fileMode())
+		if err != nil {
+			return fmt.Errorf("failed to create ref field file: %w", err)
+		}
+		if size < maxEnd {
+			err = t.addRefGap(fieldName, refGap{max(size, 0), maxEnd})
+			if err == nil {
+				err = refFile.Truncate(maxEnd)
+			}
+		}
+		closeErr := refFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to prepare ref field file: %w", err)
+		}
+		if t.db != nil {
+			t.db.files.invalidate(path)
+		}
+	}
+
+	checkedRefFiles.Store(path, true)
+	return nil
+}
+
+// hasRefGaps reports whether a ref file of the table lost data. Cleanup
+// compacts such tables regardless of their dead records to null the values.
+func (t *Table) hasRefGaps() (bool, error) {
+	for _, field := range t.Fields {
+		if field.Type != "ref" {
+			continue
+		}
+		gaps, err := readRefGaps(t.storage(), t.refGapsPath(field.Name))
+		if err != nil || len(gaps) > 0 {
+			return len(gaps) > 0, err
+		}
+	}
+	return false, nil
+}
+
+// addRefGap records a lost range of a ref file
+func (t *Table) addRefGap(fieldName string, gap refGap) error {
+	store := t.storage()
+	path := t.refGapsPath(fieldName)
+	gaps, err := readRefGaps(store, path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(append(gaps, gap))
+	if err != nil {
+		return err
+	}
+	err = writeFile(store, path+".temp", data, t.db.fileMode())
+	if err == nil {
+		err = store.Rename(path+".temp", path)
+	}
+	if err != nil {
+		store.Remove(path + ".temp")
+		return fmt.Errorf("failed to record lost ref ranges: %w", err)
+	}
+
+	t.db.log(slog.LevelWarn, "ref data lost", "schema", t.schemaName(), "table", t.TableName,
+		"field", fieldName, "start", gap[0], "end", gap[1])
+	return nil
+}
@@ -0,0 +1,90 @@
+// RefIntegrity_test.go
+// Description: Tests of ref side file integrity of the HTDB library
+// Values lost with a deleted or truncated side file must fail to read instead of reading newer values
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLostRefFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(path string) error
+		lost   int64 // Keys of the records whose notes are lost start here
+		open   bool  // Damage the file while the database is open
+	}{
+		{"deleted", os.Remove, 0, false},
+		{"truncated", func(path string) error { return os.Truncate(path, int64(5*len("note 0"))) }, 5, false},
+		{"deleted while open", os.Remove, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			db := openTestDB(t, path)
+			tm := db.GetTableManager()
+			table := createTestTable(t, db, "s", "t", noteFields)
+			for key := int64(0); key < 10; key++ {
+				insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "note": fmt.Sprint("note ", key)})
+			}
+			refPath := table.RefFilePath("note")
+			if !test.open {
+				db.Close()
+			}
+
+			// Like a copy that skipped the side file or a crash that cut it short
+			err := test.damage(refPath)
+			if err != nil {
+				t.Fatalf("failed to damage ref file: %v", err)
+			}
+
+			if !test.open {
+				checkedRefFiles.Delete(refPath) // Checked again by a new process
+				db = openTestDB(t, path)
+				tm = db.GetTableManager()
+				table, err = tm.GetTable("s", "t")
+				if err != nil {
+					t.Fatalf("failed to get table: %v", err)
+				}
+			}
+			report, err := db.Verify()
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			if report.OK() {
+				t.Errorf("verify found no problem with the %s ref file", test.name)
+			}
+
+			insertTestRecord(t, tm, table, map[string]interface{}{"key": 10, "note": "new note"})
+			records, err := tm.GetCurrentRecords(table)
+			if err != nil {
+				t.Fatalf("failed to read records: %v", err)
+			}
+			for _, record := range records {
+				key := record.FieldsData["key"].(int64)
+				note, err := table.ReadRef(record, "note")
+				switch {
+				case key == 10:
+					if err != nil || note != "new note" {
+						t.Errorf("new record reads %q, %v", note, err)
+					}
+				case key >= test.lost:
+					if !errors.Is(err, ErrRefDataMissing) {
+						t.Errorf("record %d reads %q, %v, want ErrRefDataMissing", key, note, err)
+					}
+				default:
+					if err != nil || note != fmt.Sprint("note ", key) {
+						t.Errorf("intact record %d reads %q, %v", key, note, err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -7,7 +7,10 @@ package hartoDb_go
 
 import (
 	"encoding/json"
+	"errors"
+	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,36 +18,170 @@ type Response struct {
 	TimeStamp  string
 	StatusCode int
 	Message    string
+	err        error // Underlying error, see WithError
 }
 
 const (
+	StatusOK                  = 200
 	StatusBadRequest          = 400
 	StatusSchenaDoesntExist   = 401
 	StatusTableDoesntExist    = 402
 	StatusFieldDoesntExist    = 403
+	StatusRecordDoesntExist   = 404
 	StatusSchenaAlreadyExists = 411
 	StatusTableAlreadyExists  = 412
 	StatusFieldAlreadyExists  = 413
+	StatusConflict            = 420 // The record was changed or deleted by another transaction
+	StatusLocked              = 421 // The record is locked by another transaction
+	StatusValidationFailed    = 422 // Values or definitions don't satisfy the schema
 	StatusInvalidName         = 491
 	StatusDbError             = 500
 	StatusInternalError       = 501
 	StatusUnknown             = 600
 )
 
+// ColorMode decides whether Response.String colors the status code
+type ColorMode int32
+
+const (
+	ColorAlways ColorMode = iota // Always use ANSI colors (default)
+	ColorNever                   // Render plain text
+	ColorAuto                    // Use colors only if stdout is a terminal
+)
+
+const defaultResponseTimeFormat = "2006-01-02 15:04:05"
+
+var (
+	responseColors     atomic.Int32
+	responseTimeFormat atomic.Value // string
+)
+
+// SetResponseColors sets whether Response.String uses ANSI colors
+func SetResponseColors(mode ColorMode) {
+	responseColors.Store(int32(mode))
+}
+
+// SetResponseTimeFormat sets the time layout of new responses' timestamps, e.g.
+// time.RFC3339. An empty layout restores the default "2006-01-02 15:04:05".
+func SetResponseTimeFormat(layout string) {
+	if layout == "" {
+		layout = defaultResponseTimeFormat
+	}
+	responseTimeFormat.Store(layout)
+}
+
+// useColors reports whether responses are rendered with colors
+func useColors() bool {
+	switch ColorMode(responseColors.Load()) {
+	case ColorNever:
+		return false
+	case ColorAuto:
+		return isTerminal(os.Stdout)
+	}
+	return true
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
 /*
+200 Success
 300 Warning
 400 Error
 500 Database Error
 600 Unknown
 */
 func NewResponse(statusCode int, message string) Response {
-	return Response{TimeStamp: time.Now().Format("2006-01-02 15:04:05"), StatusCode: statusCode, Message: message}
+	layout, _ := responseTimeFormat.Load().(string)
+	if layout == "" {
+		layout = defaultResponseTimeFormat
+	}
+	return Response{TimeStamp: time.Now().Format(layout), StatusCode: statusCode, Message: message}
 }
 
 func (r Response) Error() string {
 	return r.String()
 }
 
+// WithError returns a copy of the response wrapping err, so it stays
+// reachable with errors.Is and errors.As. An empty message is set to err's.
+func (r Response) WithError(err error) Response {
+	r.err = err
+	if r.Message == "" && err != nil {
+		r.Message = err.Error()
+	}
+	return r
+}
+
+// Unwrap returns the error given to WithError and the sentinel error matching
+// the status code, so errors.Is works on responses
+func (r Response) Unwrap() []error {
+	var errs []error
+	if r.err != nil {
+		errs = append(errs, r.err)
+	}
+	if sentinel := statusSentinel(r.StatusCode); sentinel != nil {
+		errs = append(errs, sentinel)
+	}
+	return errs
+}
+
+// statusSentinel returns the sentinel error of a status code, or nil
+func statusSentinel(statusCode int) error {
+	switch statusCode {
+	case StatusSchenaDoesntExist:
+		return ErrSchemaNotFound
+	case StatusTableDoesntExist:
+		return ErrTableNotFound
+	case StatusFieldDoesntExist:
+		return ErrFieldNotFound
+	case StatusRecordDoesntExist:
+		return ErrNotFound
+	case StatusSchenaAlreadyExists, StatusTableAlreadyExists, StatusFieldAlreadyExists:
+		return ErrAlreadyExists
+	case StatusConflict:
+		return ErrWriteConflict
+	case StatusLocked:
+		return ErrLocked
+	}
+	return nil
+}
+
+// StatusOf returns the status code matching an error, StatusOK for nil and
+// StatusDbError for errors without a more specific code
+func StatusOf(err error) int {
+	var response Response
+	switch {
+	case err == nil:
+		return StatusOK
+	case errors.As(err, &response):
+		return response.StatusCode
+	case errors.Is(err, ErrValidation):
+		// Checked first, validation errors may also report unknown fields
+		return StatusValidationFailed
+	case errors.Is(err, ErrSchemaNotFound):
+		return StatusSchenaDoesntExist
+	case errors.Is(err, ErrTableNotFound):
+		return StatusTableDoesntExist
+	case errors.Is(err, ErrFieldNotFound):
+		return StatusFieldDoesntExist
+	case errors.Is(err, ErrNotFound):
+		return StatusRecordDoesntExist
+	case errors.Is(err, ErrWriteConflict):
+		return StatusConflict
+	case errors.Is(err, ErrLocked):
+		return StatusLocked
+	}
+	return StatusDbError
+}
+
+func (r Response) IsSuccess() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
 func (r Response) IsWarn() bool {
 	return r.StatusCode >= 300 && r.StatusCode < 400
 }
@@ -61,17 +198,40 @@ func (r Response) IsUnknown() bool {
 	return r.StatusCode >= 600
 }
 
+// String renders the response, with a colored status code unless disabled
+// with SetResponseColors
 func (r Response) String() string {
-	var status string
+	return r.render(useColors())
+}
 
-	if r.IsWarn() {
-		status = "\033[33m" + strconv.Itoa(r.StatusCode) + "\033[0m" + " Warning"
+// PlainString renders the response like String but never uses colors
+func (r Response) PlainString() string {
+	return r.render(false)
+}
+
+// render renders the response with or without ANSI colors
+func (r Response) render(colors bool) string {
+	var color, label string
+
+	if r.IsSuccess() {
+		color, label = "\033[32m", " OK"
+	} else if r.IsWarn() {
+		color, label = "\033[33m", " Warning"
 	} else if r.IsError() {
-		status = "\033[31m" + strconv.Itoa(r.StatusCode) + "\033[0m" + " Error"
+		color, label = "\033[31m", " Error"
 	} else if r.IsDbError() {
-		status = "\033[36m" + strconv.Itoa(r.StatusCode) + "\033[0m" + " Database Error"
+		color, label = "\033[36m", " Database Error"
 	} else if r.IsUnknown() {
-		status = "\033[37m" + strconv.Itoa(r.StatusCode) + "\033[0m" + " Unknown Error"
+		color, label = "\033[37m", " Unknown Error"
+	}
+
+	status := ""
+	if label != "" {
+		status = strconv.Itoa(r.StatusCode)
+		if colors {
+			status = color + status + "\033[0m"
+		}
+		status += label
 	}
 
 	return status + " [" + r.TimeStamp + "] " + r.Message
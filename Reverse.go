@@ -0,0 +1,89 @@
+// Reverse.go
+// Description: Reverse iteration of the HTDB library
+// Streams a table newest first by reading its fixed-size records from the end of the file
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const reverseReadRecords = 256 // Records read from the table file at a time by a reverse scan
+
+// StreamRecordsReverse works like StreamRecordsWith but streams the records
+// from the end of the table file to its start, in the reverse order they were
+// written. Records are appended with increasing ids, so the newest come first
+// and a scan for the latest records can stop after a few reads. Archived
+// versions aren't part of the table file and can't be included.
+func (t *Table) StreamRecordsReverse(options ScanOptions, fn func(*Record) error) error {
+	if options.IncludeArchived {
+		return fmt.Errorf("archived records of table '%s' can't be streamed in reverse", t.TableName)
+	}
+	return t.decodeRecords(options, t.streamRawRecordsReverse, fn)
+}
+
+// streamRawRecordsReverse calls fn with the serialized bytes and offset of
+// every record in the table file, the last record first. The slice is reused
+// between calls and must not be retained. A trailing partial record is skipped
+// and returned as a *TruncatedTableError after the whole records.
+func (t *Table) streamRawRecordsReverse(fn func([]byte, int64) error) error {
+	lock := t.lock()
+	lock.RLock()
+	defer lock.RUnlock()
+
+	file, release, err := t.openFile()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read table file: %w", err)
+	}
+	defer release()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file stats: %w", err)
+	}
+
+	recordSize := int64(t.RecordSize())
+	whole := stat.Size() - stat.Size()%recordSize
+	end := whole
+	buffer := make([]byte, reverseReadRecords*recordSize)
+
+	for end > 0 {
+		start := end - int64(len(buffer))
+		if start < 0 {
+			start = 0
+		}
+		block := buffer[:end-start]
+		_, err := file.ReadAt(block, start)
+		if err != nil {
+			return fmt.Errorf("failed to read table file: %w", err)
+		}
+
+		for offset := end - recordSize; offset >= start; offset -= recordSize {
+			err = fn(block[offset-start:offset-start+recordSize], offset)
+			if errors.Is(err, ErrStopStreaming) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		end = start
+	}
+
+	if whole < stat.Size() {
+		return &TruncatedTableError{Schema: t.schemaName(), Table: t.TableName, Offset: whole, Leftover: stat.Size() - whole}
+	}
+	return nil
+}
+
+// reversed reports whether the query is sorted by id descending and can scan
+// the table from its end
+func (q *Query) reversed() bool {
+	return q.sortField == "id" && !q.sortAscending && !q.archived
+}
@@ -0,0 +1,377 @@
+// SQLImport.go
+// Description: Import from database/sql sources for the HTDB library
+// Copies the rows of a SQL query into a table, e.g. to migrate existing data
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLImportOptions configures ImportFromSQLWithOptions
+type SQLImportOptions struct {
+	BatchSize       int                     // Records inserted per transaction, defaults to 500
+	ContinueOnError bool                    // Skip rows that fail and keep importing instead of stopping at the first one
+	Progress        func(SQLImportProgress) // Called after every committed batch
+}
+
+// SQLImportProgress reports how far an import from SQL got
+type SQLImportProgress struct {
+	RowsRead     int // Rows read from the query so far
+	RowsImported int // Rows committed to the table so far
+}
+
+// SQLColumnError is a query column that can't be mapped to its field
+type SQLColumnError struct {
+	Column string
+	Field  string
+	Err    error
+}
+
+func (e *SQLColumnError) Error() string {
+	return fmt.Sprintf("column '%s' -> field '%s': %v", e.Column, e.Field, e.Err)
+}
+
+// SQLColumnErrors collects every column of a query that can't be mapped
+type SQLColumnErrors []*SQLColumnError
+
+func (e SQLColumnErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, columnErr := range e {
+		messages[i] = columnErr.Error()
+	}
+	return fmt.Sprintf("%d columns can't be imported: %s", len(e), strings.Join(messages, "; "))
+}
+
+// sqlColumn is a query column mapped to a field
+type sqlColumn struct {
+	name  string
+	field *Field
+}
+
+// ImportFromSQL runs query on db and inserts every row into table. mapping maps
+// column names to field names, a nil mapping maps columns to the fields of the
+// same name. Columns that aren't mapped are ignored, NULL values become null
+// fields. It returns the number of imported rows.
+func (tm *TableManager) ImportFromSQL(db *sql.DB, query string, table *Table, mapping map[string]string) (int, error) {
+	return tm.ImportFromSQLWithOptions(db, query, table, mapping, SQLImportOptions{})
+}
+
+// ImportFromSQLWithOptions is ImportFromSQL with batching, error handling and
+// progress reporting options. Columns whose SQL type can't be converted to
+// their field's type are reported as SQLColumnErrors before any row is read.
+// Rows that fail to convert are ImportRowErrors with Line set to the row number.
+func (tm *TableManager) ImportFromSQLWithOptions(db *sql.DB, query string, table *Table, mapping map[string]string, options SQLImportOptions) (int, error) {
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run import query: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := mapSQLColumns(rows, table, mapping)
+	if err != nil {
+		return 0, err
+	}
+
+	batch := newImportBatch(tm, table, batchSize)
+	var rowErrors ImportErrors
+	rowsRead := 0
+
+	values := make([]interface{}, len(columns))
+	targets := make([]interface{}, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+
+	for rows.Next() {
+		rowsRead++
+
+		err = rows.Scan(targets...)
+		var data map[string]interface{}
+		if err == nil {
+			data, err = convertSQLRow(values, columns)
+		}
+		if err == nil {
+			err = batch.add(data)
+		}
+		if err != nil {
+			rowErr := &ImportRowError{Line: rowsRead, Err: err}
+			if !options.ContinueOnError {
+				batch.rollback()
+				return batch.inserted, rowErr
+			}
+			rowErrors = append(rowErrors, rowErr)
+			continue
+		}
+
+		if batch.full() {
+			err = batch.commit()
+			if err != nil {
+				return batch.inserted, err
+			}
+			reportSQLProgress(options, rowsRead, batch.inserted)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		batch.rollback()
+		return batch.inserted, fmt.Errorf("failed to read import query: %v", err)
+	}
+
+	err = batch.commit()
+	if err != nil {
+		return batch.inserted, err
+	}
+	reportSQLProgress(options, rowsRead, batch.inserted)
+
+	if len(rowErrors) > 0 {
+		return batch.inserted, rowErrors
+	}
+	return batch.inserted, nil
+}
+
+// reportSQLProgress calls the progress callback if there is one
+func reportSQLProgress(options SQLImportOptions, rowsRead, rowsImported int) {
+	if options.Progress != nil {
+		options.Progress(SQLImportProgress{RowsRead: rowsRead, RowsImported: rowsImported})
+	}
+}
+
+// mapSQLColumns maps the query columns to fields and checks that their SQL
+// types can be converted. Every problem is collected before returning.
+func mapSQLColumns(rows *sql.Rows, table *Table, mapping map[string]string) ([]sqlColumn, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import query columns: %v", err)
+	}
+
+	var columnErrors SQLColumnErrors
+	columns := make([]sqlColumn, len(columnTypes))
+	seen := make(map[string]bool, len(columnTypes))
+	for i, columnType := range columnTypes {
+		name := columnType.Name()
+		seen[name] = true
+		columns[i].name = name
+
+		fieldName := name
+		if mapping != nil {
+			mapped, exists := mapping[name]
+			if !exists {
+				continue // Not imported
+			}
+			fieldName = mapped
+		}
+
+		field := findField(table, fieldName)
+		if field == nil {
+			if mapping != nil {
+				columnErrors = append(columnErrors, &SQLColumnError{Column: name, Field: fieldName, Err: fmt.Errorf("no such field in table '%s'", table.TableName)})
+			}
+			continue
+		}
+		if field.Name == "id" {
+			columnErrors = append(columnErrors, &SQLColumnError{Column: name, Field: fieldName, Err: fmt.Errorf("ids are generated on insert")})
+			continue
+		}
+
+		err := checkSQLColumnType(columnType.ScanType(), field)
+		if err != nil {
+			columnErrors = append(columnErrors, &SQLColumnError{Column: name, Field: fieldName, Err: err})
+			continue
+		}
+		columns[i].field = field
+	}
+
+	// Mapped columns the query doesn't return are a mistake as well
+	for column, fieldName := range mapping {
+		if !seen[column] {
+			columnErrors = append(columnErrors, &SQLColumnError{Column: column, Field: fieldName, Err: fmt.Errorf("query has no such column")})
+		}
+	}
+
+	if len(columnErrors) > 0 {
+		return nil, columnErrors
+	}
+	return columns, nil
+}
+
+// findField returns the field of a table with the given name
+func findField(table *Table, name string) *Field {
+	for i := range table.Fields {
+		if table.Fields[i].Name == name {
+			return &table.Fields[i]
+		}
+	}
+	return nil
+}
+
+var (
+	sqlTimeType     = reflect.TypeOf(time.Time{})
+	sqlNullTimeType = reflect.TypeOf(sql.NullTime{})
+	sqlBytesType    = reflect.TypeOf([]byte(nil))
+	sqlRawBytesType = reflect.TypeOf(sql.RawBytes(nil))
+)
+
+// sqlScanKind classifies the scan type of a column as "int", "float",
+// "string", "bool", "time", or "any" if the driver doesn't say
+func sqlScanKind(scanType reflect.Type) string {
+	if scanType == nil {
+		return "any"
+	}
+	switch scanType {
+	case sqlTimeType, sqlNullTimeType:
+		return "time"
+	case sqlBytesType, sqlRawBytesType:
+		return "string"
+	case reflect.TypeOf(sql.NullString{}):
+		return "string"
+	case reflect.TypeOf(sql.NullInt64{}), reflect.TypeOf(sql.NullInt32{}), reflect.TypeOf(sql.NullInt16{}), reflect.TypeOf(sql.NullByte{}):
+		return "int"
+	case reflect.TypeOf(sql.NullFloat64{}):
+		return "float"
+	case reflect.TypeOf(sql.NullBool{}):
+		return "bool"
+	}
+
+	switch scanType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Interface:
+		return "any"
+	}
+	return scanType.String()
+}
+
+// checkSQLColumnType reports whether values of a column's scan type can be
+// converted to the field's type
+func checkSQLColumnType(scanType reflect.Type, field *Field) error {
+	kind := sqlScanKind(scanType)
+	if kind == "any" {
+		return nil // Checked per value
+	}
+
+	var accepted []string
+	switch field.Type {
+	case Int:
+		accepted = []string{"int"}
+	case TimeID:
+		accepted = []string{"int", "time"}
+	case Float:
+		accepted = []string{"int", "float"}
+	case String, "ref":
+		accepted = []string{"string"}
+	case Bool:
+		accepted = []string{"bool", "int"}
+	default:
+		return fmt.Errorf("unsupported field type '%s'", field.Type)
+	}
+
+	for _, a := range accepted {
+		if kind == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("can't convert SQL %s values to %s", kind, field.Type)
+}
+
+// convertSQLRow converts the scanned values of a row to the types of their fields
+func convertSQLRow(values []interface{}, columns []sqlColumn) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		if column.field == nil {
+			continue
+		}
+
+		value, err := convertSQLValue(values[i], *column.field)
+		if err != nil {
+			return nil, fmt.Errorf("column '%s': %v", column.name, err)
+		}
+		data[column.field.Name] = value
+	}
+	return data, nil
+}
+
+// convertSQLValue converts a value scanned by database/sql to the type of a field.
+// Drivers return int64, float64, bool, []byte, string, time.Time or nil.
+func convertSQLValue(value interface{}, field Field) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if bytes, ok := value.([]byte); ok {
+		value = string(bytes)
+	}
+
+	switch field.Type {
+	case String, "ref":
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a string value, got %T", field.Name, value)
+		}
+		if field.Type == String && uint(len(str)) > field.capacity() {
+			return nil, fmt.Errorf("value of field '%s' is longer than %d bytes", field.Name, field.capacity())
+		}
+		return str, nil
+	case Int, TimeID:
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case time.Time:
+			if field.Type == TimeID {
+				return v.UnixNano(), nil
+			}
+		case string:
+			integer, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("field '%s' requires an integer value: %v", field.Name, err)
+			}
+			return integer, nil
+		}
+		return nil, fmt.Errorf("field '%s' requires an integer value, got %T", field.Name, value)
+	case Float:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int64:
+			return float64(v), nil
+		case string:
+			float, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("field '%s' requires a number value: %v", field.Name, err)
+			}
+			return float, nil
+		}
+		return nil, fmt.Errorf("field '%s' requires a number value, got %T", field.Name, value)
+	case Bool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int64:
+			return v != 0, nil
+		case string:
+			boolean, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("field '%s' requires a bool value: %v", field.Name, err)
+			}
+			return boolean, nil
+		}
+		return nil, fmt.Errorf("field '%s' requires a bool value, got %T", field.Name, value)
+	}
+	return nil, fmt.Errorf("unsupported field type '%s'", field.Type)
+}
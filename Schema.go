@@ -7,7 +7,12 @@ package hartoDb_go
 
 import (
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type Schema struct {
@@ -17,9 +22,15 @@ type Schema struct {
 }
 
 func (db *HTDB) Schema(name string) (*Schema, error) {
-	var pathSchema = db.mainPath + "/" + name
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if !validName(name) {
+		return nil, invalidSchemaName(name)
+	}
+	var pathSchema = db.schemaPath(name)
 	// check if folder at pathSchema exists
-	if _, err := os.Stat(pathSchema); err == nil {
+	if _, err := db.storage().Stat(pathSchema); err == nil {
 		return &Schema{
 			name:       name,
 			schemaPath: pathSchema,
@@ -29,20 +40,101 @@ func (db *HTDB) Schema(name string) (*Schema, error) {
 	return nil, NewResponse(StatusSchenaDoesntExist, "Schema "+name+" does not exist")
 }
 
+// invalidSchemaName is the error for a schema name that can't be a directory
+// name, see validName
+func invalidSchemaName(name string) Response {
+	return NewResponse(StatusInvalidName, "Can't name a schema \""+name+"\", use letters, digits, '_' and '-'")
+}
+
+// Name returns the name of the schema
+func (s *Schema) Name() string {
+	return s.name
+}
+
+// Path returns the directory of the schema
+func (s *Schema) Path() string {
+	return s.schemaPath
+}
+
+// Table returns a table of the schema
+func (s *Schema) Table(name string) (*Table, error) {
+	return s.db.getTable(s.name + ":" + name)
+}
+
+// Tables returns all tables of the schema, sorted by name
+func (s *Schema) Tables() ([]*Table, error) {
+	names, err := s.db.TableNames(s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]*Table, 0, len(names))
+	for _, name := range names {
+		table, err := s.Table(name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// SchemaNames returns the names of all schemas in the database, attached ones included, sorted
+func (db *HTDB) SchemaNames() ([]string, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	entries, err := db.storage().ReadDir(db.mainPath)
+	if err != nil {
+		return nil, NewResponse(StatusDbError, fmt.Sprint(err)).WithError(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if isSchemaDir(entry) {
+			names = append(names, entry.Name())
+		}
+	}
+	for name := range db.attachedSchemas() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isSchemaDir reports whether an entry of the main path is a schema. Hidden
+// directories like .snapshots belong to the database itself, directories of
+// other names can't be opened as schemas.
+func isSchemaDir(entry fs.DirEntry) bool {
+	return entry.IsDir() && validName(entry.Name())
+}
+
 func (db *HTDB) CreateSchema(name string) (*Schema, error) {
-	pathSchema := db.mainPath + "/" + name
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	pathSchema := filepath.Join(db.mainPath, name)
 
-	if _, err := os.Stat(pathSchema); os.IsNotExist(err) {
-		err := os.Mkdir(pathSchema, 0777)
+	store := db.storage()
+	if !validName(name) {
+		return nil, invalidSchemaName(name)
+	}
+	if _, attached := db.attachedSchemas()[name]; attached {
+		return nil, NewResponse(StatusSchenaAlreadyExists, "Schema "+name+" is attached")
+	}
+	if _, err := store.Stat(pathSchema); os.IsNotExist(err) {
+		err := store.Mkdir(pathSchema, db.dirMode())
 		if err != nil {
-			return nil, NewResponse(StatusDbError, fmt.Sprint(err))
+			return nil, NewResponse(StatusDbError, fmt.Sprint(err)).WithError(err)
 		}
 
-		_, err = os.Create(pathSchema + "/index.conf" + fileEnding)
+		err = writeFile(store, schemaIndexPath(pathSchema), nil, db.fileMode())
 		if err != nil {
-			return nil, NewResponse(StatusDbError, fmt.Sprint(err))
+			return nil, NewResponse(StatusDbError, fmt.Sprint(err)).WithError(err)
 		}
 
+		db.log(slog.LevelInfo, "schema created", "schema", name)
+
 		return &Schema{
 			name:       name,
 			schemaPath: pathSchema,
@@ -53,3 +145,27 @@ func (db *HTDB) CreateSchema(name string) (*Schema, error) {
 		return nil, NewResponse(StatusSchenaAlreadyExists, "Schema "+name+" already exists")
 	}
 }
+
+// TableNames returns the names of all tables in a schema, sorted
+func (db *HTDB) TableNames(schemaName string) ([]string, error) {
+	schema, err := db.Schema(schemaName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := db.storage().ReadDir(schema.schemaPath)
+	if err != nil {
+		return nil, NewResponse(StatusDbError, fmt.Sprint(err)).WithError(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".conf"+fileEnding) || name == "index.conf"+fileEnding {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(name, ".conf"+fileEnding))
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,399 @@
+// SchemaExport.go
+// Description: Export and import of schema definitions for the HTDB library
+// Moves table definitions between databases, e.g. for environment promotion
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const schemaDocumentVersion = 1 // Format version written by ExportSchema
+
+// SchemaDocument is the JSON document of a schema's table definitions
+type SchemaDocument struct {
+	FormatVersion int               `json:"format_version"`
+	Schema        string            `json:"schema"`
+	Tables        []TableDefinition `json:"tables"`
+}
+
+// TableDefinition is the definition of a single table, without the id field
+type TableDefinition struct {
+	Name   string  `json:"name"`
+	Fields []Field `json:"fields"`
+}
+
+// SchemaImportOptions configures ImportSchema
+type SchemaImportOptions struct {
+	Schema           string // Schema to import into, defaults to the one in the document
+	DryRun           bool   // Only report the changes, don't apply them
+	AlterExisting    bool   // Also change existing tables to match the document
+	AllowDestructive bool   // Allow changes that lose data, like dropping fields or tables
+}
+
+// SchemaChangeKind is the kind of a change made by ImportSchema
+type SchemaChangeKind string
+
+const (
+	SchemaChangeCreateSchema SchemaChangeKind = "create_schema"
+	SchemaChangeCreateTable  SchemaChangeKind = "create_table"
+	SchemaChangeDropTable    SchemaChangeKind = "drop_table"
+	SchemaChangeAddField     SchemaChangeKind = "add_field"
+	SchemaChangeDropField    SchemaChangeKind = "drop_field"
+	SchemaChangeAlterField   SchemaChangeKind = "alter_field"
+)
+
+// SchemaChange is a single difference between a document and the database
+type SchemaChange struct {
+	Kind        SchemaChangeKind `json:"kind"`
+	Table       string           `json:"table,omitempty"`
+	Field       string           `json:"field,omitempty"`
+	Destructive bool             `json:"destructive"` // Applying it can lose data
+	Description string           `json:"description"`
+}
+
+// SchemaDiff lists the changes ImportSchema made, or would make on a dry run
+type SchemaDiff struct {
+	Schema  string         `json:"schema"`
+	Changes []SchemaChange `json:"changes"`
+	Applied bool           `json:"applied"`
+}
+
+// Destructive reports whether any of the changes can lose data
+func (d *SchemaDiff) Destructive() bool {
+	for _, change := range d.Changes {
+		if change.Destructive {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the changes one per line
+func (d *SchemaDiff) String() string {
+	var b strings.Builder
+	for _, change := range d.Changes {
+		marker := "+"
+		if change.Destructive {
+			marker = "!"
+		}
+		fmt.Fprintf(&b, "%s %s\n", marker, change.Description)
+	}
+	return b.String()
+}
+
+// ExportSchema returns the table definitions of a schema as a JSON document,
+// tables sorted by name
+func (db *HTDB) ExportSchema(name string) ([]byte, error) {
+	tables, err := db.schemaTables(name)
+	if err != nil {
+		return nil, err
+	}
+
+	document := SchemaDocument{FormatVersion: schemaDocumentVersion, Schema: name, Tables: []TableDefinition{}}
+	for _, table := range tables {
+		document.Tables = append(document.Tables, TableDefinition{Name: table.TableName, Fields: userFields(table.Fields)})
+	}
+
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize schema: %v", err)
+	}
+	return data, nil
+}
+
+// ImportSchema creates the schema and tables of a document that don't exist
+// yet. With AlterExisting, existing tables are changed to match the document
+// and tables missing from it are dropped. Changes that lose data are refused
+// unless AllowDestructive is set, the returned diff lists them either way.
+func (db *HTDB) ImportSchema(doc []byte, options SchemaImportOptions) (*SchemaDiff, error) {
+	var document SchemaDocument
+	err := json.Unmarshal(doc, &document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema document: %v", err)
+	}
+	if document.FormatVersion != schemaDocumentVersion {
+		return nil, fmt.Errorf("unsupported schema document version %d", document.FormatVersion)
+	}
+
+	schemaName := options.Schema
+	if schemaName == "" {
+		schemaName = document.Schema
+	}
+	if schemaName == "" {
+		return nil, fmt.Errorf("schema document has no schema name")
+	}
+
+	diff, err := db.diffSchema(schemaName, document, options.AlterExisting)
+	if err != nil {
+		return nil, err
+	}
+	if options.DryRun {
+		return diff, nil
+	}
+	if diff.Destructive() && !options.AllowDestructive {
+		return diff, fmt.Errorf("refusing destructive schema changes:\n%s", diff)
+	}
+
+	err = db.applySchemaDiff(diff, document)
+	if err != nil {
+		return diff, err
+	}
+	diff.Applied = true
+	return diff, nil
+}
+
+// diffSchema compares a document with the schema in the database
+func (db *HTDB) diffSchema(schemaName string, document SchemaDocument, alterExisting bool) (*SchemaDiff, error) {
+	diff := &SchemaDiff{Schema: schemaName, Changes: []SchemaChange{}}
+
+	existing := make(map[string]*Table)
+	if _, err := db.Schema(schemaName); err != nil {
+		diff.Changes = append(diff.Changes, SchemaChange{
+			Kind:        SchemaChangeCreateSchema,
+			Description: fmt.Sprintf("create schema '%s'", schemaName),
+		})
+	} else {
+		tables, err := db.schemaTables(schemaName)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			existing[table.TableName] = table
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, definition := range document.Tables {
+		if definition.Name == "" {
+			return nil, fmt.Errorf("schema document has a table without a name")
+		}
+		if wanted[definition.Name] {
+			return nil, fmt.Errorf("schema document defines table '%s' twice", definition.Name)
+		}
+		wanted[definition.Name] = true
+
+		table, exists := existing[definition.Name]
+		if !exists {
+			diff.Changes = append(diff.Changes, SchemaChange{
+				Kind:        SchemaChangeCreateTable,
+				Table:       definition.Name,
+				Description: fmt.Sprintf("create table '%s' with %d fields", definition.Name, len(definition.Fields)),
+			})
+			continue
+		}
+		if alterExisting {
+			diff.Changes = append(diff.Changes, diffFields(definition.Name, userFields(table.Fields), definition.Fields)...)
+		}
+	}
+
+	if alterExisting {
+		var dropped []string
+		for name := range existing {
+			if !wanted[name] {
+				dropped = append(dropped, name)
+			}
+		}
+		sort.Strings(dropped)
+		for _, name := range dropped {
+			diff.Changes = append(diff.Changes, SchemaChange{
+				Kind:        SchemaChangeDropTable,
+				Table:       name,
+				Destructive: true,
+				Description: fmt.Sprintf("drop table '%s'", name),
+			})
+		}
+	}
+
+	return diff, nil
+}
+
+// diffFields compares the fields of an existing table with the wanted ones
+func diffFields(tableName string, current, wanted []Field) []SchemaChange {
+	var changes []SchemaChange
+
+	currentByName := make(map[string]Field, len(current))
+	for _, field := range current {
+		currentByName[field.Name] = field
+	}
+	wantedByName := make(map[string]bool, len(wanted))
+
+	for _, field := range wanted {
+		wantedByName[field.Name] = true
+		old, exists := currentByName[field.Name]
+		if !exists {
+			changes = append(changes, SchemaChange{
+				Kind:        SchemaChangeAddField,
+				Table:       tableName,
+				Field:       field.Name,
+				Description: fmt.Sprintf("add field '%s.%s' (%s, %d bytes)", tableName, field.Name, field.Type, field.Length),
+			})
+			continue
+		}
+		if sameField(old, field) {
+			continue
+		}
+
+		// Growing a field or changing its constraints keeps every value
+		destructive := old.Type != field.Type || field.Length < old.Length || old.Compression != field.Compression
+		changes = append(changes, SchemaChange{
+			Kind:        SchemaChangeAlterField,
+			Table:       tableName,
+			Field:       field.Name,
+			Destructive: destructive,
+			Description: fmt.Sprintf("alter field '%s.%s' from %s (%d bytes, %v) to %s (%d bytes, %v)",
+				tableName, field.Name, old.Type, old.Length, old.Constraints, field.Type, field.Length, field.Constraints),
+		})
+	}
+
+	for _, field := range current {
+		if !wantedByName[field.Name] {
+			changes = append(changes, SchemaChange{
+				Kind:        SchemaChangeDropField,
+				Table:       tableName,
+				Field:       field.Name,
+				Destructive: true,
+				Description: fmt.Sprintf("drop field '%s.%s'", tableName, field.Name),
+			})
+		}
+	}
+	return changes
+}
+
+// sameField reports whether two field definitions are equal
+func sameField(a, b Field) bool {
+	if a.Type != b.Type || a.Length != b.Length || a.Compression != b.Compression || a.Index != b.Index || a.Collation != b.Collation || len(a.Constraints) != len(b.Constraints) {
+		return false
+	}
+	for i := range a.Constraints {
+		if a.Constraints[i] != b.Constraints[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// applySchemaDiff makes the changes of a diff
+func (db *HTDB) applySchemaDiff(diff *SchemaDiff, document SchemaDocument) error {
+	definitions := make(map[string]TableDefinition, len(document.Tables))
+	for _, definition := range document.Tables {
+		definitions[definition.Name] = definition
+	}
+
+	altered := make(map[string]bool)
+	for _, change := range diff.Changes {
+		switch change.Kind {
+		case SchemaChangeCreateSchema:
+			_, err := db.CreateSchema(diff.Schema)
+			if err != nil {
+				return err
+			}
+		case SchemaChangeCreateTable:
+			_, err := db.tableManager.CreateTable(diff.Schema, change.Table, definitions[change.Table].Fields)
+			if err != nil {
+				return fmt.Errorf("failed to create table '%s': %v", change.Table, err)
+			}
+		case SchemaChangeDropTable:
+			err := db.dropTable(diff.Schema, change.Table)
+			if err != nil {
+				return err
+			}
+		default:
+			// All field changes of a table are applied by a single rewrite
+			if altered[change.Table] {
+				continue
+			}
+			altered[change.Table] = true
+
+			table, err := db.tableManager.GetTable(diff.Schema, change.Table)
+			if err != nil {
+				return err
+			}
+			err = db.tableManager.alterTable(table, definitions[change.Table].Fields)
+			if err != nil {
+				return fmt.Errorf("failed to alter table '%s': %v", change.Table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dropTable deletes the files of a table
+func (db *HTDB) dropTable(schemaName, tableName string) error {
+	table, err := db.tableManager.GetTable(schemaName, tableName)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := db.lockTableDDL(tableCacheKey(table))
+	if err != nil {
+		return newTableError(table, err)
+	}
+	defer unlock()
+
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	paths := []string{
+		table.filePath(),
+		table.confPath(),
+		table.layoutHashPath(),
+		table.analysisPath(),
+		table.summaryPath(),
+	}
+	paths = append(paths, table.archiveFilePaths()...)
+	for _, field := range table.Fields {
+		if field.Type == "ref" {
+			paths = append(paths, table.RefFilePath(field.Name), table.refGapsPath(field.Name))
+		}
+		if field.Index != IndexNone {
+			paths = append(paths, table.fullTextIndexPath(field.Name))
+		}
+	}
+	for _, path := range paths {
+		db.files.invalidate(path)
+		err := db.storage().Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove table file: %v", err)
+		}
+	}
+
+	db.tableManager.recordCache.invalidateTable(tableCacheKey(table))
+	db.tableManager.primaryKeys.invalidate(tableCacheKey(table))
+	return nil
+}
+
+// schemaTables loads every table of a schema, sorted by name
+func (db *HTDB) schemaTables(schemaName string) ([]*Table, error) {
+	names, err := db.TableNames(schemaName)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]*Table, 0, len(names))
+	for _, name := range names {
+		table, err := db.getTable(schemaName + ":" + name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// userFields returns the fields of a table without the id field
+func userFields(fields []Field) []Field {
+	result := []Field{}
+	for _, field := range fields {
+		if field.Name != "id" {
+			result = append(result, field)
+		}
+	}
+	return result
+}
@@ -0,0 +1,191 @@
+// Scope.go
+// Description: Scoped table views of the HTDB library
+// Restricts reads and writes of a table to the records with given field values, e.g. of one tenant
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ScopedTable is a view of a table limited to the records whose scope fields
+// hold the scope values. Queries only return those records, inserts get the
+// values set and updates and deletes of other records fail with ErrOutOfScope.
+type ScopedTable struct {
+	tm     *TableManager
+	table  *Table
+	fields []string // Scope fields, sorted
+	values map[string]interface{}
+}
+
+// Scoped returns a view of table limited to the records with the given
+// values, such as {"tenant_id": 42}. Scope fields can't be the id or ref fields.
+func (tm *TableManager) Scoped(table *Table, scope map[string]interface{}) (*ScopedTable, error) {
+	if len(scope) == 0 {
+		return nil, newTableError(table, fmt.Errorf("scope has no fields"))
+	}
+
+	scoped := &ScopedTable{tm: tm, table: table, values: make(map[string]interface{}, len(scope))}
+	for name, value := range scope {
+		field, exists := tableField(table, name)
+		if !exists {
+			return nil, newFieldError(table, name, ErrFieldNotFound)
+		}
+		if name == "id" || field.Type == "ref" {
+			return nil, newFieldError(table, name, fmt.Errorf("a %s field can't scope a table", field.Type))
+		}
+		if value == nil {
+			return nil, newFieldError(table, name, fmt.Errorf("scope value must not be null"))
+		}
+		scoped.fields = append(scoped.fields, name)
+		scoped.values[name] = value
+	}
+	sort.Strings(scoped.fields)
+	return scoped, nil
+}
+
+// tableField returns the field of a table with the given name
+func tableField(table *Table, name string) (Field, bool) {
+	for _, field := range table.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// Table returns the scoped table
+func (s *ScopedTable) Table() *Table {
+	return s.table
+}
+
+// Select creates a query for the records of the scope
+func (s *ScopedTable) Select() *Query {
+	query := s.tm.Select(s.table)
+	for _, field := range s.fields {
+		query.Where(field, "=", s.values[field])
+	}
+	return query
+}
+
+// GetRecordByID gets a record of the scope by ID, records outside of it are not found
+func (s *ScopedTable) GetRecordByID(id int64) (*Record, error) {
+	record, err := s.tm.GetRecordByID(s.table, id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.contains(record) {
+		return nil, newRecordError(s.table, id, ErrNotFound)
+	}
+	return record, nil
+}
+
+// Insert inserts a record with the scope values set
+func (s *ScopedTable) Insert(data map[string]interface{}) (*Record, error) {
+	data, err := s.scopeData(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.tm.InsertRecord(s.table, data)
+}
+
+// Update updates a record of the scope, updates can't change the scope fields
+func (s *ScopedTable) Update(record *Record, updates map[string]interface{}) (*Record, error) {
+	err := s.checkUpdate(record, updates)
+	if err != nil {
+		return nil, err
+	}
+	return s.tm.UpdateRecord(s.table, record, updates)
+}
+
+// Delete deletes a record of the scope
+func (s *ScopedTable) Delete(record *Record) error {
+	err := s.checkRecord(record)
+	if err != nil {
+		return err
+	}
+	return s.tm.DeleteRecord(s.table, record)
+}
+
+// StageInsert stages a record with the scope values set in tx
+func (s *ScopedTable) StageInsert(tx *Transaction, data map[string]interface{}) (*Record, error) {
+	data, err := s.scopeData(data)
+	if err != nil {
+		return nil, err
+	}
+	return tx.StageInsert(s.table, data)
+}
+
+// StageUpdate stages an update of a record of the scope in tx
+func (s *ScopedTable) StageUpdate(tx *Transaction, record *Record, updates map[string]interface{}) (*Record, error) {
+	err := s.checkUpdate(record, updates)
+	if err != nil {
+		return nil, err
+	}
+	return tx.StageUpdate(s.table, record, updates)
+}
+
+// StageDelete stages a delete of a record of the scope in tx
+func (s *ScopedTable) StageDelete(tx *Transaction, record *Record) error {
+	err := s.checkRecord(record)
+	if err != nil {
+		return err
+	}
+	return tx.StageDelete(s.table, record)
+}
+
+// contains reports whether a record holds the scope values
+func (s *ScopedTable) contains(record *Record) bool {
+	for _, field := range s.fields {
+		value, exists := record.FieldsData[field]
+		if !exists || record.FieldsMeta[field].IsNull || !equals(value, s.values[field]) {
+			return false
+		}
+	}
+	return true
+}
+
+// scopeData returns a copy of data with the scope values set. Data holding
+// other values for the scope fields is refused.
+func (s *ScopedTable) scopeData(data map[string]interface{}) (map[string]interface{}, error) {
+	scoped := make(map[string]interface{}, len(data)+len(s.fields))
+	for field, value := range data {
+		scoped[field] = value
+	}
+	for _, field := range s.fields {
+		if value, exists := data[field]; exists && !equals(value, s.values[field]) {
+			return nil, newFieldError(s.table, field, fmt.Errorf("%w: value %v", ErrOutOfScope, value))
+		}
+		scoped[field] = s.values[field]
+	}
+	return scoped, nil
+}
+
+// checkUpdate refuses updates of records outside the scope and of the scope fields
+func (s *ScopedTable) checkUpdate(record *Record, updates map[string]interface{}) error {
+	for _, field := range s.fields {
+		if value, exists := updates[field]; exists && !equals(value, s.values[field]) {
+			return newFieldError(s.table, field, fmt.Errorf("%w: scope fields can't be updated", ErrOutOfScope))
+		}
+	}
+	return s.checkRecord(record)
+}
+
+// checkRecord refuses records outside the scope. The stored version is
+// checked too, the given record could have been changed by the caller.
+func (s *ScopedTable) checkRecord(record *Record) error {
+	if !s.contains(record) {
+		return newRecordError(s.table, record.ID, ErrOutOfScope)
+	}
+
+	stored, err := s.tm.lookupRecord(s.table, record.ID)
+	if err != nil {
+		return err
+	}
+	if stored != nil && !s.contains(stored) {
+		return newRecordError(s.table, record.ID, ErrOutOfScope)
+	}
+	return nil
+}
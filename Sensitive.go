@@ -0,0 +1,99 @@
+// Sensitive.go
+// Description: Sensitive fields of the HTDB library
+// Withholds fields such as password hashes and tokens from query results unless revealed
+// Author: harto.dev
+
+package hartoDb_go
+
+// IsSensitive reports whether the field has the Sensitive constraint
+func (f Field) IsSensitive() bool {
+	return hasConstraint(f, Sensitive)
+}
+
+// RevealSensitive includes the sensitive fields in the returned records.
+// Without it they are left out of FieldsData, FieldsMeta and RefOffsets as if
+// the table didn't have them. Conditions and sorting can use them either way,
+// so queries built from untrusted input must not allow them there: which
+// records match, and their order, give the values away. The HTTP API rejects
+// them in where and sort.
+func (q *Query) RevealSensitive() *Query {
+	q.revealSensitive = true
+	return q
+}
+
+// Redact returns a copy of record without the values of the table's sensitive
+// fields, or record itself if it holds none. Updating or deleting the copy
+// keeps the withheld values, they are only missing from what callers can read.
+func (t *Table) Redact(record *Record) *Record {
+	if record == nil {
+		return nil
+	}
+
+	record.mu.Lock()
+	defer record.mu.Unlock()
+
+	var sensitive []string
+	for _, field := range t.Fields {
+		if field.IsSensitive() && record.holdsField(field.Name) {
+			sensitive = append(sensitive, field.Name)
+		}
+	}
+	if len(sensitive) == 0 {
+		return record
+	}
+
+	redacted := &Record{
+		ID:         record.ID,
+		Metadata:   record.Metadata,
+		FieldsData: make(map[string]interface{}, len(record.FieldsData)),
+		FieldsMeta: make(map[string]FieldMetadata, len(record.FieldsMeta)),
+		RefOffsets: make(map[string][2]int64, len(record.RefOffsets)),
+		previousID: record.previousID,
+		withheld:   &Record{FieldsData: map[string]interface{}{}, FieldsMeta: map[string]FieldMetadata{}, RefOffsets: map[string][2]int64{}},
+	}
+	record.copyFieldsTo(redacted)
+	for _, name := range sensitive {
+		if value, exists := redacted.FieldsData[name]; exists {
+			redacted.withheld.FieldsData[name] = value
+			delete(redacted.FieldsData, name)
+		}
+		if meta, exists := redacted.FieldsMeta[name]; exists {
+			redacted.withheld.FieldsMeta[name] = meta
+			delete(redacted.FieldsMeta, name)
+		}
+		if offsets, exists := redacted.RefOffsets[name]; exists {
+			redacted.withheld.RefOffsets[name] = offsets
+			delete(redacted.RefOffsets, name)
+		}
+	}
+	return redacted
+}
+
+// redact returns the record as the query returns it, see RevealSensitive
+func (q *Query) redact(record *Record) *Record {
+	if q.revealSensitive {
+		return record
+	}
+	return q.table.Redact(record)
+}
+
+// holdsField reports whether the record has a value, metadata or ref offsets for a field
+func (r *Record) holdsField(name string) bool {
+	_, hasValue := r.FieldsData[name]
+	_, hasMeta := r.FieldsMeta[name]
+	_, hasOffsets := r.RefOffsets[name]
+	return hasValue || hasMeta || hasOffsets
+}
+
+// copyFieldsTo copies the values, metadata and ref offsets of the record's fields to other
+func (r *Record) copyFieldsTo(other *Record) {
+	for name, value := range r.FieldsData {
+		other.FieldsData[name] = value
+	}
+	for name, meta := range r.FieldsMeta {
+		other.FieldsMeta[name] = meta
+	}
+	for name, offsets := range r.RefOffsets {
+		other.RefOffsets[name] = offsets
+	}
+}
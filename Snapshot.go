@@ -0,0 +1,353 @@
+// Snapshot.go
+// Description: Copy-on-write snapshots of the HTDB library
+// Freezes the files of every schema under mainPath/.snapshots for consistent backups and long analytics runs
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotsDir         = ".snapshots"    // Directory of the snapshots in the main path
+	snapshotManifestName = "manifest.json" // Written last, a snapshot without one is incomplete
+)
+
+// SnapshotInfo describes a snapshot, it is stored as its manifest
+type SnapshotInfo struct {
+	Name      string              `json:"name"`
+	CreatedAt time.Time           `json:"created_at"`
+	Files     []SnapshotFileEntry `json:"files"`
+}
+
+// SnapshotFileEntry describes a single file of a snapshot
+type SnapshotFileEntry struct {
+	Path string `json:"path"` // Relative to the snapshot, with forward slashes
+	Size int64  `json:"size"` // Bytes when the snapshot was taken
+}
+
+// linkStorage is a storage that can hard link files, snapshots of it share
+// the files with the database instead of copying them
+type linkStorage interface {
+	Link(oldPath, newPath string) error
+}
+
+// CreateSnapshot freezes the current state of every schema in the main path
+// under mainPath/.snapshots/name. On storages that support hard links the
+// files are linked while the read lock of every table is held, which pauses
+// commits only for a moment. Other storages copy the files from handles opened
+// under the same locks, writers are not blocked while copying. Table files are
+// only ever replaced by renames, so compactions and commits leave the linked
+// files of a snapshot untouched. Attached schemas are not part of snapshots.
+func (db *HTDB) CreateSnapshot(name string) (*SnapshotInfo, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if !validSnapshotName(name) {
+		return nil, NewResponse(StatusInvalidName, "Can't name a snapshot \""+name+"\"")
+	}
+
+	store := db.storage()
+	snapshotPath := db.snapshotPath(name)
+	if _, err := store.Stat(snapshotPath); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("snapshot '%s': %w", name, ErrAlreadyExists)
+	}
+	if _, err := store.Stat(filepath.Join(db.mainPath, snapshotsDir)); os.IsNotExist(err) {
+		err = store.Mkdir(filepath.Join(db.mainPath, snapshotsDir), db.dirMode())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+		}
+	}
+	err := store.Mkdir(snapshotPath, db.dirMode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot '%s': %v", name, err)
+	}
+
+	info := &SnapshotInfo{Name: name, CreatedAt: time.Now().UTC()}
+	if linker, canLink := db.store.(linkStorage); canLink {
+		info.Files, err = db.linkSnapshot(linker, snapshotPath)
+	} else {
+		info.Files, err = db.copySnapshot(snapshotPath)
+	}
+	if err == nil {
+		err = db.writeSnapshotManifest(snapshotPath, info)
+	}
+	if err != nil {
+		removeTree(store, snapshotPath)
+		return nil, fmt.Errorf("failed to create snapshot '%s': %w", name, err)
+	}
+
+	db.log(slog.LevelInfo, "snapshot created", "snapshot", name, "files", len(info.Files))
+	return info, nil
+}
+
+// linkSnapshot hard links every file of every schema into the snapshot
+func (db *HTDB) linkSnapshot(linker linkStorage, snapshotPath string) ([]SnapshotFileEntry, error) {
+	paths, locks, err := db.schemaFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lock := range locks {
+		lock.RLock()
+	}
+	defer func() {
+		for _, lock := range locks {
+			lock.RUnlock()
+		}
+	}()
+
+	store := db.storage()
+	var files []SnapshotFileEntry
+	for _, path := range paths {
+		relPath, _ := filepath.Rel(db.mainPath, path)
+		target := filepath.Join(snapshotPath, relPath)
+		relPath = filepath.ToSlash(relPath)
+		err = makeSnapshotDir(store, filepath.Dir(target), db.dirMode())
+		if err != nil {
+			return nil, err
+		}
+
+		err = linker.Link(path, target)
+		if os.IsNotExist(err) {
+			continue // Removed since the directory was listed
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to link '%s': %v", relPath, err)
+		}
+		stat, err := store.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, SnapshotFileEntry{Path: relPath, Size: stat.Size()})
+	}
+	return files, nil
+}
+
+// copySnapshot copies every file of every schema into the snapshot
+func (db *HTDB) copySnapshot(snapshotPath string) ([]SnapshotFileEntry, error) {
+	sources, err := db.snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range sources {
+			f.file.Close()
+		}
+	}()
+
+	store := db.storage()
+	var files []SnapshotFileEntry
+	for _, f := range sources {
+		target := filepath.Join(snapshotPath, filepath.FromSlash(f.path))
+		err = makeSnapshotDir(store, filepath.Dir(target), db.dirMode())
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := store.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy '%s': %v", f.path, err)
+		}
+		_, err = io.Copy(file, io.NewSectionReader(f.file, 0, f.size))
+		if err == nil && db.GetDurability() >= DurabilityFlush {
+			err = file.Sync()
+		}
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy '%s': %v", f.path, err)
+		}
+		files = append(files, SnapshotFileEntry{Path: f.path, Size: f.size})
+	}
+	return files, nil
+}
+
+// makeSnapshotDir creates a schema directory of a snapshot if it is missing
+func makeSnapshotDir(store Storage, dir string, perm os.FileMode) error {
+	if _, err := store.Stat(dir); os.IsNotExist(err) {
+		err = store.Mkdir(dir, perm)
+		if err != nil {
+			return fmt.Errorf("failed to create '%s': %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// writeSnapshotManifest completes a snapshot by writing its manifest
+func (db *HTDB) writeSnapshotManifest(snapshotPath string, info *SnapshotInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot manifest: %v", err)
+	}
+
+	store := db.storage()
+	err = writeFile(store, filepath.Join(snapshotPath, snapshotManifestName), data, db.fileMode())
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot manifest: %v", err)
+	}
+	if db.GetDurability() >= DurabilityFsync {
+		return store.SyncDir(snapshotPath)
+	}
+	return nil
+}
+
+// ListSnapshots returns the complete snapshots of the database, sorted by name
+func (db *HTDB) ListSnapshots() ([]SnapshotInfo, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	entries, err := db.storage().ReadDir(filepath.Join(db.mainPath, snapshotsDir))
+	if os.IsNotExist(err) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot directory: %v", err)
+	}
+
+	snapshots := []SnapshotInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := db.readSnapshotManifest(entry.Name())
+		if errors.Is(err, ErrSnapshotNotFound) {
+			continue // Interrupted while it was created
+		}
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, *info)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots, nil
+}
+
+// readSnapshotManifest reads the manifest of a snapshot
+func (db *HTDB) readSnapshotManifest(name string) (*SnapshotInfo, error) {
+	if !validSnapshotName(name) {
+		return nil, fmt.Errorf("snapshot '%s': %w", name, ErrSnapshotNotFound)
+	}
+	data, err := readFile(db.storage(), filepath.Join(db.snapshotPath(name), snapshotManifestName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("snapshot '%s': %w", name, ErrSnapshotNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot manifest: %v", err)
+	}
+
+	info := &SnapshotInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest of snapshot '%s': %v", ErrCorrupt, name, err)
+	}
+	return info, nil
+}
+
+// DropSnapshot removes a snapshot, incomplete ones included. Views opened
+// with OpenSnapshot keep reading the files they already opened.
+func (db *HTDB) DropSnapshot(name string) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if !validSnapshotName(name) {
+		return fmt.Errorf("snapshot '%s': %w", name, ErrSnapshotNotFound)
+	}
+
+	snapshotPath := db.snapshotPath(name)
+	if _, err := db.storage().Stat(snapshotPath); os.IsNotExist(err) {
+		return fmt.Errorf("snapshot '%s': %w", name, ErrSnapshotNotFound)
+	}
+	err := removeTree(db.storage(), snapshotPath)
+	if err != nil {
+		return fmt.Errorf("failed to drop snapshot '%s': %v", name, err)
+	}
+
+	db.log(slog.LevelInfo, "snapshot dropped", "snapshot", name)
+	return nil
+}
+
+// OpenSnapshot returns a read-only database over a snapshot. Every write
+// fails with ErrReadOnly. Close the view when done, the database itself stays
+// open.
+func (db *HTDB) OpenSnapshot(name string) (*HTDB, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if _, err := db.readSnapshotManifest(name); err != nil {
+		return nil, err
+	}
+
+	view := NewHTDBWithStorage(db.snapshotPath(name), readOnlyStorage{Storage: db.store})
+	view.SetDurability(db.GetDurability())
+	view.config.LayoutVersion = db.LayoutVersion()
+	view.logger.Store(db.logger.Load())
+	return view, nil
+}
+
+// snapshotPath returns the directory of a snapshot
+func (db *HTDB) snapshotPath(name string) string {
+	return filepath.Join(db.mainPath, snapshotsDir, name)
+}
+
+// validSnapshotName reports whether name can be used as the directory of a snapshot
+func validSnapshotName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\:`)
+}
+
+// removeTree removes a directory and everything in it
+func removeTree(store Storage, path string) error {
+	entries, err := store.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			err = removeTree(store, filepath.Join(path, entry.Name()))
+		} else {
+			err = store.Remove(filepath.Join(path, entry.Name()))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return store.Remove(path)
+}
+
+// readOnlyStorage rejects every write, it serves the views of OpenSnapshot
+type readOnlyStorage struct {
+	Storage
+}
+
+func (s readOnlyStorage) OpenFile(name string, flag int, perm fs.FileMode) (StorageFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, storagePathError("open", name, ErrReadOnly)
+	}
+	return s.Storage.OpenFile(name, flag, perm)
+}
+
+func (readOnlyStorage) Mkdir(name string, perm fs.FileMode) error {
+	return storagePathError("mkdir", name, ErrReadOnly)
+}
+
+func (readOnlyStorage) Remove(name string) error {
+	return storagePathError("remove", name, ErrReadOnly)
+}
+
+func (readOnlyStorage) Rename(oldPath, newPath string) error {
+	return storagePathError("rename", newPath, ErrReadOnly)
+}
@@ -0,0 +1,291 @@
+// StagingSpill.go
+// Description: Spilling of staged records for the HTDB library
+// Moves the staged records of large transactions out of memory into staging files until commit
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// stagingEnding is the ending of the staging files of transactions. Not
+// fileEnding, so a staging file is never taken for a table.
+const stagingEnding = ".staging"
+
+// A record in a staging file is the id of the version it replaces, the
+// serialized record, for every ref field the length and bytes of the value to
+// write at commit or noRefValue and then the length and bytes of the version
+// the replaced record must have, see StageUpdateIfVersion
+const (
+	spillPrefixSize = 8
+	spillRefLenSize = 4
+	noRefValue      = ^uint32(0)
+)
+
+// StagingStats describes the staged records of a transaction
+type StagingStats struct {
+	Limit      int   // Staged records per table kept in memory, 0 without a limit, see SetStagingLimit
+	InMemory   int   // Staged records held in memory
+	Spilled    int   // Staged records moved into staging files
+	SpillBytes int64 // Size of the staging files
+	SpillFiles int   // Tables whose records were spilled, one staging file each
+}
+
+// stagingSpill is the staging file of a table in a transaction
+type stagingSpill struct {
+	table   *Table
+	path    string
+	file    StorageFile
+	records int
+	bytes   int64
+}
+
+// SetStagingLimit sets how many staged records of a table a transaction keeps
+// in memory and writes it to the config file. Once a table reaches the limit
+// its staged records are written with their ref values to a staging file next
+// to the table, in the table's record format, and read back by Commit.
+// Rollback removes the file. Zero keeps every staged record in memory.
+func (db *HTDB) SetStagingLimit(records int) error {
+	config := db.Config()
+	config.StagingLimit = records
+	return db.SetConfig(config)
+}
+
+// stagingLimit returns the staged records per table kept in memory, 0 without a limit
+func (db *HTDB) stagingLimit() int {
+	db.configMu.Lock()
+	defer db.configMu.Unlock()
+
+	return db.config.StagingLimit
+}
+
+// stagingPath returns the path of the staging file of the table in a transaction
+func (t *Table) stagingPath(transactionID uint64) string {
+	return filepath.Join(t.SchemaPath, t.TableName+".tx"+strconv.FormatUint(transactionID, 10)+stagingEnding)
+}
+
+// StagingStats returns the staging limit of the transaction and how many of
+// its staged records are held in memory and in staging files
+func (tx *Transaction) StagingStats() StagingStats {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	stats := StagingStats{Limit: tx.db.stagingLimit(), SpillFiles: len(tx.spills)}
+	for _, records := range tx.StagedRecords {
+		stats.InMemory += len(records)
+	}
+	for _, spill := range tx.spills {
+		stats.Spilled += spill.records
+		stats.SpillBytes += spill.bytes
+	}
+	return stats
+}
+
+// spillLocked moves the staged records of a table into its staging file once
+// they reach the staging limit. The caller must hold mu.
+func (tx *Transaction) spillLocked(table *Table, name string) error {
+	limit := tx.db.stagingLimit()
+	records := tx.StagedRecords[name]
+	if limit <= 0 || len(records) < limit {
+		return nil
+	}
+
+	spill := tx.spills[name]
+	if spill == nil {
+		path := table.stagingPath(tx.ID)
+		file, err := createFile(table.storage(), path, tx.db.fileMode())
+		if err != nil {
+			return fmt.Errorf("failed to create staging file: %v", err)
+		}
+		spill = &stagingSpill{table: table, path: path, file: file}
+		if tx.spills == nil {
+			tx.spills = make(map[string]*stagingSpill)
+		}
+		tx.spills[name] = spill
+	}
+
+	written, err := spill.write(records, table)
+	if err != nil {
+		// Whatever was written of the records is cut off again, they stay in memory
+		spill.file.Truncate(spill.bytes)
+		spill.file.Seek(spill.bytes, io.SeekStart)
+		return err
+	}
+
+	spill.records += len(records)
+	spill.bytes += written
+	tx.StagedRecords[name] = []*Record{}
+
+	tx.db.log(slog.LevelDebug, "staged records spilled",
+		"transaction", tx.ID, "schema", table.schemaName(), "table", table.TableName,
+		"records", len(records), "spilled", spill.records)
+	return nil
+}
+
+// write appends records to the staging file and returns the bytes written
+func (s *stagingSpill) write(records []*Record, table *Table) (int64, error) {
+	layout := table.Layout()
+	writer := bufio.NewWriter(s.file)
+	var buf []byte
+	var written int64
+	for _, record := range records {
+		buf = binary.LittleEndian.AppendUint64(buf[:0], uint64(record.previousID))
+		data, err := record.serializeLayout(layout)
+		if err != nil {
+			return 0, fmt.Errorf("failed to serialize record: %w", err)
+		}
+		buf = append(buf, data...)
+
+		for _, field := range table.Fields {
+			if field.Type != "ref" {
+				continue
+			}
+			value, ok := record.FieldsData[field.Name].(string)
+			if !record.pendingRefs[field.Name] || record.FieldsMeta[field.Name].IsNull || !ok {
+				buf = binary.LittleEndian.AppendUint32(buf, noRefValue)
+				continue
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+			buf = append(buf, value...)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(record.expectedVersion)))
+		buf = append(buf, record.expectedVersion...)
+
+		_, err = writer.Write(buf)
+		if err != nil {
+			return 0, fmt.Errorf("failed to write staging file: %v", err)
+		}
+		written += int64(len(buf))
+	}
+	err := writer.Flush()
+	if err != nil {
+		return 0, fmt.Errorf("failed to write staging file: %v", err)
+	}
+	return written, nil
+}
+
+// loadSpilledLocked reads the spilled records back in front of the staged
+// records of their tables and removes the staging files. The caller must hold mu.
+func (tx *Transaction) loadSpilledLocked() error {
+	for name, spill := range tx.spills {
+		records, err := spill.read()
+		if err != nil {
+			return fmt.Errorf("failed to read staging file of table '%s': %w", spill.table.TableName, err)
+		}
+		tx.StagedRecords[name] = append(records, tx.StagedRecords[name]...)
+		spill.remove()
+		delete(tx.spills, name)
+	}
+	return nil
+}
+
+// removeSpillsLocked removes the staging files of the transaction. The caller must hold mu.
+func (tx *Transaction) removeSpillsLocked() {
+	for name, spill := range tx.spills {
+		spill.remove()
+		delete(tx.spills, name)
+	}
+}
+
+// read returns the records of the staging file as they were staged
+func (s *stagingSpill) read() ([]*Record, error) {
+	layout := s.table.Layout()
+	reader := bufio.NewReader(io.NewSectionReader(s.file, 0, s.bytes))
+
+	records := make([]*Record, 0, s.records)
+	data := make([]byte, spillPrefixSize+layout.Size)
+	var length [spillRefLenSize]byte
+	for i := 0; i < s.records; i++ {
+		_, err := io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		record, err := deserializeRecordLayout(data[spillPrefixSize:], layout)
+		if err != nil {
+			return nil, err
+		}
+		record.previousID = int64(binary.LittleEndian.Uint64(data[:spillPrefixSize]))
+
+		for _, field := range s.table.Fields {
+			if field.Type != "ref" {
+				continue
+			}
+			_, err = io.ReadFull(reader, length[:])
+			if err != nil {
+				return nil, err
+			}
+			size := binary.LittleEndian.Uint32(length[:])
+			if size == noRefValue {
+				continue
+			}
+			value := make([]byte, size)
+			_, err = io.ReadFull(reader, value)
+			if err != nil {
+				return nil, err
+			}
+			record.FieldsData[field.Name] = string(value)
+			record.setRefPending(field.Name)
+		}
+
+		_, err = io.ReadFull(reader, length[:])
+		if err != nil {
+			return nil, err
+		}
+		version := make([]byte, binary.LittleEndian.Uint32(length[:]))
+		_, err = io.ReadFull(reader, version)
+		if err != nil {
+			return nil, err
+		}
+		record.expectedVersion = string(version)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// remove closes and removes the staging file
+func (s *stagingSpill) remove() {
+	s.file.Close()
+	s.table.storage().Remove(s.path)
+}
+
+// removeStagingFiles removes the staging files a crash left in a schema
+// directory, those of the active transactions stay
+func (db *HTDB) removeStagingFiles(schemaPath string) error {
+	entries, err := db.storage().ReadDir(schemaPath)
+	if err != nil {
+		return fmt.Errorf("failed to read schema directory: %v", err)
+	}
+
+	tm := db.tableManager
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, stagingEnding) {
+			continue
+		}
+		_, id, _ := strings.Cut(strings.TrimSuffix(name, stagingEnding), ".tx")
+		if id, err := strconv.ParseUint(id, 10, 64); err == nil {
+			tm.transactionsMu.Lock()
+			_, active := tm.transactions[id]
+			tm.transactionsMu.Unlock()
+			if active {
+				continue
+			}
+		}
+
+		err = db.storage().Remove(filepath.Join(schemaPath, name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove staging file: %v", err)
+		}
+		db.log(slog.LevelInfo, "leftover staging file removed", "file", name)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Stats.go
+// Description: Database-wide statistics of the HTDB library
+// Sizes, record counts and runtime state for health checks and admin pages
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot of a database returned by HTDB.Stats
+type Stats struct {
+	Time               time.Time      `json:"time"`
+	Schemas            []SchemaStats  `json:"schemas"`
+	Records            int            `json:"records"`    // Every version in every table file
+	SizeBytes          int64          `json:"size_bytes"` // Table and ref files
+	ActiveTransactions int            `json:"active_transactions"`
+	RecordCache        CacheStats     `json:"record_cache"`
+	OpenFiles          int            `json:"open_files"` // Table file handles kept open, see SetMaxOpenFiles
+	CleanupRunning     bool           `json:"cleanup_running"`
+	LastCleanup        *CleanupStats  `json:"last_cleanup,omitempty"`  // Nil before the first cleanup pass
+	LastRecovery       *RecoveryStats `json:"last_recovery,omitempty"` // Nil before the first Recover
+}
+
+// SchemaStats holds the stats of a schema and its tables
+type SchemaStats struct {
+	Name       string       `json:"name"`
+	Tables     []TableStats `json:"tables"`
+	Records    int          `json:"records"`
+	SizeBytes  int64        `json:"size_bytes"`
+	QuotaBytes int64        `json:"quota_bytes,omitempty"` // Quota of the schema, see SetQuota
+}
+
+// TableStats holds the sizes and record counts of a table
+type TableStats struct {
+	Name           string  `json:"name"`
+	Records        int     `json:"records"`               // Every version in the table file
+	CurrentRecords int     `json:"current_records"`       // Versions a query can return
+	DeadRecords    int     `json:"dead_records"`          // Outdated and deleted versions a cleanup pass would drop
+	DeadRatio      float64 `json:"dead_ratio"`            // DeadRecords / Records, 0 for an empty table, see SetCompactionThreshold
+	FileBytes      int64   `json:"file_bytes"`            // Size of the table file
+	RefBytes       int64   `json:"ref_bytes"`             // Size of the ref files
+	QuotaBytes     int64   `json:"quota_bytes,omitempty"` // Quota of the table, see SetQuota
+
+	Analysis *TableAnalysis `json:"analysis,omitempty"` // Value statistics, nil before AnalyzeTable
+}
+
+// CacheStats holds the occupancy of the record cache
+type CacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Records    int    `json:"records"`
+	Bytes      int64  `json:"bytes"`
+	MaxRecords int    `json:"max_records"` // 0 if unlimited or disabled
+	MaxBytes   int64  `json:"max_bytes"`
+}
+
+// CleanupStats describes the last cleanup pass
+type CleanupStats struct {
+	Time            time.Time `json:"time"` // When the pass ended
+	TablesCleaned   int       `json:"tables_cleaned"`
+	RecordsRemoved  int       `json:"records_removed"`
+	RecordsArchived int       `json:"records_archived"`
+	BytesReclaimed  int64     `json:"bytes_reclaimed"`
+	Quarantined     int       `json:"quarantined"`
+	Errors          int       `json:"errors"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// RecoveryStats describes the last Recover, also run by Open
+type RecoveryStats struct {
+	Time            time.Time `json:"time"`
+	TruncatedTables int       `json:"truncated_tables"`
+	TruncatedBytes  int64     `json:"truncated_bytes"`
+}
+
+// tableStatsEntry is a cached TableStats, valid while the table file is unchanged
+type tableStatsEntry struct {
+	size    int64
+	modTime time.Time
+	stats   TableStats
+}
+
+// tableStatsCache keeps the record counts of tables between Stats calls
+type tableStatsCache struct {
+	entries map[string]tableStatsEntry
+	mu      sync.Mutex
+}
+
+// Stats returns sizes, record counts and runtime state of the database. Record
+// counts of tables whose file didn't change since the last call are reused, so
+// it is cheap enough to poll.
+func (db *HTDB) Stats() (*Stats, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{Time: time.Now().UTC(), Schemas: []SchemaStats{}}
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range schemas {
+		schemaStats, err := db.schemaStats(schema)
+		if err != nil {
+			return nil, err
+		}
+		stats.Schemas = append(stats.Schemas, schemaStats)
+		stats.Records += schemaStats.Records
+		stats.SizeBytes += schemaStats.SizeBytes
+	}
+
+	tm := db.tableManager
+	tm.transactionsMu.Lock()
+	stats.ActiveTransactions = len(tm.transactions)
+	tm.transactionsMu.Unlock()
+
+	cache := tm.recordCache.snapshot()
+	options := tm.recordCache.limits()
+	stats.RecordCache = CacheStats{
+		Hits:       cache.Hits,
+		Misses:     cache.Misses,
+		Records:    cache.Records,
+		Bytes:      cache.Bytes,
+		MaxRecords: options.MaxRecords,
+		MaxBytes:   options.MaxBytes,
+	}
+	stats.OpenFiles = db.files.openCount()
+	stats.CleanupRunning = tm.cleanupWorker.Load() != nil
+	stats.LastCleanup = db.lastCleanup.Load()
+	stats.LastRecovery = db.lastRecovery.Load()
+	return stats, nil
+}
+
+// schemaStats returns the stats of a schema and its tables
+func (db *HTDB) schemaStats(schema string) (SchemaStats, error) {
+	stats := SchemaStats{Name: schema, Tables: []TableStats{}}
+	_, stats.QuotaBytes = db.quotas(schema, "")
+	tables, err := db.TableNames(schema)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, tableName := range tables {
+		table, err := db.getTable(schema + ":" + tableName)
+		if err != nil {
+			return stats, err
+		}
+		tableStats, err := db.tableStats(table)
+		if err != nil {
+			return stats, err
+		}
+		tableStats.QuotaBytes, _ = db.quotas(schema, tableName)
+		stats.Tables = append(stats.Tables, tableStats)
+		stats.Records += tableStats.Records
+		stats.SizeBytes += tableStats.FileBytes + tableStats.RefBytes
+	}
+	return stats, nil
+}
+
+// tableStats returns the stats of a table, scanning the file only if it
+// changed since the cached stats were taken
+func (db *HTDB) tableStats(table *Table) (TableStats, error) {
+	store := db.storage()
+	stats := TableStats{Name: table.TableName}
+
+	for _, field := range table.Fields {
+		if field.Type != "ref" {
+			continue
+		}
+		info, err := store.Stat(table.RefFilePath(field.Name))
+		if err == nil {
+			stats.RefBytes += info.Size()
+		} else if !os.IsNotExist(err) {
+			return stats, err
+		}
+	}
+
+	analysis, err := table.readAnalysis()
+	if err != nil {
+		return stats, err
+	}
+	stats.Analysis = analysis
+
+	tablePath := table.filePath()
+	info, err := store.Stat(tablePath)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	db.statsCache.mu.Lock()
+	entry, cached := db.statsCache.entries[tablePath]
+	db.statsCache.mu.Unlock()
+	if cached && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		entry.stats.RefBytes = stats.RefBytes
+		entry.stats.Analysis = stats.Analysis
+		return entry.stats, nil
+	}
+
+	stats.FileBytes = info.Size()
+	err = table.streamRawRecords(func(data []byte) error {
+		stats.Records++
+		if isLiveRecord(data) {
+			stats.CurrentRecords++
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.DeadRecords = stats.Records - stats.CurrentRecords
+	stats.DeadRatio = deadRatio(stats.DeadRecords, stats.Records)
+
+	db.statsCache.mu.Lock()
+	db.statsCache.entries[tablePath] = tableStatsEntry{size: info.Size(), modTime: info.ModTime(), stats: stats}
+	db.statsCache.mu.Unlock()
+	return stats, nil
+}
+
+// newCleanupStats converts the report of a finished cleanup pass
+func newCleanupStats(report CleanupReport) *CleanupStats {
+	return &CleanupStats{
+		Time:            time.Now().UTC(),
+		TablesCleaned:   report.TablesCleaned,
+		RecordsRemoved:  report.RecordsRemoved,
+		RecordsArchived: report.RecordsArchived,
+		BytesReclaimed:  report.BytesReclaimed,
+		Quarantined:     report.Quarantined,
+		Errors:          report.Errors,
+		DurationSeconds: report.Duration.Seconds(),
+	}
+}
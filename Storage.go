@@ -0,0 +1,195 @@
+// Storage.go
+// Description: Storage backends for the HTDB library
+// Every file the database reads or writes goes through a storage backend
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"strconv"
+)
+
+// StorageFile is an open file of a storage backend. *os.File implements it.
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// Storage is the file system the database keeps its files in. Paths are
+// built from the main path with filepath.Join, so they use the separator of
+// the platform; backends that are not the local disk convert them with
+// filepath.ToSlash. Errors for missing files must
+// satisfy os.IsNotExist, the flags of OpenFile are those of os.OpenFile.
+type Storage interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (StorageFile, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldPath, newPath string) error
+	SyncDir(name string) error // Makes renames and creations in the directory durable
+}
+
+// storage returns the storage backend of the database, the local disk for a
+// nil database. Every operation of a closed database's storage fails with
+// ErrClosed, writes into read-only attached schemas fail with ErrReadOnly.
+func (db *HTDB) storage() Storage {
+	if db == nil || db.store == nil {
+		return OSStorage{}
+	}
+	if db.state.Load() == dbClosed {
+		return closedStorage{}
+	}
+	if current := db.attached.Load(); current != nil && len(current.readOnly) > 0 {
+		return readOnlySchemaStorage{Storage: db.store, db: db}
+	}
+	return db.store
+}
+
+// storage returns the storage backend of the table's database
+func (t *Table) storage() Storage {
+	return t.db.storage()
+}
+
+// openFile opens a file of a storage backend for reading
+func openFile(store Storage, name string) (StorageFile, error) {
+	return store.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// createFile creates or truncates a file of a storage backend, a new file gets perm
+func createFile(store Storage, name string, perm fs.FileMode) (StorageFile, error) {
+	return store.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+// readFile reads a whole file of a storage backend
+func readFile(store Storage, name string) ([]byte, error) {
+	file, err := openFile(store, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// writeFile writes a whole file of a storage backend, replacing its contents
+func writeFile(store Storage, name string, data []byte, perm fs.FileMode) error {
+	file, err := store.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// createTempFile creates a new temporary file next to path, named after it
+// with a random part and suffix. Every writer gets a file of its own, so
+// writers racing to replace the same file never write into each other's.
+// Recovery finds leftovers by their suffix.
+func createTempFile(store Storage, path, suffix string, perm fs.FileMode) (StorageFile, string, error) {
+	for attempt := 0; ; attempt++ {
+		name := path + "." + strconv.FormatUint(rand.Uint64(), 36) + suffix
+		file, err := store.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && attempt < 10 {
+			continue
+		}
+		return file, name, err
+	}
+}
+
+// writeTempFile writes data to a new temporary file for path, see
+// createTempFile, and returns its name
+func writeTempFile(store Storage, path, suffix string, data []byte, perm fs.FileMode) (string, error) {
+	file, name, err := createTempFile(store, path, suffix, perm)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(data)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		store.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// storagePathError returns the error of a storage operation on name
+func storagePathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// OSStorage keeps the files on the local disk, it is the default backend
+type OSStorage struct{}
+
+func (OSStorage) OpenFile(name string, flag int, perm fs.FileMode) (StorageFile, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // Avoid a non-nil interface holding a nil *os.File
+	}
+	return file, nil
+}
+
+func (OSStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSStorage) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (OSStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSStorage) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+// Chmod changes the mode of a file, see ApplyPermissions
+func (OSStorage) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Link hard links newPath to the file at oldPath, see CreateSnapshot
+func (OSStorage) Link(oldPath, newPath string) error {
+	return os.Link(oldPath, newPath)
+}
+
+func (OSStorage) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer dir.Close()
+
+	err = dir.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+// Summary.go
+// Description: Record count and id range of a table for the HTDB library
+// Kept next to the table file so counts and the latest record don't need a scan
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// tableSummary holds the number and id range of a table's current records.
+// It is written on commit and compaction and rebuilt by a scan once the
+// table file no longer has the size and modification time it describes.
+type tableSummary struct {
+	TableSize    int64     `json:"table_size"` // Size and modification time of the table file the summary describes
+	TableModTime time.Time `json:"table_mod_time"`
+	Current      int       `json:"current"` // Current records that are not deleted
+	MinID        int64     `json:"min_id"`  // 0 without current records
+	MaxID        int64     `json:"max_id"`
+}
+
+// describes reports whether the summary was taken of the table file with info, nil if it doesn't exist
+func (s *tableSummary) describes(info fs.FileInfo) bool {
+	if info == nil {
+		return s.TableSize == 0 && s.TableModTime.IsZero()
+	}
+	return s.TableSize == info.Size() && s.TableModTime.Equal(info.ModTime())
+}
+
+// add counts a current record
+func (s *tableSummary) add(id int64) {
+	if s.Current == 0 || id < s.MinID {
+		s.MinID = id
+	}
+	if s.Current == 0 || id > s.MaxID {
+		s.MaxID = id
+	}
+	s.Current++
+}
+
+// Count returns the number of current records of the table
+func (t *Table) Count() (int, error) {
+	summary, err := t.summary()
+	if err != nil {
+		return 0, err
+	}
+	return summary.Current, nil
+}
+
+// MinID returns the smallest id of the table's current records, 0 if it has none
+func (t *Table) MinID() (int64, error) {
+	summary, err := t.summary()
+	if err != nil {
+		return 0, err
+	}
+	return summary.MinID, nil
+}
+
+// MaxID returns the largest id of the table's current records, that of the
+// latest inserted or updated one, 0 if it has none
+func (t *Table) MaxID() (int64, error) {
+	summary, err := t.summary()
+	if err != nil {
+		return 0, err
+	}
+	return summary.MaxID, nil
+}
+
+// summary returns the stored summary of the table, rebuilding it if it is
+// missing or stale
+func (t *Table) summary() (*tableSummary, error) {
+	lock := t.lock()
+	lock.RLock()
+	defer lock.RUnlock()
+
+	store := t.storage()
+	info, err := t.fileInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readFile(store, t.summaryPath())
+	if err == nil {
+		var summary tableSummary
+		if json.Unmarshal(data, &summary) == nil && summary.describes(info) {
+			return &summary, nil
+		}
+	}
+
+	summary := &tableSummary{}
+	err = t.scanRawRecords(func(data []byte) error {
+		if isLiveRecord(data) {
+			summary.add(recordID(data))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Readers may rebuild it at the same time, the summary only saves a scan
+	err = t.writeSummary(summary)
+	if err != nil {
+		t.db.log(slog.LevelDebug, "failed to write table summary",
+			"schema", t.schemaName(), "table", t.TableName, "error", err)
+	}
+	return summary, nil
+}
+
+// summarize returns the summary of the records of a table file
+func (t *Table) summarize(records []*Record) *tableSummary {
+	summary := &tableSummary{}
+	for _, record := range records {
+		if record.Metadata.IsCurrent && !record.Metadata.IsDeleted {
+			summary.add(record.ID)
+		}
+	}
+	return summary
+}
+
+// fileInfo returns the info of the table file, nil if it doesn't exist
+func (t *Table) fileInfo() (fs.FileInfo, error) {
+	info, err := t.storage().Stat(t.filePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file stats: %w", err)
+	}
+	return info, nil
+}
+
+// writeSummary replaces the stored summary of the table through a temporary
+// file. It describes the table file as it is now, the caller must hold the
+// table's lock.
+func (t *Table) writeSummary(summary *tableSummary) error {
+	info, err := t.fileInfo()
+	if err != nil {
+		return err
+	}
+	summary.TableSize, summary.TableModTime = 0, time.Time{}
+	if info != nil {
+		summary.TableSize, summary.TableModTime = info.Size(), info.ModTime()
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to encode summary of table '%s': %v", t.TableName, err)
+	}
+
+	store := t.storage()
+	path := t.summaryPath()
+	err = writeFile(store, path+".temp", data, t.db.fileMode())
+	if err == nil {
+		err = store.Rename(path+".temp", path)
+	}
+	if err != nil {
+		store.Remove(path + ".temp")
+		return fmt.Errorf("failed to write summary of table '%s': %v", t.TableName, err)
+	}
+	return nil
+}
+
+// Count returns the number of records the query matches, up to its limit.
+// Without conditions the table's stored record count is used.
+func (q *Query) Count() (int, error) {
+	if len(q.conditions) == 0 && !q.archived {
+		count, err := q.table.Count()
+		if err != nil {
+			return 0, err
+		}
+		if q.limitCount > 0 && count > q.limitCount {
+			count = q.limitCount
+		}
+		return count, nil
+	}
+
+	records, err := q.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// First returns the first record the query matches, nil if there is none.
+// The latest or oldest record of a table, Sort("id", false).First() and
+// Sort("id", true).First() without conditions, is looked up by its id.
+func (q *Query) First() (*Record, error) {
+	if len(q.conditions) == 0 && q.sortField == "id" && !q.archived && q.db.tableManager != nil {
+		record, err := q.firstByID()
+		if record != nil || err != nil {
+			return q.redact(record), err
+		}
+	}
+
+	first := *q
+	first.limitCount = 1
+	records, err := first.GetAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// firstByID returns the record with the smallest or largest id of the
+// table, nil if the table is empty or the record couldn't be looked up
+func (q *Query) firstByID() (*Record, error) {
+	id, err := q.table.MinID()
+	if !q.sortAscending {
+		id, err = q.table.MaxID()
+	}
+	if err != nil || id == 0 {
+		return nil, err
+	}
+	return q.db.tableManager.lookupRecord(q.table, id)
+}
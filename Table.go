@@ -5,17 +5,30 @@
 package hartoDb_go
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 )
 
 type Table struct {
 	TableName  string  `json:"tableName"`
 	Fields     []Field `json:"fields"`
 	SchemaPath string  `json:"schemaPath"`
+
+	FormatVersion    int               `json:"formatVersion,omitempty"`    // Layout version of the table file, see Migrate
+	BlockCompression *BlockCompression `json:"blockCompression,omitempty"` // Records stored in compressed blocks, see SetBlockCompression
+
+	db         *HTDB         // Owning database, nil for tables loaded without one
+	layout     *RecordLayout // Cached record layout, see Layout
+	schema     string        // Name of the schema if it differs from the directory, see AttachSchema
+	generation uint64        // Definition the table was loaded with, see ddlLocks
 }
 
 type Field struct {
@@ -23,6 +36,9 @@ type Field struct {
 	Type        FieldTypes   `json:"type"`
 	Length      uint         `json:"length,omitempty"`
 	Constraints []Constraint `json:"constraints"`
+	Compression Compression  `json:"compression,omitempty"` // Gzip for ref fields, packed for string fields
+	Index       IndexKind    `json:"index,omitempty"`       // Only for string and ref fields, see CreateIndex
+	Collation   Collation    `json:"collation,omitempty"`   // Default of queries, only for string and ref fields, see Collate
 }
 
 type FieldTypes string
@@ -42,119 +58,249 @@ const (
 	PrimaryKey Constraint = "primary_key"
 	NotNull    Constraint = "not_null"
 	Unique     Constraint = "unique"
+	Sensitive  Constraint = "sensitive" // Withheld from query results, see Query.RevealSensitive
 )
 
 func NewTable(name string, fields []Field) Table {
 	return Table{
-		TableName: name,
-		Fields:    fields,
+		TableName:     name,
+		Fields:        fields,
+		FormatVersion: layoutVersion,
 	}
 }
 
-// Function to create a database table
-func (s *Schema) CreateTable(name string, fields []Field) Response {
+// schemaName returns the name of the schema the table belongs to
+func (t *Table) schemaName() string {
+	if t.schema != "" {
+		return t.schema
+	}
+	return filepath.Base(t.SchemaPath)
+}
+
+// qualifiedName returns the schema:table name of the table, which getTable resolves
+func (t *Table) qualifiedName() string {
+	return t.schemaName() + ":" + t.TableName
+}
+
+// Function to create a database table, see WithTemplate for the options
+func (s *Schema) CreateTable(name string, fields []Field, options ...TableOption) Response {
+	fields, err := s.templateFields(options, fields)
+	if err != nil {
+		var response Response
+		if errors.As(err, &response) {
+			return response
+		}
+		return NewResponse(StatusDbError, err.Error()).WithError(err)
+	}
+
 	// Prepend the timePKField to fields
 	fields = append([]Field{timePKField}, fields...)
 
+	// Check table name before it becomes part of a path
+	if len(name) == 0 {
+		return NewResponse(StatusInvalidName, "You have to give the table a name")
+	}
+
+	if !validName(name) {
+		return NewResponse(StatusInvalidName, "Can't name a Table \""+name+"\", use letters, digits, '_' and '-'")
+	}
+
+	if name == "index" {
+		return NewResponse(StatusInvalidName, "Can't name a Table \"index\", sowwy")
+	}
+
+	if err := validateFieldNames(fields); err != nil {
+		return NewResponse(StatusInvalidName, err.Error()).WithError(err)
+	}
+
 	// Set the path for the schema and table
-	var pathTable = s.schemaPath + "/" + name + fileEnding
-	var pathConf = s.schemaPath + "/" + name + ".conf" + fileEnding
+	var pathTable = tableFilePath(s.schemaPath, name)
+	var pathConf = tableConfPath(s.schemaPath, name)
+
+	newTable := Table{
+		TableName:     name,
+		Fields:        fields,
+		SchemaPath:    s.schemaPath,
+		FormatVersion: layoutVersion,
+		db:            s.db,
+	}
+
+	// Attached read-only schemas take no new tables
+	if err := newTable.checkWritable(); err != nil {
+		return NewResponse(StatusDbError, err.Error()).WithError(err)
+	}
+
+	store := s.db.storage()
 
 	// Check schema
-	if _, err := os.Stat(s.schemaPath); os.IsNotExist(err) {
+	if _, err := store.Stat(s.schemaPath); os.IsNotExist(err) {
 		// Return error if schema does not exist
 		var errorMessage = "Schema " + s.name + " does not exist"
-		return Response{time.Now().String(), 406, errorMessage}
+		return NewResponse(StatusSchenaDoesntExist, errorMessage)
 	}
 
 	// Check if table exists
-	if _, err := os.Stat(pathTable); !os.IsNotExist(err) {
+	if _, err := store.Stat(pathTable); !os.IsNotExist(err) {
 		// Return error if table file already exists
 		var errorMessage = "Table " + name + " already exists"
-		return Response{time.Now().String(), 406, errorMessage}
+		return NewResponse(StatusTableAlreadyExists, errorMessage)
 	}
 
-	// Check table name
-	if len(name) == 0 {
-		return Response{time.Now().String(), 406, "You have to give the table a name"}
+	// Validate field lengths
+	if err := validateFieldLengths(fields); err != nil {
+		return NewResponse(StatusValidationFailed, err.Error()).WithError(err)
 	}
 
-	if strings.HasPrefix(name, ".") {
-		return Response{time.Now().String(), 406, "Can't name a Table like that, sowwy"}
+	// Validate field compression
+	if err := validateFieldCompression(fields); err != nil {
+		return NewResponse(StatusValidationFailed, err.Error()).WithError(err)
 	}
 
-	if name == "index" {
-		return Response{time.Now().String(), 406, "Can't name a Table \"index\", sowwy"}
+	// Validate field indexes
+	if err := validateFieldIndexes(fields); err != nil {
+		return NewResponse(StatusValidationFailed, err.Error()).WithError(err)
+	}
+	if err := validateFieldCollations(fields); err != nil {
+		return NewResponse(StatusValidationFailed, err.Error()).WithError(err)
 	}
 
-	// Validate field lengths
-	if err := validateFieldLengths(fields); err != nil {
-		return Response{time.Now().String(), 406, err.Error()}
+	// Wait for commits on a dropped table of the same name
+	unlock, err := s.db.lockTableDDL(pathTable)
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error()).WithError(err)
 	}
+	defer unlock()
+
+	// Keep scans and writers away while the table files are created
+	lock := tableLock(pathTable)
+	lock.Lock()
+	defer lock.Unlock()
 
 	// Create the file for the table
-	file, err := os.Create(pathTable)
-	defer file.Close() // Close the file after function ends
+	file, err := createFile(store, pathTable, s.db.fileMode())
 	if err != nil {
 		// Return error if file creation fails
-		return Response{time.Now().String(), 500, "Failed to create table file: " + err.Error()}
+		return NewResponse(StatusDbError, "Failed to create table file: "+err.Error()).WithError(err)
 	}
+	defer file.Close() // Close the file after function ends
 
 	// Create a separate data file for each ref field
 	for _, field := range fields {
 		if field.Type == "ref" {
-			refFilePath := s.schemaPath + "/" + name + "." + field.Name + ".data" + fileEnding
-			refFile, err := os.Create(refFilePath)
+			refFile, err := createFile(store, newTable.RefFilePath(field.Name), s.db.fileMode())
 			if err != nil {
-				return Response{time.Now().String(), 500, "Failed to create ref field file: " + err.Error()}
+				return NewResponse(StatusDbError, "Failed to create ref field file: "+err.Error()).WithError(err)
 			}
 			refFile.Close()
 		}
 	}
 
-	confFile, err := os.Create(pathConf)
+	confFile, err := createFile(store, pathConf, s.db.fileMode())
 	if err != nil {
-		return Response{time.Now().String(), 500, fmt.Sprint(err)}
+		return NewResponse(StatusDbError, fmt.Sprint(err)).WithError(err)
 	}
 	defer confFile.Close()
 
-	// Create the configuration file
-	newTable := Table{
-		TableName:  name,
-		Fields:     fields,
-		SchemaPath: s.schemaPath,
-	}
-
 	// Serialize the table to JSON
 	tableJSON, err := json.MarshalIndent(newTable, "", "  ")
 	if err != nil {
-		return Response{time.Now().String(), 500, "Failed to serialize table to JSON: " + err.Error()}
+		return NewResponse(StatusDbError, "Failed to serialize table to JSON: "+err.Error()).WithError(err)
 	}
 
 	// Write JSON to configuration file
-	err = os.WriteFile(pathConf, tableJSON, 0644)
+	err = writeFile(store, pathConf, tableJSON, s.db.fileMode())
+	if err != nil {
+		return NewResponse(StatusDbError, "Failed to write JSON to configuration file: "+err.Error()).WithError(err)
+	}
+
+	err = newTable.writeLayoutHash(store)
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error()).WithError(err)
+	}
+
+	// Indexes of an empty table are empty
+	err = newTable.rebuildIndexes()
 	if err != nil {
-		return Response{time.Now().String(), 500, "Failed to write JSON to configuration file: " + err.Error()}
+		return NewResponse(StatusDbError, err.Error()).WithError(err)
 	}
 
 	// Log success message
-	return Response{time.Now().String(), 200, "Table created successfully"}
+	s.db.log(slog.LevelInfo, "table created", "schema", s.name, "table", name, "fields", len(fields))
+	return NewResponse(StatusOK, "Table created successfully")
 }
 
-func validateFieldLengths(fields []Field) error {
+// validateFieldNames checks that every field has a unique name that can be part
+// of a ref file name, see validName
+func validateFieldNames(fields []Field) error {
+	seen := make(map[string]bool, len(fields))
 	for _, f := range fields {
-		if f.Type == "ref" && f.Length != 128 {
-			return fmt.Errorf("field '%s' of type 'ref' must have a length of %d bytes", f.Name, 128)
+		if !validName(f.Name) {
+			return fmt.Errorf("can't name a field '%s', use letters, digits, '_' and '-'", f.Name)
 		}
-		if f.Type == "timeID" && f.Length != 8 {
-			return fmt.Errorf("field '%s' of type 'timeID' must have a length of 8 bytes", f.Name)
+		if seen[f.Name] {
+			return fmt.Errorf("field '%s' is defined more than once", f.Name)
 		}
+		seen[f.Name] = true
 	}
 	return nil
 }
 
+// Field lengths in bytes, see validateFieldLengths
+const (
+	maxStringLength = 1<<16 - 1
+	refFieldLength  = 128 // The offsets into the side file, padded
+)
+
+// validateFieldLengths checks the length of every field against its type and
+// reports every field out of bounds at once
+func validateFieldLengths(fields []Field) error {
+	var problems ValidationErrors
+	for _, f := range fields {
+		if message := fieldLengthProblem(f); message != "" {
+			problems = append(problems, &ValidationError{Field: f.Name, Constraint: CheckLength, Value: f.Length, Message: message})
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// fieldLengthProblem describes why the length of a field doesn't fit its type,
+// or returns "" if it does
+func fieldLengthProblem(f Field) string {
+	switch f.Type {
+	case String:
+		if f.Length < 1 || f.Length > maxStringLength {
+			return fmt.Sprintf("type 'string' must have a length of 1 to %d bytes, not %d", maxStringLength, f.Length)
+		}
+	case Int:
+		if f.Length != 1 && f.Length != 2 && f.Length != 4 && f.Length != 8 {
+			return fmt.Sprintf("type 'int' must have a length of 1, 2, 4 or 8 bytes, not %d", f.Length)
+		}
+	case Float, TimeID:
+		if f.Length != 8 {
+			return fmt.Sprintf("type '%s' must have a length of 8 bytes, not %d", f.Type, f.Length)
+		}
+	case Bool:
+		if f.Length != 1 {
+			return fmt.Sprintf("type 'bool' must have a length of 1 byte, not %d", f.Length)
+		}
+	case "ref":
+		if f.Length != refFieldLength {
+			return fmt.Sprintf("type 'ref' must have a length of %d bytes, not %d", refFieldLength, f.Length)
+		}
+	}
+	return ""
+}
+
 // GetTable returns a table by name from a schema
 func GetTable(tableName string, mainPath string) (*Table, error) {
+	return getTableFrom(OSStorage{}, tableName, mainPath)
+}
+
+// getTableFrom is GetTable reading the configuration from a storage backend
+func getTableFrom(store Storage, tableName string, mainPath string) (*Table, error) {
 	// Split the tableName into schema and table parts if it contains a colon
 	parts := strings.Split(tableName, ":")
 	var schemaName, tableNameOnly string
@@ -168,120 +314,498 @@ func GetTable(tableName string, mainPath string) (*Table, error) {
 		tableNameOnly = tableName
 	}
 
-	// Construct paths
-	schemaPath := mainPath + "/" + schemaName
-	tableConfPath := schemaPath + "/" + tableNameOnly + ".conf" + fileEnding
+	return loadTable(store, schemaName, tableNameOnly, filepath.Join(mainPath, schemaName))
+}
+
+// loadTable reads the configuration of a table in the schema directory schemaPath
+func loadTable(store Storage, schemaName, tableNameOnly, schemaPath string) (*Table, error) {
+	tableConfPath := tableConfPath(schemaPath, tableNameOnly)
 
 	// Check if the schema exists
-	if _, err := os.Stat(schemaPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("schema '%s' does not exist", schemaName)
+	if _, err := store.Stat(schemaPath); os.IsNotExist(err) {
+		return nil, &TableError{Schema: schemaName, Table: tableNameOnly, Err: ErrSchemaNotFound}
 	}
 
 	// Check if the table configuration exists
-	if _, err := os.Stat(tableConfPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("table '%s' does not exist in schema '%s'", tableNameOnly, schemaName)
+	if _, err := store.Stat(tableConfPath); os.IsNotExist(err) {
+		return nil, &TableError{Schema: schemaName, Table: tableNameOnly, Err: ErrTableNotFound}
 	}
 
+	// Changes of the fields swap the records, the layout hash and the
+	// configuration under the table's write lock, they are read in one piece
+	lock := tableLock(tableFilePath(schemaPath, tableNameOnly))
+	lock.RLock()
+	defer lock.RUnlock()
+
 	// Read the table configuration
-	tableConf, err := os.ReadFile(tableConfPath)
+	tableConf, err := readFile(store, tableConfPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read table configuration: %v", err)
+		return nil, fmt.Errorf("failed to read table configuration: %w", err)
 	}
 
 	var table Table
 	err = json.Unmarshal(tableConf, &table)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse table configuration: %v", err)
+		return nil, &TableError{Schema: schemaName, Table: tableNameOnly, Err: fmt.Errorf("%w: failed to parse table configuration: %v", ErrCorrupt, err)}
+	}
+
+	err = checkLayoutVersion(table.FormatVersion)
+	if err != nil {
+		return nil, &TableError{Schema: schemaName, Table: tableNameOnly, Err: err}
 	}
 
 	// Set the schema path
 	table.SchemaPath = schemaPath
+	table.Layout()
+
+	err = table.checkLayoutHash(store)
+	if err != nil {
+		return nil, &TableError{Schema: schemaName, Table: tableNameOnly, Err: err}
+	}
 
 	return &table, nil
 }
 
+// writeTempSuffix marks the temporary files of WriteRecords, see createTempFile
+const writeTempSuffix = ".write.temp"
+
+// isWriteTemp reports whether a file of a schema directory is a temporary
+// file of WriteRecords, including the <table>.htdb.temp of older versions
+func isWriteTemp(name string) bool {
+	if strings.HasSuffix(name, writeTempSuffix) {
+		return true
+	}
+	tableName, found := strings.CutSuffix(name, fileEnding+".temp")
+	return found && validName(tableName)
+}
+
+// removeWriteTemps removes the temporary files interrupted writes of the
+// table left behind and returns their paths. It holds the table's write lock,
+// so a write still in progress keeps its file.
+func (t *Table) removeWriteTemps() ([]string, error) {
+	lock := t.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	store := t.storage()
+	entries, err := store.ReadDir(t.SchemaPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema directory: %w", err)
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, t.TableName+fileEnding+".") || !isWriteTemp(name) {
+			continue
+		}
+		path := filepath.Join(t.SchemaPath, name)
+		err = store.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove temporary file: %w", err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
 // WriteRecords writes records to the table file
 func (t *Table) WriteRecords(records []*Record) error {
+	lock := t.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	return t.writeRecords(records)
+}
+
+// writeRecords writes records to the table file. The caller must hold the table's write lock.
+func (t *Table) writeRecords(records []*Record) error {
 	// Construct the table file path
-	tablePath := t.SchemaPath + "/" + t.TableName + fileEnding
+	tablePath := t.filePath()
 
-	// Create a temporary file
-	tempPath := tablePath + ".temp"
-	tempFile, err := os.Create(tempPath)
+	// Create a temporary file of this write's own, a failed write leaves none behind
+	store := t.storage()
+	tempFile, tempPath, err := createTempFile(store, tablePath, writeTempSuffix, t.db.fileMode())
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
+		return fmt.Errorf("failed to create temporary file: %w", err)
 	}
-	defer tempFile.Close()
+	replaced := false
+	defer func() {
+		tempFile.Close()
+		if !replaced {
+			store.Remove(tempPath)
+		}
+	}()
 
 	// Write each record to the temporary file
-	for _, record := range records {
-		data, err := record.Serialize(t.Fields)
-		if err != nil {
-			return fmt.Errorf("failed to serialize record: %v", err)
-		}
+	writer := bufio.NewWriter(tempFile)
+	err = t.encodeRecords(writer, records)
+	if err != nil {
+		return fmt.Errorf("failed to write records to temporary file: %w", err)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to write record to temporary file: %w", err)
+	}
 
-		_, err = tempFile.Write(data)
+	// Make the new contents durable before they replace the old file
+	durability := t.durability()
+	if durability >= DurabilityFlush {
+		err = tempFile.Sync()
 		if err != nil {
-			return fmt.Errorf("failed to write record to temporary file: %v", err)
+			return fmt.Errorf("failed to sync temporary file: %w", err)
 		}
 	}
 
 	// Close the temporary file
 	tempFile.Close()
 
+	// The layout is recorded first, an interruption before the rename makes
+	// the old records fail the check rather than be read with the wrong layout
+	err = t.writeLayoutHash(store)
+	if err != nil {
+		return err
+	}
+
 	// Replace the old file with the new one
-	err = os.Rename(tempPath, tablePath)
+	err = store.Rename(tempPath, tablePath)
 	if err != nil {
-		return fmt.Errorf("failed to replace table file: %v", err)
+		return fmt.Errorf("failed to replace table file: %w", err)
 	}
+	replaced = true
+
+	if durability >= DurabilityFsync {
+		err = store.SyncDir(t.SchemaPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Cached handles still point at the replaced file
+	if t.db != nil {
+		t.db.files.invalidate(tablePath)
+	}
+
+	metrics := t.db.metricsSink()
+	metrics.Inc(MetricRecordsWritten, int64(len(records)))
+	metrics.Inc(MetricBytesWritten, int64(len(records)*t.Layout().Size))
 
 	return nil
 }
 
-// GetAllRecords reads all records from the table file
-func (t *Table) GetAllRecords() ([]*Record, error) {
-	// Construct the table file path
-	tablePath := t.SchemaPath + "/" + t.TableName + fileEnding
+// ErrStopStreaming can be returned from a StreamRecords callback to stop the
+// scan early. StreamRecords then returns nil.
+var ErrStopStreaming = errors.New("stop streaming")
 
-	// Check if the table file exists
-	if _, err := os.Stat(tablePath); os.IsNotExist(err) {
-		return []*Record{}, nil // Return empty slice if file doesn't exist
+// GetAllRecords reads all records from the table file. If the file ends in a
+// partial record the whole records are returned with a *TruncatedTableError.
+func (t *Table) GetAllRecords() ([]*Record, error) {
+	records := []*Record{}
+	err := t.StreamRecords(func(record *Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if errors.Is(err, ErrTruncatedTable) {
+		return records, err
 	}
-
-	// Read the table file
-	data, err := os.ReadFile(tablePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read table file: %v", err)
+		return nil, err
 	}
 
-	// Calculate record size
-	recordSize := 0
-	for _, field := range t.Fields {
-		if field.Name == "id" {
-			continue // ID is handled separately
+	return records, nil
+}
+
+// ScanMode decides what a scan does with a corrupt record
+type ScanMode int
+
+const (
+	ScanStrict   ScanMode = iota // Fail the scan on the first corrupt record (default)
+	ScanTolerant                 // Skip corrupt records and move copies of them into the table's quarantine file
+)
+
+// ScanOptions selects which record versions a scan returns and which fields it decodes
+type ScanOptions struct {
+	IncludeDeleted  bool     // Also return records marked as deleted
+	IncludeHistory  bool     // Also return superseded (non-current) versions
+	IncludeArchived bool     // Also return the versions in the table's archive, before the others, see CleanupArchive
+	Fields          []string // Fields to decode, empty decodes every field
+	Mode            ScanMode // What to do with corrupt records
+}
+
+// accepts checks the metadata byte of a serialized record against the options,
+// so skipped versions are never deserialized
+func (o ScanOptions) accepts(data []byte) bool {
+	flags := recordFlags(data)
+	if flags&flagCurrent == 0 && !o.IncludeHistory {
+		return false
+	}
+	if flags&flagDeleted != 0 && !o.IncludeDeleted {
+		return false
+	}
+	return true
+}
+
+// StreamRecordsFields works like StreamRecords but only decodes the given fields,
+// the bytes of every other field are skipped. A nil fields list decodes every field.
+func (t *Table) StreamRecordsFields(fields []string, fn func(*Record) error) error {
+	return t.StreamRecordsWith(ScanOptions{IncludeDeleted: true, IncludeHistory: true, Fields: fields}, fn)
+}
+
+// StreamRecordsWith streams the records selected by options. Records that are
+// filtered out by their metadata are skipped without being deserialized.
+// Corrupt records fail the scan, or are quarantined in ScanTolerant mode.
+func (t *Table) StreamRecordsWith(options ScanOptions, fn func(*Record) error) error {
+	if options.IncludeArchived {
+		// A version archived by an interrupted cleanup may still be in the table
+		seen := make(map[int64]bool)
+		stopped := false
+		err := t.streamArchive(options, seen, func(record *Record) error {
+			err := fn(record)
+			stopped = errors.Is(err, ErrStopStreaming)
+			return err
+		})
+		if err != nil || stopped {
+			return err
 		}
-		recordSize += int(field.Length)
-		recordSize += 1 // Field metadata (1 byte for isNull)
+		options.IncludeArchived = false
+		return t.StreamRecordsWith(options, func(record *Record) error {
+			if seen[record.ID] {
+				return nil
+			}
+			return fn(record)
+		})
 	}
 
-	// Add metadata size
-	recordSize += 12 // 8 bytes for ID, 4 bytes for metadata
+	var offset int64
+	return t.decodeRecords(options, func(visit func([]byte, int64) error) error {
+		return t.streamRawRecords(func(data []byte) error {
+			recordOffset := offset
+			offset += int64(len(data))
+			return visit(data, recordOffset)
+		})
+	}, fn)
+}
 
-	// Parse records
-	var records []*Record
-	for i := 0; i < len(data); i += recordSize {
-		if i+recordSize > len(data) {
-			break // Partial record, skip
+// decodeRecords calls fn with the records selected by options of the raw
+// records read visits with their byte offsets
+func (t *Table) decodeRecords(options ScanOptions, read func(visit func([]byte, int64) error) error, fn func(*Record) error) error {
+	layout := t.Layout()
+	fields := options.Fields
+	var quarantined []QuarantinedRecord
+	err := read(func(data []byte, recordOffset int64) error {
+		err := checkRecordData(data, layout)
+		if err != nil && options.Mode == ScanTolerant {
+			quarantined = append(quarantined, newQuarantinedRecord(data, recordOffset, err))
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to deserialize record at offset %d: %w", recordOffset, err)
+		}
+		if !options.accepts(data) {
+			return nil
 		}
 
-		recordData := data[i : i+recordSize]
-		record, err := DeserializeRecord(recordData, t.Fields)
+		record := &Record{}
+		err = record.DeserializeInto(data, layout, fields...)
 		if err != nil {
-			return nil, fmt.Errorf("failed to deserialize record: %v", err)
+			return fmt.Errorf("failed to deserialize record at offset %d: %w", recordOffset, err)
 		}
+		return fn(record)
+	})
+
+	// The records stay in the table file, a failed quarantine doesn't fail the read
+	if len(quarantined) > 0 {
+		if _, quarantineErr := t.quarantine(quarantined); quarantineErr != nil {
+			t.db.log(slog.LevelError, "failed to quarantine records",
+				"schema", t.schemaName(), "table", t.TableName, "error", quarantineErr)
+		}
+	}
+	return err
+}
 
+// allRecords reads all records from the table file. The caller must hold the table's lock.
+func (t *Table) allRecords() ([]*Record, error) {
+	layout := t.Layout()
+	records := []*Record{}
+	err := t.scanRawRecords(func(data []byte) error {
+		record, err := deserializeRecordLayout(data, layout)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize record: %w", err)
+		}
 		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return records, nil
 }
+
+// StreamRecords reads the table file one record at a time and calls fn for each
+// record, without loading the whole file into memory. A partial record at the
+// end of the file is reported with a *TruncatedTableError after fn saw the
+// whole records.
+func (t *Table) StreamRecords(fn func(*Record) error) error {
+	return t.streamRawRecords(func(data []byte) error {
+		record, err := deserializeRecordLayout(data, t.Layout())
+		if err != nil {
+			return fmt.Errorf("failed to deserialize record: %w", err)
+		}
+		return fn(record)
+	})
+}
+
+// readRecordAt reads the record with the given record number from the table file.
+// It returns nil without an error if the file holds fewer records.
+func (t *Table) readRecordAt(position int64) (*Record, error) {
+	lock := t.lock()
+	lock.RLock()
+	defer lock.RUnlock()
+
+	file, release, err := t.openFile()
+	if err == nil {
+		defer release()
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table file: %w", err)
+	}
+
+	layout := t.Layout()
+	data := make([]byte, layout.Size)
+	_, err = file.ReadAt(data, position*int64(layout.Size))
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table file: %w", err)
+	}
+
+	return deserializeRecordLayout(data, layout)
+}
+
+// ScanInto streams the table like StreamRecords but decodes every record into
+// the same Record to avoid per-record allocations. The record passed to fn is
+// overwritten by the next one and must be cloned if it needs to be kept. If
+// fields are given only those fields are decoded.
+func (t *Table) ScanInto(record *Record, fn func(*Record) error, fields ...string) error {
+	layout := t.Layout()
+	return t.streamRawRecords(func(data []byte) error {
+		err := record.DeserializeInto(data, layout, fields...)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize record: %w", err)
+		}
+		return fn(record)
+	})
+}
+
+// streamRawRecords calls fn with the serialized bytes of every record in the
+// table file. The slice is reused between calls and must not be retained. A
+// trailing partial record is returned as a *TruncatedTableError.
+func (t *Table) streamRawRecords(fn func([]byte) error) error {
+	lock := t.lock()
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return t.scanRawRecords(fn)
+}
+
+// scanRawRecords is streamRawRecords without locking. The caller must hold the table's lock.
+func (t *Table) scanRawRecords(fn func([]byte) error) error {
+	// Open the table file, a missing file has no records
+	file, release, err := t.openFile()
+	if err == nil {
+		defer release()
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read table file: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file stats: %w", err)
+	}
+
+	// Read through a section reader, cached handles are shared and must not
+	// depend on the file offset
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, stat.Size()))
+	recordData := make([]byte, t.RecordSize())
+
+	for offset := int64(0); ; offset += int64(len(recordData)) {
+		_, err := io.ReadFull(reader, recordData)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return &TruncatedTableError{Schema: t.schemaName(), Table: t.TableName, Offset: offset, Leftover: stat.Size() - offset}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read table file: %w", err)
+		}
+
+		err = fn(recordData)
+		if errors.Is(err, ErrStopStreaming) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// openFile opens the table file for reading, through the database's file
+// cache if it has one. release must be called once the file is no longer used.
+func (t *Table) openFile() (StorageFile, func(), error) {
+	if t.db != nil {
+		return t.db.files.get(t.filePath())
+	}
+	file, err := openTableFile(t.storage(), t.filePath())
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func() { file.Close() }, nil
+}
+
+// durability returns the durability level of the owning database
+func (t *Table) durability() Durability {
+	if t.db == nil {
+		return DurabilityNone
+	}
+	return t.db.GetDurability()
+}
+
+// tableLocks holds one lock per table file. Writers (commits, rollbacks,
+// compaction, DDL) take the write lock, scans take the read lock.
+var tableLocks = struct {
+	locks map[string]*sync.RWMutex
+	mu    sync.Mutex
+}{locks: make(map[string]*sync.RWMutex)}
+
+// tableLock returns the lock of the table file at tablePath
+func tableLock(tablePath string) *sync.RWMutex {
+	if absPath, err := filepath.Abs(tablePath); err == nil {
+		tablePath = absPath
+	}
+
+	tableLocks.mu.Lock()
+	defer tableLocks.mu.Unlock()
+
+	lock, exists := tableLocks.locks[tablePath]
+	if !exists {
+		lock = &sync.RWMutex{}
+		tableLocks.locks[tablePath] = lock
+	}
+	return lock
+}
+
+// lock returns the lock of the table's file
+func (t *Table) lock() *sync.RWMutex {
+	return tableLock(t.filePath())
+}
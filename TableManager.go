@@ -6,54 +6,128 @@
 package hartoDb_go
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // TableManager manages tables, transactions, and records in the database
 type TableManager struct {
 	db             *HTDB
-	cleanupWorker  *CleanupWorker
+	cleanupWorker  atomic.Pointer[CleanupWorker] // Nil unless the worker runs, read by commits, see StartCleanupWorker
+	cleanupMu      sync.Mutex                    // Held while the worker is started or stopped
 	transactions   map[uint64]*Transaction
 	transactionsMu sync.Mutex
+	recordCache    *recordCache
+	primaryKeys    *primaryKeyIndex
+	asyncWriter    *asyncWriter
+	triggers       *triggerRegistry
 }
 
 // NewTableManager creates a new table manager
 func NewTableManager(db *HTDB) *TableManager {
-	return &TableManager{
+	tm := &TableManager{
 		db:           db,
 		transactions: make(map[uint64]*Transaction),
+		recordCache:  newRecordCache(),
+		primaryKeys:  newPrimaryKeyIndex(),
+		triggers:     newTriggerRegistry(),
 	}
+	tm.asyncWriter = newAsyncWriter(tm)
+	return tm
+}
+
+// SetRecordCache enables the in-memory cache of current records with the given
+// limits. Passing zero limits disables the cache and drops everything in it.
+func (tm *TableManager) SetRecordCache(options RecordCacheOptions) {
+	tm.recordCache.configure(options)
+}
+
+// RecordCacheStats returns the hit and miss counters of the record cache
+func (tm *TableManager) RecordCacheStats() RecordCacheStats {
+	return tm.recordCache.snapshot()
 }
 
 // StartCleanupWorker starts the background cleanup worker
-func (tm *TableManager) StartCleanupWorker(interval time.Duration) error {
-	if tm.cleanupWorker != nil {
+func (tm *TableManager) StartCleanupWorker(interval time.Duration, options ...CleanupOption) error {
+	tm.cleanupMu.Lock()
+	defer tm.cleanupMu.Unlock()
+
+	if tm.cleanupWorker.Load() != nil {
 		return fmt.Errorf("cleanup worker is already running")
 	}
 
-	tm.cleanupWorker = NewCleanupWorker(tm.db, interval)
-	return tm.cleanupWorker.Start()
+	worker := NewCleanupWorker(tm.db, interval, options...)
+	err := worker.Start()
+	if err != nil {
+		return err
+	}
+
+	tm.cleanupWorker.Store(worker)
+	return nil
 }
 
 // StopCleanupWorker stops the background cleanup worker
 func (tm *TableManager) StopCleanupWorker() error {
-	if tm.cleanupWorker == nil {
+	tm.cleanupMu.Lock()
+	defer tm.cleanupMu.Unlock()
+
+	worker := tm.cleanupWorker.Load()
+	if worker == nil {
 		return fmt.Errorf("cleanup worker is not running")
 	}
 
-	err := tm.cleanupWorker.Stop()
+	err := worker.Stop()
 	if err != nil {
 		return err
 	}
 
-	tm.cleanupWorker = nil
+	tm.cleanupWorker.Store(nil)
 	return nil
 }
 
-// BeginTransaction begins a new transaction
+// Compact runs a single cleanup pass over every table right away and returns
+// its report. It can be used with or without a running cleanup worker.
+func (tm *TableManager) Compact() (CleanupReport, error) {
+	worker := NewCleanupWorker(tm.db, 0)
+	if running := tm.cleanupWorker.Load(); running != nil {
+		worker.SetMetricsCollector(running.metricsCollector())
+		worker.concurrency = running.passConcurrency()
+	}
+
+	worker.performCleanup()
+	report := worker.LastReport()
+	if report.Errors > 0 {
+		return report, fmt.Errorf("cleanup failed for %d schemas or tables", report.Errors)
+	}
+	return report, nil
+}
+
+// BeginTransaction begins a new transaction. Once Close was called the returned
+// transaction is not active and every operation on it returns ErrClosed.
 func (tm *TableManager) BeginTransaction() *Transaction {
+	if err := tm.db.checkAccepting(); err != nil {
+		return &Transaction{
+			ID:            atomic.AddUint64(&transactionCounter, 1),
+			StartTime:     time.Now(),
+			Status:        TransactionFailed,
+			LockedRecords: make(map[string]int64),
+			StagedRecords: make(map[string][]*Record),
+			db:            tm.db,
+			stagedTables:  make(map[string]*Table),
+			beginErr:      err,
+		}
+	}
+	return tm.beginTransaction()
+}
+
+// beginTransaction begins a new transaction even while the database is
+// closing, so queued work can still be written
+func (tm *TableManager) beginTransaction() *Transaction {
 	tm.transactionsMu.Lock()
 	defer tm.transactionsMu.Unlock()
 
@@ -62,44 +136,130 @@ func (tm *TableManager) BeginTransaction() *Transaction {
 	return tx
 }
 
-// CommitTransaction commits a transaction
+// TransactionInfo describes an active transaction
+type TransactionInfo struct {
+	ID        uint64
+	StartTime time.Time
+	Tables    []string          // Tables with staged records, as schema:table
+	Records   int               // Number of staged records, including the spilled ones
+	Actor     string            // See Transaction.SetActor
+	Tags      map[string]string // See Transaction.SetTag
+}
+
+// ActiveTransactions lists the transactions that were begun and neither
+// committed nor rolled back yet, oldest first
+func (tm *TableManager) ActiveTransactions() []TransactionInfo {
+	tm.transactionsMu.Lock()
+	active := make([]*Transaction, 0, len(tm.transactions))
+	for _, tx := range tm.transactions {
+		active = append(active, tx)
+	}
+	tm.transactionsMu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+
+	infos := make([]TransactionInfo, 0, len(active))
+	for _, tx := range active {
+		infos = append(infos, tx.info())
+	}
+	return infos
+}
+
+// info describes the transaction
+func (tx *Transaction) info() TransactionInfo {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	info := TransactionInfo{
+		ID:        tx.ID,
+		StartTime: tx.StartTime,
+		Tables:    tx.stagedTableNames(),
+		Actor:     tx.actor,
+		Tags:      tx.copyTags(),
+	}
+	for _, records := range tx.StagedRecords {
+		info.Records += len(records)
+	}
+	for _, spill := range tx.spills {
+		info.Records += spill.records
+	}
+	return info
+}
+
+// CommitTransaction commits a transaction, publishes its changes to the
+// subscribers and then runs the after-triggers of the written records. An
+// error of an after-trigger doesn't undo the commit. What the commit wrote is
+// summarized by tx.CommitResult.
 func (tm *TableManager) CommitTransaction(tx *Transaction) error {
+	err := tm.commitTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tm.runAfterTriggers(tx)
+	if err != nil {
+		return fmt.Errorf("transaction committed, but %w", err)
+	}
+	return nil
+}
+
+// commitTransaction commits a transaction and forgets it
+func (tm *TableManager) commitTransaction(tx *Transaction) error {
+	if tx.beginErr != nil {
+		return tx.beginErr
+	}
+
 	tm.transactionsMu.Lock()
 	defer tm.transactionsMu.Unlock()
 
 	if _, exists := tm.transactions[tx.ID]; !exists {
-		return fmt.Errorf("transaction not found")
+		return fmt.Errorf("%w: transaction %d not found", ErrTxNotActive, tx.ID)
 	}
 
 	err := tx.Commit()
 	if err != nil {
+		if tx.Status == TransactionFailed {
+			// Part of the transaction was written, it can't be used any more
+			tm.recordCache.invalidateIDs(tx.touchedIDs())
+			delete(tm.transactions, tx.ID)
+		}
 		return err
 	}
 
+	// Cached copies of the records touched by the transaction are stale now
+	tm.recordCache.invalidateIDs(tx.touchedIDs())
+
+	// Published while commits are serialized so subscribers see them in commit order
+	tm.db.events.publish(tx)
+
 	delete(tm.transactions, tx.ID)
 	return nil
 }
 
 // RollbackTransaction rolls back a transaction
 func (tm *TableManager) RollbackTransaction(tx *Transaction) error {
+	if tx.beginErr != nil {
+		return tx.beginErr
+	}
+
 	tm.transactionsMu.Lock()
 	defer tm.transactionsMu.Unlock()
 
 	if _, exists := tm.transactions[tx.ID]; !exists {
-		return fmt.Errorf("transaction not found")
+		return fmt.Errorf("%w: transaction %d not found", ErrTxNotActive, tx.ID)
 	}
 
 	err := tx.Rollback()
-	if err != nil {
+	if err != nil && tx.Status == TransactionActive {
 		return err
 	}
 
+	// A RollbackError still ends the transaction
 	delete(tm.transactions, tx.ID)
-	return nil
+	return err
 }
 
 // CreateTable creates a new table
-func (tm *TableManager) CreateTable(schemaName, tableName string, fields []Field) (*Table, error) {
+func (tm *TableManager) CreateTable(schemaName, tableName string, fields []Field, options ...TableOption) (*Table, error) {
 	// Get the schema
 	schema, err := tm.db.Schema(schemaName)
 	if err != nil {
@@ -107,13 +267,14 @@ func (tm *TableManager) CreateTable(schemaName, tableName string, fields []Field
 	}
 
 	// Create the table
-	resp := schema.CreateTable(tableName, fields)
-	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf(resp.Message)
+	resp := schema.CreateTable(tableName, fields, options...)
+	if !resp.IsSuccess() {
+		return nil, resp
 	}
+	tm.recordCache.invalidateTable(tableFilePath(schema.schemaPath, tableName))
 
 	// Get the table
-	table, err := GetTable(schemaName+":"+tableName, tm.db.GetMainPath())
+	table, err := tm.db.getTable(schemaName + ":" + tableName)
 	if err != nil {
 		return nil, err
 	}
@@ -123,7 +284,7 @@ func (tm *TableManager) CreateTable(schemaName, tableName string, fields []Field
 
 // GetTable gets a table by name
 func (tm *TableManager) GetTable(schemaName, tableName string) (*Table, error) {
-	return GetTable(schemaName+":"+tableName, tm.db.GetMainPath())
+	return tm.db.getTable(schemaName + ":" + tableName)
 }
 
 // InsertRecord inserts a new record into a table
@@ -141,6 +302,7 @@ func (tm *TableManager) InsertRecord(table *Table, data map[string]interface{})
 	// Commit the transaction
 	err = tm.CommitTransaction(tx)
 	if err != nil {
+		tm.rollbackUnapplied(tx)
 		return nil, err
 	}
 
@@ -149,11 +311,16 @@ func (tm *TableManager) InsertRecord(table *Table, data map[string]interface{})
 
 // UpdateRecord updates an existing record in a table
 func (tm *TableManager) UpdateRecord(table *Table, record *Record, updates map[string]interface{}) (*Record, error) {
+	return tm.updateRecord(table, record, updates, "")
+}
+
+// updateRecord updates a record in its own transaction, see UpdateRecordIfVersion
+func (tm *TableManager) updateRecord(table *Table, record *Record, updates map[string]interface{}, expectedVersion string) (*Record, error) {
 	// Begin a transaction
 	tx := tm.BeginTransaction()
 
 	// Stage the update
-	updatedRecord, err := tx.StageUpdate(table, record, updates)
+	updatedRecord, err := tx.stageUpdate(table, record, updates, expectedVersion)
 	if err != nil {
 		tm.RollbackTransaction(tx)
 		return nil, err
@@ -162,6 +329,7 @@ func (tm *TableManager) UpdateRecord(table *Table, record *Record, updates map[s
 	// Commit the transaction
 	err = tm.CommitTransaction(tx)
 	if err != nil {
+		tm.rollbackUnapplied(tx)
 		return nil, err
 	}
 
@@ -170,11 +338,16 @@ func (tm *TableManager) UpdateRecord(table *Table, record *Record, updates map[s
 
 // DeleteRecord deletes a record from a table
 func (tm *TableManager) DeleteRecord(table *Table, record *Record) error {
+	return tm.deleteRecord(table, record, "")
+}
+
+// deleteRecord deletes a record in its own transaction, see DeleteRecordIfVersion
+func (tm *TableManager) deleteRecord(table *Table, record *Record, expectedVersion string) error {
 	// Begin a transaction
 	tx := tm.BeginTransaction()
 
 	// Stage the delete
-	err := tx.StageDelete(table, record)
+	err := tx.stageDelete(table, record, expectedVersion)
 	if err != nil {
 		tm.RollbackTransaction(tx)
 		return err
@@ -183,46 +356,149 @@ func (tm *TableManager) DeleteRecord(table *Table, record *Record) error {
 	// Commit the transaction
 	err = tm.CommitTransaction(tx)
 	if err != nil {
+		tm.rollbackUnapplied(tx)
 		return err
 	}
 
 	return nil
 }
 
+// rollbackUnapplied rolls back a transaction whose commit failed before
+// anything was written, so its record locks are released
+func (tm *TableManager) rollbackUnapplied(tx *Transaction) {
+	tx.mu.Lock()
+	active := tx.Status == TransactionActive
+	tx.mu.Unlock()
+
+	if active {
+		tm.RollbackTransaction(tx)
+	}
+}
+
 // GetAllRecords gets all records from a table
 func (tm *TableManager) GetAllRecords(table *Table) ([]*Record, error) {
 	return table.GetAllRecords()
 }
 
-// GetCurrentRecords gets all current (not deleted) records from a table
+// GetCurrentRecords gets all current (not deleted) records from a table, one
+// version per logical record. Like GetAllRecords it returns the whole records
+// with a *TruncatedTableError if the table file ends in a partial record.
 func (tm *TableManager) GetCurrentRecords(table *Table) ([]*Record, error) {
-	records, err := table.GetAllRecords()
+	var currentRecords []*Record
+	err := table.StreamRecordsWith(ScanOptions{}, func(record *Record) error {
+		currentRecords = append(currentRecords, record)
+		return nil
+	})
+	if errors.Is(err, ErrTruncatedTable) {
+		return latestVersions(table, currentRecords), err
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	var currentRecords []*Record
+	return latestVersions(table, currentRecords), nil
+}
+
+// latestVersions keeps only the newest of several current versions of the
+// same logical record, which only a damaged or half-migrated table file holds.
+// The newest is the one committed last, or with the highest id if the commit
+// times are equal. Dropped versions are counted as MetricDuplicateVersions and
+// logged.
+func latestVersions(table *Table, records []*Record) []*Record {
+	latest := make(map[int64]*Record, len(records))
+	for _, record := range records {
+		newest, exists := latest[record.LogicalID()]
+		if !exists || newerVersion(record, newest) {
+			latest[record.LogicalID()] = record
+		}
+	}
+	if len(latest) == len(records) {
+		return records
+	}
+
+	kept := records[:0]
+	var duplicates []int64
 	for _, record := range records {
-		if record.Metadata.IsCurrent && !record.Metadata.IsDeleted {
-			currentRecords = append(currentRecords, record)
+		if latest[record.LogicalID()] != record {
+			duplicates = append(duplicates, record.ID)
+			continue
 		}
+		kept = append(kept, record)
 	}
 
-	return currentRecords, nil
+	table.db.metricsSink().Inc(MetricDuplicateVersions, int64(len(duplicates)))
+	table.db.log(slog.LevelWarn, "table holds several current versions of a record, using the latest",
+		"schema", table.schemaName(), "table", table.TableName, "versions", len(duplicates), "ids", duplicates)
+	return kept
+}
+
+// newerVersion reports whether record is a newer version than other
+func newerVersion(record, other *Record) bool {
+	if record.Metadata.CommittedAt != other.Metadata.CommittedAt {
+		return record.Metadata.CommittedAt > other.Metadata.CommittedAt
+	}
+	return record.ID > other.ID
 }
 
 // GetRecordByID gets a record by ID
 func (tm *TableManager) GetRecordByID(table *Table, id int64) (*Record, error) {
-	records, err := table.GetAllRecords()
+	record, err := tm.lookupRecord(table, id)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, record := range records {
-		if record.ID == id && record.Metadata.IsCurrent {
-			return record, nil
+	if record == nil {
+		return nil, newRecordError(table, id, ErrNotFound)
+	}
+	return record, nil
+}
+
+// lookupRecord returns the current version of a record, consulting the record
+// cache first. It returns nil without an error if there is no such record.
+func (tm *TableManager) lookupRecord(table *Table, id int64) (*Record, error) {
+	if record, ok := tm.recordCache.get(table, id); ok {
+		tm.db.metricsSink().Inc(MetricCacheHits, 1)
+		return record, nil
+	}
+
+	// Seek straight to the record through the primary key index
+	position, indexed, err := tm.primaryKeys.lookup(table, id)
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		return nil, nil
+	}
+
+	record, err := table.readRecordAt(position)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil && record.ID == id {
+		if !record.Metadata.IsCurrent {
+			return nil, nil
 		}
+		tm.recordCache.put(table, record)
+		return record, nil
 	}
 
-	return nil, fmt.Errorf("record not found")
+	// The index didn't match the file, drop it and fall back to a scan
+	tm.primaryKeys.invalidate(tableCacheKey(table))
+
+	var found *Record
+	err = table.StreamRecordsWith(ScanOptions{IncludeDeleted: true}, func(record *Record) error {
+		if record.ID == id {
+			found = record
+			return ErrStopStreaming
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if found != nil {
+		tm.recordCache.put(table, found)
+	}
+	return found, nil
 }
@@ -0,0 +1,216 @@
+// TableManager_test.go
+// Description: Tests of the table manager of the HTDB library
+// Concurrent inserts and scans must neither lose records nor race, run with -race
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConcurrentInsertsAndScans(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	const writers, inserts, readers = 8, 25, 4
+	var inserted atomic.Int64
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < inserts; i++ {
+				_, err := tm.InsertRecord(table, map[string]interface{}{"key": writer*inserts + i, "note": "value"})
+				if err != nil {
+					t.Errorf("failed to insert record: %v", err)
+					continue
+				}
+				inserted.Add(1)
+			}
+		}(writer)
+	}
+
+	stop := make(chan struct{})
+	var readersWg sync.WaitGroup
+	for reader := 0; reader < readers; reader++ {
+		readersWg.Add(1)
+		go func() {
+			defer readersWg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				records, err := tm.GetAllRecords(table)
+				if err != nil {
+					t.Errorf("failed to read records: %v", err)
+					return
+				}
+				if int64(len(records)) > writers*inserts {
+					t.Errorf("scan returned %d records, more than were inserted", len(records))
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readersWg.Wait()
+
+	records, err := tm.GetAllRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if int64(len(records)) != inserted.Load() {
+		t.Errorf("table holds %d records, %d inserts succeeded", len(records), inserted.Load())
+	}
+	keys := make(map[int64]bool, len(records))
+	for _, record := range records {
+		key, _ := asInt64(record.FieldsData["key"])
+		if keys[key] {
+			t.Errorf("record with key %d was written twice", key)
+		}
+		keys[key] = true
+	}
+}
+
+// A table file holding several current versions of a record, as a damaged or
+// half-migrated file may, still reads as one version per logical record
+func TestDuplicateCurrentVersions(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	metrics := newTestMetrics()
+	db.SetMetricsSink(metrics)
+
+	record := insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "first"})
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 2, "note": "other"})
+	for _, note := range []string{"second", "third"} {
+		var err error
+		record, err = tm.UpdateRecord(table, record, map[string]interface{}{"note": note})
+		if err != nil {
+			t.Fatalf("failed to update record: %v", err)
+		}
+	}
+
+	all, err := tm.GetAllRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	for _, record := range all {
+		record.Metadata.IsCurrent = true
+	}
+	err = table.WriteRecords(all)
+	if err != nil {
+		t.Fatalf("failed to write records: %v", err)
+	}
+
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read current records: %v", err)
+	}
+	selected, err := tm.Select(table).GetAll()
+	if err != nil {
+		t.Fatalf("failed to select records: %v", err)
+	}
+	// Newest first the scan stops at the limit, older versions must not use it up
+	descending, err := tm.Select(table).Sort("id", false).Limit(2).GetAll()
+	if err != nil {
+		t.Fatalf("failed to select records newest first: %v", err)
+	}
+	want := map[int64]string{1: "third", 2: "other"}
+	for name, records := range map[string][]*Record{"GetCurrentRecords": records, "Select": selected, "Select id desc": descending} {
+		if len(records) != len(want) {
+			t.Errorf("%s returns %d records, want %d", name, len(records), len(want))
+		}
+		for _, record := range records {
+			key := record.FieldsData["key"].(int64)
+			note, err := table.ReadRef(record, "note")
+			if err != nil {
+				t.Fatalf("failed to read ref of record %d: %v", key, err)
+			}
+			if note != want[key] {
+				t.Errorf("%s returns record %d with note %q, want %q", name, key, note, want[key])
+			}
+		}
+	}
+	if got := metrics.counter(MetricDuplicateVersions); got != 4 {
+		t.Errorf("counted %d duplicate versions, want 4", got)
+	}
+}
+
+// The newest version is the one committed last, whatever its place in the file
+func TestLatestVersionsOutOfOrder(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	table := createTestTable(t, db, "s", "t", noteFields)
+	version := func(id, origin, committedAt int64) *Record {
+		record := NewRecord(id, map[string]interface{}{"key": int64(1)})
+		record.Metadata.OriginID = origin
+		record.Metadata.CommittedAt = committedAt
+		return record
+	}
+
+	tests := []struct {
+		name     string
+		versions []*Record
+		want     int64
+	}{
+		{"committed last first in file", []*Record{version(30, 10, 300), version(10, 0, 100), version(20, 10, 200)}, 30},
+		{"same commit time", []*Record{version(20, 10, 100), version(10, 0, 100)}, 20},
+	}
+	for _, test := range tests {
+		kept := latestVersions(table, test.versions)
+		if len(kept) != 1 || kept[0].ID != test.want {
+			var ids []int64
+			for _, record := range kept {
+				ids = append(ids, record.ID)
+			}
+			t.Errorf("%s: kept versions %v, want [%d]", test.name, ids, test.want)
+		}
+	}
+}
+
+func BenchmarkGetRecordByID(b *testing.B) {
+	db := openTestDB(b, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(b, db, "s", "t", noteFields)
+	const records = 1000000
+	appendBenchmarkRecords(b, table, records, func(i int) map[string]interface{} {
+		return map[string]interface{}{"key": i + 1}
+	})
+
+	b.Run("index", func(b *testing.B) {
+		_, err := tm.GetRecordByID(table, 1) // Builds the index
+		if err != nil {
+			b.Fatalf("failed to get record: %v", err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			id := int64(i*7919%records + 1)
+			record, err := tm.GetRecordByID(table, id)
+			if err != nil || record.ID != id {
+				b.Fatalf("failed to get record %d: %v", id, err)
+			}
+		}
+	})
+
+	// The scan every lookup did before the index
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key := i*7919%records + 1
+			found, err := tm.Select(table).Where("key", "=", key).GetAll()
+			if err != nil || len(found) != 1 {
+				b.Fatalf("failed to find record %d: %v", key, err)
+			}
+		}
+	})
+}
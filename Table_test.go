@@ -0,0 +1,248 @@
+// Table_test.go
+// Description: Tests of table file writes of the HTDB library
+// Concurrent writers and recovery must never mix or lose a table file
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writerRecords returns records that all carry the writer's number
+func writerRecords(writer, count int) []*Record {
+	records := make([]*Record, count)
+	for i := range records {
+		records[i] = NewRecord(int64(i+1), map[string]interface{}{"key": int64(writer), "note": nil})
+	}
+	return records
+}
+
+func TestConcurrentWriteRecords(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	table := createTestTable(t, db, "s", "t", noteFields)
+	outputs := [][]*Record{writerRecords(1, 2000), writerRecords(2, 2000)}
+
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		for _, records := range outputs {
+			wg.Add(1)
+			go func(records []*Record) {
+				defer wg.Done()
+				err := table.WriteRecords(records)
+				if err != nil {
+					t.Errorf("failed to write records: %v", err)
+				}
+			}(records)
+		}
+		wg.Wait()
+
+		// The file holds the complete output of one writer
+		records, err := table.GetAllRecords()
+		if err != nil {
+			t.Fatalf("failed to read records: %v", err)
+		}
+		if len(records) != 2000 {
+			t.Fatalf("round %d: table holds %d records, want 2000", round, len(records))
+		}
+		writer := records[0].FieldsData["key"]
+		for i, record := range records {
+			if record.FieldsData["key"] != writer || record.ID != int64(i+1) {
+				t.Fatalf("round %d: record %d is %v of writer %v, the writes were mixed", round, i, record.ID, record.FieldsData["key"])
+			}
+		}
+	}
+
+	entries, err := db.storage().ReadDir(filepath.Join(db.mainPath, "s"))
+	if err != nil {
+		t.Fatalf("failed to read schema directory: %v", err)
+	}
+	for _, entry := range entries {
+		if isWriteTemp(entry.Name()) {
+			t.Errorf("write left %s behind", entry.Name())
+		}
+	}
+}
+
+// Recover runs on a live database, it must not take the temporary files of
+// writes in progress away
+func TestRecoverDuringWrites(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	table := createTestTable(t, db, "s", "t", noteFields)
+	records := writerRecords(1, 20000)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			err := table.WriteRecords(records)
+			if err != nil {
+				t.Errorf("failed to write records: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			_, err := db.Recover()
+			if err != nil {
+				t.Errorf("failed to recover: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestOpenRemovesWriteTemps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openTestDB(t, path)
+	createTestTable(t, db, "s", "t", noteFields)
+	db.Close()
+
+	schemaPath := filepath.Join(path, "s")
+	stale := []string{"t.htdb.abc" + writeTempSuffix, "t.htdb.temp"}
+	kept := []string{"t.conf.htdb.temp", "other.htdb.abc.write"}
+	for _, name := range append(stale, kept...) {
+		err := writeFile(OSStorage{}, filepath.Join(schemaPath, name), []byte("partial"), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	openTestDB(t, path)
+	for _, name := range stale {
+		if _, err := (OSStorage{}).Stat(filepath.Join(schemaPath, name)); err == nil {
+			t.Errorf("Open left %s behind", name)
+		}
+	}
+	for _, name := range kept {
+		if _, err := (OSStorage{}).Stat(filepath.Join(schemaPath, name)); err != nil {
+			t.Errorf("Open removed %s: %v", name, err)
+		}
+	}
+}
+
+// failingCreateStorage fails the creation of files with the given name
+type failingCreateStorage struct {
+	Storage
+	name string
+}
+
+func (s failingCreateStorage) OpenFile(name string, flag int, perm fs.FileMode) (StorageFile, error) {
+	if flag&os.O_CREATE != 0 && filepath.Base(name) == s.name {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("disk full")}
+	}
+	return s.Storage.OpenFile(name, flag, perm)
+}
+
+func TestCreateTableFileError(t *testing.T) {
+	store := failingCreateStorage{Storage: NewMemoryStorage(), name: "t" + fileEnding}
+	db, err := Open("db", OpenOptions{Create: true, Storage: store})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	schema, err := db.CreateSchema("s")
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+
+	response := schema.CreateTable("t", noteFields)
+	if response.StatusCode != StatusDbError {
+		t.Errorf("CreateTable answered %d %s, want %d", response.StatusCode, response.Message, StatusDbError)
+	}
+}
+
+func TestCreateTableReadOnlySchema(t *testing.T) {
+	dir := t.TempDir()
+	source := openTestDB(t, filepath.Join(dir, "source"))
+	createTestTable(t, source, "catalog", "products", noteFields)
+	source.Close()
+
+	db := openTestDB(t, filepath.Join(dir, "db"))
+	schemaPath := filepath.Join(dir, "source", "catalog")
+	err := db.AttachSchema("catalog", schemaPath, true)
+	if err != nil {
+		t.Fatalf("failed to attach schema: %v", err)
+	}
+	schema, err := db.Schema("catalog")
+	if err != nil {
+		t.Fatalf("failed to get schema: %v", err)
+	}
+
+	response := schema.CreateTable("orders", noteFields)
+	if !errors.Is(response, ErrReadOnly) {
+		t.Fatalf("CreateTable answered %d %s, want ErrReadOnly", response.StatusCode, response.Message)
+	}
+	entries, err := os.ReadDir(schemaPath)
+	if err != nil {
+		t.Fatalf("failed to read schema directory: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "orders") {
+			t.Errorf("CreateTable left %s in the read-only schema", entry.Name())
+		}
+	}
+}
+
+// SetDurability may change the level while commits read it
+func TestSetDurabilityDuringWrites(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "db"))
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := int64(0); key < 50; key++ {
+			insertTestRecord(t, tm, table, map[string]interface{}{"key": key, "note": "value"})
+		}
+	}()
+	levels := []Durability{DurabilityNone, DurabilityFlush, DurabilityFsync}
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		default:
+			db.SetDurability(levels[i%len(levels)])
+		}
+	}
+}
+
+func BenchmarkWriteRecords(b *testing.B) {
+	levels := []struct {
+		name       string
+		durability Durability
+	}{
+		{"none", DurabilityNone},
+		{"flush", DurabilityFlush},
+		{"fsync", DurabilityFsync},
+	}
+	for _, level := range levels {
+		b.Run(level.name, func(b *testing.B) {
+			db := openTestDB(b, filepath.Join(b.TempDir(), "db"))
+			db.SetDurability(level.durability)
+			table := createTestTable(b, db, "s", "t", noteFields)
+			records := writerRecords(1, 10000)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(records) * table.RecordSize()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := table.WriteRecords(records)
+				if err != nil {
+					b.Fatalf("failed to write records: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+// Template.go
+// Description: Table templates of the HTDB library
+// Field sets defined once per schema and prepended to the fields of new tables
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// schemaIndex is the content of a schema's index file, empty for schemas
+// without settings
+type schemaIndex struct {
+	Templates map[string][]Field `json:"templates,omitempty"` // See DefineTemplate
+}
+
+// TableOption configures CreateTable
+type TableOption func(*tableOptions)
+
+// tableOptions are the settings of a CreateTable call
+type tableOptions struct {
+	templates []string
+}
+
+// WithTemplate prepends the fields of a template of the schema to the fields
+// of the new table, after the id. Given more than once, the templates are
+// prepended in the order given. A field name defined twice fails the call.
+func WithTemplate(name string) TableOption {
+	return func(options *tableOptions) {
+		options.templates = append(options.templates, name)
+	}
+}
+
+// DefineTemplate defines or replaces a template of the schema, see
+// WithTemplate. Tables keep the fields they were created with, replacing a
+// template only changes the tables created afterwards.
+func (s *Schema) DefineTemplate(name string, fields []Field) error {
+	if !validName(name) {
+		return NewResponse(StatusInvalidName, "Can't name a template \""+name+"\", use letters, digits, '_' and '-'")
+	}
+	if len(fields) == 0 {
+		return NewResponse(StatusBadRequest, "Template "+name+" has no fields")
+	}
+	if err := validateFieldNames(append([]Field{timePKField}, fields...)); err != nil {
+		return NewResponse(StatusInvalidName, err.Error()).WithError(err)
+	}
+	for _, validate := range []func([]Field) error{validateFieldLengths, validateFieldCompression, validateFieldIndexes, validateFieldCollations} {
+		if err := validate(fields); err != nil {
+			return NewResponse(StatusValidationFailed, err.Error()).WithError(err)
+		}
+	}
+
+	return s.updateIndex(func(index *schemaIndex) {
+		if index.Templates == nil {
+			index.Templates = make(map[string][]Field)
+		}
+		index.Templates[name] = append([]Field(nil), fields...)
+	})
+}
+
+// DropTemplate removes a template of the schema, tables created with it keep its fields
+func (s *Schema) DropTemplate(name string) error {
+	index, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+	if _, exists := index.Templates[name]; !exists {
+		return templateNotFound(s, name)
+	}
+
+	return s.updateIndex(func(index *schemaIndex) {
+		delete(index.Templates, name)
+	})
+}
+
+// Template returns the fields of a template of the schema
+func (s *Schema) Template(name string) ([]Field, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	fields, exists := index.Templates[name]
+	if !exists {
+		return nil, templateNotFound(s, name)
+	}
+	return fields, nil
+}
+
+// TemplateNames returns the names of the templates of the schema, sorted
+func (s *Schema) TemplateNames() ([]string, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(index.Templates))
+	for name := range index.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// templateNotFound returns the error for a template the schema doesn't have
+func templateNotFound(s *Schema, name string) error {
+	return NewResponse(StatusBadRequest, "Template "+name+" does not exist in schema "+s.name).WithError(ErrTemplateNotFound)
+}
+
+// templateFields returns the fields of the templates of a CreateTable call
+// followed by fields, failing on a field name defined twice
+func (s *Schema) templateFields(options []TableOption, fields []Field) ([]Field, error) {
+	var settings tableOptions
+	for _, option := range options {
+		option(&settings)
+	}
+	if len(settings.templates) == 0 {
+		return fields, nil
+	}
+
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var combined []Field
+	definedBy := make(map[string]string) // Field name to the template defining it
+	for _, name := range settings.templates {
+		templateFields, exists := index.Templates[name]
+		if !exists {
+			return nil, templateNotFound(s, name)
+		}
+		for _, field := range templateFields {
+			if other, exists := definedBy[field.Name]; exists {
+				return nil, NewResponse(StatusFieldAlreadyExists,
+					fmt.Sprintf("Field %s is defined by templates %s and %s", field.Name, other, name))
+			}
+			definedBy[field.Name] = name
+			combined = append(combined, field)
+		}
+	}
+	for _, field := range fields {
+		if template, exists := definedBy[field.Name]; exists {
+			return nil, NewResponse(StatusFieldAlreadyExists,
+				fmt.Sprintf("Field %s is defined by template %s and the table", field.Name, template))
+		}
+	}
+	return append(combined, fields...), nil
+}
+
+// readIndex reads the index file of the schema
+func (s *Schema) readIndex() (*schemaIndex, error) {
+	lock := tableLock(schemaIndexPath(s.schemaPath))
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return s.readIndexLocked()
+}
+
+// readIndexLocked reads the index file, the caller must hold its lock
+func (s *Schema) readIndexLocked() (*schemaIndex, error) {
+	index := &schemaIndex{}
+	data, err := readFile(s.db.storage(), schemaIndexPath(s.schemaPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of schema '%s': %w", s.name, err)
+	}
+	if len(data) == 0 {
+		return index, nil
+	}
+
+	err = json.Unmarshal(data, index)
+	if err != nil {
+		return nil, fmt.Errorf("%w: index of schema '%s' can't be parsed: %v", ErrCorrupt, s.name, err)
+	}
+	return index, nil
+}
+
+// updateIndex applies change to the index file of the schema and replaces it
+// through a temporary file
+func (s *Schema) updateIndex(change func(*schemaIndex)) error {
+	if s.db.isReadOnlySchema(s.name) {
+		return fmt.Errorf("schema '%s': %w", s.name, ErrReadOnly)
+	}
+
+	path := schemaIndexPath(s.schemaPath)
+	lock := tableLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	index, err := s.readIndexLocked()
+	if err != nil {
+		return err
+	}
+	change(index)
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize index of schema '%s': %v", s.name, err)
+	}
+
+	store := s.db.storage()
+	err = writeFile(store, path+".temp", data, s.db.fileMode())
+	if err == nil {
+		err = store.Rename(path+".temp", path)
+	}
+	if err != nil {
+		store.Remove(path + ".temp")
+		return fmt.Errorf("failed to write index of schema '%s': %w", s.name, err)
+	}
+	return nil
+}
@@ -6,7 +6,12 @@
 package hartoDb_go
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,13 +19,91 @@ import (
 
 // Transaction represents a database transaction
 type Transaction struct {
-	ID            uint64               // Unique transaction ID
-	StartTime     time.Time            // When the transaction started
-	Status        TransactionStatus    // Current status of the transaction
-	LockedRecords map[string]int64     // Map of tableName:recordID for locked records
-	StagedRecords map[string][]*Record // Map of tableName:records for staged changes
-	db            *HTDB                // Reference to the database
-	mu            sync.Mutex           // Mutex for concurrent access
+	ID            uint64                   // Unique transaction ID
+	StartTime     time.Time                // When the transaction started
+	Status        TransactionStatus        // Current status of the transaction
+	LockedRecords map[string]int64         // Ids of the locked records by schema:table:id
+	StagedRecords map[string][]*Record     // Staged changes by schema:table
+	db            *HTDB                    // Reference to the database
+	mu            sync.Mutex               // Mutex for concurrent access
+	stagedTables  map[string]*Table        // Tables of the staged records by schema:table
+	skipTriggers  bool                     // Set by imports and restores, which must not run triggers
+	beginErr      error                    // Set if the transaction was begun on a closing database
+	actor         string                   // Who the changes are made for, see SetActor
+	tags          map[string]string        // See SetTag
+	spills        map[string]*stagingSpill // Staging files by schema:table, see SetStagingLimit
+	result        *CommitResult            // Set once committed, see CommitResult
+
+	stagedGenerations map[string]uint64 // Table definitions the records were staged against, see ddlLocks
+	stagedLayouts     map[string]string // Layout hashes of the tables when first staged to, by table file
+}
+
+// SetActor records who the changes of the transaction are made for, such as
+// "user:42". The change log keeps it with every change of the transaction.
+func (tx *Transaction) SetActor(actor string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.actor = actor
+}
+
+// Actor returns who the changes of the transaction are made for, see SetActor
+func (tx *Transaction) Actor() string {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.actor
+}
+
+// SetTag attaches a key/value tag to the transaction, such as "source" =
+// "importer". Tags are carried into the change events and the change log of
+// its commit, the commit log lines and ActiveTransactions. An empty value
+// removes the tag.
+func (tx *Transaction) SetTag(key, value string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if value == "" {
+		delete(tx.tags, key)
+		return
+	}
+	if tx.tags == nil {
+		tx.tags = make(map[string]string)
+	}
+	tx.tags[key] = value
+}
+
+// Tags returns a copy of the tags of the transaction, see SetTag
+func (tx *Transaction) Tags() map[string]string {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.copyTags()
+}
+
+// copyTags returns a copy of the tags, nil without tags. The caller must hold mu.
+func (tx *Transaction) copyTags() map[string]string {
+	if len(tx.tags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(tx.tags))
+	for key, value := range tx.tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+// logAttrs returns the actor and tags of the transaction as log key/value
+// pairs, if it has any. The caller must hold mu.
+func (tx *Transaction) logAttrs() []any {
+	var attrs []any
+	if tx.actor != "" {
+		attrs = append(attrs, "actor", tx.actor)
+	}
+	if len(tx.tags) > 0 {
+		attrs = append(attrs, "tags", tx.copyTags())
+	}
+	return attrs
 }
 
 // TransactionStatus represents the status of a transaction
@@ -30,13 +113,75 @@ const (
 	TransactionActive TransactionStatus = iota
 	TransactionCommitted
 	TransactionRolledBack
+	TransactionFailed // A commit failed after some tables were written, see CommitError
 )
 
+// CommitError is returned when a commit fails. Tables are committed one at a
+// time in name order, Applied lists the tables written before the failure and
+// NotApplied the failed table and every table after it. If Applied isn't
+// empty the transaction is TransactionFailed and can't be retried or rolled back.
+type CommitError struct {
+	TransactionID uint64
+	Table         string   // Table whose commit failed, as schema:table like Applied and NotApplied
+	Applied       []string // Tables whose records were written
+	NotApplied    []string // Tables whose records were not written
+	Err           error
+}
+
+func (e *CommitError) Error() string {
+	return fmt.Sprintf("commit of transaction %d failed on table '%s' (%d of %d tables applied): %v",
+		e.TransactionID, e.Table, len(e.Applied), len(e.Applied)+len(e.NotApplied), e.Err)
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// Partial reports whether some tables were written before the commit failed
+func (e *CommitError) Partial() bool {
+	return len(e.Applied) > 0
+}
+
+// RollbackError is returned when the records of some tables couldn't be
+// unlocked during a rollback. The staged records are discarded either way.
+type RollbackError struct {
+	TransactionID uint64
+	RolledBack    []string         // Tables whose records were unlocked, as schema:table
+	Failed        map[string]error // Tables whose records may still be locked, with the reason
+}
+
+func (e *RollbackError) Error() string {
+	tables := make([]string, 0, len(e.Failed))
+	for table := range e.Failed {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	messages := make([]string, len(tables))
+	for i, table := range tables {
+		messages[i] = fmt.Sprintf("%s: %v", table, e.Failed[table])
+	}
+	return fmt.Sprintf("rollback of transaction %d failed for %d tables: %s",
+		e.TransactionID, len(tables), strings.Join(messages, "; "))
+}
+
+func (e *RollbackError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// errTableAltered is returned for records staged against an outdated table definition
+var errTableAltered = fmt.Errorf("%w: %w, reload the table and stage the records again", ErrWriteConflict, ErrSchemaChanged)
+
 // Global transaction counter for generating unique IDs
 var transactionCounter uint64 = 0
 
 // NewTransaction creates a new transaction
 func NewTransaction(db *HTDB) *Transaction {
+	db.metricsSink().Inc(MetricTransactionsBegun, 1)
 	return &Transaction{
 		ID:            atomic.AddUint64(&transactionCounter, 1),
 		StartTime:     time.Now(),
@@ -44,9 +189,28 @@ func NewTransaction(db *HTDB) *Transaction {
 		LockedRecords: make(map[string]int64),
 		StagedRecords: make(map[string][]*Record),
 		db:            db,
+		stagedTables:  make(map[string]*Table),
+
+		stagedGenerations: make(map[string]uint64),
+		stagedLayouts:     make(map[string]string),
 	}
 }
 
+// checkActive returns ErrClosed once the database is closed and ErrTxNotActive
+// if the transaction has ended. The caller must hold the transaction mutex.
+func (tx *Transaction) checkActive() error {
+	if tx.beginErr != nil {
+		return tx.beginErr
+	}
+	if err := tx.db.checkOpen(); err != nil {
+		return err
+	}
+	if tx.Status != TransactionActive {
+		return ErrTxNotActive
+	}
+	return nil
+}
+
 // LockRecord locks a record for this transaction
 func (tx *Transaction) LockRecord(table *Table, record *Record) error {
 	tx.mu.Lock()
@@ -58,34 +222,103 @@ func (tx *Transaction) LockRecord(table *Table, record *Record) error {
 // lockRecordInternal locks a record without acquiring the transaction mutex
 // This is used internally by methods that already hold the transaction mutex
 func (tx *Transaction) lockRecordInternal(table *Table, record *Record) error {
-	if tx.Status != TransactionActive {
-		return fmt.Errorf("transaction is not active")
+	if err := tx.checkActive(); err != nil {
+		return err
 	}
 
-	// Try to lock the record
-	err := record.Lock(tx.ID)
-	if err != nil {
-		return err
+	// Another transaction may hold the record through a different copy
+	if owner, locked := tx.db.recordLocks.tryLock(recordLockKey{table: tableCacheKey(table), id: record.ID}, tx.ID); !locked {
+		tx.db.metricsSink().Inc(MetricLockConflicts, 1)
+		return newRecordError(table, record.ID, &LockError{ID: record.ID, TransactionID: owner})
+	}
+
+	// The lock is ours, a flag left on this copy by an earlier owner is outdated
+	if record.Lock(tx.ID) != nil {
+		record.Unlock()
+		record.Lock(tx.ID)
 	}
 
 	// Add to locked records
-	key := fmt.Sprintf("%s:%d", table.TableName, record.ID)
+	key := fmt.Sprintf("%s:%d", table.qualifiedName(), record.ID)
 	tx.LockedRecords[key] = record.ID
 
 	return nil
 }
 
-// StageUpdate stages an update to a record
+// StageUpdate stages an update to a record. The before-update triggers of the
+// table run on the staged copy before it is validated and ref values are
+// written. Every problem with the updated record is returned as ValidationErrors.
 func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[string]interface{}) (*Record, error) {
+	return tx.stageUpdate(table, record, updates, "")
+}
+
+// stageUpdate stages an update, see StageUpdateIfVersion for expectedVersion
+func (tx *Transaction) stageUpdate(table *Table, record *Record, updates map[string]interface{}, expectedVersion string) (*Record, error) {
+	if err := checkVersion(table, record, expectedVersion); err != nil {
+		return nil, err
+	}
+	staging, err := tx.prepareUpdate(table, record, updates)
+	if err != nil {
+		return nil, err
+	}
+	staging.expectedVersion = expectedVersion
+
+	// Triggers run without the transaction mutex so they may stage further changes
+	err = tx.runTriggers(table, BeforeUpdate, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateRecord(table, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	// New ref values are written to the ref files at commit
+	for _, field := range table.Fields {
+		if field.Type != "ref" || staging.FieldsMeta[field.Name].IsNull {
+			continue
+		}
+		value, exists := staging.FieldsData[field.Name]
+		if !exists {
+			continue
+		}
+		_, updated := updates[field.Name]
+		if !updated && value == record.FieldsData[field.Name] {
+			continue // Unchanged, the offsets of the old version still apply
+		}
+
+		if _, ok := value.(string); !ok {
+			return nil, fmt.Errorf("field '%s' requires a string value", field.Name)
+		}
+		staging.setRefPending(field.Name)
+	}
+
+	err = tx.stage(table, staging)
+	if err != nil {
+		return nil, err
+	}
+	return staging, nil
+}
+
+// prepareUpdate locks the record and returns a staging copy with the updates applied
+func (tx *Transaction) prepareUpdate(table *Table, record *Record, updates map[string]interface{}) (*Record, error) {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	if tx.Status != TransactionActive {
-		return nil, fmt.Errorf("transaction is not active")
+	if err := tx.checkActive(); err != nil {
+		return nil, err
+	}
+	if err := table.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if record.Metadata.IsDeleted {
+		return nil, newRecordError(table, record.ID, fmt.Errorf("%w: record was deleted", ErrWriteConflict))
 	}
 
 	// Lock the record if not already locked
-	key := fmt.Sprintf("%s:%d", table.TableName, record.ID)
+	key := fmt.Sprintf("%s:%d", table.qualifiedName(), record.ID)
 	if _, exists := tx.LockedRecords[key]; !exists {
 		err := tx.lockRecordInternal(table, record)
 		if err != nil {
@@ -94,254 +327,542 @@ func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[str
 	}
 
 	// Create a staging copy
-	staging, err := record.Clone(tx.ID)
+	staging, err := record.Clone(tx.db, tx.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Apply updates
+	// Apply updates, unknown fields and bad values are reported by the validation.
+	// Ref values are written to the ref file once the triggers ran.
 	for field, value := range updates {
-		// Check if field exists in the table schema
-		fieldExists := false
-		var fieldDef Field
-		for _, f := range table.Fields {
-			if f.Name == field {
-				fieldExists = true
-				fieldDef = f
-				break
-			}
+		if value == nil {
+			staging.FieldsMeta[field] = FieldMetadata{IsNull: true}
+			delete(staging.FieldsData, field)
+			delete(staging.RefOffsets, field)
+			delete(staging.pendingRefs, field)
+			continue
 		}
 
-		if !fieldExists {
-			return nil, fmt.Errorf("field '%s' does not exist in table '%s'", field, table.TableName)
-		}
+		staging.FieldsData[field] = value
+		staging.FieldsMeta[field] = FieldMetadata{IsNull: false}
+	}
 
-		// Handle ref fields specially
-		if fieldDef.Type == "ref" {
-			if value == nil {
-				staging.FieldsMeta[field] = FieldMetadata{IsNull: true}
-				delete(staging.FieldsData, field)
-				delete(staging.RefOffsets, field)
-			} else {
-				strValue, ok := value.(string)
-				if !ok {
-					return nil, fmt.Errorf("field '%s' requires a string value", field)
-				}
+	return staging, nil
+}
 
-				// Store the value in the ref file
-				err := staging.WriteRefData(table.SchemaPath, table.TableName, field, strValue)
-				if err != nil {
-					return nil, err
-				}
+// StageDelete stages a delete operation for a record. The before-delete
+// triggers of the table can veto it.
+func (tx *Transaction) StageDelete(table *Table, record *Record) error {
+	return tx.stageDelete(table, record, "")
+}
 
-				staging.FieldsData[field] = strValue
-				staging.FieldsMeta[field] = FieldMetadata{IsNull: false}
-			}
-		} else {
-			// Regular field
-			if value == nil {
-				staging.FieldsMeta[field] = FieldMetadata{IsNull: true}
-				delete(staging.FieldsData, field)
-			} else {
-				staging.FieldsData[field] = value
-				staging.FieldsMeta[field] = FieldMetadata{IsNull: false}
-			}
-		}
+// stageDelete stages a delete, see StageDeleteIfVersion for expectedVersion
+func (tx *Transaction) stageDelete(table *Table, record *Record, expectedVersion string) error {
+	if err := checkVersion(table, record, expectedVersion); err != nil {
+		return err
 	}
+	staging, err := tx.prepareDelete(table, record)
+	if err != nil {
+		return err
+	}
+	staging.expectedVersion = expectedVersion
 
-	// Add to staged records
-	if _, exists := tx.StagedRecords[table.TableName]; !exists {
-		tx.StagedRecords[table.TableName] = []*Record{}
+	err = tx.runTriggers(table, BeforeDelete, staging)
+	if err != nil {
+		return err
 	}
-	tx.StagedRecords[table.TableName] = append(tx.StagedRecords[table.TableName], staging)
 
-	return staging, nil
+	return tx.stage(table, staging)
 }
 
-// StageDelete stages a delete operation for a record
-func (tx *Transaction) StageDelete(table *Table, record *Record) error {
+// prepareDelete locks the record and returns a staging copy marked as deleted
+func (tx *Transaction) prepareDelete(table *Table, record *Record) (*Record, error) {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	if tx.Status != TransactionActive {
-		return fmt.Errorf("transaction is not active")
+	if err := tx.checkActive(); err != nil {
+		return nil, err
+	}
+	if err := table.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if record.Metadata.IsDeleted {
+		return nil, newRecordError(table, record.ID, fmt.Errorf("%w: record was deleted", ErrWriteConflict))
 	}
 
 	// Lock the record if not already locked
-	key := fmt.Sprintf("%s:%d", table.TableName, record.ID)
+	key := fmt.Sprintf("%s:%d", table.qualifiedName(), record.ID)
 	if _, exists := tx.LockedRecords[key]; !exists {
 		err := tx.lockRecordInternal(table, record)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	// Create a staging copy
-	staging, err := record.Clone(tx.ID)
+	staging, err := record.Clone(tx.db, tx.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Mark as deleted
 	staging.Metadata.IsDeleted = true
-
-	// Add to staged records
-	if _, exists := tx.StagedRecords[table.TableName]; !exists {
-		tx.StagedRecords[table.TableName] = []*Record{}
-	}
-	tx.StagedRecords[table.TableName] = append(tx.StagedRecords[table.TableName], staging)
-
-	return nil
+	return staging, nil
 }
 
-// Global counter for generating unique IDs
-var recordIDCounter int64 = 0
-
-// StageInsert stages a new record for insertion
+// StageInsert stages a new record for insertion. The before-insert triggers of
+// the table run on the new record before it is validated and ref values are
+// written. Every problem with the record is returned as ValidationErrors.
 func (tx *Transaction) StageInsert(table *Table, data map[string]interface{}) (*Record, error) {
 	tx.mu.Lock()
-	defer tx.mu.Unlock()
-
-	if tx.Status != TransactionActive {
-		return nil, fmt.Errorf("transaction is not active")
+	err := tx.checkActive()
+	tx.mu.Unlock()
+	if err == nil {
+		err = table.checkWritable()
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Generate a new ID with a counter to ensure uniqueness
-	id := time.Now().UnixNano() + atomic.AddInt64(&recordIDCounter, 1)
+	// Ids of a database strictly increase
+	id := tx.db.nextID()
 
 	// Create a new record
 	record := NewRecord(id, data)
 	record.Metadata.IsLocked = true
 	record.Metadata.TransactionID = tx.ID
 
+	err = tx.runTriggers(table, BeforeInsert, record)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateRecord(table, record)
+	if err != nil {
+		return nil, err
+	}
+
 	// Handle ref fields
 	for _, field := range table.Fields {
 		if field.Type == "ref" {
-			value, exists := data[field.Name]
+			value, exists := record.FieldsData[field.Name]
 			if !exists || value == nil {
 				continue
 			}
 
-			strValue, ok := value.(string)
-			if !ok {
+			if _, ok := value.(string); !ok {
 				return nil, fmt.Errorf("field '%s' requires a string value", field.Name)
 			}
 
-			// Store the value in the ref file
-			err := record.WriteRefData(table.SchemaPath, table.TableName, field.Name, strValue)
-			if err != nil {
-				return nil, err
-			}
+			// The value is written to the ref file at commit
+			record.setRefPending(field.Name)
 		}
 	}
 
-	// Add to staged records
-	if _, exists := tx.StagedRecords[table.TableName]; !exists {
-		tx.StagedRecords[table.TableName] = []*Record{}
+	err = tx.stage(table, record)
+	if err != nil {
+		return nil, err
 	}
-	tx.StagedRecords[table.TableName] = append(tx.StagedRecords[table.TableName], record)
-
 	return record, nil
 }
 
+// stage adds a prepared record to the staged records of its table
+func (tx *Transaction) stage(table *Table, record *Record) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.checkActive(); err != nil {
+		return err
+	}
+
+	// Every record of a table must be staged against the same definition
+	key := tableCacheKey(table)
+	if generation, exists := tx.stagedGenerations[key]; exists && generation != table.generation {
+		return newTableError(table, errTableAltered)
+	}
+	tx.stagedGenerations[key] = table.generation
+	if _, exists := tx.stagedLayouts[key]; !exists {
+		tx.stagedLayouts[key] = table.Layout().Hash()
+	}
+
+	// Add to staged records, same-named tables of other schemas are kept apart
+	name := table.qualifiedName()
+	if _, exists := tx.StagedRecords[name]; !exists {
+		tx.StagedRecords[name] = []*Record{}
+	}
+	tx.StagedRecords[name] = append(tx.StagedRecords[name], record)
+	tx.stagedTables[name] = table
+
+	// Records that can't be spilled stay in memory
+	err := tx.spillLocked(table, name)
+	if err != nil {
+		tx.db.log(slog.LevelWarn, "failed to spill staged records",
+			"transaction", tx.ID, "schema", table.schemaName(), "table", table.TableName, "error", err)
+	}
+	return nil
+}
+
+// checkLayout fails with ErrSchemaChanged if the fields of table no longer
+// match the ones its records were staged against
+func (tx *Transaction) checkLayout(table *Table) error {
+	staged, exists := tx.stagedLayouts[tableCacheKey(table)]
+	if !exists || staged == table.Layout().Hash() {
+		return nil
+	}
+
+	tx.db.log(slog.LevelWarn, "table changed during the transaction, commit refused",
+		"transaction", tx.ID, "schema", table.schemaName(), "table", table.TableName)
+	return newTableError(table, errTableAltered)
+}
+
 // Commit commits the transaction
 func (tx *Transaction) Commit() error {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	if tx.Status != TransactionActive {
-		return fmt.Errorf("transaction is not active")
+	if err := tx.checkActive(); err != nil {
+		return err
+	}
+	if err := tx.loadSpilledLocked(); err != nil {
+		return err
 	}
 
-	// Process each table's staged records
-	for tableName, records := range tx.StagedRecords {
-		// Get the table
-		table, err := GetTable(tableName, tx.db.GetMainPath())
-		if err != nil {
-			fmt.Println(err)
-			return fmt.Errorf("failed to get table '%s': %v", tableName, err)
+	// Structure changes of the tables wait until every record is written
+	tableNames := tx.stagedTableNames()
+	keys := tx.commitKeys()
+	generations := tx.db.ddl.beginCommit(keys)
+	defer tx.db.ddl.endCommit(keys)
+	for _, tableName := range tableNames {
+		table := tx.stagedTables[tableName]
+		key := tableCacheKey(table)
+		if generations[key] != tx.stagedGenerations[key] {
+			return &CommitError{
+				TransactionID: tx.ID,
+				Table:         tableName,
+				NotApplied:    tableNames,
+				Err:           newTableError(table, errTableAltered),
+			}
 		}
+	}
 
-		// Get existing records to update their is_current flag
-		existingRecords, err := table.GetAllRecords()
+	// The configuration may also have been changed on disk, by hand or by another process
+	for _, tableName := range tableNames {
+		current, err := tx.db.getTable(tableName)
+		if errors.Is(err, ErrSchemaMismatch) {
+			err = fmt.Errorf("%w: %w", errTableAltered, err)
+		} else if err == nil {
+			err = tx.checkLayout(current)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to get existing records for table '%s': %v", tableName, err)
+			return &CommitError{TransactionID: tx.ID, Table: tableName, NotApplied: tableNames, Err: err}
 		}
+	}
 
-		// Update existing records' is_current flag
-		for _, staged := range records {
-			for _, existing := range existingRecords {
-				// If this is an update to an existing record (not a new insert)
-				if existing.FieldsData["id"] == staged.FieldsData["id"] && !staged.Metadata.IsDeleted {
-					existing.Metadata.IsCurrent = false
+	// Quotas are checked before any table file is written
+	tables := make([]*Table, len(tableNames))
+	added := make([]int64, len(tableNames))
+	for i, tableName := range tableNames {
+		tables[i] = tx.stagedTables[tableName]
+		added[i] = int64(len(tx.StagedRecords[tableName]) * tables[i].RecordSize())
+	}
+	err := tx.db.checkQuotas(tables, added)
+	if err != nil {
+		failed := tableNames[0]
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			for i := len(tables) - 1; i >= 0; i-- {
+				if tables[i].schemaName() == quotaErr.Schema && (quotaErr.Table == "" || quotaErr.Table == tables[i].TableName) {
+					failed = tableNames[i]
 				}
 			}
 		}
+		return &CommitError{TransactionID: tx.ID, Table: failed, NotApplied: tableNames, Err: err}
+	}
 
-		// Mark staged records as current and not locked
-		for _, record := range records {
-			record.Metadata.IsCurrent = true
-			record.Metadata.IsLocked = false
-			record.Metadata.TransactionID = 0
+	// Expected versions are checked again by commitTable, under the table's lock
+	for i, tableName := range tableNames {
+		err := checkStagedVersions(tables[i], tx.StagedRecords[tableName])
+		if err != nil {
+			return &CommitError{TransactionID: tx.ID, Table: tableName, NotApplied: tableNames, Err: err}
 		}
+	}
 
-		// Append all records (existing and staged) to the table file
-		err = table.WriteRecords(append(existingRecords, records...))
+	// Process each table's staged records
+	start := time.Now()
+	result := &CommitResult{TransactionID: tx.ID, Tables: make(map[string]TableCommitResult, len(tableNames))}
+	for i, tableName := range tableNames {
+		records := tx.StagedRecords[tableName]
+		tableResult, err := tx.commitTable(tableName, records, start)
 		if err != nil {
-			return fmt.Errorf("failed to write records to table '%s': %v", tableName, err)
+			commitErr := &CommitError{
+				TransactionID: tx.ID,
+				Table:         tableName,
+				Applied:       tableNames[:i],
+				NotApplied:    tableNames[i:],
+				Err:           err,
+			}
+			if commitErr.Partial() {
+				tx.Status = TransactionFailed
+				tx.db.recordLocks.releaseAll(tx.ID)
+			}
+			tx.db.log(slog.LevelError, "transaction commit failed", append([]any{
+				"transaction", tx.ID, "table", tableName, "applied", i, "error", err}, tx.logAttrs()...)...)
+			return commitErr
 		}
+		result.Tables[tableName] = tableResult
 	}
+	result.Duration = time.Since(start)
 
 	// Update transaction status
 	tx.Status = TransactionCommitted
+	tx.result = result
+	tx.db.recordLocks.releaseAll(tx.ID)
+
+	if tx.db.hasQuotas() {
+		for _, table := range tables {
+			tx.db.usage.refresh(table)
+		}
+	}
+
+	metrics := tx.db.metricsSink()
+	metrics.Inc(MetricTransactionsCommitted, 1)
+	metrics.Observe(MetricCommitDuration, result.Duration.Seconds())
+	result.observe(metrics)
+
+	duration := result.Duration
+	written := result.Records()
+	tx.db.log(slog.LevelDebug, "transaction committed", append([]any{
+		"transaction", tx.ID, "tables", len(tx.StagedRecords), "records", written,
+		"bytes", result.BytesWritten(), "duration", duration},
+		tx.logAttrs()...)...)
+
+	// Commits at or above the slow commit threshold are logged as warnings
+	threshold := time.Duration(tx.db.slowCommitThreshold.Load())
+	if threshold > 0 && duration >= threshold {
+		metrics.Inc(MetricSlowCommits, 1)
+		tx.db.log(slog.LevelWarn, "slow commit", append([]any{
+			"transaction", tx.ID, "tables", tableNames, "records", written, "duration", duration},
+			tx.logAttrs()...)...)
+	}
 
 	return nil
 }
 
+// commitTable writes the staged records of a single table, stamped with the
+// commit time and the transaction, and returns what it wrote. The table's
+// write lock is held for the whole read-modify-write cycle so concurrent
+// commits can't lose each other's records.
+func (tx *Transaction) commitTable(tableName string, records []*Record, committedAt time.Time) (TableCommitResult, error) {
+	result := countChanges(records)
+
+	// Get the table
+	table, err := tx.db.getTable(tableName)
+	if err != nil {
+		return result, fmt.Errorf("failed to get table '%s': %w", tableName, err)
+	}
+
+	start := time.Now()
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+	tx.db.metricsSink().Observe(MetricTableLockWait, time.Since(start).Seconds())
+
+	// Checked again under the lock, the records would be written with the new fields
+	err = tx.checkLayout(table)
+	if err != nil {
+		return result, err
+	}
+
+	// Get existing records to update their is_current flag
+	existingRecords, err := table.allRecords()
+	if err != nil {
+		return result, fmt.Errorf("failed to get existing records for table '%s': %w", tableName, err)
+	}
+
+	// Updates and deletes of a given version fail if it was replaced meanwhile
+	err = checkReplacedVersions(table, existingRecords, records)
+	if err != nil {
+		return result, err
+	}
+
+	// Versions replaced by an update or delete are no longer current
+	replaced := make(map[int64]bool)
+	for _, staged := range records {
+		if staged.previousID != 0 {
+			replaced[staged.previousID] = true
+		}
+	}
+	for _, existing := range existingRecords {
+		if replaced[existing.ID] {
+			existing.Metadata.IsCurrent = false
+		}
+	}
+
+	// Mark staged records as current and not locked, unless a later one of the
+	// transaction replaced them
+	for _, record := range records {
+		record.Metadata.IsCurrent = !replaced[record.ID]
+		record.Metadata.IsLocked = false
+		record.Metadata.TransactionID = 0
+		record.Metadata.CommittedAt = committedAt.UnixNano()
+		record.Metadata.CommittedBy = tx.ID
+	}
+
+	// Ref values go first, the records carry their offsets
+	result.BytesWritten, err = table.writePendingRefs(records)
+	if err != nil {
+		return result, fmt.Errorf("failed to write ref data of table '%s': %w", tableName, err)
+	}
+
+	// Append all records (existing and staged) to the table file
+	allRecords := append(existingRecords, records...)
+	err = table.writeRecords(allRecords)
+	if err != nil {
+		return result, fmt.Errorf("failed to write records to table '%s': %w", tableName, err)
+	}
+	result.BytesWritten += int64(len(allRecords) * table.RecordSize())
+	for _, record := range records {
+		record.pendingRefs = nil
+	}
+
+	// Counts and the id range are read without a scan, see Table.Count
+	summary := table.summarize(allRecords)
+	err = table.writeSummary(summary)
+	if err != nil {
+		tx.db.log(slog.LevelWarn, "failed to update table summary",
+			"schema", table.schemaName(), "table", table.TableName, "error", err)
+	}
+
+	// The records are committed, a stale index only slows queries down until it is rebuilt
+	err = table.updateIndexes(len(existingRecords), allRecords)
+	if err != nil {
+		tx.db.log(slog.LevelWarn, "failed to update indexes",
+			"schema", table.schemaName(), "table", table.TableName, "error", err)
+	}
+
+	// Existing records keep their position, the staged ones follow them
+	if tx.db.tableManager != nil {
+		tx.db.tableManager.primaryKeys.appended(table, len(existingRecords), records)
+		tx.db.tableManager.checkCompactionThreshold(table, len(allRecords)-summary.Current, len(allRecords))
+	}
+
+	// The records are committed, failing the table now would let a retry write them twice
+	if tx.db.changes != nil {
+		err = tx.db.changes.appendCommit(tx, table, records, table.durability())
+		if err != nil {
+			tx.db.log(slog.LevelError, "failed to log changes",
+				"transaction", tx.ID, "schema", table.schemaName(), "table", table.TableName, "error", err)
+		}
+	}
+
+	tx.db.log(slog.LevelDebug, "table committed",
+		"transaction", tx.ID, "schema", filepath.Base(table.SchemaPath), "table", table.TableName,
+		"records", len(records), "duration", time.Since(start))
+
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
 // Rollback rolls back the transaction
 func (tx *Transaction) Rollback() error {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	if tx.Status != TransactionActive {
-		return fmt.Errorf("transaction is not active")
+	if err := tx.checkActive(); err != nil {
+		return err
 	}
 
 	// No need to do anything with staged records, they will be ignored
-	// Just unlock any locked records
-	for tableName, _ := range tx.StagedRecords {
-		// Get the table
-		table, err := GetTable(tableName, tx.db.GetMainPath())
-		if err != nil {
-			return fmt.Errorf("failed to get table '%s': %v", tableName, err)
-		}
+	tx.removeSpillsLocked()
 
-		// Get existing records to unlock them
-		existingRecords, err := table.GetAllRecords()
+	// Just unlock any locked records, trying every table even if one fails
+	rollbackErr := &RollbackError{TransactionID: tx.ID, Failed: make(map[string]error)}
+	for _, tableName := range tx.stagedTableNames() {
+		err := tx.rollbackTable(tableName)
 		if err != nil {
-			return fmt.Errorf("failed to get existing records for table '%s': %v", tableName, err)
+			rollbackErr.Failed[tableName] = err
+			continue
 		}
+		rollbackErr.RolledBack = append(rollbackErr.RolledBack, tableName)
+	}
 
-		// Unlock records
-		for _, existing := range existingRecords {
-			if existing.Metadata.IsLocked && existing.Metadata.TransactionID == tx.ID {
-				existing.Metadata.IsLocked = false
-				existing.Metadata.TransactionID = 0
-			}
-		}
+	// Update transaction status
+	tx.Status = TransactionRolledBack
+	tx.db.recordLocks.releaseAll(tx.ID)
 
-		// Write the updated records back to the table
-		err = table.WriteRecords(existingRecords)
-		if err != nil {
-			return fmt.Errorf("failed to write records to table '%s': %v", tableName, err)
+	tx.db.metricsSink().Inc(MetricTransactionsRolledBack, 1)
+	tx.db.log(slog.LevelDebug, "transaction rolled back", "transaction", tx.ID, "tables", len(tx.StagedRecords))
+
+	if len(rollbackErr.Failed) > 0 {
+		tx.db.log(slog.LevelError, "transaction rollback failed",
+			"transaction", tx.ID, "tables", len(rollbackErr.Failed), "error", rollbackErr)
+		return rollbackErr
+	}
+	return nil
+}
+
+// stagedTableNames returns the schema:table names of the tables with staged records, sorted
+func (tx *Transaction) stagedTableNames() []string {
+	names := make([]string, 0, len(tx.StagedRecords))
+	for tableName := range tx.StagedRecords {
+		names = append(names, tableName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rollbackTable unlocks the records of a single table that this transaction locked
+func (tx *Transaction) rollbackTable(tableName string) error {
+	// Get the table
+	table, err := tx.db.getTable(tableName)
+	if err != nil {
+		return fmt.Errorf("failed to get table '%s': %w", tableName, err)
+	}
+
+	lock := table.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Get existing records to unlock them
+	existingRecords, err := table.allRecords()
+	if err != nil {
+		return fmt.Errorf("failed to get existing records for table '%s': %w", tableName, err)
+	}
+
+	// Unlock records
+	for _, existing := range existingRecords {
+		if existing.Metadata.IsLocked && existing.Metadata.TransactionID == tx.ID {
+			existing.Metadata.IsLocked = false
+			existing.Metadata.TransactionID = 0
 		}
 	}
 
-	// Update transaction status
-	tx.Status = TransactionRolledBack
+	// Write the updated records back to the table
+	err = table.writeRecords(existingRecords)
+	if err != nil {
+		return fmt.Errorf("failed to write records to table '%s': %w", tableName, err)
+	}
 
 	return nil
 }
 
+// touchedIDs returns the ids of every record the transaction locked or staged
+func (tx *Transaction) touchedIDs() []int64 {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	var ids []int64
+	for _, id := range tx.LockedRecords {
+		ids = append(ids, id)
+	}
+	for _, records := range tx.StagedRecords {
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+	}
+	return ids
+}
+
 // Note: The actual implementations of GetTable, WriteRecords, and GetAllRecords
 // are in the Table.go file.
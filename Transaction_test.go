@@ -0,0 +1,190 @@
+// Transaction_test.go
+// Description: Tests of transactions of the HTDB library
+// Changes staged for tables of the same name in different schemas stay apart,
+// and a commit whose change log can't be written is still applied once
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stageNotes stages an update of the record with key 1 and an insert with key
+// 2 in the table, both with the given note
+func stageNotes(t *testing.T, tm *TableManager, tx *Transaction, table *Table, note string) {
+	t.Helper()
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	_, err = tx.StageUpdate(table, records[0], map[string]interface{}{"note": note})
+	if err != nil {
+		t.Fatalf("failed to stage update: %v", err)
+	}
+	_, err = tx.StageInsert(table, map[string]interface{}{"key": 2, "note": note})
+	if err != nil {
+		t.Fatalf("failed to stage insert: %v", err)
+	}
+}
+
+func TestSameTableNameInTwoSchemas(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	tables := map[string]*Table{
+		"a": createTestTable(t, db, "a", "users", noteFields),
+		"b": createTestTable(t, db, "b", "users", noteFields),
+	}
+	for schema, table := range tables {
+		insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "created in " + schema})
+	}
+
+	tx := tm.BeginTransaction()
+	for schema, table := range tables {
+		stageNotes(t, tm, tx, table, "rolled back in "+schema)
+	}
+	err := tm.RollbackTransaction(tx)
+	if err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	for schema, table := range tables {
+		want := fmt.Sprint(map[int64]string{1: "created in " + schema})
+		if got := fmt.Sprint(currentValues(t, tm, table)); got != want {
+			t.Errorf("%s:users after rollback = %s, want %s", schema, got, want)
+		}
+	}
+
+	// The rollback unlocked the records of both tables
+	tx = tm.BeginTransaction()
+	for schema, table := range tables {
+		stageNotes(t, tm, tx, table, "committed in "+schema)
+	}
+	err = tm.CommitTransaction(tx)
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	for schema, table := range tables {
+		note := "committed in " + schema
+		want := fmt.Sprint(map[int64]string{1: note, 2: note})
+		if got := fmt.Sprint(currentValues(t, tm, table)); got != want {
+			t.Errorf("%s:users after commit = %s, want %s", schema, got, want)
+		}
+	}
+}
+
+// Ref values are written once per field file at commit, so rows with ref
+// fields insert about as fast as the same rows stored inline
+func BenchmarkRefInserts(b *testing.B) {
+	const records = 1000
+	schemas := []struct {
+		name      string
+		valueType FieldTypes
+	}{
+		{"ref", "ref"},
+		{"inline", String},
+	}
+	for _, schema := range schemas {
+		b.Run(schema.name, func(b *testing.B) {
+			length := uint(refFieldLength)
+			if schema.valueType == String {
+				length = 256
+			}
+			fields := []Field{
+				{Name: "key", Type: Int, Length: 8},
+				{Name: "title", Type: schema.valueType, Length: length},
+				{Name: "body", Type: schema.valueType, Length: length},
+			}
+			db := openTestDB(b, filepath.Join(b.TempDir(), "db"))
+			db.SetDurability(DurabilityNone)
+			tm := db.GetTableManager()
+			body := strings.Repeat("body ", 40)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Commits read the table, every run starts with an empty one
+				b.StopTimer()
+				table := createTestTable(b, db, "s", fmt.Sprint("t", i), fields)
+				b.StartTimer()
+
+				tx := tm.BeginTransaction()
+				for key := 0; key < records; key++ {
+					data := map[string]interface{}{"key": key, "title": fmt.Sprint("title ", key), "body": body}
+					_, err := tx.StageInsert(table, data)
+					if err != nil {
+						b.Fatalf("failed to stage insert: %v", err)
+					}
+				}
+				err := tm.CommitTransaction(tx)
+				if err != nil {
+					b.Fatalf("failed to commit: %v", err)
+				}
+			}
+			b.ReportMetric(float64(b.N*records)/b.Elapsed().Seconds(), "records/s")
+		})
+	}
+}
+
+// failingWriteFile fails every write, like a full disk
+type failingWriteFile struct {
+	StorageFile
+}
+
+func (f failingWriteFile) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// The table file is written before the change log, a log that can't be written
+// leaves the commit applied instead of failing it for a retry to write again
+func TestChangeLogWriteFailure(t *testing.T) {
+	db := openTestDB(t, MemoryPath)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "s", "t", noteFields)
+	err := db.EnableChangeLog(ChangeLogOptions{})
+	if err != nil {
+		t.Fatalf("failed to enable change log: %v", err)
+	}
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 1, "note": "created"})
+
+	segment := db.changes.current
+	db.changes.current = failingWriteFile{segment}
+	tx := tm.BeginTransaction()
+	stageNotes(t, tm, tx, table, "committed")
+	err = tm.CommitTransaction(tx)
+	db.changes.current = segment
+	if err != nil {
+		t.Fatalf("commit failed with the change log: %v", err)
+	}
+	if tx.Status != TransactionCommitted {
+		t.Errorf("transaction status = %v, want committed", tx.Status)
+	}
+	if err = tm.CommitTransaction(tx); err == nil {
+		t.Errorf("committed the transaction twice")
+	}
+
+	want := fmt.Sprint(map[int64]string{1: "committed", 2: "committed"})
+	if got := fmt.Sprint(currentValues(t, tm, table)); got != want {
+		t.Errorf("current records = %s, want %s", got, want)
+	}
+	all, err := tm.GetAllRecords(table)
+	if err != nil {
+		t.Fatalf("failed to read records: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("table holds %d records, want 3", len(all))
+	}
+
+	// The log goes on after the failed write
+	insertTestRecord(t, tm, table, map[string]interface{}{"key": 3, "note": "logged"})
+	changes, err := db.ChangesSince(0, 0)
+	if err != nil {
+		t.Fatalf("failed to read changes: %v", err)
+	}
+	if len(changes) != 2 || changes[1].Values["note"] != "logged" {
+		t.Errorf("change log holds %+v, want the two logged inserts", changes)
+	}
+}
@@ -0,0 +1,165 @@
+// Trigger.go
+// Description: Table triggers for the HTDB library
+// Runs registered functions before staging and after committing table operations
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TriggerEvent is the table operation and phase a trigger runs for
+type TriggerEvent int
+
+const (
+	BeforeInsert TriggerEvent = iota
+	BeforeUpdate
+	BeforeDelete
+	AfterInsert
+	AfterUpdate
+	AfterDelete
+)
+
+// String returns the name of the event
+func (e TriggerEvent) String() string {
+	switch e {
+	case BeforeInsert:
+		return "before insert"
+	case BeforeUpdate:
+		return "before update"
+	case BeforeDelete:
+		return "before delete"
+	case AfterInsert:
+		return "after insert"
+	case AfterUpdate:
+		return "after update"
+	case AfterDelete:
+		return "after delete"
+	}
+	return fmt.Sprintf("trigger event %d", int(e))
+}
+
+// TriggerFunc is called with the transaction and the record of an operation.
+// Before-triggers get the staged record and may change its FieldsData, setting
+// a field to nil makes it null. An error vetoes the operation. After-triggers get the committed record.
+type TriggerFunc func(tx *Transaction, record *Record) error
+
+// triggerKey identifies the triggers of a table for one event
+type triggerKey struct {
+	table string // tableCacheKey of the table
+	event TriggerEvent
+}
+
+// triggerRegistry holds the registered triggers of a table manager
+type triggerRegistry struct {
+	triggers map[triggerKey][]TriggerFunc
+	mu       sync.RWMutex
+}
+
+// newTriggerRegistry creates an empty trigger registry
+func newTriggerRegistry() *triggerRegistry {
+	return &triggerRegistry{triggers: make(map[triggerKey][]TriggerFunc)}
+}
+
+// RegisterTrigger registers fn to run for event on a table. Triggers of the
+// same event run in registration order. Before-triggers run while the
+// operation is staged, after-triggers once the transaction has committed and
+// may start transactions of their own. Imports skip triggers.
+func (tm *TableManager) RegisterTrigger(schemaName, tableName string, event TriggerEvent, fn TriggerFunc) error {
+	if event < BeforeInsert || event > AfterDelete {
+		return fmt.Errorf("unknown trigger event %d", int(event))
+	}
+	if fn == nil {
+		return fmt.Errorf("trigger function is nil")
+	}
+
+	table, err := tm.GetTable(schemaName, tableName)
+	if err != nil {
+		return err
+	}
+
+	key := triggerKey{table: tableCacheKey(table), event: event}
+	tm.triggers.mu.Lock()
+	tm.triggers.triggers[key] = append(tm.triggers.triggers[key], fn)
+	tm.triggers.mu.Unlock()
+	return nil
+}
+
+// get returns the triggers of a table for event
+func (r *triggerRegistry) get(table *Table, event TriggerEvent) []TriggerFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.triggers[triggerKey{table: tableCacheKey(table), event: event}]
+}
+
+// run calls the triggers of a table for event, stopping at the first error
+func (r *triggerRegistry) run(tx *Transaction, table *Table, event TriggerEvent, record *Record) error {
+	for _, fn := range r.get(table, event) {
+		err := fn(tx, record)
+		if err != nil {
+			return fmt.Errorf("%s trigger on table '%s' failed: %v", event, table.TableName, err)
+		}
+	}
+	return nil
+}
+
+// runTriggers runs the triggers of a table for event unless the transaction
+// skips them
+func (tx *Transaction) runTriggers(table *Table, event TriggerEvent, record *Record) error {
+	if tx.skipTriggers || tx.db == nil || tx.db.tableManager == nil {
+		return nil
+	}
+
+	err := tx.db.tableManager.triggers.run(tx, table, event, record)
+	if err != nil {
+		return err
+	}
+	syncFieldsMeta(record)
+	return nil
+}
+
+// syncFieldsMeta updates the null flags of a record after a trigger changed
+// its FieldsData. Fields set to nil become null.
+func syncFieldsMeta(record *Record) {
+	for name, value := range record.FieldsData {
+		if value == nil {
+			delete(record.FieldsData, name)
+			delete(record.RefOffsets, name)
+		}
+		record.FieldsMeta[name] = FieldMetadata{IsNull: value == nil}
+	}
+}
+
+// runAfterTriggers runs the after-triggers for every record a committed
+// transaction wrote. Every record is handed to its triggers even if an earlier
+// one failed, the first error is returned.
+func (tm *TableManager) runAfterTriggers(tx *Transaction) error {
+	if tx.skipTriggers {
+		return nil
+	}
+
+	var firstErr error
+	for tableName, records := range tx.StagedRecords {
+		table := tx.stagedTables[tableName]
+		if table == nil {
+			continue
+		}
+
+		for _, record := range records {
+			event := AfterInsert
+			if record.Metadata.IsDeleted {
+				event = AfterDelete
+			} else if record.previousID != 0 {
+				event = AfterUpdate
+			}
+
+			err := tm.triggers.run(tx, table, event, record)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
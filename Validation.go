@@ -0,0 +1,204 @@
+// Validation.go
+// Description: Record validation for the HTDB library
+// Checks staged records against their table's fields and reports every problem at once
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Checks reported in ValidationError.Constraint besides the field constraints
+const (
+	CheckUnknownField = "unknown_field" // The table has no field of that name
+	CheckType         = "type"          // The value has the wrong type for the field
+	CheckLength       = "length"        // The value is longer than the field
+	CheckRange        = "range"         // The number doesn't fit the field without wrapping
+)
+
+// ValidationError is a single field problem of a record
+type ValidationError struct {
+	Field      string      `json:"field"`
+	Constraint string      `json:"constraint"` // A Constraint such as "not_null" or one of the Check constants
+	Value      interface{} `json:"value"`      // The offending value, nil for missing values
+	Message    string      `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("field '%s' (%s): %s", e.Field, e.Constraint, e.Message)
+}
+
+// Is matches ErrValidation, and ErrFieldNotFound for unknown fields
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation || (target == ErrFieldNotFound && e.Constraint == CheckUnknownField)
+}
+
+// ValidationErrors holds every problem found while validating a record
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, validationErr := range e {
+		messages[i] = validationErr.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.summary(), strings.Join(messages, "; "))
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, validationErr := range e {
+		errs[i] = validationErr
+	}
+	return errs
+}
+
+// summary describes the number of problems
+func (e ValidationErrors) summary() string {
+	if len(e) == 1 {
+		return "validation failed for 1 field"
+	}
+	return fmt.Sprintf("validation failed for %d fields", len(e))
+}
+
+// MarshalJSON encodes the errors as {"message": ..., "errors": [...]}
+func (e ValidationErrors) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Message string             `json:"message"`
+		Errors  []*ValidationError `json:"errors"`
+	}{
+		Message: e.summary(),
+		Errors:  []*ValidationError(e),
+	})
+}
+
+// validateRecord checks every value of a record against the table's fields.
+// Fields are checked in schema order, unknown fields in name order.
+func validateRecord(table *Table, record *Record) error {
+	var errs ValidationErrors
+	add := func(field, constraint string, value interface{}, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{
+			Field:      field,
+			Constraint: constraint,
+			Value:      value,
+			Message:    fmt.Sprintf(format, args...),
+		})
+	}
+
+	known := map[string]bool{"id": true} // Every record carries its id
+	for _, field := range table.Fields {
+		known[field.Name] = true
+
+		value, exists := record.FieldsData[field.Name]
+		isNull := record.FieldsMeta[field.Name].IsNull || !exists
+		if field.Type == "ref" && !record.FieldsMeta[field.Name].IsNull {
+			// Records read from disk only carry the offsets of their ref values
+			_, hasOffsets := record.RefOffsets[field.Name]
+			isNull = !exists && !hasOffsets
+		}
+
+		if isNull {
+			if hasConstraint(field, NotNull) {
+				add(field.Name, string(NotNull), nil, "value is required")
+			}
+			continue
+		}
+		if !exists {
+			continue
+		}
+
+		if !valueMatchesType(field.Type, value) {
+			add(field.Name, CheckType, value, "requires a value of type '%s', got %T", field.Type, value)
+			continue
+		}
+		if str, ok := value.(string); ok && field.Type == String && uint(len(str)) > field.capacity() {
+			add(field.Name, CheckLength, value, "value is %d bytes long, the field holds %d", len(str), field.capacity())
+		}
+		if message := numericRangeProblem(field, value, table.Layout().floatBits); message != "" {
+			add(field.Name, CheckRange, value, "%s", message)
+		}
+	}
+
+	var unknown []string
+	for name := range record.FieldsData {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		add(name, CheckUnknownField, record.FieldsData[name], "field does not exist in table '%s'", table.TableName)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// numericRangeProblem describes why a number can't be stored in a field
+// as it is, or returns "" if it can. Int fields hold signed integers of their
+// width. Float fields of layouts without floatBits store whole numbers from 0
+// to 2^64-1, fractions would be cut off.
+func numericRangeProblem(field Field, value interface{}, floatBits bool) string {
+	switch field.Type {
+	case Int:
+		n, ok := asInt64(value)
+		if !ok || field.Length >= 8 || field.Length == 0 {
+			return ""
+		}
+		bits := 8 * field.Length
+		low, high := int64(-1)<<(bits-1), int64(1)<<(bits-1)-1
+		if n < low || n > high {
+			return fmt.Sprintf("value %d doesn't fit the %d byte field, the allowed range is %d to %d", n, field.Length, low, high)
+		}
+	case Float:
+		f, ok := value.(float64)
+		if !ok || floatBits {
+			return ""
+		}
+		if f != math.Trunc(f) || f < 0 || f >= 1<<64 {
+			return fmt.Sprintf("value %v doesn't fit the field of this unmigrated table, the allowed range is whole numbers from 0 to %d", f, uint64(math.MaxUint64))
+		}
+	}
+	return ""
+}
+
+// hasConstraint reports whether a field has a constraint
+func hasConstraint(field Field, constraint Constraint) bool {
+	for _, c := range field.Constraints {
+		if c == constraint {
+			return true
+		}
+	}
+	return false
+}
+
+// valueMatchesType reports whether a Go value can be stored in a field of the given type
+func valueMatchesType(fieldType FieldTypes, value interface{}) bool {
+	switch fieldType {
+	case TimeID:
+		_, ok := value.(int64)
+		return ok
+	case Int:
+		switch value.(type) {
+		case int, int64:
+			return true
+		}
+		return false
+	case Float:
+		_, ok := value.(float64)
+		return ok
+	case String, "ref":
+		_, ok := value.(string)
+		return ok
+	case Bool:
+		_, ok := value.(bool)
+		return ok
+	}
+	return false
+}
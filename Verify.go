@@ -0,0 +1,431 @@
+// Verify.go
+// Description: File integrity verification for the HTDB library
+// Checks table, conf and ref files for damage, e.g. after an unclean shutdown
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Remediation suggests how to fix a problem found by Verify
+type Remediation string
+
+const (
+	RemediationRecover      Remediation = "recover"       // Run Recover, it finishes compactions and truncates torn trailing records
+	RemediationRebuildIndex Remediation = "rebuild_index" // Drop and rebuild the index, it is rebuilt on next use
+	RemediationCompact      Remediation = "compact"       // Run a cleanup pass, invalid ref values are nulled
+	RemediationRestore      Remediation = "restore"       // The data can't be repaired in place, restore it from a backup
+)
+
+// VerifyProblem is a single problem found by Verify
+type VerifyProblem struct {
+	File        string      // Path of the damaged file
+	Offset      int64       // Byte offset of the problem in the file, -1 for the whole file
+	Problem     string      // What is wrong
+	Remediation Remediation // Suggested fix
+}
+
+// VerifyReport is the result of Verify and VerifyTable
+type VerifyReport struct {
+	TablesChecked  int
+	RecordsChecked int
+	Problems       []VerifyProblem
+}
+
+// OK reports whether no problems were found
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// add records a problem
+func (r *VerifyReport) add(file string, offset int64, remediation Remediation, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, VerifyProblem{
+		File:        file,
+		Offset:      offset,
+		Problem:     fmt.Sprintf(format, args...),
+		Remediation: remediation,
+	})
+}
+
+// merge adds the counts and problems of another report
+func (r *VerifyReport) merge(other *VerifyReport) {
+	r.TablesChecked += other.TablesChecked
+	r.RecordsChecked += other.RecordsChecked
+	r.Problems = append(r.Problems, other.Problems...)
+}
+
+// Verify checks every table of every schema. Problems with the files are
+// returned in the report, the error is only set if verifying itself failed.
+func (db *HTDB) Verify() (*VerifyReport, error) {
+	report := &VerifyReport{}
+
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, schema := range schemas {
+		schemaPath := db.schemaPath(schema)
+		entries, err := db.storage().ReadDir(schemaPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema '%s': %v", schema, err)
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			path := filepath.Join(schemaPath, name)
+
+			// Leftovers of an interrupted compaction
+			if strings.HasSuffix(name, ".compact.journal") || strings.HasSuffix(name, compactionTempSuffix) {
+				report.add(path, -1, RemediationRecover, "leftover of an interrupted compaction")
+				continue
+			}
+			if isWriteTemp(name) {
+				report.add(path, -1, RemediationRecover, "leftover of an interrupted table write")
+				continue
+			}
+
+			if !strings.HasSuffix(name, ".conf"+fileEnding) || name == "index.conf"+fileEnding {
+				continue
+			}
+
+			tableName := strings.TrimSuffix(name, ".conf"+fileEnding)
+			table, err := db.getTable(schema + ":" + tableName)
+			if err != nil {
+				report.add(path, -1, RemediationRestore, "unreadable table configuration: %v", err)
+				continue
+			}
+
+			tableReport, err := db.tableManager.VerifyTable(table)
+			if err != nil {
+				return nil, err
+			}
+			report.merge(tableReport)
+		}
+	}
+
+	return report, nil
+}
+
+// RecoverReport is the result of Recover
+type RecoverReport struct {
+	Truncated []TruncatedTableError // Tables whose partial trailing record was cut off
+}
+
+// Recover repairs what an unclean shutdown can leave behind: interrupted
+// compactions are finished or reverted, temporary files of interrupted table
+// writes are removed and partial records at the end of table files are
+// truncated. The bytes of a partial record are lost. Staging files of
+// transactions that no longer exist are removed. Read-only
+// attached schemas are skipped. Each table is repaired under its write lock, so
+// Recover can run on a database in use.
+func (db *HTDB) Recover() (*RecoverReport, error) {
+	err := recoverCompactions(db.storage(), db.mainPath, db.logger.Load())
+	if err != nil {
+		return nil, err
+	}
+	for _, attached := range db.attachedSchemas() {
+		if !attached.ReadOnly {
+			err = recoverSchemaCompactions(db.storage(), attached.Path, db.logger.Load())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	report := &RecoverReport{}
+	schemas, err := db.SchemaNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range schemas {
+		if db.isReadOnlySchema(schema) {
+			continue
+		}
+		err = db.removeStagingFiles(db.schemaPath(schema))
+		if err != nil {
+			return nil, err
+		}
+		tableNames, err := db.TableNames(schema)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tableName := range tableNames {
+			table, err := db.getTable(schema + ":" + tableName)
+			if errors.Is(err, ErrSchemaMismatch) {
+				continue // The record size isn't known
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			removed, err := table.removeWriteTemps()
+			if err != nil {
+				return nil, err
+			}
+			for _, path := range removed {
+				db.log(slog.LevelInfo, "interrupted table write file removed", "file", path)
+			}
+
+			truncated, err := table.truncatePartialRecord()
+			if err != nil {
+				return nil, err
+			}
+			if truncated != nil {
+				db.log(slog.LevelWarn, "truncated partial record",
+					"schema", schema, "table", tableName, "offset", truncated.Offset, "bytes", truncated.Leftover)
+				report.Truncated = append(report.Truncated, *truncated)
+			}
+		}
+	}
+
+	recovery := &RecoveryStats{Time: time.Now().UTC(), TruncatedTables: len(report.Truncated)}
+	for _, truncated := range report.Truncated {
+		recovery.TruncatedBytes += truncated.Leftover
+	}
+	db.lastRecovery.Store(recovery)
+	return report, nil
+}
+
+// truncatePartialRecord cuts a partial record off the end of the table file.
+// It returns what was cut off, or nil if the file holds whole records only.
+func (t *Table) truncatePartialRecord() (*TruncatedTableError, error) {
+	lock := t.lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	tablePath := t.filePath()
+	file, err := t.storage().OpenFile(tablePath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table file: %w", err)
+	}
+	defer file.Close()
+	if isBlockFile(file) {
+		return nil, nil // Written whole through a rename, VerifyTable checks its blocks
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file stats: %w", err)
+	}
+	remainder := stat.Size() % int64(t.RecordSize())
+	if remainder == 0 {
+		return nil, nil
+	}
+
+	offset := stat.Size() - remainder
+	err = file.Truncate(offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to truncate table file: %w", err)
+	}
+	if t.durability() >= DurabilityFlush {
+		err = file.Sync()
+		if err != nil {
+			return nil, fmt.Errorf("failed to sync table file: %w", err)
+		}
+	}
+
+	return &TruncatedTableError{Schema: t.schemaName(), Table: t.TableName, Offset: offset, Leftover: remainder}, nil
+}
+
+// VerifyTable checks that a table's file holds whole, well-formed records that
+// match its configuration, that every ref offset lies within its side file and
+// that the resident primary key index matches the file
+func (tm *TableManager) VerifyTable(table *Table) (*VerifyReport, error) {
+	report := &VerifyReport{TablesChecked: 1}
+
+	lock := table.lock()
+	lock.RLock()
+	defer lock.RUnlock()
+
+	tablePath := table.filePath()
+	confPath := table.confPath()
+	layout := table.Layout()
+
+	// The conf must describe a usable record
+	store := table.storage()
+	conf, err := readFile(store, confPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table configuration: %v", err)
+	}
+	var confTable Table
+	if json.Unmarshal(conf, &confTable) != nil {
+		report.add(confPath, -1, RemediationRestore, "table configuration is not valid JSON")
+		return report, nil
+	}
+	for _, field := range table.Fields {
+		if message := fieldLengthProblem(field); message != "" {
+			report.add(confPath, -1, RemediationRestore, "field '%s' of %s", field.Name, message)
+		}
+	}
+
+	file, err := openTableFile(store, tablePath)
+	if os.IsNotExist(err) {
+		return report, nil // No records yet
+	}
+	if errors.Is(err, ErrCorrupt) {
+		report.add(tablePath, -1, RemediationRestore, "%v", err)
+		return report, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table file: %v", err)
+	}
+	defer file.Close()
+	if blocks, isBlocks := file.(*blockFile); isBlocks && blocks.recordSize != int64(layout.Size) {
+		report.add(tablePath, -1, RemediationRestore,
+			"blocks hold records of %d bytes, the configuration describes %d", blocks.recordSize, layout.Size)
+		return report, nil
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file stats: %v", err)
+	}
+	if remainder := stat.Size() % int64(layout.Size); remainder != 0 {
+		report.add(tablePath, stat.Size()-remainder, RemediationRecover,
+			"file size %d is not a multiple of the record size %d from the configuration, %d trailing bytes",
+			stat.Size(), layout.Size, remainder)
+	}
+
+	refs, err := verifyRefFiles(store, table, report)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check every whole record
+	positions := make(map[int64]int64)
+	data := make([]byte, layout.Size)
+	for position := int64(0); ; position++ {
+		offset := position * int64(layout.Size)
+		_, err := file.ReadAt(data, offset)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrCorrupt) {
+			report.add(tablePath, offset, RemediationRestore, "%v", err)
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read table file: %v", err)
+		}
+		report.RecordsChecked++
+
+		verifyRecord(data, layout, tablePath, offset, refs, report)
+		positions[recordID(data)] = position
+	}
+
+	// A ref file shorter than the offsets records hold was truncated or replaced
+	for _, field := range table.Fields {
+		size, end := refs.sizes[field.Name], refs.ends[field.Name]
+		if field.Type == "ref" && size >= 0 && size < end {
+			report.add(table.RefFilePath(field.Name), size, RemediationCompact,
+				"ref file of field '%s' is %d bytes long, records reference up to %d", field.Name, size, end)
+		}
+	}
+
+	// A resident primary key index must point at the right records
+	if keys, resident := tm.primaryKeys.snapshot(table); resident {
+		for id, position := range keys {
+			if actual, exists := positions[id]; !exists || actual != position {
+				report.add(tablePath, -1, RemediationRebuildIndex, "primary key index is out of date for record %d", id)
+				break
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// verifyRefs describes the ref side files of a table during a verification
+type verifyRefs struct {
+	sizes map[string]int64    // Size of every ref file by field, -1 for missing ones
+	gaps  map[string][]refGap // Lost ranges by field, see ErrRefDataMissing
+	ends  map[string]int64    // Highest end offset the records reference by field
+}
+
+// verifyRefFiles returns the size and lost ranges of every ref side file of a table
+func verifyRefFiles(store Storage, table *Table, report *VerifyReport) (*verifyRefs, error) {
+	refs := &verifyRefs{
+		sizes: make(map[string]int64),
+		gaps:  make(map[string][]refGap),
+		ends:  make(map[string]int64),
+	}
+	for _, field := range table.Fields {
+		if field.Type != "ref" {
+			continue
+		}
+
+		gaps, err := readRefGaps(store, table.refGapsPath(field.Name))
+		if err != nil {
+			return nil, err
+		}
+		refs.gaps[field.Name] = gaps
+
+		stat, err := store.Stat(table.RefFilePath(field.Name))
+		if os.IsNotExist(err) {
+			refs.sizes[field.Name] = -1
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file stats: %v", err)
+		}
+		refs.sizes[field.Name] = stat.Size()
+	}
+	return refs, nil
+}
+
+// verifyRecord checks the header, null flags and ref offsets of a serialized record
+func verifyRecord(data []byte, layout *RecordLayout, tablePath string, offset int64, refs *verifyRefs, report *VerifyReport) {
+	id := recordID(data)
+
+	if flags := recordFlags(data); flags&^knownFlags != 0 {
+		report.add(tablePath, offset+recordFlagsOffset, RemediationRestore, "record %d has unknown metadata flags %#x", id, flags)
+	}
+
+	for _, fieldLayout := range layout.Fields {
+		field := fieldLayout.Field
+		isNull := data[fieldLayout.MetaOffset]
+		if isNull > 1 {
+			report.add(tablePath, offset+int64(fieldLayout.MetaOffset), RemediationRestore,
+				"record %d has an invalid null flag %d for field '%s'", id, isNull, field.Name)
+			continue
+		}
+		if isNull == 1 || field.Type != "ref" {
+			continue
+		}
+
+		start := int64(binary.LittleEndian.Uint64(data[fieldLayout.DataOffset : fieldLayout.DataOffset+8]))
+		end := int64(binary.LittleEndian.Uint64(data[fieldLayout.DataOffset+8 : fieldLayout.DataOffset+16]))
+		refs.ends[field.Name] = max(refs.ends[field.Name], end)
+		size := refs.sizes[field.Name]
+		if err := checkRefGaps(refs.gaps[field.Name], field.Name, [2]int64{start, end}); err != nil {
+			report.add(tablePath, offset+int64(fieldLayout.DataOffset), RemediationCompact,
+				"record %d lost its value: %v", id, err)
+			continue
+		}
+		if size < 0 {
+			report.add(tablePath, offset+int64(fieldLayout.DataOffset), RemediationCompact,
+				"record %d references field '%s' but its ref file is missing", id, field.Name)
+			continue
+		}
+		if start < 0 || start > end || end > size {
+			report.add(tablePath, offset+int64(fieldLayout.DataOffset), RemediationCompact,
+				"record %d has ref offsets [%d, %d] outside the %d bytes of field '%s'", id, start, end, size, field.Name)
+		}
+	}
+}
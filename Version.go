@@ -0,0 +1,119 @@
+// Version.go
+// Description: Record versions of the HTDB library
+// Version tokens of committed records for optimistic concurrency, e.g. HTTP ETags
+// Author: harto.dev
+
+package hartoDb_go
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Version returns a token identifying this version of the record, derived from
+// its id and commit time. Every update or delete commits a new version with a
+// new token. It is computed from fields that survive JSON marshaling, so a
+// record decoded from JSON has the version of the record it was encoded from.
+// Staged records get theirs when they are committed.
+func (r *Record) Version() string {
+	return strconv.FormatInt(r.Metadata.CommittedAt, 36) + "-" + strconv.FormatInt(r.ID, 36)
+}
+
+// UpdateRecordIfVersion updates a record like UpdateRecord if its stored
+// version is still expectedVersion, else it fails with ErrVersionMismatch
+func (tm *TableManager) UpdateRecordIfVersion(table *Table, record *Record, updates map[string]interface{}, expectedVersion string) (*Record, error) {
+	return tm.updateRecord(table, record, updates, expectedVersion)
+}
+
+// DeleteRecordIfVersion deletes a record like DeleteRecord if its stored
+// version is still expectedVersion, else it fails with ErrVersionMismatch
+func (tm *TableManager) DeleteRecordIfVersion(table *Table, record *Record, expectedVersion string) error {
+	return tm.deleteRecord(table, record, expectedVersion)
+}
+
+// StageUpdateIfVersion stages an update like StageUpdate. The commit fails
+// with ErrVersionMismatch unless record is still stored as expectedVersion.
+func (tx *Transaction) StageUpdateIfVersion(table *Table, record *Record, updates map[string]interface{}, expectedVersion string) (*Record, error) {
+	return tx.stageUpdate(table, record, updates, expectedVersion)
+}
+
+// StageDeleteIfVersion stages a delete like StageDelete. The commit fails
+// with ErrVersionMismatch unless record is still stored as expectedVersion.
+func (tx *Transaction) StageDeleteIfVersion(table *Table, record *Record, expectedVersion string) error {
+	return tx.stageDelete(table, record, expectedVersion)
+}
+
+// checkVersion fails if the given record isn't the expected version, an empty
+// expected version accepts any
+func checkVersion(table *Table, record *Record, expectedVersion string) error {
+	if expectedVersion == "" || record.Version() == expectedVersion {
+		return nil
+	}
+	return newRecordError(table, record.ID, versionMismatch(expectedVersion, record.Version()))
+}
+
+// checkStagedVersions checks the versions expected by the records staged for
+// a table, so Commit can fail before it writes any table
+func checkStagedVersions(table *Table, staged []*Record) error {
+	expects := false
+	for _, record := range staged {
+		expects = expects || record.expectedVersion != ""
+	}
+	if !expects {
+		return nil
+	}
+
+	lock := table.lock()
+	lock.RLock()
+	defer lock.RUnlock()
+
+	existing, err := table.allRecords()
+	if err != nil {
+		return fmt.Errorf("failed to get existing records for table '%s': %w", table.TableName, err)
+	}
+	return checkReplacedVersions(table, existing, staged)
+}
+
+// checkReplacedVersions fails if a staged record expects a version of the
+// record it replaces that is no longer the current one in the table file.
+// The caller must hold the table's write lock.
+func checkReplacedVersions(table *Table, existing []*Record, staged []*Record) error {
+	expected := make(map[int64]string)
+	stagedIDs := make(map[int64]bool, len(staged))
+	for _, record := range staged {
+		stagedIDs[record.ID] = true
+		if record.expectedVersion != "" {
+			expected[record.previousID] = record.expectedVersion
+		}
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+
+	for _, record := range existing {
+		version, exists := expected[record.ID]
+		if !exists {
+			continue
+		}
+		if !record.Metadata.IsCurrent {
+			return newRecordError(table, record.ID, versionMismatch(version, "replaced"))
+		}
+		if record.Version() != version {
+			return newRecordError(table, record.ID, versionMismatch(version, record.Version()))
+		}
+		delete(expected, record.ID)
+	}
+
+	// Versions staged earlier in the transaction were checked when staging
+	for id, version := range expected {
+		if !stagedIDs[id] {
+			return newRecordError(table, id, versionMismatch(version, "removed"))
+		}
+	}
+	return nil
+}
+
+// versionMismatch returns the ErrVersionMismatch of an expected version that isn't the stored one
+func versionMismatch(expected, stored string) error {
+	return fmt.Errorf("%w: expected %s, stored %s", ErrVersionMismatch, expected, stored)
+}
@@ -0,0 +1,221 @@
+// CLI.go
+// Description: Command line administration tool for the HTDB library
+// Holds the logic of cmd/htdb so it can be run and tested without a process
+// Author: harto.dev
+
+// Package cli implements the htdb administration tool:
+//
+//	htdb [-db path] [-json] <command> [arguments]
+//
+//	schemas                                           list the schemas
+//	tables <schema>                                   list the tables of a schema
+//	ls [-prefix p] [-limit n] [-after name] [schema]  list a page of the schemas or of a schema's tables
+//	stats <schema> <table>                            show record counts and sizes of a table
+//	describe <schema> <table>                         show where every field lives in a record
+//	query <statement>                                 run a statement of the query language
+//	export [-format csv|jsonl] [-o file] <schema> <table>
+//	import [-format csv|jsonl] [-i file] [-continue] <schema> <table>
+//	compact                                           run a cleanup pass over every table
+//	verify                                            check every table for damaged files
+//	recover                                           finish interrupted compactions and truncate torn records
+//	migrate                                           upgrade tables of an older layout version
+//	backup [-gzip] <file>                             write a backup archive, "-" is stdout
+//	restore <file>                                    restore a backup archive, "-" is stdin
+//
+// Output is a plain table unless -json is given. Everything goes through the
+// public API of the library.
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	htdb "github.com/HartoMedia/hartodb-go"
+)
+
+// Exit codes of Run
+const (
+	ExitOK      = 0 // The command succeeded
+	ExitFailure = 1 // The command failed, or verify found problems
+	ExitUsage   = 2 // The command line is invalid
+)
+
+// usageError is a mistake on the command line
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+// command is a subcommand of the tool
+type command struct {
+	usage string
+	run   func(c *runner, args []string) error
+}
+
+var commands = map[string]command{
+	"schemas":  {"schemas", (*runner).schemas},
+	"tables":   {"tables <schema>", (*runner).tables},
+	"ls":       {"ls [-prefix p] [-limit n] [-after name] [schema]", (*runner).ls},
+	"stats":    {"stats <schema> <table>", (*runner).stats},
+	"describe": {"describe <schema> <table>", (*runner).describe},
+	"query":    {"query <statement>", (*runner).query},
+	"export":   {"export [-format csv|jsonl] [-o file] <schema> <table>", (*runner).exportTable},
+	"import":   {"import [-format csv|jsonl] [-i file] [-continue] <schema> <table>", (*runner).importTable},
+	"compact":  {"compact", (*runner).compact},
+	"verify":   {"verify", (*runner).verify},
+	"recover":  {"recover", (*runner).recover},
+	"migrate":  {"migrate", (*runner).migrate},
+	"backup":   {"backup [-gzip] <file>", (*runner).backup},
+	"restore":  {"restore <file>", (*runner).restore},
+}
+
+// runner holds the state of a single invocation
+type runner struct {
+	db     *htdb.HTDB
+	tm     *htdb.TableManager
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// Run runs the tool with the arguments after the program name and returns the exit code
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("htdb", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dbPath := flags.String("db", ".", "main path of the database")
+	jsonOutput := flags.Bool("json", false, "print JSON instead of tables")
+	flags.Usage = func() { printUsage(stderr, flags) }
+
+	err := flags.Parse(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if flags.NArg() == 0 {
+		printUsage(stderr, flags)
+		return ExitUsage
+	}
+
+	cmd, exists := commands[flags.Arg(0)]
+	if !exists {
+		fmt.Fprintf(stderr, "htdb: unknown command '%s'\n", flags.Arg(0))
+		printUsage(stderr, flags)
+		return ExitUsage
+	}
+
+	db := htdb.NewHTDB(*dbPath)
+	defer db.Close()
+
+	c := &runner{
+		db:     db,
+		tm:     db.GetTableManager(),
+		json:   *jsonOutput,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	err = cmd.run(c, flags.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(stderr, "htdb: %v\n", err)
+		if _, ok := err.(*usageError); ok {
+			fmt.Fprintf(stderr, "usage: htdb %s\n", cmd.usage)
+			return ExitUsage
+		}
+		return ExitFailure
+	}
+	return ExitOK
+}
+
+// printUsage prints the global flags and every command
+func printUsage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: htdb [-db path] [-json] <command> [arguments]")
+	fmt.Fprintln(w, "\ncommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+
+	fmt.Fprintln(w, "\nflags:")
+	flags.PrintDefaults()
+}
+
+// parseArgs parses the flags of a command and checks the number of remaining arguments
+func parseArgs(flags *flag.FlagSet, args []string, count int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, &usageError{message: err.Error()}
+	}
+	if flags.NArg() != count {
+		return nil, &usageError{message: fmt.Sprintf("expected %d arguments, got %d", count, flags.NArg())}
+	}
+	return flags.Args(), nil
+}
+
+// printJSON prints a value as indented JSON
+func (c *runner) printJSON(value interface{}) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// printTable prints rows as aligned columns under a header
+func (c *runner) printTable(header []string, rows [][]string) error {
+	writer := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+// formatValue formats a field value for a table cell
+func formatValue(value interface{}) string {
+	if value == nil {
+		return "NULL"
+	}
+	return fmt.Sprint(value)
+}
+
+// openInput opens a file to read from, "-" or an empty name is stdin
+func (c *runner) openInput(name string) (io.ReadCloser, error) {
+	if name == "" || name == "-" {
+		return io.NopCloser(c.stdin), nil
+	}
+	return os.Open(name)
+}
+
+// createOutput creates a file to write to, "-" or an empty name is stdout
+func (c *runner) createOutput(name string) (io.WriteCloser, error) {
+	if name == "" || name == "-" {
+		return nopWriteCloser{c.stdout}, nil
+	}
+	return os.Create(name)
+}
+
+// nopWriteCloser doesn't close the writer it wraps
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
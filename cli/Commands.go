@@ -0,0 +1,556 @@
+// Commands.go
+// Description: Commands of the htdb administration tool
+// Every command only uses the public API of the library
+// Author: harto.dev
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+
+	htdb "github.com/HartoMedia/hartodb-go"
+)
+
+// schemas lists the schemas of the database
+func (c *runner) schemas(args []string) error {
+	_, err := parseArgs(flag.NewFlagSet("schemas", flag.ContinueOnError), args, 0)
+	if err != nil {
+		return err
+	}
+
+	names, err := c.db.SchemaNames()
+	if err != nil {
+		return err
+	}
+	if names == nil {
+		names = []string{}
+	}
+
+	if c.json {
+		return c.printJSON(names)
+	}
+	rows := make([][]string, len(names))
+	for i, name := range names {
+		rows[i] = []string{name}
+	}
+	return c.printTable([]string{"SCHEMA"}, rows)
+}
+
+// ls lists a page of the schemas, or of the tables of a schema
+func (c *runner) ls(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	prefix := flags.String("prefix", "", "only names starting with it")
+	limit := flags.Int("limit", 0, "most names to list, 0 for all")
+	after := flags.String("after", "", "list the names after it, the next page of a previous ls")
+	err := flags.Parse(args)
+	if err != nil {
+		return &usageError{message: err.Error()}
+	}
+	if flags.NArg() > 1 {
+		return &usageError{message: fmt.Sprintf("expected at most 1 argument, got %d", flags.NArg())}
+	}
+
+	options := htdb.ListOptions{Prefix: *prefix, Limit: *limit, After: *after}
+	header := "SCHEMA"
+	var page htdb.ListPage
+	if flags.NArg() == 0 {
+		page, err = c.db.ListSchemas(options)
+	} else {
+		header = "TABLE"
+		page, err = c.db.ListTables(flags.Arg(0), options)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(page)
+	}
+	rows := make([][]string, len(page.Names))
+	for i, name := range page.Names {
+		rows[i] = []string{name}
+	}
+	err = c.printTable([]string{header}, rows)
+	if err == nil && page.Next != "" {
+		_, err = fmt.Fprintf(c.stdout, "more names follow, continue with -after %s\n", page.Next)
+	}
+	return err
+}
+
+// tableSummary is a row of the tables command
+type tableSummary struct {
+	Name       string `json:"name"`
+	Fields     int    `json:"fields"`
+	RecordSize int    `json:"record_size"`
+}
+
+// tables lists the tables of a schema
+func (c *runner) tables(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("tables", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	names, err := c.db.TableNames(args[0])
+	if err != nil {
+		return err
+	}
+
+	summaries := []tableSummary{}
+	for _, name := range names {
+		table, err := c.tm.GetTable(args[0], name)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, tableSummary{Name: name, Fields: len(table.Fields), RecordSize: table.RecordSize()})
+	}
+
+	if c.json {
+		return c.printJSON(summaries)
+	}
+	rows := make([][]string, len(summaries))
+	for i, summary := range summaries {
+		rows[i] = []string{summary.Name, strconv.Itoa(summary.Fields), strconv.Itoa(summary.RecordSize)}
+	}
+	return c.printTable([]string{"TABLE", "FIELDS", "RECORD SIZE"}, rows)
+}
+
+// tableStats is the output of the stats command
+type tableStats struct {
+	Schema         string       `json:"schema"`
+	Table          string       `json:"table"`
+	Fields         []htdb.Field `json:"fields"`
+	RecordSize     int          `json:"record_size"`
+	Records        int          `json:"records"`         // Every version in the table file
+	CurrentRecords int          `json:"current_records"` // Records a query can return
+	DeadRecords    int          `json:"dead_records"`    // Outdated and deleted versions a cleanup pass would drop
+	FileSize       int64        `json:"file_size"`
+}
+
+// stats shows record counts and sizes of a table
+func (c *runner) stats(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("stats", flag.ContinueOnError), args, 2)
+	if err != nil {
+		return err
+	}
+
+	table, err := c.tm.GetTable(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	all, err := c.tm.GetAllRecords(table)
+	if err != nil {
+		return err
+	}
+	current, err := c.tm.GetCurrentRecords(table)
+	if err != nil {
+		return err
+	}
+
+	stats := tableStats{
+		Schema:         args[0],
+		Table:          args[1],
+		Fields:         table.Fields,
+		RecordSize:     table.RecordSize(),
+		Records:        len(all),
+		CurrentRecords: len(current),
+		DeadRecords:    len(all) - len(current),
+		FileSize:       int64(len(all)) * int64(table.RecordSize()),
+	}
+
+	if c.json {
+		return c.printJSON(stats)
+	}
+	rows := [][]string{
+		{"schema", stats.Schema},
+		{"table", stats.Table},
+		{"fields", strconv.Itoa(len(stats.Fields))},
+		{"record size", strconv.Itoa(stats.RecordSize)},
+		{"records", strconv.Itoa(stats.Records)},
+		{"current records", strconv.Itoa(stats.CurrentRecords)},
+		{"dead records", strconv.Itoa(stats.DeadRecords)},
+		{"file size", strconv.FormatInt(stats.FileSize, 10)},
+	}
+	return c.printTable([]string{"STAT", "VALUE"}, rows)
+}
+
+// layoutEntry is a row of the output of the describe command
+type layoutEntry struct {
+	Part           string `json:"part"`
+	Name           string `json:"name"`
+	Type           string `json:"type,omitempty"`
+	Offset         int    `json:"offset"`
+	Length         int    `json:"length"`
+	MetaByteOffset int    `json:"meta_byte_offset"` // -1 for the header and audit parts
+}
+
+// describe shows the byte ranges of a table's records, see htdb.RecordLayout.Entries
+func (c *runner) describe(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("describe", flag.ContinueOnError), args, 2)
+	if err != nil {
+		return err
+	}
+
+	table, err := c.tm.GetTable(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	entries := []layoutEntry{}
+	for _, entry := range table.Layout().Entries() {
+		entries = append(entries, layoutEntry{
+			Part:           entry.Part,
+			Name:           entry.FieldName,
+			Type:           string(entry.Type),
+			Offset:         entry.Offset,
+			Length:         entry.Length,
+			MetaByteOffset: entry.MetaByteOffset,
+		})
+	}
+
+	if c.json {
+		return c.printJSON(entries)
+	}
+	rows := make([][]string, len(entries))
+	for i, entry := range entries {
+		meta := "-"
+		if entry.MetaByteOffset >= 0 {
+			meta = strconv.Itoa(entry.MetaByteOffset)
+		}
+		rows[i] = []string{entry.Part, entry.Name, entry.Type, strconv.Itoa(entry.Offset), strconv.Itoa(entry.Length), meta}
+	}
+	return c.printTable([]string{"PART", "NAME", "TYPE", "OFFSET", "LENGTH", "META"}, rows)
+}
+
+// query runs a statement of the query language and prints the records it returns
+func (c *runner) query(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("query", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.db.Exec(args[0])
+	if err != nil {
+		return err
+	}
+
+	// Columns are the id followed by every selected field in schema order
+	columns := result.Fields
+
+	if c.json {
+		records := make([]map[string]interface{}, len(result.Records))
+		for i, record := range result.Records {
+			object := map[string]interface{}{"id": record.ID}
+			for _, name := range columns {
+				object[name] = record.FieldsData[name]
+			}
+			records[i] = object
+		}
+		return c.printJSON(map[string]interface{}{"affected": result.Affected, "records": records})
+	}
+
+	if len(result.Records) == 0 {
+		_, err = fmt.Fprintf(c.stdout, "%d records affected\n", result.Affected)
+		return err
+	}
+	rows := make([][]string, len(result.Records))
+	for i, record := range result.Records {
+		row := []string{strconv.FormatInt(record.ID, 10)}
+		for _, name := range columns {
+			row = append(row, formatValue(record.FieldsData[name]))
+		}
+		rows[i] = row
+	}
+	return c.printTable(append([]string{"id"}, columns...), rows)
+}
+
+// fileFormat returns the format flag, or guesses it from the file extension
+func fileFormat(format, file string) (string, error) {
+	if format == "" {
+		format = "csv"
+		if ext := filepath.Ext(file); ext == ".jsonl" || ext == ".ndjson" {
+			format = "jsonl"
+		}
+	}
+	if format != "csv" && format != "jsonl" {
+		return "", &usageError{message: fmt.Sprintf("unknown format '%s', use csv or jsonl", format)}
+	}
+	return format, nil
+}
+
+// exportTable writes the current records of a table as CSV or JSON Lines
+func (c *runner) exportTable(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or jsonl, guessed from the file extension")
+	output := flags.String("o", "-", "file to write, - is stdout")
+	args, err := parseArgs(flags, args, 2)
+	if err != nil {
+		return err
+	}
+	*format, err = fileFormat(*format, *output)
+	if err != nil {
+		return err
+	}
+
+	table, err := c.tm.GetTable(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	w, err := c.createOutput(*output)
+	if err != nil {
+		return err
+	}
+
+	if *format == "jsonl" {
+		err = c.tm.ExportJSONL(table, w, htdb.JSONLExportOptions{})
+	} else {
+		err = c.tm.ExportCSV(table, w, htdb.CSVExportOptions{})
+	}
+	closeErr := w.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// importTable inserts the records of a CSV or JSON Lines file into a table
+func (c *runner) importTable(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or jsonl, guessed from the file extension")
+	input := flags.String("i", "-", "file to read, - is stdin")
+	continueOnError := flags.Bool("continue", false, "skip rows that fail instead of stopping")
+	args, err := parseArgs(flags, args, 2)
+	if err != nil {
+		return err
+	}
+	*format, err = fileFormat(*format, *input)
+	if err != nil {
+		return err
+	}
+
+	table, err := c.tm.GetTable(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	r, err := c.openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var inserted int
+	if *format == "jsonl" {
+		inserted, err = c.tm.ImportJSONL(table, r, htdb.JSONLImportOptions{ContinueOnError: *continueOnError})
+	} else {
+		inserted, err = c.tm.ImportCSV(table, r, htdb.CSVImportOptions{ContinueOnError: *continueOnError})
+	}
+
+	if c.json {
+		result := map[string]interface{}{"inserted": inserted}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+		printErr := c.printJSON(result)
+		if err == nil {
+			err = printErr
+		}
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%d records imported\n", inserted)
+	return err
+}
+
+// compact runs a cleanup pass over every table
+func (c *runner) compact(args []string) error {
+	_, err := parseArgs(flag.NewFlagSet("compact", flag.ContinueOnError), args, 0)
+	if err != nil {
+		return err
+	}
+
+	report, err := c.tm.Compact()
+	if c.json {
+		printErr := c.printJSON(report)
+		if err == nil {
+			err = printErr
+		}
+		return err
+	}
+
+	rows := [][]string{
+		{"tables cleaned", strconv.Itoa(report.TablesCleaned)},
+		{"records removed", strconv.Itoa(report.RecordsRemoved)},
+		{"bytes reclaimed", strconv.FormatInt(report.BytesReclaimed, 10)},
+		{"invalid refs", strconv.Itoa(report.InvalidRefs)},
+		{"quarantined", strconv.Itoa(report.Quarantined)},
+		{"errors", strconv.Itoa(report.Errors)},
+		{"duration", report.Duration.String()},
+	}
+	printErr := c.printTable([]string{"STAT", "VALUE"}, rows)
+	if err == nil {
+		err = printErr
+	}
+	return err
+}
+
+// verify checks every table and fails if any problem was found
+func (c *runner) verify(args []string) error {
+	_, err := parseArgs(flag.NewFlagSet("verify", flag.ContinueOnError), args, 0)
+	if err != nil {
+		return err
+	}
+
+	report, err := c.db.Verify()
+	if err != nil {
+		return err
+	}
+	if report.Problems == nil {
+		report.Problems = []htdb.VerifyProblem{}
+	}
+
+	if c.json {
+		err = c.printJSON(report)
+	} else if report.OK() {
+		_, err = fmt.Fprintf(c.stdout, "%d tables and %d records checked, no problems found\n", report.TablesChecked, report.RecordsChecked)
+	} else {
+		rows := make([][]string, len(report.Problems))
+		for i, problem := range report.Problems {
+			rows[i] = []string{problem.File, strconv.FormatInt(problem.Offset, 10), problem.Problem, string(problem.Remediation)}
+		}
+		err = c.printTable([]string{"FILE", "OFFSET", "PROBLEM", "REMEDIATION"}, rows)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !report.OK() {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+	return nil
+}
+
+// recover repairs what an unclean shutdown left behind
+func (c *runner) recover(args []string) error {
+	_, err := parseArgs(flag.NewFlagSet("recover", flag.ContinueOnError), args, 0)
+	if err != nil {
+		return err
+	}
+
+	report, err := c.db.Recover()
+	if err != nil {
+		return err
+	}
+	if report.Truncated == nil {
+		report.Truncated = []htdb.TruncatedTableError{}
+	}
+
+	if c.json {
+		return c.printJSON(report)
+	}
+	if len(report.Truncated) == 0 {
+		_, err = fmt.Fprintln(c.stdout, "no torn records found")
+		return err
+	}
+	rows := make([][]string, len(report.Truncated))
+	for i, truncated := range report.Truncated {
+		rows[i] = []string{truncated.Schema, truncated.Table, strconv.FormatInt(truncated.Offset, 10), strconv.FormatInt(truncated.Leftover, 10)}
+	}
+	return c.printTable([]string{"SCHEMA", "TABLE", "OFFSET", "BYTES TRUNCATED"}, rows)
+}
+
+// migrate upgrades the tables of an older layout version
+func (c *runner) migrate(args []string) error {
+	_, err := parseArgs(flag.NewFlagSet("migrate", flag.ContinueOnError), args, 0)
+	if err != nil {
+		return err
+	}
+
+	report, err := c.db.Migrate()
+	if err != nil {
+		return err
+	}
+	if report.Tables == nil {
+		report.Tables = []string{}
+	}
+
+	if c.json {
+		return c.printJSON(report)
+	}
+	if len(report.Tables) == 0 {
+		_, err = fmt.Fprintf(c.stdout, "layout version %d, no tables to migrate\n", report.ToVersion)
+		return err
+	}
+	rows := make([][]string, len(report.Tables))
+	for i, table := range report.Tables {
+		rows[i] = []string{table, strconv.Itoa(report.FromVersion), strconv.Itoa(report.ToVersion)}
+	}
+	return c.printTable([]string{"TABLE", "FROM", "TO"}, rows)
+}
+
+// backup writes a backup archive of the database
+func (c *runner) backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	gzip := flags.Bool("gzip", false, "compress the archive")
+	args, err := parseArgs(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	w, err := c.createOutput(args[0])
+	if err != nil {
+		return err
+	}
+
+	var files int
+	err = c.db.Backup(w, htdb.BackupOptions{
+		Gzip:     *gzip,
+		Progress: func(progress htdb.BackupProgress) { files = progress.FilesDone },
+	})
+	closeErr := w.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "-" {
+		return nil // stdout holds the archive
+	}
+	if c.json {
+		return c.printJSON(map[string]interface{}{"files": files})
+	}
+	_, err = fmt.Fprintf(c.stdout, "%d files backed up\n", files)
+	return err
+}
+
+// restore unpacks a backup archive into the empty database
+func (c *runner) restore(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("restore", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.openInput(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	err = c.db.Restore(r)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(map[string]interface{}{"restored": true})
+	}
+	_, err = fmt.Fprintln(c.stdout, "backup restored")
+	return err
+}
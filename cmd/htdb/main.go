@@ -0,0 +1,16 @@
+// main.go
+// Description: Entry point of the htdb administration tool
+// The commands live in the cli package
+// Author: harto.dev
+
+package main
+
+import (
+	"os"
+
+	"github.com/HartoMedia/hartodb-go/cli"
+)
+
+func main() {
+	os.Exit(cli.Run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
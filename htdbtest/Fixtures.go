@@ -0,0 +1,223 @@
+// Fixtures.go
+// Description: Test fixtures for code built on the HTDB library
+// Throwaway databases, tables and records for tests, torn down with the test
+// Author: harto.dev
+
+// Package htdbtest helps writing tests against an HTDB database:
+//
+//	db := htdbtest.NewTempDB(t)
+//	table := htdbtest.MustCreateTable(t, db, "shop", "items", fields)
+//	htdbtest.SeedRecords(t, db.GetTableManager(), table, rows)
+//	htdbtest.AssertTableEquals(t, db.GetTableManager(), table, want)
+//
+// Databases are closed when the test ends. Helpers stop the test with
+// t.Fatal when the database fails.
+package htdbtest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	htdb "github.com/HartoMedia/hartodb-go"
+)
+
+// NewTempDB opens an empty database kept in process memory, closed when the
+// test ends
+func NewTempDB(t testing.TB) *htdb.HTDB {
+	t.Helper()
+	db, err := htdb.Open(htdb.MemoryPath, htdb.OpenOptions{})
+	if err != nil {
+		t.Fatalf("htdbtest: failed to open database: %v", err)
+	}
+	t.Cleanup(func() { closeDB(t, db) })
+	return db
+}
+
+// NewTempDirDB opens an empty database in a temporary directory, for tests
+// that need real files. The database is closed and the directory removed
+// when the test ends.
+func NewTempDirDB(t testing.TB) *htdb.HTDB {
+	t.Helper()
+	db, err := htdb.Open(t.TempDir(), htdb.OpenOptions{})
+	if err != nil {
+		t.Fatalf("htdbtest: failed to open database: %v", err)
+	}
+	t.Cleanup(func() { closeDB(t, db) })
+	return db
+}
+
+// closeDB closes a database at the end of a test, unless the test closed it
+func closeDB(t testing.TB, db *htdb.HTDB) {
+	err := db.Close()
+	if err != nil && !errors.Is(err, htdb.ErrClosed) {
+		t.Errorf("htdbtest: failed to close database: %v", err)
+	}
+}
+
+// MustCreateTable creates a table with fields, and its schema if it doesn't
+// exist yet. The id field is added by the database.
+func MustCreateTable(t testing.TB, db *htdb.HTDB, schema, name string, fields []htdb.Field) *htdb.Table {
+	t.Helper()
+	s, err := db.Schema(schema)
+	if errors.Is(err, htdb.ErrSchemaNotFound) {
+		s, err = db.CreateSchema(schema)
+	}
+	if err != nil {
+		t.Fatalf("htdbtest: failed to create schema '%s': %v", schema, err)
+	}
+
+	response := s.CreateTable(name, fields)
+	if response.StatusCode != htdb.StatusOK {
+		t.Fatalf("htdbtest: failed to create table '%s:%s': %v", schema, name, response.Message)
+	}
+	table, err := db.GetTableManager().GetTable(schema, name)
+	if err != nil {
+		t.Fatalf("htdbtest: failed to get table '%s:%s': %v", schema, name, err)
+	}
+	return table
+}
+
+// SeedRecords inserts rows into a table in a single transaction and returns
+// the records in the order of rows
+func SeedRecords(t testing.TB, tm *htdb.TableManager, table *htdb.Table, rows []map[string]interface{}) []*htdb.Record {
+	t.Helper()
+	tx := tm.BeginTransaction()
+	records := make([]*htdb.Record, 0, len(rows))
+	for i, row := range rows {
+		record, err := tx.StageInsert(table, row)
+		if err != nil {
+			tm.RollbackTransaction(tx)
+			t.Fatalf("htdbtest: failed to stage row %d of '%s': %v", i, table.TableName, err)
+		}
+		records = append(records, record)
+	}
+
+	err := tm.CommitTransaction(tx)
+	if err != nil {
+		t.Fatalf("htdbtest: failed to seed '%s': %v", table.TableName, err)
+	}
+	return records
+}
+
+// AssertTableEquals checks that the current records of a table are want, in
+// any order. Ids and timeID fields are ignored, as they differ on every run,
+// as are the commit times and transactions of the records. Fields missing
+// from a row of want are expected to be null, values are compared like
+// htdb.DiffRecords does, ref fields by their stored values.
+func AssertTableEquals(t testing.TB, tm *htdb.TableManager, table *htdb.Table, want []map[string]interface{}) {
+	t.Helper()
+	records, err := tm.GetCurrentRecords(table)
+	if err != nil {
+		t.Fatalf("htdbtest: failed to read '%s': %v", table.TableName, err)
+	}
+
+	matched := make([]bool, len(records))
+	var missing []string
+	for _, row := range want {
+		expected := htdb.NewRecord(0, row)
+		found := false
+		for i, record := range records {
+			if matched[i] {
+				continue
+			}
+			equal, err := sameRecord(table, expected, record)
+			if err != nil {
+				t.Fatalf("htdbtest: failed to compare records of '%s': %v", table.TableName, err)
+			}
+			if equal {
+				matched[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, formatRow(table, row))
+		}
+	}
+
+	var unexpected []string
+	for i, record := range records {
+		if !matched[i] {
+			unexpected = append(unexpected, formatRecord(t, table, record))
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return
+	}
+
+	var report strings.Builder
+	fmt.Fprintf(&report, "htdbtest: table '%s' doesn't hold the expected records", table.TableName)
+	for _, row := range missing {
+		fmt.Fprintf(&report, "\n  missing:    %s", row)
+	}
+	for _, row := range unexpected {
+		fmt.Fprintf(&report, "\n  unexpected: %s", row)
+	}
+	t.Error(report.String())
+}
+
+// sameRecord reports whether two records differ only in ignored fields
+func sameRecord(table *htdb.Table, expected, record *htdb.Record) (bool, error) {
+	diffs, err := table.DiffRecordContent(expected, record)
+	if err != nil {
+		return false, err
+	}
+	for _, diff := range diffs {
+		if !ignoredField(table, diff.Field) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ignoredField reports whether AssertTableEquals skips a field
+func ignoredField(table *htdb.Table, name string) bool {
+	for _, field := range table.Fields {
+		if field.Name == name {
+			return field.Type == htdb.TimeID
+		}
+	}
+	return false
+}
+
+// formatRecord formats the compared fields of a stored record for a report
+func formatRecord(t testing.TB, table *htdb.Table, record *htdb.Record) string {
+	row := make(map[string]interface{})
+	for _, field := range table.Fields {
+		if field.Type == htdb.TimeID || record.FieldsMeta[field.Name].IsNull {
+			continue
+		}
+		value := record.FieldsData[field.Name]
+		if field.Type == "ref" {
+			text, err := table.ReadRef(record, field.Name)
+			if err != nil {
+				t.Fatalf("htdbtest: failed to read '%s' of record %d: %v", field.Name, record.ID, err)
+			}
+			value = text
+		}
+		if text, ok := value.(string); ok {
+			value = strings.TrimRight(text, "\x00")
+		}
+		row[field.Name] = value
+	}
+	return formatRow(table, row)
+}
+
+// formatRow formats the compared fields of a row, sorted by name
+func formatRow(table *htdb.Table, row map[string]interface{}) string {
+	names := make([]string, 0, len(row))
+	for name, value := range row {
+		if value != nil && !ignoredField(table, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%#v", name, row[name])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
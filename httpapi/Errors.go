@@ -0,0 +1,109 @@
+// Errors.go
+// Description: Error responses of the HTTP/JSON API
+// Maps the errors of the library to HTTP statuses and JSON bodies, usable by custom handlers too
+// Author: harto.dev
+
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	htdb "github.com/HartoMedia/hartodb-go"
+)
+
+// ErrorBody is the JSON body of an error response
+type ErrorBody struct {
+	Code    int                     `json:"code"` // Status code of the library such as 404 or 422, see htdb.StatusOf
+	Message string                  `json:"message"`
+	Fields  []*htdb.ValidationError `json:"fields,omitempty"` // The failed checks of a validation error
+}
+
+// WriteError writes err as an ErrorBody with the HTTP status HTTPStatus
+// returns for it. Handlers built on the library can use it to answer with the
+// same error payloads as the Server.
+func WriteError(w http.ResponseWriter, err error) {
+	writeJSON(w, HTTPStatus(err), NewErrorBody(err))
+}
+
+// NewErrorBody returns the body WriteError writes for err
+func NewErrorBody(err error) ErrorBody {
+	body := ErrorBody{Code: htdb.StatusOf(err), Message: err.Error()}
+
+	var response htdb.Response
+	var validationErrs htdb.ValidationErrors
+	var validationErr *htdb.ValidationError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		body.Message = "request timed out"
+	case errors.Is(err, context.Canceled):
+		body.Message = "request cancelled"
+	case errors.As(err, &response):
+		body.Message = response.Message
+	}
+
+	switch {
+	case errors.As(err, &validationErrs):
+		body.Fields = validationErrs
+	case errors.As(err, &validationErr):
+		body.Fields = []*htdb.ValidationError{validationErr}
+	}
+	return body
+}
+
+// HTTPStatus returns the HTTP status matching an error, 200 for nil. Errors
+// with a status code of the library are mapped by it, see htdb.StatusOf,
+// others by the sentinel error they match.
+func HTTPStatus(err error) int {
+	// Updates and deletes given a version answer an If-Match header
+	if errors.Is(err, htdb.ErrVersionMismatch) {
+		return http.StatusPreconditionFailed
+	}
+
+	code := htdb.StatusOf(err)
+	if code != htdb.StatusDbError {
+		return httpStatus(code)
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, htdb.ErrClosed), errors.Is(err, htdb.ErrDDLTimeout):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, htdb.ErrSnapshotNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, htdb.ErrAlreadyExists), errors.Is(err, htdb.ErrTxNotActive):
+		return http.StatusConflict
+	case errors.Is(err, htdb.ErrReadOnly), errors.Is(err, htdb.ErrOutOfScope):
+		return http.StatusForbidden
+	case errors.Is(err, htdb.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// httpStatus maps a Response status code to an HTTP status
+func httpStatus(code int) int {
+	switch code {
+	case htdb.StatusSchenaDoesntExist, htdb.StatusTableDoesntExist, htdb.StatusRecordDoesntExist:
+		return http.StatusNotFound
+	case htdb.StatusSchenaAlreadyExists, htdb.StatusTableAlreadyExists, htdb.StatusFieldAlreadyExists, htdb.StatusConflict:
+		return http.StatusConflict
+	case htdb.StatusLocked:
+		return http.StatusLocked
+	case htdb.StatusValidationFailed:
+		return http.StatusUnprocessableEntity
+	}
+
+	switch {
+	case code >= 200 && code < 300:
+		return http.StatusOK
+	case code >= 400 && code < 500:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,742 @@
+// Server.go
+// Description: HTTP/JSON API for the HTDB library
+// Exposes the TableManager of a database over HTTP, this package is optional
+// Author: harto.dev
+
+// Package httpapi serves an HTDB database over HTTP/JSON:
+//
+//	GET    /schemas                              list the schemas (prefix, limit, cursor)
+//	GET    /schemas/{schema}/tables              list the tables of a schema (prefix, limit, cursor)
+//	GET    /{schema}/{table}/records             query records (where, sort, order, fields, limit, cursor)
+//	POST   /{schema}/{table}/records             insert a record
+//	PATCH  /{schema}/{table}/records/{id}        update a record
+//	DELETE /{schema}/{table}/records/{id}        delete a record
+//	POST   /transactions                         run several operations in one transaction
+//	GET    /healthz                              database statistics, see htdb.Stats
+//
+// Conditions are passed as where=field:operator:value, operators are eq, ne,
+// gt, ge, lt and le. Single records are returned with their version as ETag,
+// PATCH and DELETE with an If-Match header fail with 412 once the record
+// changed, see htdb.Record.Version. Errors are returned as ErrorBody objects, see WriteError.
+// Fields with the htdb.Sensitive constraint are left out of every response
+// and can't be used in where or sort.
+package httpapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	htdb "github.com/HartoMedia/hartodb-go"
+)
+
+const (
+	defaultTimeout  = 30 * time.Second // Time a request may take unless configured otherwise
+	defaultPageSize = 100              // Records per page without a limit parameter
+	maxPageSize     = 1000             // Largest accepted limit parameter
+	maxBodySize     = 10 << 20         // Largest accepted request body
+)
+
+// Server serves a database over HTTP. It implements http.Handler.
+type Server struct {
+	db      *htdb.HTDB
+	tm      *htdb.TableManager
+	timeout time.Duration
+	mux     *http.ServeMux
+}
+
+// NewServer creates a server for db. Every request is cancelled after timeout,
+// a zero timeout uses 30 seconds.
+func NewServer(db *htdb.HTDB, timeout time.Duration) *Server {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	s := &Server{
+		db:      db,
+		tm:      db.GetTableManager(),
+		timeout: timeout,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /schemas", s.listSchemas)
+	s.mux.HandleFunc("GET /schemas/{schema}/tables", s.listTables)
+	s.mux.HandleFunc("GET /{schema}/{table}/records", s.listRecords)
+	s.mux.HandleFunc("POST /{schema}/{table}/records", s.insertRecord)
+	s.mux.HandleFunc("PATCH /{schema}/{table}/records/{id}", s.updateRecord)
+	s.mux.HandleFunc("DELETE /{schema}/{table}/records/{id}", s.deleteRecord)
+	s.mux.HandleFunc("POST /transactions", s.runTransaction)
+	s.mux.HandleFunc("GET /healthz", s.health)
+	return s
+}
+
+// ServeHTTP handles a request with the server's timeout applied
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+
+	s.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// ListenAndServe serves the API on addr until the listener fails
+func (s *Server) ListenAndServe(addr string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: s.timeout,
+	}
+	return server.ListenAndServe()
+}
+
+// --- Handlers ---
+
+func (s *Server) listSchemas(w http.ResponseWriter, r *http.Request) {
+	options, err := listOptions(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	page, err := s.db.ListSchemas(options)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"schemas":    page.Names,
+		"nextCursor": encodeNameCursor(page.Next),
+	})
+}
+
+func (s *Server) listTables(w http.ResponseWriter, r *http.Request) {
+	options, err := listOptions(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	page, err := s.db.ListTables(r.PathValue("schema"), options)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tables":     page.Names,
+		"nextCursor": encodeNameCursor(page.Next),
+	})
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.db.Stats()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) listRecords(w http.ResponseWriter, r *http.Request) {
+	table, err := s.table(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	params := r.URL.Query()
+	query := s.tm.Select(table)
+
+	for _, raw := range params["where"] {
+		condition, err := parseCondition(table, raw)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		query.Where(condition.Field, condition.Operator, condition.Value)
+	}
+
+	if sortField := params.Get("sort"); sortField != "" {
+		order := strings.ToLower(params.Get("order"))
+		if order != "" && order != "asc" && order != "desc" {
+			WriteError(w, htdb.NewResponse(htdb.StatusBadRequest, "order must be asc or desc"))
+			return
+		}
+		if err := checkFields(table, sortField); err != nil {
+			WriteError(w, err)
+			return
+		}
+		for _, field := range table.Fields {
+			if field.Name == sortField {
+				if err := checkNotSensitive(field); err != nil {
+					WriteError(w, err)
+					return
+				}
+			}
+		}
+		query.Sort(sortField, order != "desc")
+	}
+
+	var fields []string
+	if rawFields := params.Get("fields"); rawFields != "" {
+		fields = strings.Split(rawFields, ",")
+		if err := checkFields(table, fields...); err != nil {
+			WriteError(w, err)
+			return
+		}
+		query.Fields(fields...)
+	}
+
+	pageSize := defaultPageSize
+	if rawLimit := params.Get("limit"); rawLimit != "" {
+		pageSize, err = strconv.Atoi(rawLimit)
+		if err != nil || pageSize <= 0 || pageSize > maxPageSize {
+			WriteError(w, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize)))
+			return
+		}
+	}
+
+	offset, err := decodeCursor(params.Get("cursor"))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	// Fetch one record more than the page holds to know whether there is a next page
+	query.Limit(offset + pageSize + 1)
+	records, err := query.GetAllContext(r.Context())
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	page := []*htdb.Record{}
+	if offset < len(records) {
+		page = records[offset:]
+	}
+	var nextCursor string
+	if len(page) > pageSize {
+		page = page[:pageSize]
+		nextCursor = encodeCursor(offset + pageSize)
+	}
+
+	result := make([]map[string]interface{}, 0, len(page))
+	for _, record := range page {
+		values, err := recordJSON(table, record, fields)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		result = append(result, values)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"records":    result,
+		"nextCursor": nextCursor,
+	})
+}
+
+func (s *Server) insertRecord(w http.ResponseWriter, r *http.Request) {
+	table, err := s.table(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	data, err := readValues(r, table)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	err = r.Context().Err()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	record, err := s.tm.InsertRecord(table, data)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	values, err := recordJSON(table, record, nil)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	setETag(w, record)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"record": values})
+}
+
+func (s *Server) updateRecord(w http.ResponseWriter, r *http.Request) {
+	table, record, err := s.record(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	updates, err := readValues(r, table)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	err = r.Context().Err()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	updated, err := s.tm.UpdateRecordIfVersion(table, record, updates, ifMatch(r))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	values, err := recordJSON(table, updated, nil)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	setETag(w, updated)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"record": values})
+}
+
+func (s *Server) deleteRecord(w http.ResponseWriter, r *http.Request) {
+	table, record, err := s.record(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	err = r.Context().Err()
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	err = s.tm.DeleteRecordIfVersion(table, record, ifMatch(r))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// transactionRequest is the body of POST /transactions
+type transactionRequest struct {
+	Operations []transactionOperation `json:"operations"`
+}
+
+// transactionOperation is a single step of a transactional batch
+type transactionOperation struct {
+	Op     string          `json:"op"` // insert, update or delete
+	Schema string          `json:"schema"`
+	Table  string          `json:"table"`
+	ID     int64           `json:"id,omitempty"`   // Record to update or delete
+	Data   json.RawMessage `json:"data,omitempty"` // Values to insert or update
+}
+
+func (s *Server) runTransaction(w http.ResponseWriter, r *http.Request) {
+	var request transactionRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&request)
+	if err != nil {
+		WriteError(w, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err)))
+		return
+	}
+	if len(request.Operations) == 0 {
+		WriteError(w, htdb.NewResponse(htdb.StatusBadRequest, "no operations given"))
+		return
+	}
+
+	tx := s.tm.BeginTransaction()
+	results := make([]map[string]interface{}, 0, len(request.Operations))
+
+	for i, op := range request.Operations {
+		result, err := s.stageOperation(tx, op)
+		if err != nil {
+			s.tm.RollbackTransaction(tx)
+			WriteError(w, prefixError(fmt.Sprintf("operation %d", i), err))
+			return
+		}
+		results = append(results, result)
+	}
+
+	// Nothing is written yet, a timed out request can still back out cleanly
+	err = r.Context().Err()
+	if err != nil {
+		s.tm.RollbackTransaction(tx)
+		WriteError(w, err)
+		return
+	}
+
+	err = s.tm.CommitTransaction(tx)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"transactionId": tx.ID,
+		"results":       results,
+	})
+}
+
+// stageOperation stages a single operation of a transactional batch
+func (s *Server) stageOperation(tx *htdb.Transaction, op transactionOperation) (map[string]interface{}, error) {
+	table, err := s.lookupTable(op.Schema, op.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "insert":
+		data, err := table.ParseJSONValues(op.Data)
+		if err != nil {
+			return nil, htdb.NewResponse(htdb.StatusBadRequest, err.Error())
+		}
+		record, err := tx.StageInsert(table, data)
+		if err != nil {
+			return nil, err
+		}
+		values, err := recordJSON(table, record, nil)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"op": op.Op, "record": values}, nil
+
+	case "update":
+		record, err := s.tm.GetRecordByID(table, op.ID)
+		if errors.Is(err, htdb.ErrNotFound) {
+			return nil, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("record %d: %v", op.ID, err))
+		}
+		if err != nil {
+			return nil, err
+		}
+		updates, err := table.ParseJSONValues(op.Data)
+		if err != nil {
+			return nil, htdb.NewResponse(htdb.StatusBadRequest, err.Error())
+		}
+		updated, err := tx.StageUpdate(table, record, updates)
+		if err != nil {
+			return nil, err
+		}
+		values, err := recordJSON(table, updated, nil)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"op": op.Op, "record": values}, nil
+
+	case "delete":
+		record, err := s.tm.GetRecordByID(table, op.ID)
+		if errors.Is(err, htdb.ErrNotFound) {
+			return nil, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("record %d: %v", op.ID, err))
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = tx.StageDelete(table, record)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"op": op.Op, "id": op.ID}, nil
+	}
+
+	return nil, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("unknown operation '%s'", op.Op))
+}
+
+// --- Helpers ---
+
+// table loads the table named by the request path
+func (s *Server) table(r *http.Request) (*htdb.Table, error) {
+	return s.lookupTable(r.PathValue("schema"), r.PathValue("table"))
+}
+
+// lookupTable loads a table, reporting missing schemas and tables with their
+// status codes. The path values are decoded, a "%2F" in them is a '/', so
+// they are checked before they reach the file system.
+func (s *Server) lookupTable(schemaName, tableName string) (*htdb.Table, error) {
+	if !htdb.ValidName(schemaName) || !htdb.ValidName(tableName) {
+		return nil, htdb.NewResponse(htdb.StatusInvalidName, "invalid schema or table name")
+	}
+
+	_, err := s.db.Schema(schemaName)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := s.tm.GetTable(schemaName, tableName)
+	if err != nil {
+		return nil, htdb.NewResponse(htdb.StatusTableDoesntExist, err.Error())
+	}
+	return table, nil
+}
+
+// record loads the table and the current record named by the request path
+func (s *Server) record(r *http.Request) (*htdb.Table, *htdb.Record, error) {
+	table, err := s.table(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, nil, htdb.NewResponse(htdb.StatusBadRequest, "invalid record id")
+	}
+
+	// Other errors, such as failed reads of the table file, are not a missing record
+	record, err := s.tm.GetRecordByID(table, id)
+	if errors.Is(err, htdb.ErrNotFound) || err == nil && record.Metadata.IsDeleted {
+		return nil, nil, errRecordNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return table, record, nil
+}
+
+// ifMatch returns the version of the If-Match header, empty without one or for "*"
+func ifMatch(r *http.Request) string {
+	version := strings.TrimSpace(r.Header.Get("If-Match"))
+	if version == "*" {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(version, "W/"), `"`)
+}
+
+// setETag sets the version of a record as the ETag of the response
+func setETag(w http.ResponseWriter, record *htdb.Record) {
+	w.Header().Set("ETag", `"`+record.Version()+`"`)
+}
+
+// errRecordNotFound is returned for ids without a current record
+var errRecordNotFound = htdb.NewResponse(htdb.StatusRecordDoesntExist, "record not found")
+
+// readValues decodes the JSON object in the request body into field values
+func readValues(r *http.Request, table *htdb.Table) (map[string]interface{}, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("failed to read request body: %v", err))
+	}
+	if len(body) > maxBodySize {
+		return nil, htdb.NewResponse(htdb.StatusBadRequest, "request body too large")
+	}
+
+	values, err := table.ParseJSONValues(body)
+	if err != nil {
+		return nil, htdb.NewResponse(htdb.StatusBadRequest, err.Error())
+	}
+	return values, nil
+}
+
+// conditionOperators maps the operators of the where parameter to Query.Where operators
+var conditionOperators = map[string]string{
+	"eq": "=",
+	"ne": "!=",
+	"gt": ">",
+	"ge": ">=",
+	"lt": "<",
+	"le": "<=",
+}
+
+// parseCondition parses a where parameter (field:operator:value), converting
+// the value to the type of the field
+func parseCondition(table *htdb.Table, raw string) (htdb.FilterCondition, error) {
+	parts := strings.SplitN(raw, ":", 3)
+	if len(parts) != 3 {
+		return htdb.FilterCondition{}, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("invalid condition '%s', expected field:operator:value", raw))
+	}
+
+	operator, ok := conditionOperators[parts[1]]
+	if !ok {
+		return htdb.FilterCondition{}, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("unknown operator '%s'", parts[1]))
+	}
+
+	for _, field := range table.Fields {
+		if field.Name != parts[0] {
+			continue
+		}
+		if err := checkNotSensitive(field); err != nil {
+			return htdb.FilterCondition{}, err
+		}
+		value, err := parseFieldValue(field, parts[2])
+		if err != nil {
+			return htdb.FilterCondition{}, htdb.NewResponse(htdb.StatusBadRequest, err.Error())
+		}
+		return htdb.FilterCondition{Field: field.Name, Operator: operator, Value: value}, nil
+	}
+	return htdb.FilterCondition{}, htdb.NewResponse(htdb.StatusFieldDoesntExist, fmt.Sprintf("field '%s' does not exist", parts[0]))
+}
+
+// checkFields returns a StatusFieldDoesntExist response for the first name
+// the table has no field of
+func checkFields(table *htdb.Table, names ...string) error {
+	known := make(map[string]bool, len(table.Fields))
+	for _, field := range table.Fields {
+		known[field.Name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return htdb.NewResponse(htdb.StatusFieldDoesntExist, fmt.Sprintf("field '%s' does not exist", name))
+		}
+	}
+	return nil
+}
+
+// checkNotSensitive returns a StatusBadRequest response for a sensitive
+// field. Which records match a condition on it, or the order they are sorted
+// in, would give its values away.
+func checkNotSensitive(field htdb.Field) error {
+	if field.IsSensitive() {
+		return htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("field '%s' is sensitive and can't be used in where or sort", field.Name))
+	}
+	return nil
+}
+
+// parseFieldValue converts a query parameter to the type of a field
+func parseFieldValue(field htdb.Field, raw string) (interface{}, error) {
+	switch field.Type {
+	case htdb.Int, htdb.TimeID:
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires an integer value", field.Name)
+		}
+		return value, nil
+	case htdb.Float:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires a number value", field.Name)
+		}
+		return value, nil
+	case htdb.Bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s' requires a bool value", field.Name)
+		}
+		return value, nil
+	}
+	return raw, nil
+}
+
+// encodeCursor returns the opaque cursor of the page starting at offset
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+// listOptions reads the prefix, limit and cursor parameters of a listing.
+// Without a limit every name is listed.
+func listOptions(r *http.Request) (htdb.ListOptions, error) {
+	params := r.URL.Query()
+	options := htdb.ListOptions{Prefix: params.Get("prefix")}
+
+	if rawLimit := params.Get("limit"); rawLimit != "" {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return options, htdb.NewResponse(htdb.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+		}
+		options.Limit = limit
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(after) == 0 {
+			return options, htdb.NewResponse(htdb.StatusBadRequest, "invalid cursor")
+		}
+		options.After = string(after)
+	}
+	return options, nil
+}
+
+// encodeNameCursor returns the cursor of the listing page after name, empty
+// on the last page
+func encodeNameCursor(name string) string {
+	if name == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// decodeCursor returns the offset a cursor points to, an empty cursor is the first page
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		offset, err := strconv.Atoi(string(raw))
+		if err == nil && offset >= 0 {
+			return offset, nil
+		}
+	}
+	return 0, htdb.NewResponse(htdb.StatusBadRequest, "invalid cursor")
+}
+
+// recordJSON returns the fields of a record for a response, with ref fields
+// resolved to their content. If fields are given only those are included.
+// Sensitive fields are never included. A ref value that can't be read, such
+// as one lost with its side file, fails the response instead of reading null.
+func recordJSON(table *htdb.Table, record *htdb.Record, fields []string) (map[string]interface{}, error) {
+	result := map[string]interface{}{"id": record.ID}
+
+	for _, field := range table.Fields {
+		if field.Name == "id" || field.IsSensitive() {
+			continue
+		}
+		if len(fields) > 0 && !containsString(fields, field.Name) {
+			continue
+		}
+
+		if meta, exists := record.FieldsMeta[field.Name]; !exists || meta.IsNull {
+			result[field.Name] = nil
+			continue
+		}
+
+		if field.Type == "ref" {
+			value, err := table.ReadRef(record, field.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read field '%s' of record %d: %w", field.Name, record.ID, err)
+			}
+			result[field.Name] = value
+			continue
+		}
+		result[field.Name] = record.FieldsData[field.Name]
+	}
+	return result, nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixError adds context to an error, keeping the status code of a Response
+func prefixError(prefix string, err error) error {
+	var response htdb.Response
+	if errors.As(err, &response) {
+		response.Message = prefix + ": " + response.Message
+		return response
+	}
+	return fmt.Errorf("%s: %w", prefix, err)
+}
+
+// writeJSON writes a JSON response body
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,242 @@
+// Server_test.go
+// Description: Tests of the HTTP/JSON API for the HTDB library
+// Query parameters naming fields the table doesn't have, or sensitive fields in where and sort, are rejected,
+// and only a missing record is a 404, unreadable records and ref values fail the request
+// Author: harto.dev
+
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	htdb "github.com/HartoMedia/hartodb-go"
+)
+
+func TestListRecordsUnknownFields(t *testing.T) {
+	db, err := htdb.Open(htdb.MemoryPath, htdb.OpenOptions{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	schema, err := db.CreateSchema("s")
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	response := schema.CreateTable("t", []htdb.Field{{Name: "key", Type: htdb.Int, Length: 8}})
+	if response.StatusCode != htdb.StatusOK {
+		t.Fatalf("failed to create table: %v", response.Message)
+	}
+	server := NewServer(db, time.Minute)
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"sort=key&fields=key", http.StatusOK},
+		{"sort=nope", http.StatusBadRequest},
+		{"fields=key,nope", http.StatusBadRequest},
+		{"where=nope:eq:1", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "/s/t/records?"+test.query, nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: answered %d, want %d", test.query, recorder.Code, test.status)
+		}
+		if test.status == http.StatusOK {
+			continue
+		}
+		var body ErrorBody
+		err := json.NewDecoder(recorder.Body).Decode(&body)
+		if err != nil {
+			t.Fatalf("%s: failed to decode error: %v", test.query, err)
+		}
+		if body.Code != htdb.StatusFieldDoesntExist {
+			t.Errorf("%s: error code %d, want %d", test.query, body.Code, htdb.StatusFieldDoesntExist)
+		}
+	}
+}
+
+// Path values are decoded, "%2F" must not lead the server out of the database
+func TestPathTraversalRejected(t *testing.T) {
+	dir := t.TempDir()
+	other, err := htdb.Open(filepath.Join(dir, "other"), htdb.OpenOptions{Create: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	schema, err := other.CreateSchema("secret")
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	response := schema.CreateTable("t", []htdb.Field{{Name: "key", Type: htdb.Int, Length: 8}})
+	if response.StatusCode != htdb.StatusOK {
+		t.Fatalf("failed to create table: %v", response.Message)
+	}
+	other.Close()
+
+	db, err := htdb.Open(filepath.Join(dir, "db"), htdb.OpenOptions{Create: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	server := NewServer(db, time.Minute)
+
+	requests := []struct {
+		method, path string
+	}{
+		{"POST", "/..%2Fother%2Fsecret/t/records"},
+		{"GET", "/..%2Fother%2Fsecret/t/records"},
+		{"POST", "/..%2F..%2Fother%2Fsecret/t/records"},
+		{"GET", "/schemas/..%2Fother%2Fsecret/tables"},
+	}
+	for _, request := range requests {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(request.method, request.path, strings.NewReader(`{"key": 1}`)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s %s answered %d, want %d", request.method, request.path, recorder.Code, http.StatusBadRequest)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "other", "secret", "t.htdb"))
+	if err == nil && info.Size() > 0 {
+		t.Errorf("a request wrote %d bytes into the other database", info.Size())
+	}
+}
+
+// Matches and order of a sensitive field give its values away
+func TestSensitiveFieldQueriesRejected(t *testing.T) {
+	db, err := htdb.Open(htdb.MemoryPath, htdb.OpenOptions{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	schema, err := db.CreateSchema("s")
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	response := schema.CreateTable("t", []htdb.Field{
+		{Name: "key", Type: htdb.Int, Length: 8},
+		{Name: "secret", Type: htdb.String, Length: 32, Constraints: []htdb.Constraint{htdb.Sensitive}},
+	})
+	if response.StatusCode != htdb.StatusOK {
+		t.Fatalf("failed to create table: %v", response.Message)
+	}
+	tm := db.GetTableManager()
+	table, err := tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	_, err = tm.InsertRecord(table, map[string]interface{}{"key": 1, "secret": "hunter2"})
+	if err != nil {
+		t.Fatalf("failed to insert record: %v", err)
+	}
+	server := NewServer(db, time.Minute)
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"where=key:eq:1&sort=key", http.StatusOK},
+		{"where=secret:eq:hunter2", http.StatusBadRequest},
+		{"where=secret:gt:a", http.StatusBadRequest},
+		{"sort=secret", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "/s/t/records?"+test.query, nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: answered %d, want %d", test.query, recorder.Code, test.status)
+		}
+		if strings.Contains(recorder.Body.String(), "hunter2") {
+			t.Errorf("%s: response holds the secret: %s", test.query, recorder.Body.String())
+		}
+	}
+}
+
+// Only a missing record is a 404, records or ref values that can't be read
+// fail the request instead of reading as missing or null
+func TestUnreadableRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := htdb.Open(path, htdb.OpenOptions{Create: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	schema, err := db.CreateSchema("s")
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	response := schema.CreateTable("t", []htdb.Field{
+		{Name: "key", Type: htdb.Int, Length: 8},
+		{Name: "note", Type: "ref", Length: 128},
+	})
+	if response.StatusCode != htdb.StatusOK {
+		t.Fatalf("failed to create table: %v", response.Message)
+	}
+	tm := db.GetTableManager()
+	table, err := tm.GetTable("s", "t")
+	if err != nil {
+		t.Fatalf("failed to get table: %v", err)
+	}
+	_, err = tm.InsertRecord(table, map[string]interface{}{"key": 1, "note": "created"})
+	if err != nil {
+		t.Fatalf("failed to insert record: %v", err)
+	}
+	server := NewServer(db, time.Minute)
+
+	serve := func(method, path string) int {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(`{"key": 2}`)))
+		return recorder.Code
+	}
+	requests := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/s/t/records", http.StatusOK},
+		{"PATCH", "/s/t/records/99", http.StatusNotFound},
+		{"DELETE", "/s/t/records/99", http.StatusNotFound},
+	}
+	for _, request := range requests {
+		if status := serve(request.method, request.path); status != request.status {
+			t.Errorf("%s %s answered %d, want %d", request.method, request.path, status, request.status)
+		}
+	}
+
+	err = os.Remove(table.RefFilePath("note"))
+	if err != nil {
+		t.Fatalf("failed to remove ref file: %v", err)
+	}
+	if status := serve("GET", "/s/t/records"); status != http.StatusInternalServerError {
+		t.Errorf("GET with a lost ref file answered %d, want %d", status, http.StatusInternalServerError)
+	}
+
+	// A table file cut short after the open fails reads of its records
+	db.Close()
+	db, err = htdb.Open(path, htdb.OpenOptions{})
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	tableFile := filepath.Join(path, "s", "t.htdb")
+	info, err := os.Stat(tableFile)
+	if err == nil {
+		err = os.Truncate(tableFile, info.Size()-1)
+	}
+	if err != nil {
+		t.Fatalf("failed to truncate table file: %v", err)
+	}
+	server = NewServer(db, time.Minute)
+	for _, method := range []string{"PATCH", "DELETE"} {
+		if status := serve(method, "/s/t/records/1"); status != http.StatusInternalServerError {
+			t.Errorf("%s of an unreadable record answered %d, want %d", method, status, http.StatusInternalServerError)
+		}
+	}
+}
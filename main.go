@@ -8,12 +8,54 @@
 // didnt do the last step about the responses
 package hartoDb_go
 
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
 type HTDB struct {
-	mainPath      string
-	lastTimestamp int64
-	tableManager  *TableManager
+	mainPath     string
+	ids          *idGenerator // Record ids, see GetLastTimestamp
+	tableManager *TableManager
+	files        *fileCache                  // Open table file handles, see SetMaxOpenFiles
+	changes      *changeLog                  // Change data capture log, nil until EnableChangeLog
+	store        Storage                     // Where the files live, see Storage
+	ddl          *ddlLocks                   // Structure changes against commits, see ddlLocks
+	recordLocks  *recordLocks                // Records locked by transactions, see LockRecordWait
+	events       *eventBus                   // Subscribers of committed changes, see Subscribe
+	attached     atomic.Pointer[attachments] // Schemas outside the main path, see AttachSchema
+
+	logger              atomic.Pointer[slog.Logger]   // See SetLogger
+	slowQueryThreshold  atomic.Int64                  // Nanoseconds, see SetSlowQueryThreshold
+	slowCommitThreshold atomic.Int64                  // Nanoseconds, see SetSlowCommitThreshold
+	ddlTimeout          atomic.Int64                  // Nanoseconds, see SetDDLTimeout
+	durability          atomic.Int32                  // A Durability, read by every commit, see SetDurability
+	metrics             atomic.Pointer[metricsHolder] // See SetMetricsSink
+
+	state       atomic.Int32 // dbOpen, dbClosing or dbClosed
+	closePolicy ClosePolicy  // What Close does with active transactions
+	lock        *processLock // Held from Open until Close, nil for NewHTDB
+	config      Config       // See Config and SetConfig
+	configMu    sync.Mutex
+
+	statsCache   *tableStatsCache              // Record counts of unchanged tables, see Stats
+	usage        *usageTracker                 // Bytes used by tables, see SetQuota
+	lastCleanup  atomic.Pointer[CleanupStats]  // Nil before the first cleanup pass
+	lastRecovery atomic.Pointer[RecoveryStats] // Nil before the first Recover
 }
 
+// Durability controls how hard the database works to get writes onto disk
+// before an operation returns. Higher levels are safer against power loss but slower.
+type Durability int
+
+const (
+	DurabilityNone  Durability = iota // Leave flushing to the operating system (fastest)
+	DurabilityFlush                   // Fsync every written file before it is used
+	DurabilityFsync                   // Fsync written files and their directory so renames survive too
+)
+
 // --- Field Presets ---
 var timePKField = Field{
 	Name:        "id",
@@ -36,11 +78,32 @@ var timePKField = Field{
 
 const fileEnding string = ".htdb"
 
-// Constructor
+// Constructor. A mainPath of MemoryPath keeps the whole database in process memory.
 func NewHTDB(mainPath string) *HTDB {
+	if mainPath == MemoryPath {
+		return NewHTDBWithStorage(mainPath, NewMemoryStorage())
+	}
+	return NewHTDBWithStorage(mainPath, OSStorage{})
+}
+
+// NewHTDBWithStorage creates a database keeping its files in store, mainPath
+// is the directory of the database within it
+func NewHTDBWithStorage(mainPath string, store Storage) *HTDB {
+	if memory, ok := store.(*memoryStorage); ok {
+		memory.mkdirAll(mainPath)
+	}
+
 	db := &HTDB{
 		mainPath: mainPath,
+		store:    store,
 	}
+	db.files = newFileCache(db.store, defaultMaxOpenFiles)
+	db.ids = &idGenerator{}
+	db.ddl = newDDLLocks()
+	db.recordLocks = newRecordLocks()
+	db.usage = newUsageTracker()
+	db.statsCache = &tableStatsCache{entries: make(map[string]tableStatsEntry)}
+	db.events = newEventBus(db)
 	db.tableManager = NewTableManager(db)
 	return db
 }
@@ -53,12 +116,15 @@ func (db *HTDB) SetMainPath(path string) {
 	db.mainPath = path
 }
 
+// GetLastTimestamp returns the highest record id handed out or found in the tables
 func (db *HTDB) GetLastTimestamp() int64 {
-	return db.lastTimestamp
+	return db.ids.highWater()
 }
 
+// SetLastTimestamp makes sure every record id handed out from now on is greater
+// than timestamp. Lowering the high-water mark is not possible.
 func (db *HTDB) SetLastTimestamp(timestamp int64) {
-	db.lastTimestamp = timestamp
+	db.ids.observe(timestamp)
 }
 
 func (db *HTDB) GetTableManager() *TableManager {
@@ -68,3 +134,46 @@ func (db *HTDB) GetTableManager() *TableManager {
 func (db *HTDB) SetTableManager(tm *TableManager) {
 	db.tableManager = tm
 }
+
+func (db *HTDB) GetDurability() Durability {
+	return Durability(db.durability.Load())
+}
+
+// SetDurability changes the durability level, also while commits are running
+func (db *HTDB) SetDurability(durability Durability) {
+	db.durability.Store(int32(durability))
+}
+
+// SetMaxOpenFiles sets how many table file handles are kept open between operations
+func (db *HTDB) SetMaxOpenFiles(maxOpen int) {
+	db.files.setMaxOpen(maxOpen)
+}
+
+// getTable loads a table ("schema:table") and attaches the database's file cache to it
+func (db *HTDB) getTable(tableName string) (*Table, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(tableName, ":") {
+		tableName = db.defaultSchema() + ":" + tableName
+	}
+	// Taken before the configuration is read, a change in between is caught by the commit
+	schemaName, tableNameOnly, _ := strings.Cut(tableName, ":")
+	if !validName(schemaName) {
+		return nil, invalidSchemaName(schemaName)
+	}
+	if !validName(tableNameOnly) {
+		return nil, NewResponse(StatusInvalidName, "Can't name a Table \""+tableNameOnly+"\", use letters, digits, '_' and '-'")
+	}
+	schemaPath := db.schemaPath(schemaName)
+	generation := db.ddl.generation(tableFilePath(schemaPath, tableNameOnly))
+	table, err := loadTable(db.storage(), schemaName, tableNameOnly, schemaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	table.db = db
+	table.schema = schemaName
+	table.generation = generation
+	return table, nil
+}